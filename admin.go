@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminInstance is the view of an instance returned by the admin API.
+type adminInstance struct {
+	ID               string     `json:"id"`
+	OrganizationGUID string     `json:"organization_guid"`
+	SpaceGUID        string     `json:"space_guid"`
+	CreatedAt        *time.Time `json:"created_at,omitempty"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+}
+
+// adminBinding is the view of a binding returned by the admin API. It never
+// includes the binding's token.
+type adminBinding struct {
+	ID               string     `json:"id"`
+	Accessor         string     `json:"accessor"`
+	OrganizationGUID string     `json:"organization_guid"`
+	SpaceGUID        string     `json:"space_guid"`
+	CreatedAt        *time.Time `json:"created_at,omitempty"`
+	UpdatedAt        *time.Time `json:"updated_at,omitempty"`
+}
+
+// adminState is the broker's in-memory state returned by the admin API.
+type adminState struct {
+	Instances []adminInstance `json:"instances"`
+	Bindings  []adminBinding  `json:"bindings"`
+	Quiescing bool            `json:"quiescing"`
+}
+
+// attachAdminRoutes adds the operational endpoints for platform engineers to
+// the router.
+func attachAdminRoutes(router *mux.Router, b *Broker) {
+	router.HandleFunc("/admin/state", b.handleAdminState).Methods("GET")
+	router.HandleFunc("/admin/bindings/{binding_id}/revoke", b.handleAdminRevokeBinding).Methods("POST")
+	router.HandleFunc("/admin/quiesce", b.handleAdminQuiesce).Methods("POST")
+	router.HandleFunc("/admin/reconcile", b.handleAdminReconcile).Methods("POST")
+}
+
+// handleAdminState returns the instances and bindings known to the broker.
+func (b *Broker) handleAdminState(w http.ResponseWriter, r *http.Request) {
+	b.log.Printf("[INFO] admin: listing instances and bindings")
+	respondJSON(w, http.StatusOK, b.adminState())
+}
+
+// handleAdminRevokeBinding immediately revokes the token of a binding and
+// forgets the binding, without going through the platform.
+func (b *Broker) handleAdminRevokeBinding(w http.ResponseWriter, r *http.Request) {
+	logger := b.requestLog(r.Context()).With("binding_id", mux.Vars(r)["binding_id"])
+	bindingID := mux.Vars(r)["binding_id"]
+
+	actor := actorOrUnknown(originatingIdentity(r))
+	logger.Printf("[WARN] admin: force-revoking binding %s as requested by %s", bindingID, actor)
+
+	if err := b.forceRevokeBinding(bindingID); err != nil {
+		logger.Printf("[ERR] admin: failed to revoke binding %s: %s", bindingID, err)
+		respondJSON(w, http.StatusInternalServerError, map[string]string{
+			"description": err.Error(),
+		})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{})
+}
+
+// handleAdminQuiesce stops the broker from accepting new instances and
+// bindings.
+func (b *Broker) handleAdminQuiesce(w http.ResponseWriter, r *http.Request) {
+	actor := actorOrUnknown(originatingIdentity(r))
+	b.log.Printf("[WARN] admin: quiescing as requested by %s", actor)
+	b.Quiesce()
+	respondJSON(w, http.StatusOK, map[string]string{})
+}
+
+// handleAdminReconcile repairs the drift between Vault and the instance given
+// by the instance_id query parameter, or every instance if there is none, and
+// reports what was found.
+func (b *Broker) handleAdminReconcile(w http.ResponseWriter, r *http.Request) {
+	actor := actorOrUnknown(originatingIdentity(r))
+	target := "all instances"
+	var instanceIDs []string
+	if id := r.URL.Query().Get("instance_id"); id != "" {
+		b.instancesLock.Lock()
+		_, ok := b.instances[id]
+		b.instancesLock.Unlock()
+		if !ok {
+			respondJSON(w, http.StatusNotFound, map[string]string{
+				"description": "instance " + id + " does not exist",
+			})
+			return
+		}
+		target = "instance " + id
+		instanceIDs = append(instanceIDs, id)
+	}
+	b.requestLog(r.Context()).Printf("[WARN] admin: reconciling %s as requested by %s", target, actor)
+
+	reports, err := b.reconcileInstances(instanceIDs...)
+	if err != nil {
+		b.log.Printf("[ERR] admin: failed to reconcile: %s", err)
+		respondJSON(w, http.StatusInternalServerError, map[string]string{
+			"description": err.Error(),
+		})
+		return
+	}
+	status := http.StatusOK
+	for _, report := range reports {
+		if report.Error != "" {
+			status = http.StatusInternalServerError
+		}
+	}
+	respondJSON(w, status, map[string]interface{}{"instances": reports})
+}
+
+// forceRevokeBinding revokes the cached binding the same way as Unbind, which
+// also revokes its secret's lease, credentials in CredHub, and entity alias.
+// It does nothing if the binding is already gone.
+func (b *Broker) forceRevokeBinding(bindingID string) error {
+	logger := b.log.With("binding_id", bindingID)
+	b.bindLock.Lock()
+	info, ok := b.binds[bindingID]
+	b.bindLock.Unlock()
+	if !ok {
+		logger.Printf("[INFO] admin: binding %s does not exist, nothing to revoke", bindingID)
+		return nil
+	}
+
+	// Serialize with other operations on the instance and make sure the
+	// binding was not unbound while waiting
+	instanceID := info.instanceID
+	b.instanceMutex.Lock(instanceID)
+	defer b.instanceMutex.Unlock(instanceID)
+
+	b.bindLock.Lock()
+	current, ok := b.binds[bindingID]
+	b.bindLock.Unlock()
+	if !ok || current != info {
+		logger.Printf("[INFO] admin: binding %s was removed concurrently, nothing to revoke", bindingID)
+		return nil
+	}
+
+	return b.revokeBinding(instanceID, bindingID, info)
+}
+
+// adminState returns a snapshot of the cached instances and bindings, sorted
+// by ID.
+func (b *Broker) adminState() adminState {
+	state := adminState{
+		Instances: []adminInstance{},
+		Bindings:  []adminBinding{},
+		Quiescing: b.quiesced(),
+	}
+
+	b.instancesLock.Lock()
+	for id, info := range b.instances {
+		state.Instances = append(state.Instances, adminInstance{
+			ID:               id,
+			OrganizationGUID: info.OrganizationGUID,
+			SpaceGUID:        info.SpaceGUID,
+			CreatedAt:        timestamp(info.CreatedAt),
+			UpdatedAt:        timestamp(info.UpdatedAt),
+		})
+	}
+	b.instancesLock.Unlock()
+
+	b.bindLock.Lock()
+	for id, info := range b.binds {
+		state.Bindings = append(state.Bindings, adminBinding{
+			ID:               id,
+			Accessor:         info.Accessor,
+			OrganizationGUID: info.Organization,
+			SpaceGUID:        info.Space,
+			CreatedAt:        timestamp(info.CreatedAt),
+			UpdatedAt:        timestamp(info.UpdatedAt),
+		})
+	}
+	b.bindLock.Unlock()
+
+	sort.Slice(state.Instances, func(i, j int) bool {
+		return state.Instances[i].ID < state.Instances[j].ID
+	})
+	sort.Slice(state.Bindings, func(i, j int) bool {
+		return state.Bindings[i].ID < state.Bindings[j].ID
+	})
+	return state
+}
+
+// respondJSON writes the value as a JSON response with the given status.
+func respondJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBroker_AdminState(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The instance predates the timestamps, while the binding has them
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	env.Broker.binds["binding-id"] = &bindingInfo{
+		Organization: "organization-guid",
+		Space:        "space-guid",
+		Binding:      "binding-id",
+		ClientToken:  "secret-token",
+		Accessor:     "accessor",
+		CreatedAt:    created,
+		UpdatedAt:    created,
+	}
+
+	router := mux.NewRouter()
+	attachAdminRoutes(router, env.Broker)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/state", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, w.Code)
+	}
+	if strings.Contains(w.Body.String(), "secret-token") {
+		t.Fatalf("expected the token to not be returned but received %s", w.Body.String())
+	}
+
+	var state adminState
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	expected := adminState{
+		Instances: []adminInstance{
+			{ID: "instance-id", OrganizationGUID: "organization-guid", SpaceGUID: "space-guid"},
+		},
+		Bindings: []adminBinding{
+			{
+				ID:               "binding-id",
+				Accessor:         "accessor",
+				OrganizationGUID: "organization-guid",
+				SpaceGUID:        "space-guid",
+				CreatedAt:        &created,
+				UpdatedAt:        &created,
+			},
+		},
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Fatalf("expected %+v but received %+v", expected, state)
+	}
+}
+
+func TestBroker_AdminRevokeBinding(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.addBinding("binding-id", &bindingInfo{
+		Organization:  "organization-guid",
+		Space:         "space-guid",
+		Binding:       "binding-id",
+		ClientToken:   "secret-token",
+		Accessor:      "accessor",
+		LeaseID:       "cf/instance-id/aws/sts/cf-bind/lease-id",
+		EntityAliasID: "entity-alias-id",
+		instanceID:    "instance-id",
+	})
+
+	router := mux.NewRouter()
+	attachAdminRoutes(router, env.Broker)
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "/admin/bindings/binding-id/revoke", nil)
+		r.Header.Set(OriginatingIdentityHeader, "cloudfoundry eyJ1c2VyX2lkIjoiYWRtaW4ifQ==")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+
+	if n := env.Requests.count("POST /v1/auth/token/revoke-accessor"); n != 1 {
+		t.Fatalf("expected the accessor to be revoked once but it was revoked %d times", n)
+	}
+	if !env.Requests.contains("PUT /v1/sys/revoke/cf/instance-id/aws/sts/cf-bind/lease-id") {
+		t.Fatal("expected the lease of the binding's secret to be revoked")
+	}
+	if !env.Requests.contains("DELETE /v1/identity/entity-alias/id/entity-alias-id") {
+		t.Fatal("expected the entity alias of the binding to be deleted")
+	}
+	if !env.Requests.contains("DELETE /v1/cf/broker/instance-id/binding-id") {
+		t.Fatal("expected the binding info to be deleted")
+	}
+	if _, ok := env.Broker.binds["binding-id"]; ok {
+		t.Fatal("expected the binding to be removed from the cache")
+	}
+	if renewing(&env.Broker.renewals, "binding-id") {
+		t.Fatal("expected the renewal to be stopped")
+	}
+}
+
+func TestBroker_AdminRevokeBinding_CredhubRef(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	ts := newFakeCredhub()
+	defer ts.Close()
+	env.Broker.credhub = newCredhubClient(ts.URL, "broker", "secret", nil)
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	ref := "/c/broker/hashicorp-vault/binding-id/credentials"
+	if ts.get(ref) == nil {
+		t.Fatal("expected the credentials to be stored in credhub")
+	}
+
+	router := mux.NewRouter()
+	attachAdminRoutes(router, env.Broker)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/bindings/binding-id/revoke", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ts.get(ref) != nil {
+		t.Fatal("expected the credentials to be deleted from credhub")
+	}
+}
+
+func TestBroker_AdminQuiesce(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	router := mux.NewRouter()
+	attachAdminRoutes(router, env.Broker)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/quiesce", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if !env.Broker.adminState().Quiescing {
+		t.Fatal("expected the state to show the broker is quiescing")
+	}
+
+	// New instances and bindings are rejected with a retryable error
+	_, err := env.Broker.Provision(env.Context, "other-instance-id", brokerapi.ProvisionDetails{}, env.Async)
+	if err != errQuiescing {
+		t.Fatalf("expected %v but received %v", errQuiescing, err)
+	}
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != errQuiescing {
+		t.Fatalf("expected %v but received %v", errQuiescing, err)
+	}
+	if errQuiescing.ValidatedStatusCode(nil) != http.StatusServiceUnavailable {
+		t.Fatal("expected quiescing to return 503")
+	}
+
+	// Existing bindings can still be removed
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_AdminReconcile(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	router := mux.NewRouter()
+	attachAdminRoutes(router, env.Broker)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/reconcile?instance_id=missing-id", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected %d but received %d", http.StatusNotFound, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/reconcile?instance_id=instance-id", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var response struct {
+		Instances []reconcileReport `json:"instances"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	expected := []reconcileReport{
+		{
+			InstanceID: "instance-id",
+			Drift: []string{
+				"policy cf-instance-id is missing",
+				"mount cf/instance-id/secret is missing",
+				"mount cf/instance-id/transit is missing",
+				"mount cf/organization-guid/secret is missing",
+				"mount cf/space-guid/secret is missing",
+			},
+		},
+	}
+	sort.Strings(response.Instances[0].Drift[1:])
+	if !reflect.DeepEqual(response.Instances, expected) {
+		t.Fatalf("expected %+v but received %+v", expected, response.Instances)
+	}
+	for _, r := range []string{
+		"PUT /v1/sys/policy/cf-instance-id",
+		"POST /v1/sys/mounts/cf/instance-id/secret",
+		"POST /v1/sys/mounts/cf/instance-id/transit",
+	} {
+		if !env.Requests.contains(r) {
+			t.Errorf("expected %s to repair the drift", r)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// BrokerAPIVersionHeader is the header in which the platform sends the
+// version of the service broker API it uses.
+const BrokerAPIVersionHeader = "X-Broker-API-Version"
+
+// apiVersion is a version of the service broker API, such as 2.14.
+type apiVersion struct {
+	Major int
+	Minor int
+}
+
+func (v apiVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// less returns true if v is older than o.
+func (v apiVersion) less(o apiVersion) bool {
+	return v.Major < o.Major || (v.Major == o.Major && v.Minor < o.Minor)
+}
+
+// parseAPIVersion parses a version of the form MAJOR.MINOR.
+func parseAPIVersion(s string) (apiVersion, error) {
+	parts := strings.Split(strings.TrimSpace(s), ".")
+	if len(parts) != 2 {
+		return apiVersion{}, fmt.Errorf("invalid broker API version %q", s)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return apiVersion{}, fmt.Errorf("invalid broker API version %q", s)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return apiVersion{}, fmt.Errorf("invalid broker API version %q", s)
+	}
+	return apiVersion{Major: major, Minor: minor}, nil
+}
+
+// apiVersionChecker rejects service broker API requests which do not send a
+// supported version, with 412 Precondition Failed as the API requires. Other
+// requests, such as those to the admin API, are passed through.
+type apiVersionChecker struct {
+	next http.Handler
+	min  apiVersion
+	log  *Logger
+}
+
+func (c *apiVersionChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	header := r.Header.Get(BrokerAPIVersionHeader)
+	version, err := parseAPIVersion(header)
+	switch {
+	case header == "":
+		err = fmt.Errorf("missing %s header", BrokerAPIVersionHeader)
+	case err != nil:
+	case version.Major != c.min.Major || version.less(c.min):
+		err = fmt.Errorf("broker API version %s is not supported, the minimum is %s", version, c.min)
+	}
+	if err != nil {
+		c.log.Printf("[WARN] rejecting %s %s: %s", r.Method, r.URL.Path, err)
+		respondJSON(w, http.StatusPreconditionFailed, brokerapi.ErrorResponse{
+			Description: err.Error(),
+		})
+		return
+	}
+
+	c.log.Printf("[DEBUG] negotiated broker API version %s for %s %s", version, r.Method, r.URL.Path)
+	c.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAPIVersion(t *testing.T) {
+	cases := []struct {
+		i   string
+		e   apiVersion
+		err bool
+	}{
+		{"2.14", apiVersion{2, 14}, false},
+		{" 2.0 ", apiVersion{2, 0}, false},
+		{"2", apiVersion{}, true},
+		{"2.14.1", apiVersion{}, true},
+		{"two.fourteen", apiVersion{}, true},
+		{"2.-1", apiVersion{}, true},
+		{"", apiVersion{}, true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.i), func(t *testing.T) {
+			v, err := parseAPIVersion(tc.i)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error to be %t, got %v", tc.err, err)
+			}
+			if v != tc.e {
+				t.Errorf("expected %s but received %s", tc.e, v)
+			}
+		})
+	}
+}
+
+func TestAPIVersionChecker(t *testing.T) {
+	checker := &apiVersionChecker{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		min: apiVersion{2, 13},
+		log: NewLogger(&bytes.Buffer{}, LogFormatText, LogLevelInfo),
+	}
+
+	cases := []struct {
+		path    string
+		version string
+		e       int
+	}{
+		{"/v2/catalog", "2.14", http.StatusOK},
+		{"/v2/catalog", "2.13", http.StatusOK},
+		{"/v2/catalog", "2.12", http.StatusPreconditionFailed},
+		{"/v2/catalog", "3.0", http.StatusPreconditionFailed},
+		{"/v2/catalog", "latest", http.StatusPreconditionFailed},
+		{"/v2/service_instances/instance-id", "", http.StatusPreconditionFailed},
+		{"/admin/instances", "", http.StatusOK},
+		{"/metrics", "", http.StatusOK},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.version), func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			if tc.version != "" {
+				r.Header.Set(BrokerAPIVersionHeader, tc.version)
+			}
+			w := httptest.NewRecorder()
+			checker.ServeHTTP(w, r)
+			if w.Code != tc.e {
+				t.Fatalf("expected %d but received %d", tc.e, w.Code)
+			}
+		})
+	}
+}
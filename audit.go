@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// auditDeviceTypes are the audit devices the broker can enable.
+var auditDeviceTypes = map[string]struct{}{
+	"file":   struct{}{},
+	"socket": struct{}{},
+	"syslog": struct{}{},
+}
+
+// enableAudit enables the configured audit device at b.auditPath, unless an
+// audit device is already enabled there. Enabling audit devices requires sudo
+// on sys/audit, which the broker's token may not have.
+func (b *Broker) enableAudit() error {
+	path := strings.Trim(b.auditPath, "/")
+
+	audits, err := b.vault().Sys().ListAudit()
+	if err != nil {
+		if vaultErrorCode(err) == 403 {
+			return errors.Wrap(err, "the broker's token is not allowed to list audit devices, "+
+				"which requires sudo on sys/audit")
+		}
+		return errors.Wrap(err, "failed to list audit devices")
+	}
+	for k, existing := range audits {
+		if strings.Trim(k, "/") != path {
+			continue
+		}
+		if existing.Type != b.audit.Type {
+			b.log.Printf("[WARN] audit device %s is of type %s instead of %s, leaving it unchanged",
+				path, existing.Type, b.audit.Type)
+			return nil
+		}
+		b.log.Printf("[DEBUG] audit device %s is already enabled", path)
+		return nil
+	}
+
+	b.log.Printf("[INFO] enabling %s audit device at %s", b.audit.Type, path)
+	if err := b.vault().Sys().EnableAuditWithOptions(path, b.audit); err != nil {
+		if vaultErrorCode(err) == 403 {
+			return errors.Wrapf(err, "the broker's token is not allowed to enable audit device %s, "+
+				"which requires sudo on sys/audit/%s", path, path)
+		}
+		return errors.Wrapf(err, "failed to enable audit device %s", path)
+	}
+	return nil
+}
+
+// newAuditOptions returns the options of the audit device to enable.
+func newAuditOptions(auditType string, options map[string]string) *api.EnableAuditOptions {
+	return &api.EnableAuditOptions{
+		Type:        auditType,
+		Description: "Audit device enabled by the Vault service broker",
+		Options:     options,
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBroker_EnableAudit(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.audit = newAuditOptions("file", map[string]string{"file_path": "stdout"})
+
+	env.Broker.auditPath = "cf-broker"
+	if err := env.Broker.enableAudit(); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("PUT /v1/sys/audit/cf-broker") {
+		t.Fatal("expected the audit device to be enabled")
+	}
+
+	// An audit device which is already enabled is left alone
+	env.Broker.auditPath = "existing"
+	if err := env.Broker.enableAudit(); err != nil {
+		t.Fatal(err)
+	}
+	if env.Requests.contains("PUT /v1/sys/audit/existing") {
+		t.Fatal("expected the existing audit device to not be enabled again")
+	}
+
+	env.Broker.auditPath = "forbidden"
+	err := env.Broker.enableAudit()
+	if err == nil || !strings.Contains(err.Error(), "requires sudo") {
+		t.Fatalf("expected an error explaining the missing permission but got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// AuthMethodToken authenticates the broker with the static VAULT_TOKEN.
+	AuthMethodToken = "token"
+
+	// AuthMethodCert authenticates the broker by logging in to Vault's cert
+	// auth method with the configured TLS client certificate.
+	AuthMethodCert = "cert"
+
+	// AuthMethodAppRole authenticates the broker by logging in to Vault's
+	// AppRole auth method with VAULT_ROLE_ID and VAULT_SECRET_ID.
+	AuthMethodAppRole = "approle"
+
+	// AuthMethodKubernetes authenticates the broker by logging in to Vault's
+	// Kubernetes auth method with its service account token.
+	AuthMethodKubernetes = "kubernetes"
+)
+
+// VaultNamespaceHeader is the header which selects the Vault namespace of a
+// request.
+const VaultNamespaceHeader = "X-Vault-Namespace"
+
+// newVaultClient builds a Vault client from the configuration, including the
+// TLS settings used to verify Vault and to present a client certificate. The
+// client's transport is wrapped by each of the given wrappers in turn.
+func newVaultClient(c *Configuration, wrappers ...func(http.RoundTripper) http.RoundTripper) (*api.Client, error) {
+	vaultConfig := api.DefaultConfig()
+	vaultConfig.Address = c.VaultAddr
+
+	// The client counts attempts rather than retries, so a request is tried
+	// once more than the number of retries. Zero values keep the defaults.
+	vaultConfig.MaxRetries = c.VaultMaxRetries + 1
+	if c.VaultClientTimeout > 0 {
+		vaultConfig.Timeout = c.VaultClientTimeout
+	}
+
+	if err := vaultConfig.ConfigureTLS(&api.TLSConfig{
+		CACert:     c.VaultCACert,
+		CAPath:     c.VaultCAPath,
+		ClientCert: c.VaultClientCert,
+		ClientKey:  c.VaultClientKey,
+		Insecure:   c.VaultSkipVerify,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to configure TLS: %s", err)
+	}
+
+	client, err := api.NewClient(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client has neither failover nor namespace support, so both are
+	// handled by the transport. This must happen after the client is created,
+	// which expects the default transport.
+	if len(c.VaultAddrs) > 1 {
+		t, err := newFailoverTransport(c.VaultAddrs, vaultConfig.HttpClient.Transport)
+		if err != nil {
+			return nil, err
+		}
+		vaultConfig.HttpClient.Transport = t
+	}
+	if c.VaultNamespace != "" {
+		vaultConfig.HttpClient.Transport = &namespaceTransport{
+			namespace: c.VaultNamespace,
+			next:      vaultConfig.HttpClient.Transport,
+		}
+	}
+	for _, wrap := range wrappers {
+		vaultConfig.HttpClient.Transport = wrap(vaultConfig.HttpClient.Transport)
+	}
+	return client, nil
+}
+
+// namespaceTransport sets the Vault namespace header on each request.
+type namespaceTransport struct {
+	namespace string
+	next      http.RoundTripper
+}
+
+func (t *namespaceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the original request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set(VaultNamespaceHeader, t.namespace)
+	return t.next.RoundTrip(r)
+}
+
+// newVaultLogin returns a function which logs in to Vault using the
+// configured auth method and returns the new token. It returns nil for the
+// token auth method, whose static token cannot be replaced.
+func newVaultLogin(c *Configuration) (func() (string, error), error) {
+	data := map[string]interface{}{}
+	var jwtPath string
+	switch c.VaultAuthMethod {
+	case AuthMethodToken:
+		return nil, nil
+	case AuthMethodCert:
+		if c.VaultCertRole != "" {
+			data["name"] = c.VaultCertRole
+		}
+	case AuthMethodAppRole:
+		data["role_id"] = c.VaultRoleID
+		if c.VaultSecretID != "" {
+			data["secret_id"] = c.VaultSecretID
+		}
+	case AuthMethodKubernetes:
+		data["role"] = c.VaultK8sRole
+		jwtPath = c.VaultK8sTokenPath
+	default:
+		return nil, fmt.Errorf("unsupported auth method %q", c.VaultAuthMethod)
+	}
+
+	// Log in with a dedicated client so that logging in never changes the
+	// token used by the broker's client.
+	client, err := newVaultClient(c)
+	if err != nil {
+		return nil, err
+	}
+	client.ClearToken()
+
+	path := "auth/" + c.vaultAuthMount() + "/login"
+	return func() (string, error) {
+		if jwtPath == "" {
+			return loginWithPath(client, path, data)
+		}
+
+		// Kubernetes rotates projected service account tokens, so the token
+		// is read again on every login.
+		jwt, err := readVaultTokenFile(jwtPath)
+		if err != nil {
+			return "", err
+		}
+		withJWT := make(map[string]interface{}, len(data)+1)
+		for k, v := range data {
+			withJWT[k] = v
+		}
+		withJWT["jwt"] = jwt
+		return loginWithPath(client, path, withJWT)
+	}, nil
+}
+
+// readVaultTokenFile reads the broker's token from the given file.
+func readVaultTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token file: %s", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// loginWithPath writes the login data to the given path and returns the token
+// from the response.
+func loginWithPath(client *api.Client, path string, data map[string]interface{}) (string, error) {
+	secret, err := client.Logical().Write(path, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to login at %s: %s", path, err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", fmt.Errorf("login at %s returned no token", path)
+	}
+	return secret.Auth.ClientToken, nil
+}
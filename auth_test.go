@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// loginServer returns a fake Vault which accepts logins at the given path and
+// records the request bodies.
+func loginServer(t *testing.T, path string, bodies *[]map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path || r.Method != "PUT" || r.Header.Get("X-Vault-Token") != "" {
+			w.WriteHeader(400)
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		*bodies = append(*bodies, body)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"auth": {"client_token": "login-token", "accessor": "login-accessor", "renewable": true, "lease_duration": 3600}}`))
+	}))
+}
+
+func TestNewVaultLogin_Token(t *testing.T) {
+	login, err := newVaultLogin(&Configuration{
+		VaultAddr:       "http://127.0.0.1:8200/",
+		VaultAuthMethod: AuthMethodToken,
+		VaultToken:      "static-token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != nil {
+		t.Fatal("expected no login for the token auth method")
+	}
+}
+
+func TestNewVaultLogin_Cert(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := loginServer(t, "/v1/auth/tls/login", &bodies)
+	defer ts.Close()
+
+	login, err := newVaultLogin(&Configuration{
+		VaultAddr:       ts.URL,
+		VaultAuthMethod: AuthMethodCert,
+		VaultAuthMount:  "/tls/",
+		VaultCertRole:   "broker",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "login-token" {
+		t.Fatalf("expected %q but received %q", "login-token", token)
+	}
+	expected := []map[string]interface{}{{"name": "broker"}}
+	if !reflect.DeepEqual(bodies, expected) {
+		t.Fatalf("expected %v but received %v", expected, bodies)
+	}
+}
+
+func TestNewVaultLogin_AppRole(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := loginServer(t, "/v1/auth/approle/login", &bodies)
+	defer ts.Close()
+
+	login, err := newVaultLogin(&Configuration{
+		VaultAddr:       ts.URL,
+		VaultAuthMethod: AuthMethodAppRole,
+		VaultRoleID:     "role",
+		VaultSecretID:   "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := login(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []map[string]interface{}{
+		{"role_id": "role", "secret_id": "secret"},
+		{"role_id": "role", "secret_id": "secret"},
+	}
+	if !reflect.DeepEqual(bodies, expected) {
+		t.Fatalf("expected %v but received %v", expected, bodies)
+	}
+}
+
+func TestNewVaultLogin_Kubernetes(t *testing.T) {
+	var bodies []map[string]interface{}
+	ts := loginServer(t, "/v1/auth/kubernetes/login", &bodies)
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "k8s-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("jwt-1\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	login, err := newVaultLogin(&Configuration{
+		VaultAddr:         ts.URL,
+		VaultAuthMethod:   AuthMethodKubernetes,
+		VaultK8sRole:      "broker",
+		VaultK8sTokenPath: f.Name(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := login(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated token must be used on the next login
+	if err := ioutil.WriteFile(f.Name(), []byte("jwt-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := login(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]interface{}{
+		{"role": "broker", "jwt": "jwt-1"},
+		{"role": "broker", "jwt": "jwt-2"},
+	}
+	if !reflect.DeepEqual(bodies, expected) {
+		t.Fatalf("expected %v but received %v", expected, bodies)
+	}
+
+	os.Remove(f.Name())
+	if _, err := login(); err == nil {
+		t.Fatal("expected an error for a missing service account token")
+	}
+}
+
+func TestNewVaultClient_Namespace(t *testing.T) {
+	var namespaces []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		namespaces = append(namespaces, r.Header.Get(VaultNamespaceHeader))
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	client, err := newVaultClient(&Configuration{
+		VaultAddr:      ts.URL,
+		VaultNamespace: "team-a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Read("secret/foo"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"team-a"}
+	if !reflect.DeepEqual(namespaces, expected) {
+		t.Fatalf("expected %v but received %v", expected, namespaces)
+	}
+}
+
+func TestNewVaultClient_Retries(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	client, err := newVaultClient(&Configuration{
+		VaultAddr:       ts.URL,
+		VaultMaxRetries: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Read("secret/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts but received %d", attempts)
+	}
+}
+
+func TestNewVaultClient_Timeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(404)
+	}))
+	defer ts.Close()
+
+	client, err := newVaultClient(&Configuration{
+		VaultAddr:          ts.URL,
+		VaultClientTimeout: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Logical().Read("secret/foo"); err == nil {
+		t.Fatal("expected the request to time out")
+	}
+}
+
+func TestNewVaultClient_MissingCert(t *testing.T) {
+	config := &Configuration{
+		VaultAddr:       "https://127.0.0.1:8200/",
+		VaultClientCert: "/does/not/exist.crt",
+		VaultClientKey:  "/does/not/exist.key",
+	}
+	if _, err := newVaultClient(config); err == nil {
+		t.Fatal("expected an error for a missing client certificate")
+	}
+}
@@ -3,15 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
+	"net/http"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/api"
 	"github.com/pivotal-cf/brokerapi"
 	"github.com/pkg/errors"
@@ -20,8 +26,50 @@ import (
 const (
 	// VaultPeriodicTTL is the token role periodic TTL.
 	VaultPeriodicTTL = 5 * 24 * 60 * 60
+
+	// renewRetryMin and renewRetryMax bound the exponential backoff between
+	// attempts to renew a token after a failure.
+	renewRetryMin = 1 * time.Second
+	renewRetryMax = 5 * time.Minute
+
+	// renewRetryAttempts is the number of times the broker's token is retried
+	// with a backoff before falling back to retrying every renewRetryMax.
+	renewRetryAttempts = 6
+
+	// renewJitterMin and renewJitterPerBinding size the window over which the
+	// first renewals of bindings are spread when no window is configured: at
+	// least renewJitterMin, growing with the number of bindings.
+	renewJitterMin        = 5 * time.Second
+	renewJitterPerBinding = 10 * time.Millisecond
+
+	// renewTokenGrace is how close to expiring the broker's token gets
+	// renewed. Closer to its max TTL, renewal gives up, like the grace of
+	// api.Renewer.
+	renewTokenGrace = 15 * time.Second
 )
 
+// jitterRand is the source of renewal jitter. It is seeded on start so that
+// brokers restarted together do not renew in lockstep.
+var jitterRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+// lockedSource makes a rand.Source safe for concurrent use.
+type lockedSource struct {
+	lock sync.Mutex
+	src  rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.src.Seed(seed)
+}
+
 // Ensure we implement the broker API
 var _ brokerapi.ServiceBroker = (*Broker)(nil)
 
@@ -31,17 +79,116 @@ type bindingInfo struct {
 	Binding      string
 	ClientToken  string
 	Accessor     string
-	stopCh       chan struct{}
+
+	// TTL, NumUses, and AdditionalPolicies are the bind parameters the token
+	// was created with. Tokens with a TTL or limited uses are not renewed.
+	TTL                time.Duration `json:",omitempty"`
+	NumUses            int           `json:",omitempty"`
+	AdditionalPolicies []string      `json:",omitempty"`
+
+	// SharedSpace is the space the binding was created from, if it is not
+	// the instance's own space but one the instance is shared with.
+	SharedSpace string `json:",omitempty"`
+
+	// RequestedBy is the originating identity of the user who created the
+	// binding, if the platform sent one.
+	RequestedBy string `json:",omitempty"`
+
+	// SSHSignedKey and SSHSerialNumber are the SSH certificate signed for the
+	// binding, on plans with the SSH engine.
+	SSHSignedKey    string `json:",omitempty"`
+	SSHSerialNumber string `json:",omitempty"`
+
+	// AWSAccessKey, AWSSecretKey, and AWSSecurityToken are the AWS
+	// credentials generated for the binding, on plans with the AWS engine.
+	AWSAccessKey     string `json:",omitempty"`
+	AWSSecretKey     string `json:",omitempty"`
+	AWSSecurityToken string `json:",omitempty"`
+
+	// LeaseID is the lease of the binding's secret, such as its AWS
+	// credentials, which is revoked when the binding is deleted. Renewable
+	// leases are renewed along with the token.
+	LeaseID        string `json:",omitempty"`
+	LeaseRenewable bool   `json:",omitempty"`
+
+	// Wrapping is the response-wrapping token holding the binding's
+	// credentials, if the binding was requested with a wrap_ttl. Such bindings
+	// are only given the wrapping token.
+	Wrapping *api.SecretWrapInfo `json:",omitempty"`
+
+	// EntityID and EntityAliasID are the Vault Identity entity of the
+	// instance and the alias which attaches the binding's token to it, if
+	// bindings are given identities.
+	EntityID      string `json:",omitempty"`
+	EntityAliasID string `json:",omitempty"`
+
+	// CredhubRef is the name of the binding's credentials in CredHub, if
+	// they are stored there and the platform is only given the reference.
+	CredhubRef string `json:",omitempty"`
+
+	// CreatedAt and UpdatedAt are when the binding was created and last
+	// changed. They are zero for bindings created before they were recorded.
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	instanceID string
+}
+
+// matches returns true if the binding was created with the given parameters
+// from the given space, so that a retried bind can be given the binding
+// instead of a second token.
+func (info *bindingInfo) matches(params *bindParameters, sharedSpace string) bool {
+	return info.TTL == params.ttl &&
+		info.NumUses == params.NumUses &&
+		reflect.DeepEqual(info.AdditionalPolicies, params.AdditionalPolicies) &&
+		info.SharedSpace == sharedSpace &&
+		(info.SSHSignedKey != "") == (params.SSHPublicKey != "") &&
+		(info.Wrapping != nil) == (params.wrapTTL > 0)
 }
 
 type instanceInfo struct {
 	OrganizationGUID string
 	SpaceGUID        string
+
+	// PlanID is the catalog ID of the instance's plan. It is empty for
+	// instances provisioned before the plan was recorded, which are assumed
+	// to use the default plan.
+	PlanID string `json:",omitempty"`
+
+	// ExtraMounts are mounted in addition to the plan's engines, as requested
+	// when the instance was provisioned.
+	ExtraMounts []ExtraMount `json:",omitempty"`
+
+	// SharedSpaces are the other spaces which the instance is shared with and
+	// which have bound to it. Their bindings use the "cf-instanceID-shared"
+	// policy.
+	SharedSpaces []string `json:",omitempty"`
+
+	// KVVersion is 2 if the instance's KV mount was created with version 2
+	// of the engine, and 0 for version 1.
+	KVVersion int `json:",omitempty"`
+
+	// EntityID is the Vault Identity entity which the tokens of the
+	// instance's bindings are attached to. It is created on the first bind
+	// if bindings are given identities.
+	EntityID string `json:",omitempty"`
+
+	// CreatedAt and UpdatedAt are when the instance was provisioned and last
+	// updated. They are zero for instances provisioned before they were
+	// recorded.
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 type Broker struct {
-	log         *log.Logger
+	log *Logger
+
+	// vaultClient is the client the broker talks to Vault with. Its token
+	// is never changed once other goroutines may use it. Replacing the
+	// broker's token swaps in a copy of the client instead, so the client
+	// is read with vault.
 	vaultClient *api.Client
+	vaultLock   sync.RWMutex
 
 	// service-specific customization
 	serviceID          string
@@ -49,38 +196,291 @@ type Broker struct {
 	serviceDescription string
 	serviceTags        []string
 
-	// plan-specific customization
-	planName        string
-	planDescription string
+	// serviceMetadata is shown in the marketplace, for example by Apps
+	// Manager. It is nil if none is configured.
+	serviceMetadata *brokerapi.ServiceMetadata
+
+	// dashboardURL renders the dashboard URL of an instance. It is nil if no
+	// dashboard is configured.
+	dashboardURL *template.Template
+
+	// bindAllowedPolicies are the policies which may be requested with the
+	// additional_policies bind parameter, and defaultBindPolicies are
+	// attached to every binding token.
+	bindAllowedPolicies []string
+	defaultBindPolicies []string
+
+	// bindMaxNumUses is the largest num_uses bind parameter accepted. Zero
+	// rejects the parameter.
+	bindMaxNumUses int
+
+	// maxBindings is the most bindings an instance may have. Zero means no
+	// limit.
+	maxBindings int
+
+	// events receives the lifecycle events of instances and bindings. It is
+	// nil if no event sink is configured.
+	events *eventSink
+
+	// bindIdentity toggles whether binding tokens are attached to a Vault
+	// Identity entity per instance, through an alias per binding in the token
+	// auth method with accessor tokenAuthAccessor. Start looks up the
+	// accessor if it is empty.
+	bindIdentity      bool
+	tokenAuthAccessor string
+
+	// credhub stores the credentials of new bindings, which the platform
+	// then only gets a reference to. It is nil if credentials are returned
+	// directly.
+	credhub *credhubClient
+
+	// serviceCapabilities, spaceCapabilities, and orgCapabilities replace the
+	// default capabilities of each instance's policy on its own, its space's,
+	// and its organization's paths, if set.
+	serviceCapabilities []string
+	spaceCapabilities   []string
+	orgCapabilities     []string
+
+	// bindingTransitMount and bindingTransitKey name the transit key used to
+	// encrypt stored binding info. Binding info is stored in plaintext if the
+	// key is empty.
+	bindingTransitMount string
+	bindingTransitKey   string
+
+	// plans are the service plans offered by the broker. The first plan is
+	// the default when a request does not specify one.
+	plans []*Plan
+
+	// sealWrapErr is why plans with seal_wrap cannot be provisioned, or nil
+	// if Vault supports seal wrapping or no plan needs it.
+	sealWrapErr error
 
 	// vaultAdvertiseAddr is the address where Vault should be advertised to
-	// clients.
-	vaultAdvertiseAddr string
+	// clients. If vaultAdvertiseAddrTemplate is set, it renders the address
+	// of each binding instead, for example by organization or space.
+	vaultAdvertiseAddr         string
+	vaultAdvertiseAddrTemplate *template.Template
+
+	// vaultAdvertiseCACert is the PEM-encoded CA certificate given to clients
+	// to verify Vault's TLS certificate. It is omitted from the credentials if
+	// empty.
+	vaultAdvertiseCACert string
+
+	// vaultNamespace is the Vault namespace the broker works in. It is given
+	// to clients if set.
+	vaultNamespace string
 
 	// vaultRenewToken toggles whether the broker should renew the supplied token.
 	vaultRenewToken bool
 
+	// checkTokenCapabilities toggles whether Start checks that the broker's
+	// token has the capabilities it needs.
+	checkTokenCapabilities bool
+
+	// dryRun toggles whether operations only log what they would change in
+	// Vault and succeed without changing it.
+	dryRun bool
+
+	// renewJitter is the window over which the first renewal of each binding
+	// is randomly delayed. If zero, the window grows with the number of
+	// bindings.
+	renewJitter time.Duration
+
+	// renewIncrement is the increment in seconds requested when renewing the
+	// broker's and the bindings' tokens. Zero lets Vault decide.
+	renewIncrement int
+
+	// renewGrace is how close to expiring the broker's token gets renewed,
+	// renewTokenGrace if zero.
+	renewGrace time.Duration
+
+	// vaultStartupWait is how long Start waits for Vault to be unsealed and
+	// reachable, checking every vaultStartupPollInterval. Zero disables the
+	// wait.
+	vaultStartupWait         time.Duration
+	vaultStartupPollInterval time.Duration
+
+	// healthProbeInterval is how often Vault and the broker's token are
+	// checked in the background, with the result kept in vaultHealth. Zero
+	// disables the probe.
+	healthProbeInterval time.Duration
+	vaultHealth         vaultHealth
+
+	// vaultLogin logs in to Vault and returns a new token for the broker. It
+	// is nil if the broker was given a static token, which cannot be replaced.
+	vaultLogin func() (string, error)
+
+	// bindingLister lists the bindings known to the platform. If set, bindings
+	// which are missing from the platform are revoked every reconcileInterval.
+	bindingLister     bindingLister
+	reconcileInterval time.Duration
+
+	// mountDescription renders the description of the mounts created for an
+	// instance, with the names nameResolver looks up if it is set. No
+	// description is set if it is nil.
+	mountDescription *template.Template
+	nameResolver     nameResolver
+
+	// nameLookupStrict fails provisioning if the names of the organization
+	// or space cannot be looked up, instead of describing the mounts with
+	// their GUIDs. Failed lookups are retried after nameLookupRetryDelay,
+	// doubling with each retry.
+	nameLookupStrict     bool
+	nameLookupRetryDelay time.Duration
+
+	// policyTemplate, if set, replaces ServicePolicyTemplate in generating
+	// the policies of instances.
+	policyTemplate *template.Template
+
+	// orphans is the set of "instanceID/bindingID" keys found missing from
+	// the platform on the last reconcile pass. It is only used by reconcile.
+	orphans map[string]struct{}
+
+	// operationTimeout bounds Provision, Deprovision, Bind, and Unbind when the
+	// request context has no deadline. Zero disables the timeout.
+	operationTimeout time.Duration
+
+	// tokenMaxTTL, tokenNumUses, and tokenNoDefaultPolicy further constrain
+	// the tokens created for bindings. They are written to each instance's
+	// token role if set.
+	tokenMaxTTL          time.Duration
+	tokenNumUses         int
+	tokenNoDefaultPolicy bool
+
+	// bindSelfHeal toggles whether Bind recreates an instance's token role and
+	// policy when they were deleted out-of-band.
+	bindSelfHeal bool
+
+	// restoreConcurrency is the number of instances or bindings restored at
+	// once on start.
+	restoreConcurrency int
+
+	// restoreFailureThreshold is the fraction of instances and bindings that
+	// may fail to restore on start before starting the broker fails.
+	restoreFailureThreshold float64
+
+	// unmountOnUpdate toggles whether Update removes the backends that are not
+	// part of the new plan. This destroys the data stored in them.
+	unmountOnUpdate bool
+
+	// mountPrefix is the root path under which secret engines are mounted
+	// and the broker's metadata is stored.
+	mountPrefix string
+
+	// mountDefaultLeaseTTL and mountMaxLeaseTTL are the lease TTLs given to
+	// new mounts. If zero, mounts inherit the Vault system defaults.
+	mountDefaultLeaseTTL time.Duration
+	mountMaxLeaseTTL     time.Duration
+
+	// awsRoleARN and awsRegion configure the AWS engine of each instance,
+	// which assumes the role using the root credentials awsAccessKeyID and
+	// awsSecretAccessKey, or Vault's own credentials if they are empty.
+	awsRoleARN         string
+	awsRegion          string
+	awsAccessKeyID     string
+	awsSecretAccessKey string
+
+	// sshAllowedUsers are the users which the SSH certificates of bindings are
+	// valid for, the first being the default, and sshCertTTL is how long the
+	// certificates are valid for.
+	sshAllowedUsers []string
+	sshCertTTL      time.Duration
+
+	// pkiAllowedDomains are the domains, and their subdomains, which the PKI
+	// engine of each instance issues certificates for. The certificates are
+	// valid for pkiCertTTL, and the CA of each engine for pkiCATTL.
+	pkiAllowedDomains []string
+	pkiCertTTL        time.Duration
+	pkiCATTL          time.Duration
+
+	// audit is the audit device enabled at auditPath on start, or nil if the
+	// broker does not enable one.
+	audit     *api.EnableAuditOptions
+	auditPath string
+
+	// driftCheck toggles whether restored instances are compared with Vault
+	// on start, and driftRepair whether what is missing is created again.
+	driftCheck  bool
+	driftRepair bool
+
+	// mountReconcile toggles whether existing mounts are tuned to match the
+	// configured lease TTLs.
+	mountReconcile bool
+
 	// mountMutex is used to protect updates to the mount table
 	mountMutex sync.Mutex
 
-	// Binds is used to track all the bindings and perform
+	// instanceMutex serializes operations on a single instance.
+	instanceMutex keyedMutex
+
+	// sharedMountCleanup toggles whether the shared organization and space
+	// mounts are removed along with the last instance using them.
+	// sharedMutex, keyed by organization and space GUIDs, serializes those
+	// removals with provisions in the same organization or space.
+	sharedMountCleanup bool
+	sharedMutex        keyedMutex
+
+	// disableOrgMount and disableSpaceMount stop the broker from creating the
+	// shared organization and space mounts and from granting access to them.
+	disableOrgMount   bool
+	disableSpaceMount bool
+
+	// Binds is used to track all the bindings, and renewals to perform
 	// their renewal at (Expiration/2) intervals.
 	binds    map[string]*bindingInfo
 	bindLock sync.Mutex
+	renewals renewalManager
 
 	// instances is used to map instances to their space and org GUID.
 	instances     map[string]*instanceInfo
 	instancesLock sync.Mutex
 
+	// restoreIncomplete is set if some instances could not be restored, so
+	// that instances is missing some of them. It is protected by
+	// instancesLock.
+	restoreIncomplete bool
+
+	// tokenStopCh stops the renewal of the broker's token, so that renewal can
+	// be restarted when the token is replaced.
+	tokenStopCh chan struct{}
+	tokenLock   sync.Mutex
+
+	// renewalFailures counts failed renewals by kind and reason, and
+	// tokenRenewalHealthy is 1 while the last renewal of the broker's token
+	// succeeded, for the metrics.
+	renewalFailures     labeledCounter
+	tokenRenewalHealthy int32
+
 	// stopLock, stopped, and stopCh are used to control the stopping behavior of
 	// the broker.
 	stopLock sync.Mutex
 	running  bool
 	stopCh   chan struct{}
+
+	// renewers tracks the goroutines renewing tokens, so that Stop can wait
+	// up to stopTimeout for them to exit. renewersActive counts them for the
+	// log.
+	renewers       sync.WaitGroup
+	renewersActive int32
+	stopTimeout    time.Duration
+
+	// quiescing is set to 1 once the broker stops accepting new instances
+	// and bindings, for example while it is shutting down.
+	quiescing int32
+
+	// store holds the metadata of instances and bindings, in the KV mount at
+	// backendPath of version backendVersion. Start sets it if it is nil.
+	store          metadataStore
+	backendPath    string
+	backendVersion int
 }
 
-// Start is used to start the broker
-func (b *Broker) Start() error {
+// Start is used to start the broker. Cancelling the context aborts waiting for
+// Vault and restoring the instances and bindings, in which case Start returns
+// an error. The background work of the broker, such as renewals, only starts
+// once everything else has succeeded, so a failed Start leaves nothing
+// running.
+func (b *Broker) Start(ctx context.Context) error {
 	b.log.Printf("[INFO] starting broker")
 
 	b.stopLock.Lock()
@@ -92,12 +492,12 @@ func (b *Broker) Start() error {
 		return nil
 	}
 
-	// Create the stop channel
-	b.stopCh = make(chan struct{})
-
-	// Start background renewal
-	if b.vaultRenewToken {
-		go b.renewVaultToken()
+	// Wait for Vault to come up, since nothing below works until it has
+	if b.vaultStartupWait > 0 {
+		b.log.Printf("[DEBUG] waiting for vault to be ready")
+		if err := waitForVault(ctx, b.vault(), b.log, b.vaultStartupWait, b.vaultStartupPollInterval); err != nil {
+			return err
+		}
 	}
 
 	// Ensure binds is initialized
@@ -110,39 +510,104 @@ func (b *Broker) Start() error {
 		b.instances = make(map[string]*instanceInfo)
 	}
 
-	// Ensure the generic secret backend at cf/broker is mounted.
-	mounts := map[string]string{
-		"cf/broker": "generic",
+	// Ensure the mount prefix is set
+	if b.mountPrefix == "" {
+		b.mountPrefix = DefaultMountPrefix
+	}
+
+	// Ensure the metadata store is set, by default in <prefix>/broker
+	if b.backendPath == "" {
+		b.backendPath = mountPath(b.mountPrefix, "broker")
 	}
-	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
-	if err := b.idempotentMount(mounts); err != nil {
-		return errors.Wrap(err, "failed to create mounts")
+	if b.store == nil {
+		b.store = newKVStore(b.vault, b.backendPath, b.backendVersion)
 	}
 
-	// Restore timers
-	b.log.Printf("[DEBUG] restoring bindings")
-	instances, err := b.listDir("cf/broker/")
-	if err != nil {
-		return errors.Wrap(err, "failed to list instances")
+	// Check the token can do its job before touching anything
+	if b.checkTokenCapabilities {
+		b.log.Printf("[DEBUG] checking the capabilities of the broker's token")
+		if err := b.checkCapabilities(); err != nil {
+			return err
+		}
 	}
-	for _, inst := range instances {
-		inst = strings.Trim(inst, "/")
 
-		if err := b.restoreInstance(inst); err != nil {
-			return errors.Wrapf(err, "failed to restore instance data for %q", inst)
+	// Seal wrapping needs Vault Enterprise. Without it only the plans which
+	// ask for it are refused, so that the others keep working.
+	b.sealWrapErr = nil
+	for _, p := range b.plans {
+		if p.SealWrap {
+			if err := b.checkSealWrap(); err != nil {
+				b.log.Printf("[ERR] plans with seal_wrap cannot be provisioned: %s", err)
+				b.sealWrapErr = err
+			}
+			break
 		}
+	}
 
-		binds, err := b.listDir("cf/broker/" + inst + "/")
+	// Entity aliases of binding tokens are created against the token auth
+	// method
+	if b.bindIdentity && b.tokenAuthAccessor == "" {
+		accessor, err := b.lookupTokenAuthAccessor()
 		if err != nil {
-			return errors.Wrapf(err, "failed to list binds for instance %q", inst)
+			return err
 		}
+		b.tokenAuthAccessor = accessor
+	}
 
-		for _, bind := range binds {
-			bind = strings.Trim(bind, "/")
-			if err := b.restoreBind(inst, bind); err != nil {
-				return errors.Wrapf(err, "failed to restore bind %q", bind)
-			}
+	// Nothing is written in a dry run, and nothing was provisioned to restore
+	if b.dryRun {
+		b.log.Printf("[INFO] dry-run: operations are logged and change nothing in vault, nothing is restored")
+		b.startBackground()
+		return nil
+	}
+
+	// Ensure the KV mount of the metadata store exists. Mounts of version 2
+	// cannot be created with the options of our Vault client, so they must be
+	// created beforehand.
+	if b.backendVersion == 2 {
+		table, err := b.listMounts()
+		if err != nil {
+			return errors.Wrap(err, "failed to list mounts")
+		}
+		if _, ok := table[strings.Trim(b.backendPath, "/")]; !ok {
+			return fmt.Errorf("the KV version 2 mount %s for the broker's metadata does not exist", b.backendPath)
+		}
+	} else {
+		mounts := []Mount{
+			{Path: b.backendPath, Type: KV},
 		}
+		b.log.Printf("[DEBUG] creating mounts %s", mountsToKV(mounts, ", "))
+		if err := b.idempotentMount(nil, mounts); err != nil {
+			return errors.Wrap(err, "failed to create mounts")
+		}
+	}
+
+	// Enable the audit device. Auditing is not required for the broker to
+	// work, so failures are only logged.
+	if b.audit != nil {
+		if err := b.enableAudit(); err != nil {
+			b.log.Printf("[ERR] failed to enable audit device: %s", err)
+		}
+	}
+
+	// Ensure the key which encrypts binding info exists
+	if b.bindingTransitKey != "" {
+		path := b.bindingTransitMount + "/keys/" + b.bindingTransitKey
+		b.log.Printf("[DEBUG] creating binding encryption key %s", path)
+		if _, err := b.vault().Logical().Write(path, nil); err != nil {
+			return errors.Wrapf(err, "failed to create binding encryption key %s", path)
+		}
+	}
+
+	// Restore timers
+	b.log.Printf("[DEBUG] restoring bindings")
+	instances, err := b.listDir(ctx, "")
+	if err != nil {
+		return errors.Wrap(err, "failed to list instances")
+	}
+	instances = trimKeys(instances)
+	if err := b.restore(ctx, instances); err != nil {
+		return err
 	}
 
 	// Log our restore status
@@ -151,31 +616,194 @@ func (b *Broker) Start() error {
 		len(b.binds), len(instances))
 	b.bindLock.Unlock()
 
+	// Update the token roles of instances provisioned before the allowed or
+	// default policies or identities were configured
+	if err := b.migrateTokenRoles(ctx); err != nil {
+		return err
+	}
+
+	// Report instances which no longer match Vault
+	if b.driftCheck {
+		if _, err := b.checkDrift(b.driftRepair); err != nil {
+			b.log.Printf("[WARN] failed to check for drift: %s", err)
+		}
+	}
+
+	// Start the background work, including the renewals of the restored
+	// bindings, and reconciliation of orphaned bindings
+	b.startBackground()
+	if b.bindingLister != nil && b.reconcileInterval > 0 {
+		go b.reconcileLoop()
+	}
+
+	return nil
+}
+
+// startBackground creates the stop channel and starts the work the broker does
+// in the background until it is stopped, and marks the broker as running.
+func (b *Broker) startBackground() {
+	b.stopCh = make(chan struct{})
+
+	// Start background renewal
+	if b.vaultRenewToken {
+		b.restartTokenRenewal()
+	}
+	b.goRenewer(b.runRenewals)
+
+	// Check Vault between operations, so a broken connection or token shows
+	// up before a user runs into it
+	if b.healthProbeInterval > 0 {
+		go b.healthProbeLoop()
+	}
+
+	// Deliver lifecycle events in the background
+	if b.events != nil {
+		go b.events.run(b.stopCh)
+	}
+
 	b.running = true
+}
+
+// restore restores the given instances and all of their bindings, using a pool
+// of workers to perform the restores concurrently. Failures are logged, and an
+// error is only returned if the fraction of failed restores exceeds the
+// configured threshold, or if the context is cancelled.
+func (b *Broker) restore(ctx context.Context, instances []string) error {
+	var lock sync.Mutex
+	var result *multierror.Error
+	total := len(instances)
+
+	// Restore the instances and list their bindings
+	type bind struct {
+		instanceID string
+		bindingID  string
+	}
+	var binds []bind
+	b.forEachParallel(len(instances), func(i int) {
+		inst := instances[i]
+
+		err := b.restoreInstance(ctx, inst)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to restore instance data for %q", inst)
+		}
+
+		var ids []string
+		if err == nil {
+			ids, err = b.listDir(ctx, metadataKey(inst))
+			if err != nil {
+				err = errors.Wrapf(err, "failed to list binds for instance %q", inst)
+			}
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			result = multierror.Append(result, err)
+			b.instancesLock.Lock()
+			b.restoreIncomplete = true
+			b.instancesLock.Unlock()
+			return
+		}
+		for _, id := range trimKeys(ids) {
+			binds = append(binds, bind{instanceID: inst, bindingID: id})
+		}
+	})
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "restore aborted")
+	}
 
+	// Restore the bindings
+	total += len(binds)
+	b.forEachParallel(len(binds), func(i int) {
+		if err := b.restoreBind(ctx, binds[i].instanceID, binds[i].bindingID); err != nil {
+			lock.Lock()
+			result = multierror.Append(result, errors.Wrapf(err, "failed to restore bind %q", binds[i].bindingID))
+			lock.Unlock()
+		}
+	})
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "restore aborted")
+	}
+	if result == nil {
+		return nil
+	}
+	for _, err := range result.Errors {
+		b.log.Printf("[ERR] %s", strings.Replace(err.Error(), "\n", " ", -1))
+	}
+	failed := len(result.Errors)
+	if float64(failed)/float64(total) > b.restoreFailureThreshold {
+		return errors.Wrapf(result, "failed to restore %d of %d instances and binds", failed, total)
+	}
+	b.log.Printf("[WARN] failed to restore %d of %d instances and binds", failed, total)
 	return nil
 }
 
+// forEachParallel calls fn for every index in [0, n), running at most
+// b.restoreConcurrency calls at once. It returns when all calls are done.
+func (b *Broker) forEachParallel(n int, fn func(i int)) {
+	workers := b.restoreConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// trimKeys strips the leading and trailing slashes from keys returned by
+// listDir and removes the duplicates that result when a key is both a secret
+// and a directory.
+func trimKeys(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	result := make([]string, 0, len(keys))
+	for _, k := range keys {
+		k = strings.Trim(k, "/")
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		result = append(result, k)
+	}
+	return result
+}
+
 // restoreInstance restores the data for the instance by the given ID.
-func (b *Broker) restoreInstance(instanceID string) error {
-	b.log.Printf("[INFO] restoring info for instance %s", instanceID)
+func (b *Broker) restoreInstance(ctx context.Context, instanceID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	path := "cf/broker/" + instanceID
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+	logger.Printf("[INFO] restoring info for instance %s", instanceID)
 
-	secret, err := b.vaultClient.Logical().Read(path)
+	info, err := b.readInstance(instanceID)
 	if err != nil {
-		return errors.Wrapf(err, "failed to read instance info at %q", path)
+		return err
 	}
-	if secret == nil || len(secret.Data) == 0 {
-		b.log.Printf("[INFO] restoreInstance %s has no secret data", path)
+	if info == nil {
 		return nil
 	}
 
-	// Decode the binding info
-	b.log.Printf("[DEBUG] decoding bind data from %s", path)
-	info, err := decodeInstanceInfo(secret.Data)
-	if err != nil {
-		return errors.Wrapf(err, "failed to decode instance info for %s", path)
+	// The plan determines the instance's mounts, so warn if it is no longer
+	// offered. Instances without a recorded plan use the default plan.
+	if _, err := b.findPlan(info.PlanID); err != nil {
+		logger.Printf("[WARN] instance %s has plan %q which is not in the catalog: %s", instanceID, info.PlanID, err)
 	}
 
 	// Store the info
@@ -186,66 +814,194 @@ func (b *Broker) restoreInstance(instanceID string) error {
 	return nil
 }
 
-// listDir is used to list a directory
-func (b *Broker) listDir(dir string) ([]string, error) {
-	b.log.Printf("[DEBUG] listing directory %q", dir)
-	secret, err := b.vaultClient.Logical().List(dir)
+// writeInstance stores the info for the instance by the given ID and saves it
+// to the cache.
+func (b *Broker) writeInstance(instanceID string, info *instanceInfo) error {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode instance json")
+	}
+
+	key := metadataKey(instanceID)
+	path := b.store.Path(key)
+	b.log.Printf("[DEBUG] storing instance metadata at %s", path)
+	if err := b.store.Write(key, map[string]interface{}{
+		"json": string(payload),
+	}); err != nil {
+		return errors.Wrapf(err, "failed to commit instance %s", path)
+	}
+
+	b.log.Printf("[DEBUG] saving instance %s to cache", instanceID)
+	b.instancesLock.Lock()
+	b.instances[instanceID] = info
+	b.instancesLock.Unlock()
+	return nil
+}
+
+// instanceDashboardURL renders the dashboard URL of the instance. It returns
+// an empty string if no dashboard is configured.
+func (b *Broker) instanceDashboardURL(instanceID string, info *instanceInfo) (string, error) {
+	if b.dashboardURL == nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := b.dashboardURL.Execute(&buf, &DashboardURLInput{
+		ServiceInstanceGUID: instanceID,
+		OrganizationGUID:    info.OrganizationGUID,
+		SpaceGUID:           info.SpaceGUID,
+		Namespace:           b.vaultNamespace,
+		Prefix:              b.mountPrefix,
+	}); err != nil {
+		return "", errors.Wrapf(err, "failed to render dashboard URL for %s", instanceID)
+	}
+	return buf.String(), nil
+}
+
+// readInstance reads the stored info for the instance by the given ID. It
+// returns nil if no info is stored for the instance.
+func (b *Broker) readInstance(instanceID string) (*instanceInfo, error) {
+	key := metadataKey(instanceID)
+	path := b.store.Path(key)
+
+	b.log.Printf("[DEBUG] reading instance info from %s", path)
+	data, err := b.store.Read(key)
 	if err != nil {
-		return nil, errors.Wrapf(err, "listDir %s", dir)
+		return nil, errors.Wrapf(err, "failed to read instance info at %q", path)
 	}
-	if secret == nil || len(secret.Data) == 0 {
-		b.log.Printf("[INFO] listDir %s has no secret data", dir)
+	if data == nil {
+		b.log.Printf("[INFO] readInstance %s has no secret data", path)
 		return nil, nil
 	}
 
-	keysRaw, ok := secret.Data["keys"].([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("listDir %s keys are not []interface{}", dir)
+	// Decode the instance info
+	b.log.Printf("[DEBUG] decoding instance data from %s", path)
+	info, err := decodeInstanceInfo(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode instance info for %s", path)
 	}
-	keys := make([]string, len(keysRaw))
-	for i, v := range keysRaw {
-		typed, ok := v.(string)
-		if !ok {
-			return nil, fmt.Errorf("listDir %s key %q is not string", dir, v)
-		}
-		keys[i] = typed
+	return info, nil
+}
+
+// listDir is used to list a directory of the metadata store
+func (b *Broker) listDir(ctx context.Context, dir string) ([]string, error) {
+	path := b.store.Path(dir)
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrapf(err, "listDir %s", path)
 	}
 
+	b.log.Printf("[DEBUG] listing directory %q", path)
+	keys, err := b.store.List(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listDir %s", path)
+	}
+	if keys == nil {
+		b.log.Printf("[INFO] listDir %s has no secret data", path)
+	}
 	return keys, nil
 }
 
+// existingBinding returns the binding of the instance with the given ID, or
+// nil if there is none. The cache is used unless it may be missing bindings,
+// in which case the binding is read from Vault.
+func (b *Broker) existingBinding(ctx context.Context, instanceID, bindingID string, cold bool) (*bindingInfo, error) {
+	if !cold {
+		b.bindLock.Lock()
+		defer b.bindLock.Unlock()
+		if info, ok := b.binds[bindingID]; ok && info.instanceID == instanceID {
+			return info, nil
+		}
+		return nil, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	key := metadataKey(instanceID, bindingID)
+	data, err := b.store.Read(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read bind info at %q", b.store.Path(key))
+	}
+	if data == nil {
+		return nil, nil
+	}
+	info, _, err := b.openBindingInfo(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode binding info for %s", b.store.Path(key))
+	}
+	return info, nil
+}
+
+// countBindings returns the number of bindings of the instance other than the
+// given one. The cached bindings are counted, unless the cache may be missing
+// some of them, for example because the instance was not restored yet, in
+// which case the bindings stored in Vault are counted instead.
+func (b *Broker) countBindings(ctx context.Context, instanceID, exclude string, cold bool) (int, error) {
+	if cold {
+		ids, err := b.listDir(ctx, metadataKey(instanceID))
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for _, id := range trimKeys(ids) {
+			if id != exclude {
+				n++
+			}
+		}
+		return n, nil
+	}
+
+	b.bindLock.Lock()
+	defer b.bindLock.Unlock()
+	n := 0
+	for id, info := range b.binds {
+		if info.instanceID == instanceID && id != exclude {
+			n++
+		}
+	}
+	return n, nil
+}
+
 // restoreBind is used to restore a binding
-func (b *Broker) restoreBind(instanceID, bindingID string) error {
-	b.log.Printf("[INFO] restoring bind for instance %s for binding %s",
+func (b *Broker) restoreBind(ctx context.Context, instanceID, bindingID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	logger := b.requestLog(ctx).With("instance_id", instanceID, "binding_id", bindingID)
+	logger.Printf("[INFO] restoring bind for instance %s for binding %s",
 		instanceID, bindingID)
 
 	// Read from Vault
-	path := "cf/broker/" + instanceID + "/" + bindingID
-	b.log.Printf("[DEBUG] reading bind from %s", path)
-	secret, err := b.vaultClient.Logical().Read(path)
+	key := metadataKey(instanceID, bindingID)
+	path := b.store.Path(key)
+	logger.Printf("[DEBUG] reading bind from %s", path)
+	data, err := b.store.Read(key)
 	if err != nil {
 		return errors.Wrapf(err, "failed to read bind info at %q", path)
 	}
-	if secret == nil || len(secret.Data) == 0 {
-		b.log.Printf("[INFO] restoreBind %s has no secret data", path)
+	if data == nil {
+		logger.Printf("[INFO] restoreBind %s has no secret data", path)
 		return nil
 	}
 
 	// Decode the binding info
-	b.log.Printf("[DEBUG] decoding bind data from %s", path)
-	info, err := decodeBindingInfo(secret.Data)
+	logger.Printf("[DEBUG] decoding bind data from %s", path)
+	info, encrypted, err := b.openBindingInfo(data)
 	if err != nil {
 		return errors.Wrapf(err, "failed to decode binding info for %s", path)
 	}
 
-	// Start a renewer for this token
-	info.stopCh = make(chan struct{})
-	go b.renewAuth(info.ClientToken, info.Accessor, info.stopCh)
+	// Encrypt binding info stored before encryption was enabled
+	if b.bindingTransitKey != "" && !encrypted {
+		logger.Printf("[INFO] encrypting binding info at %s", path)
+		if err := b.writeBindingInfo(key, info); err != nil {
+			logger.Printf("[WARN] failed to encrypt binding info at %s: %s", path, err)
+		}
+	}
 
-	// Store the info
-	b.bindLock.Lock()
-	b.binds[bindingID] = info
-	b.bindLock.Unlock()
+	// Store the info and schedule its token for renewal
+	info.instanceID = instanceID
+	b.addBinding(bindingID, info)
 	return nil
 }
 
@@ -264,11 +1020,62 @@ func (b *Broker) Stop() error {
 	// Close the stop channel and mark as stopped
 	close(b.stopCh)
 	b.running = false
+
+	// Let the renewers finish the calls to Vault they are in the middle of
+	if b.stopTimeout > 0 {
+		if n := b.waitRenewers(b.stopTimeout); n > 0 {
+			b.log.Printf("[WARN] %d renewers were still running after %s, stopping anyway", n, b.stopTimeout)
+		} else {
+			b.log.Printf("[DEBUG] all renewers stopped")
+		}
+	}
 	return nil
 }
 
+// errQuiescing is returned by Provision and Bind while the broker is
+// quiescing. The platform retries requests which fail with 503.
+var errQuiescing = brokerapi.NewFailureResponse(
+	errors.New("the broker is shutting down, retry later"), http.StatusServiceUnavailable, "quiesce")
+
+// Quiesce stops the broker from accepting new instances and bindings, so that
+// another broker can take over, for example during a rolling deploy. Unbind,
+// Deprovision and token renewals keep working until the broker is stopped.
+func (b *Broker) Quiesce() {
+	if atomic.CompareAndSwapInt32(&b.quiescing, 0, 1) {
+		b.log.Printf("[INFO] quiescing, rejecting new instances and bindings")
+	}
+}
+
+// quiesced returns true once Quiesce was called.
+func (b *Broker) quiesced() bool {
+	return atomic.LoadInt32(&b.quiescing) == 1
+}
+
 func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 	b.log.Printf("[INFO] listing services")
+
+	plans := make([]brokerapi.ServicePlan, len(b.plans))
+	for i, p := range b.plans {
+		plans[i] = brokerapi.ServicePlan{
+			ID:          b.planID(p),
+			Name:        p.Name,
+			Description: p.Description,
+			Free:        brokerapi.FreeValue(p.free()),
+		}
+		if p.DisplayName != "" || len(p.Bullets) > 0 || len(p.Costs) > 0 {
+			plans[i].Metadata = &brokerapi.ServicePlanMetadata{
+				DisplayName: p.DisplayName,
+				Bullets:     p.Bullets,
+			}
+			for _, c := range p.Costs {
+				plans[i].Metadata.Costs = append(plans[i].Metadata.Costs, brokerapi.ServicePlanCost{
+					Amount: c.Amount,
+					Unit:   c.Unit,
+				})
+			}
+		}
+	}
+
 	return []brokerapi.Service{
 		{
 			ID:            b.serviceID,
@@ -276,148 +1083,430 @@ func (b *Broker) Services(ctx context.Context) []brokerapi.Service {
 			Description:   b.serviceDescription,
 			Tags:          b.serviceTags,
 			Bindable:      true,
-			PlanUpdatable: false,
-			Plans: []brokerapi.ServicePlan{
-				{
-					ID:          fmt.Sprintf("%s.%s", b.serviceID, b.planName),
-					Name:        b.planName,
-					Description: b.planDescription,
-					Free:        brokerapi.FreeValue(true),
-				},
-			},
+			PlanUpdatable: true,
+			Plans:         plans,
+			Metadata:      b.serviceMetadata,
 		},
 	}
 }
 
+// planID returns the catalog ID of the given plan.
+func (b *Broker) planID(p *Plan) string {
+	return fmt.Sprintf("%s.%s", b.serviceID, p.Name)
+}
+
+// findPlan returns the plan with the given catalog ID. An empty ID resolves to
+// the default plan.
+func (b *Broker) findPlan(planID string) (*Plan, error) {
+	if len(b.plans) == 0 {
+		return nil, errors.New("no plans are configured")
+	}
+	if planID == "" {
+		return b.plans[0], nil
+	}
+	for _, p := range b.plans {
+		if b.planID(p) == planID {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown plan %q", planID)
+}
+
 // Provision is used to setup a new instance of Vault tenant. For each
 // tenant we create a new Vault policy called "cf-instanceID". This is
 // granted access to the service, space, and org contexts. We then create
 // a token role called "cf-instanceID" which is periodic. Lastly, we mount
-// the backends for the instance, and optionally for the space and org if
-// they do not exist yet.
+// the backends for the instance, as determined by its plan, and optionally
+// for the space and org if they do not exist yet.
 func (b *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, async bool) (brokerapi.ProvisionedServiceSpec, error) {
-	b.log.Printf("[INFO] provisioning instance %s in %s/%s",
+	spec, err := b.provision(ctx, instanceID, details, async)
+	b.emitEvent(ctx, lifecycleEvent{
+		Type:             eventProvision,
+		InstanceID:       instanceID,
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+	}, err)
+	return spec, err
+}
+
+func (b *Broker) provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, async bool) (brokerapi.ProvisionedServiceSpec, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+	logger.Printf("[INFO] provisioning instance %s in %s/%s",
 		instanceID, details.OrganizationGUID, details.SpaceGUID)
 
 	// Create the spec to return
 	var spec brokerapi.ProvisionedServiceSpec
-
-	// Generate the new policy
-	var buf bytes.Buffer
-	inp := ServicePolicyTemplateInput{
-		ServiceID: instanceID,
-		SpaceID:   details.SpaceGUID,
-		OrgID:     details.OrganizationGUID,
+	if b.quiesced() {
+		logger.Printf("[WARN] rejecting provision of %s while quiescing", instanceID)
+		return spec, errQuiescing
 	}
 
-	b.log.Printf("[DEBUG] generating policy for %s", instanceID)
-	if err := GeneratePolicy(&buf, &inp); err != nil {
-		return spec, b.wErrorf(err, "failed to generate policy for %s", instanceID)
+	// Reject IDs which would change the paths and policies they go into
+	if err := checkGUIDs(
+		[2]string{"instance", instanceID},
+		[2]string{"organization", details.OrganizationGUID},
+		[2]string{"space", details.SpaceGUID},
+	); err != nil {
+		logger.Printf("[WARN] rejecting instance %s: %s", instanceID, err)
+		return spec, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-id")
 	}
 
-	// Create the new policy
-	policyName := "cf-" + instanceID
-	b.log.Printf("[DEBUG] creating new policy %s", policyName)
-	if err := b.vaultClient.Sys().PutPolicy(policyName, buf.String()); err != nil {
-		return spec, b.wErrorf(err, "failed to create policy %s", policyName)
+	ctx, cancel := b.operationContext(ctx)
+	defer cancel()
+
+	// Serialize retries of the same provision and other operations on this
+	// instance
+	b.instanceMutex.Lock(instanceID)
+	defer b.instanceMutex.Unlock(instanceID)
+	if err := b.checkContext(ctx, "provision", instanceID); err != nil {
+		return spec, err
 	}
 
-	// Create the new token role
-	path := "/auth/token/roles/cf-" + instanceID
-	data := map[string]interface{}{
-		"allowed_policies": policyName,
-		"period":           VaultPeriodicTTL,
-		"renewable":        true,
+	// Parse the parameters before changing anything
+	params, err := parseProvisionParameters(details.RawParameters)
+	if err != nil {
+		logger.Printf("[WARN] rejecting parameters for instance %s: %s", instanceID, err)
+		return spec, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-parameters")
 	}
-	b.log.Printf("[DEBUG] creating new token role for %s", path)
-	if _, err := b.vaultClient.Logical().Write(path, data); err != nil {
-		return spec, b.wErrorf(err, "failed to create token role for %s", path)
+
+	// Find the plan to determine which backends to mount
+	plan, err := b.findPlan(details.PlanID)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to provision %s", instanceID)
 	}
 
-	// Determine the mounts we need
-	mounts := map[string]string{
-		"/cf/" + details.OrganizationGUID + "/secret": "generic",
-		"/cf/" + details.SpaceGUID + "/secret":        "generic",
-		"/cf/" + instanceID + "/secret":               "generic",
-		"/cf/" + instanceID + "/transit":              "transit",
+	// Check if the instance already exists, either in the cache or in Vault
+	logger.Printf("[DEBUG] looking up instance %s from cache", instanceID)
+	b.instancesLock.Lock()
+	existing, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		var err error
+		existing, err = b.readInstance(instanceID)
+		if err != nil {
+			return spec, b.error(err)
+		}
+	}
+	if existing != nil {
+		// Instances without a recorded plan have the default plan
+		existingPlan, _ := b.findPlan(existing.PlanID)
+		if existing.OrganizationGUID != details.OrganizationGUID ||
+			existing.SpaceGUID != details.SpaceGUID ||
+			existingPlan != plan ||
+			!reflect.DeepEqual(existing.ExtraMounts, params.ExtraMounts) {
+			logger.Printf("[WARN] instance %s already exists in %s/%s with plan %q",
+				instanceID, existing.OrganizationGUID, existing.SpaceGUID, existing.PlanID)
+			return spec, brokerapi.ErrInstanceAlreadyExists
+		}
+		logger.Printf("[INFO] instance %s is already provisioned", instanceID)
+		spec.DashboardURL, err = b.instanceDashboardURL(instanceID, existing)
+		if err != nil {
+			return spec, b.error(err)
+		}
+		return spec, nil
+	}
+	if plan.SealWrap && b.sealWrapErr != nil {
+		return spec, b.wErrorf(b.sealWrapErr, "failed to provision %s", instanceID)
 	}
+	if b.dryRun {
+		if err := b.dryRunProvision(instanceID, details.OrganizationGUID, details.SpaceGUID, plan, params); err != nil {
+			return spec, err
+		}
+		return spec, nil
+	}
+
+	// Determine the mounts we need. The instance's policy grants access to
+	// everything under its path, so it covers the extra mounts as well. The
+	// names in their descriptions are looked up before changing anything, so
+	// that a strict lookup which fails leaves nothing behind.
+	mounts := b.vaultMounts(instanceID, details.OrganizationGUID, details.SpaceGUID, plan)
+	mounts = append(mounts, extraMounts(b.mountPrefix, instanceID, plan, params.ExtraMounts)...)
+	if err := b.describeMounts(mounts, instanceID, details.OrganizationGUID, details.SpaceGUID); err != nil && b.nameLookupStrict {
+		logger.Printf("[ERR] rejecting instance %s: %s", instanceID, err)
+		return spec, brokerapi.NewFailureResponse(
+			fmt.Errorf("the names of the organization and space cannot be looked up, please retry later: %s", err),
+			http.StatusServiceUnavailable, "name-lookup")
+	}
+
+	// Track what has been created so it can be removed if a later step fails
+	rollback := provisionRollback{extraMounts: params.ExtraMounts}
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			b.rollbackProvision(instanceID, plan, &rollback)
+		}
+	}()
 
-	// Mount the backends
-	b.log.Printf("[DEBUG] creating mounts %s", mapToKV(mounts, ", "))
-	if err := b.idempotentMount(mounts); err != nil {
-		return spec, b.wErrorf(err, "failed to create mounts %s", mapToKV(mounts, ", "))
+	// Keep the shared mounts from being removed until the instance is
+	// recorded
+	if b.sharedMountCleanup {
+		unlock := b.lockShared(details.OrganizationGUID, details.SpaceGUID)
+		defer unlock()
 	}
 
-	// Generate instance info
-	info := &instanceInfo{
-		OrganizationGUID: details.OrganizationGUID,
-		SpaceGUID:        details.SpaceGUID,
+	// Fetch the mount table once for the whole operation
+	if err := b.checkContext(ctx, "provision", instanceID); err != nil {
+		return spec, err
 	}
-	payload, err := json.Marshal(info)
+	table, err := b.listMounts()
 	if err != nil {
-		return spec, b.wErrorf(err, "failed to encode instance json")
+		return spec, b.wErrorf(err, "failed to list mounts")
 	}
+	rollback.table = table
 
-	// Store the token and metadata in the generic secret backend
-	instancePath := "cf/broker/" + instanceID
-	b.log.Printf("[DEBUG] storing instance metadata at %s", instancePath)
-	if _, err := b.vaultClient.Logical().Write(instancePath, map[string]interface{}{
-		"json": string(payload),
-	}); err != nil {
-		return spec, b.wErrorf(err, "failed to commit instance %s", instancePath)
+	// Generate and create the new policy
+	if err := b.checkContext(ctx, "provision", instanceID); err != nil {
+		return spec, err
+	}
+	rollback.policy = true
+	if err := b.putPolicy(instanceID, details.OrganizationGUID, details.SpaceGUID, plan); err != nil {
+		return spec, b.error(err)
 	}
 
-	// Save the instance
-	b.log.Printf("[DEBUG] saving instance %s to cache", instanceID)
-	b.instancesLock.Lock()
-	b.instances[instanceID] = info
-	b.instancesLock.Unlock()
+	// Create the new token role
+	if err := b.checkContext(ctx, "provision", instanceID); err != nil {
+		return spec, err
+	}
+	rollback.role = true
+	if err := b.putTokenRole(instanceID); err != nil {
+		return spec, b.error(err)
+	}
+
+	// Mount the backends
+	if err := b.checkContext(ctx, "provision", instanceID); err != nil {
+		return spec, err
+	}
+	rollback.mounts = true
+	logger.Printf("[DEBUG] creating mounts %s", mountsToKV(mounts, ", "))
+	if err := b.idempotentMount(table, mounts); err != nil {
+		return spec, b.wErrorf(err, "failed to create mounts %s", mountsToKV(mounts, ", "))
+	}
+
+	// Create the plan's transit key. It is removed along with the transit
+	// mount on rollback.
+	if err := b.checkContext(ctx, "provision", instanceID); err != nil {
+		return spec, err
+	}
+	if err := b.putTransitKey(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+	if err := b.putSSHCA(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+	if err := b.putAWSRole(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+	if err := b.putPKIRole(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+
+	// Store the instance metadata in the generic secret backend and save the
+	// instance
+	if err := b.checkContext(ctx, "provision", instanceID); err != nil {
+		return spec, err
+	}
+	now := time.Now().UTC()
+	info := &instanceInfo{
+		OrganizationGUID: details.OrganizationGUID,
+		SpaceGUID:        details.SpaceGUID,
+		PlanID:           b.planID(plan),
+		ExtraMounts:      params.ExtraMounts,
+		KVVersion:        plan.kvMountVersion(),
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if err := b.writeInstance(instanceID, info); err != nil {
+		return spec, b.error(err)
+	}
 
 	// Done
+	succeeded = true
+	spec.DashboardURL, err = b.instanceDashboardURL(instanceID, info)
+	if err != nil {
+		// The instance was created, so only log the error
+		logger.Printf("[ERR] failed to render the dashboard URL of instance %s: %s", instanceID, err)
+	}
 	return spec, nil
 }
 
+// provisionRollback records which parts of an instance a failed Provision
+// attempted to create.
+type provisionRollback struct {
+	policy bool
+	role   bool
+	mounts bool
+
+	// table is the mount table used by the failed Provision.
+	table mountTable
+
+	// extraMounts are removed along with the plan's mounts.
+	extraMounts []ExtraMount
+}
+
+// rollbackProvision removes the parts of an instance recorded in r. Only the
+// instance's own backends are unmounted, since the shared organization and
+// space backends may be in use by other instances. Failures are logged and
+// otherwise ignored so that the original provisioning error is returned.
+func (b *Broker) rollbackProvision(instanceID string, plan *Plan, r *provisionRollback) {
+	logger := b.log.With("instance_id", instanceID)
+	logger.Printf("[WARN] rolling back failed provision of %s", instanceID)
+
+	if r.mounts {
+		mounts := mountPaths(append(instanceMounts(b.mountPrefix, instanceID, plan),
+			extraMounts(b.mountPrefix, instanceID, plan, r.extraMounts)...))
+		logger.Printf("[DEBUG] removing mounts %s", strings.Join(mounts, ", "))
+		if err := b.idempotentUnmount(r.table, mounts); err != nil {
+			logger.Printf("[ERR] rollback: failed to remove mounts for %s: %s", instanceID, err)
+		}
+	}
+
+	if r.role {
+		path := "/auth/token/roles/cf-" + instanceID
+		logger.Printf("[DEBUG] deleting token role %s", path)
+		if _, err := b.vault().Logical().Delete(path); err != nil {
+			logger.Printf("[ERR] rollback: failed to delete token role %s: %s", path, err)
+		}
+	}
+
+	if r.policy {
+		policyName := "cf-" + instanceID
+		logger.Printf("[DEBUG] deleting policy %s", policyName)
+		if err := b.vault().Sys().DeletePolicy(policyName); err != nil {
+			logger.Printf("[ERR] rollback: failed to delete policy %s: %s", policyName, err)
+		}
+	}
+}
+
 // Deprovision is used to remove a tenant of Vault. We use this to
 // remove all the backends of the tenant, delete the token role, and policy.
+// Unmounting the transit backend deletes the instance's transit key.
 func (b *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, async bool) (brokerapi.DeprovisionServiceSpec, error) {
-	b.log.Printf("[INFO] deprovisioning %s", instanceID)
+	// The instance is gone afterwards, so look up its space first
+	e := b.instanceEvent(eventDeprovision, instanceID)
+	spec, err := b.deprovision(ctx, instanceID, details, async)
+	b.emitEvent(ctx, e, err)
+	return spec, err
+}
+
+func (b *Broker) deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, async bool) (brokerapi.DeprovisionServiceSpec, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+	logger.Printf("[INFO] deprovisioning %s", instanceID)
 
 	// Create the spec to return
 	var spec brokerapi.DeprovisionServiceSpec
 
+	ctx, cancel := b.operationContext(ctx)
+	defer cancel()
+
+	// Serialize with other operations on this instance
+	b.instanceMutex.Lock(instanceID)
+	defer b.instanceMutex.Unlock(instanceID)
+	if err := b.checkContext(ctx, "deprovision", instanceID); err != nil {
+		return spec, err
+	}
+
+	// Find the plan and the extra mounts to determine which backends were
+	// mounted. The recorded plan is preferred over the one in the request,
+	// which is only used if the instance has no record.
+	b.instancesLock.Lock()
+	instance := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if instance == nil {
+		var err error
+		if instance, err = b.readInstance(instanceID); err != nil {
+			return spec, b.error(err)
+		}
+	}
+	planID := details.PlanID
+	var extras []ExtraMount
+	if instance != nil {
+		planID = instance.PlanID
+		extras = instance.ExtraMounts
+	}
+	plan, err := b.findPlan(planID)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to deprovision %s", instanceID)
+	}
+	if b.dryRun {
+		b.dryRunDeprovision(instanceID, plan, extras)
+		return spec, nil
+	}
+
+	// Revoke the bindings first, so that no token outlives the instance
+	if err := b.revokeInstanceBindings(ctx, instanceID); err != nil {
+		return spec, b.wErrorf(err, "failed to revoke bindings of %s", instanceID)
+	}
+
 	// Unmount the backends
-	mounts := []string{
-		"/cf/" + instanceID + "/secret",
-		"/cf/" + instanceID + "/transit",
+	if err := b.checkContext(ctx, "deprovision", instanceID); err != nil {
+		return spec, err
 	}
-	b.log.Printf("[DEBUG] removing mounts %s", strings.Join(mounts, ", "))
-	if err := b.idempotentUnmount(mounts); err != nil {
+	mounts := mountPaths(append(instanceMounts(b.mountPrefix, instanceID, plan),
+		extraMounts(b.mountPrefix, instanceID, plan, extras)...))
+	logger.Printf("[DEBUG] removing mounts %s", strings.Join(mounts, ", "))
+	if err := b.idempotentUnmount(nil, mounts); err != nil {
 		return spec, b.wErrorf(err, "failed to remove mounts")
 	}
 
 	// Delete the token role
+	if err := b.checkContext(ctx, "deprovision", instanceID); err != nil {
+		return spec, err
+	}
 	path := "/auth/token/roles/cf-" + instanceID
-	b.log.Printf("[DEBUG] deleting token role %s", path)
-	if _, err := b.vaultClient.Logical().Delete(path); err != nil {
+	logger.Printf("[DEBUG] deleting token role %s", path)
+	if _, err := b.vault().Logical().Delete(path); err != nil {
 		return spec, b.wErrorf(err, "failed to delete token role %s", path)
 	}
 
 	// Delete the token policy
+	if err := b.checkContext(ctx, "deprovision", instanceID); err != nil {
+		return spec, err
+	}
 	policyName := "cf-" + instanceID
-	b.log.Printf("[DEBUG] deleting policy %s", policyName)
-	if err := b.vaultClient.Sys().DeletePolicy(policyName); err != nil {
+	logger.Printf("[DEBUG] deleting policy %s", policyName)
+	if err := b.vault().Sys().DeletePolicy(policyName); err != nil {
 		return spec, b.wErrorf(err, "failed to delete policy %s", policyName)
 	}
+	if instance != nil && len(instance.SharedSpaces) > 0 {
+		policyName := sharedPolicyName(instanceID)
+		logger.Printf("[DEBUG] deleting policy %s", policyName)
+		if err := b.vault().Sys().DeletePolicy(policyName); err != nil {
+			return spec, b.wErrorf(err, "failed to delete policy %s", policyName)
+		}
+	}
+
+	// Delete the entity which the tokens of the bindings were attached to
+	if instance != nil && instance.EntityID != "" {
+		if err := b.checkContext(ctx, "deprovision", instanceID); err != nil {
+			return spec, err
+		}
+		if err := b.deleteInstanceEntity(instanceID); err != nil {
+			return spec, b.error(err)
+		}
+	}
+
+	// Remove the shared mounts if no other instance uses them
+	if b.sharedMountCleanup && instance != nil {
+		if err := b.checkContext(ctx, "deprovision", instanceID); err != nil {
+			return spec, err
+		}
+		if err := b.removeUnusedSharedMounts(instanceID, instance.OrganizationGUID, instance.SpaceGUID); err != nil {
+			return spec, b.wErrorf(err, "failed to remove shared mounts")
+		}
+	}
 
 	// Delete the instance info
-	instancePath := "cf/broker/" + instanceID
-	b.log.Printf("[DEBUG] deleting instance info at %s", instancePath)
-	if _, err := b.vaultClient.Logical().Delete(instancePath); err != nil {
+	if err := b.checkContext(ctx, "deprovision", instanceID); err != nil {
+		return spec, err
+	}
+	instancePath := b.store.Path(metadataKey(instanceID))
+	logger.Printf("[DEBUG] deleting instance info at %s", instancePath)
+	if err := b.store.Delete(metadataKey(instanceID)); err != nil {
 		return spec, b.wErrorf(err, "failed to delete instance info at %s", instancePath)
 	}
 
 	// Delete the instance from the map
-	b.log.Printf("[DEBUG] removing instance %s from cache", instanceID)
+	logger.Printf("[DEBUG] removing instance %s from cache", instanceID)
 	b.instancesLock.Lock()
 	delete(b.instances, instanceID)
 	b.instancesLock.Unlock()
@@ -426,209 +1515,1751 @@ func (b *Broker) Deprovision(ctx context.Context, instanceID string, details bro
 	return spec, nil
 }
 
+// lockShared locks the shared mounts of the organization and space, always in
+// that order, and returns the function which unlocks them.
+func (b *Broker) lockShared(orgGUID, spaceGUID string) func() {
+	b.sharedMutex.Lock(orgGUID)
+	if spaceGUID == orgGUID {
+		return func() { b.sharedMutex.Unlock(orgGUID) }
+	}
+	b.sharedMutex.Lock(spaceGUID)
+	return func() {
+		b.sharedMutex.Unlock(spaceGUID)
+		b.sharedMutex.Unlock(orgGUID)
+	}
+}
+
+// removeUnusedSharedMounts removes the shared organization and space mounts
+// of the instance which is being deprovisioned if no other instance is in the
+// same organization or space. Nothing is removed if some instances could not
+// be restored, since they may still use the mounts.
+func (b *Broker) removeUnusedSharedMounts(instanceID, orgGUID, spaceGUID string) error {
+	logger := b.log.With("instance_id", instanceID)
+	unlock := b.lockShared(orgGUID, spaceGUID)
+	defer unlock()
+
+	b.instancesLock.Lock()
+	incomplete := b.restoreIncomplete
+	orgUsed, spaceUsed := false, false
+	for id, info := range b.instances {
+		if id == instanceID {
+			continue
+		}
+		orgUsed = orgUsed || info.OrganizationGUID == orgGUID
+		spaceUsed = spaceUsed || info.SpaceGUID == spaceGUID
+	}
+	b.instancesLock.Unlock()
+	if incomplete {
+		logger.Printf("[WARN] keeping shared mounts of %s/%s since not all instances were restored", orgGUID, spaceGUID)
+		return nil
+	}
+
+	// Disabled shared mounts were not created by the broker, so leave them
+	var unmounts []string
+	if !spaceUsed && !b.disableSpaceMount {
+		unmounts = append(unmounts, sharedMount(b.mountPrefix, spaceGUID).Path)
+	}
+	if !orgUsed && !b.disableOrgMount {
+		unmounts = append(unmounts, sharedMount(b.mountPrefix, orgGUID).Path)
+	}
+	if len(unmounts) == 0 {
+		return nil
+	}
+	logger.Printf("[INFO] removing unused shared mounts %s", strings.Join(unmounts, ", "))
+	return b.idempotentUnmount(nil, unmounts)
+}
+
 // Bind is used to attach a tenant of Vault to an application in CloudFoundry.
 // This should create a credential that is used to authorize against Vault.
 func (b *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	b.log.Printf("[INFO] binding service %s to instance %s",
-		bindingID, instanceID)
+	binding, err := b.bind(ctx, instanceID, bindingID, details)
+	e := b.instanceEvent(eventBind, instanceID)
+	e.BindingID = bindingID
+	b.emitEvent(ctx, e, err)
+	return binding, err
+}
+
+func (b *Broker) bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID, "binding_id", bindingID)
+	actor := contextIdentity(ctx)
+	logger.Printf("[INFO] binding service %s to instance %s as requested by %s",
+		bindingID, instanceID, actorOrUnknown(actor))
 
 	// Create the binding to return
 	var binding brokerapi.Binding
+	if b.quiesced() {
+		logger.Printf("[WARN] rejecting binding %s while quiescing", bindingID)
+		return binding, errQuiescing
+	}
 
-	// Create the role name to create the token against
-	roleName := "cf-" + instanceID
+	// Reject IDs which would change the paths and policies they go into,
+	// including the space of a binding from a space the instance is shared
+	// with
+	ids := [][2]string{{"instance", instanceID}, {"binding", bindingID}}
+	if pc := contextPlatform(ctx); pc != nil && pc.SpaceGUID != "" {
+		ids = append(ids, [2]string{"space", pc.SpaceGUID})
+	}
+	if err := checkGUIDs(ids...); err != nil {
+		logger.Printf("[WARN] rejecting binding %s: %s", bindingID, err)
+		return binding, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-id")
+	}
 
-	// Create the token
-	renewable := true
-	b.log.Printf("[DEBUG] creating token with role %s", roleName)
-	secret, err := b.vaultClient.Auth().Token().CreateWithRole(&api.TokenCreateRequest{
-		Policies:    []string{roleName},
-		Metadata:    map[string]string{"cf-instance-id": instanceID, "cf-binding-id": bindingID},
-		DisplayName: "cf-bind-" + bindingID,
-		Renewable:   &renewable,
-	}, roleName)
+	ctx, cancel := b.operationContext(ctx)
+	defer cancel()
+
+	// Serialize with other operations on this instance
+	b.instanceMutex.Lock(instanceID)
+	defer b.instanceMutex.Unlock(instanceID)
+	if err := b.checkContext(ctx, "bind", bindingID); err != nil {
+		return binding, err
+	}
+
+	// Parse the parameters before changing anything
+	params, err := parseBindParameters(details.RawParameters, b.bindAllowedPolicies, b.bindMaxNumUses)
 	if err != nil {
-		return binding, b.wErrorf(err, "failed to create token with role %s", roleName)
+		logger.Printf("[WARN] rejecting parameters for binding %s: %s", bindingID, err)
+		return binding, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-parameters")
 	}
-	if secret.Auth == nil {
-		return binding, b.errorf("secret with role %s has no auth", roleName)
+
+	// Nothing was provisioned in a dry run, so there is no instance to find
+	// and the plan in the request is used
+	if b.dryRun {
+		plan, err := b.findPlan(details.PlanID)
+		if err != nil {
+			return binding, b.wErrorf(err, "failed to bind %s", bindingID)
+		}
+		return b.dryRunBind(instanceID, bindingID, plan, params), nil
 	}
 
-	// Get the instance for this instanceID
-	b.log.Printf("[DEBUG] looking up instance %s from cache", instanceID)
+	// Get the instance for this instanceID, restoring it if the cache does
+	// not have it yet, for example because the broker restarted
+	logger.Printf("[DEBUG] looking up instance %s from cache", instanceID)
 	b.instancesLock.Lock()
 	instance, ok := b.instances[instanceID]
+	cold := !ok || b.restoreIncomplete
 	b.instancesLock.Unlock()
 	if !ok {
-		return binding, b.errorf("no instance exists with ID %s", instanceID)
+		if err := b.restoreInstance(ctx, instanceID); err != nil {
+			return binding, b.wErrorf(err, "failed to restore instance %s", instanceID)
+		}
+		b.instancesLock.Lock()
+		instance, ok = b.instances[instanceID]
+		b.instancesLock.Unlock()
+	}
+	if !ok {
+		logger.Printf("[WARN] no instance exists with ID %s", instanceID)
+		return binding, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	// Find the plan to determine which backends to return. The recorded plan
+	// is used rather than the one in the request, since that is what was
+	// mounted.
+	plan, err := b.findPlan(instance.PlanID)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to bind %s", bindingID)
+	}
+	if details.PlanID != "" && details.PlanID != b.planID(plan) {
+		logger.Printf("[WARN] binding %s requested plan %q but instance %s has plan %q, using the latter",
+			bindingID, details.PlanID, instanceID, b.planID(plan))
+	}
+
+	// Bindings from other spaces which the instance is shared with get the
+	// instance's paths only, since its shared mounts belong to its own space
+	var sharedSpace string
+	if pc := contextPlatform(ctx); pc != nil && pc.SpaceGUID != "" && pc.SpaceGUID != instance.SpaceGUID {
+		sharedSpace = pc.SpaceGUID
+	}
+
+	// The platform retries binds which time out, so return the binding if
+	// it already exists rather than creating a second token
+	existing, err := b.existingBinding(ctx, instanceID, bindingID, cold)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to look up binding %s", bindingID)
+	}
+	if existing != nil {
+		if !existing.matches(params, sharedSpace) {
+			logger.Printf("[WARN] binding %s already exists with different parameters", bindingID)
+			return binding, brokerapi.ErrBindingAlreadyExists
+		}
+		logger.Printf("[INFO] binding %s already exists, returning its credentials", bindingID)
+		binding.Credentials = b.platformCredentials(instanceID, instance, plan, existing)
+		return binding, nil
+	}
+
+	// Enforce the limit on bindings before creating anything
+	if b.maxBindings > 0 {
+		n, err := b.countBindings(ctx, instanceID, bindingID, cold)
+		if err != nil {
+			return binding, b.wErrorf(err, "failed to count the bindings of instance %s", instanceID)
+		}
+		if n >= b.maxBindings {
+			err := fmt.Errorf("instance %s has reached the maximum of %d bindings, unbind one and retry", instanceID, b.maxBindings)
+			logger.Printf("[WARN] rejecting binding %s: %s", bindingID, err)
+			return binding, brokerapi.NewFailureResponse(err, http.StatusTooManyRequests, "max-bindings")
+		}
+	}
+
+	// Sign the SSH key first, since it is the part most likely to be rejected
+	var sshSignedKey, sshSerialNumber string
+	switch {
+	case plan.hasEngine(SSH) && params.SSHPublicKey == "":
+		err := fmt.Errorf("ssh_public_key is required by plan %q", plan.Name)
+		logger.Printf("[WARN] rejecting parameters for binding %s: %s", bindingID, err)
+		return binding, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-parameters")
+	case !plan.hasEngine(SSH) && params.SSHPublicKey != "":
+		err := fmt.Errorf("plan %q has no ssh engine to sign ssh_public_key", plan.Name)
+		logger.Printf("[WARN] rejecting parameters for binding %s: %s", bindingID, err)
+		return binding, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-parameters")
+	case params.SSHPublicKey != "":
+		if err := b.checkContext(ctx, "bind", bindingID); err != nil {
+			return binding, err
+		}
+		sshSignedKey, sshSerialNumber, err = b.signSSHKey(instanceID, params.SSHPublicKey)
+		if err != nil {
+			return binding, b.error(err)
+		}
+	}
+
+	// Create the role name to create the token against
+	roleName := "cf-" + instanceID
+
+	// Share the instance with the binding's space
+	if sharedSpace != "" {
+		logger.Printf("[INFO] binding %s is from space %s, which instance %s is shared with",
+			bindingID, sharedSpace, instanceID)
+		if err := b.checkContext(ctx, "bind", bindingID); err != nil {
+			return binding, err
+		}
+		if instance, err = b.shareInstance(instanceID, instance, plan, sharedSpace); err != nil {
+			return binding, b.error(err)
+		}
+	}
+
+	// Attach the token to the instance's entity through an alias of its own
+	var entityAliasID string
+	if b.bindIdentity {
+		if err := b.checkContext(ctx, "bind", bindingID); err != nil {
+			return binding, err
+		}
+		if instance, err = b.instanceEntity(instanceID, instance); err != nil {
+			return binding, b.error(err)
+		}
+		if entityAliasID, err = b.createEntityAlias(instanceID, bindingID, instance.EntityID); err != nil {
+			return binding, b.error(err)
+		}
+	}
+
+	// Create the token
+	if err := b.checkContext(ctx, "bind", bindingID); err != nil {
+		b.abandonEntityAlias(logger, entityAliasID)
+		return binding, err
+	}
+	secret, err := b.createBindToken(instanceID, bindingID, actor, instance, params, sharedSpace)
+	if err != nil && b.bindSelfHeal && isUnknownRoleError(err) {
+		// The role, and likely the policy with it, was deleted out-of-band.
+		// Recreate both from the instance details and try once more.
+		logger.Printf("[WARN] token role %s is missing, recreating the role and policy for instance %s: %s",
+			roleName, instanceID, err)
+		if err := b.putPolicy(instanceID, instance.OrganizationGUID, instance.SpaceGUID, plan); err != nil {
+			return binding, b.error(err)
+		}
+		if err := b.putTokenRole(instanceID); err != nil {
+			return binding, b.error(err)
+		}
+		if sharedSpace != "" {
+			if err := b.putSharedPolicy(instanceID, plan); err != nil {
+				return binding, b.error(err)
+			}
+		}
+		secret, err = b.createBindToken(instanceID, bindingID, actor, instance, params, sharedSpace)
+	}
+	if err == nil {
+		err = checkTokenSecret(secret)
+	}
+	if err != nil {
+		b.abandonEntityAlias(logger, entityAliasID)
+		return binding, b.wErrorf(err, "failed to create token with role %s", roleName)
 	}
 
 	// Create a binding info object
+	now := time.Now().UTC()
 	info := &bindingInfo{
 		Organization: instance.OrganizationGUID,
 		Space:        instance.SpaceGUID,
 		Binding:      bindingID,
 		ClientToken:  secret.Auth.ClientToken,
 		Accessor:     secret.Auth.Accessor,
+		instanceID:   instanceID,
+
+		TTL:                params.ttl,
+		NumUses:            params.NumUses,
+		AdditionalPolicies: params.AdditionalPolicies,
+		SharedSpace:        sharedSpace,
+
+		RequestedBy: actor,
+
+		SSHSignedKey:    sshSignedKey,
+		SSHSerialNumber: sshSerialNumber,
+
+		EntityID:      instance.EntityID,
+		EntityAliasID: entityAliasID,
+
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	// abandon revokes the token and the lease of a binding which failed
+	abandon := func() {
+		a := secret.Auth.Accessor
+		if err := b.vault().Auth().Token().RevokeAccessor(a); err != nil {
+			logger.Printf("[WARN] failed to revoke accessor %s", a)
+		}
+		if info.LeaseID != "" {
+			if err := b.vault().Sys().Revoke(info.LeaseID); err != nil {
+				logger.Printf("[WARN] failed to revoke lease %s", info.LeaseID)
+			}
+		}
+		b.abandonEntityAlias(logger, entityAliasID)
+		if info.CredhubRef != "" {
+			if err := b.credhub.Delete(info.CredhubRef); err != nil {
+				logger.Printf("[WARN] failed to delete credentials %s from credhub", info.CredhubRef)
+			}
+		}
+	}
+
+	// Generate the AWS credentials. The token is revoked if this fails.
+	if plan.hasEngine(AWS) {
+		err = b.checkContext(ctx, "bind", bindingID)
+		if err == nil {
+			if err = b.generateAWSCredentials(instanceID, info); err != nil {
+				err = b.error(err)
+			}
+		}
+		if err != nil {
+			abandon()
+			return binding, err
+		}
+	}
+
+	// Wrap the credentials if requested, so that only the wrapping token is
+	// given to the application
+	if params.wrapTTL > 0 {
+		err = b.checkContext(ctx, "bind", bindingID)
+		if err == nil {
+			credentials := b.bindingCredentials(instanceID, instance, plan, info)
+			logger.Printf("[DEBUG] wrapping credentials of binding %s for %s", bindingID, params.wrapTTL)
+			if info.Wrapping, err = b.wrapData(credentials, params.wrapTTL); err != nil {
+				err = b.wErrorf(err, "failed to wrap credentials of binding %s", bindingID)
+			}
+		}
+		if err != nil {
+			abandon()
+			return binding, err
+		}
+	}
+
+	// Store the credentials in CredHub, so that the platform only gets a
+	// reference to them. The token and lease are revoked if this fails.
+	if b.credhub != nil {
+		err = b.checkContext(ctx, "bind", bindingID)
+		if err == nil {
+			ref := b.credhub.credhubRef(b.serviceName, bindingID)
+			logger.Printf("[DEBUG] storing credentials of binding %s in credhub at %s", bindingID, ref)
+			if err = b.credhub.SetJSON(ref, b.bindingCredentials(instanceID, instance, plan, info)); err != nil {
+				err = b.wErrorf(err, "failed to store credentials of binding %s in credhub", bindingID)
+			} else {
+				info.CredhubRef = ref
+			}
+		}
+		if err != nil {
+			abandon()
+			return binding, err
+		}
+	}
+
+	// Store the token and metadata in the generic secret backend. The token
+	// and lease are revoked if the bind was aborted in the meantime.
+	key := metadataKey(instanceID, bindingID)
+	err = b.checkContext(ctx, "bind", bindingID)
+	if err == nil {
+		logger.Printf("[DEBUG] storing binding metadata at %s", b.store.Path(key))
+		err = b.writeBindingInfo(key, info)
 	}
-	data, err := json.Marshal(info)
 	if err != nil {
-		return binding, b.wErrorf(err, "failed to encode binding json")
+		abandon()
+		return binding, err
 	}
 
-	// Store the token and metadata in the generic secret backend
-	path := "cf/broker/" + instanceID + "/" + bindingID
-	b.log.Printf("[DEBUG] storing binding metadata at %s", path)
-	if _, err := b.vaultClient.Logical().Write(path, map[string]interface{}{
-		"json": string(data),
-	}); err != nil {
-		a := secret.Auth.Accessor
-		if err := b.vaultClient.Auth().Token().RevokeAccessor(a); err != nil {
-			b.log.Printf("[WARN] failed to revoke accessor %s", a)
+	// Store the info and start renewing the token
+	logger.Printf("[DEBUG] saving bind %s to cache", bindingID)
+	b.addBinding(bindingID, info)
+
+	// Save the credentials
+	binding.Credentials = b.platformCredentials(instanceID, instance, plan, info)
+	return binding, nil
+}
+
+// bindingCredentials returns the credentials of a binding given to the
+// application. The credentials of wrapped bindings only hold the wrapping
+// token and what is needed to unwrap it.
+func (b *Broker) bindingCredentials(instanceID string, instance *instanceInfo, plan *Plan, info *bindingInfo) map[string]interface{} {
+	addr := b.bindingAddr(instanceID, instance, info)
+	if info.Wrapping != nil {
+		return b.wrappedCredentials(addr, info.Wrapping)
+	}
+
+	backends := make(map[string]interface{})
+	for _, m := range instanceMounts(b.mountPrefix, instanceID, plan) {
+		backends[string(m.Type)] = m.Path
+	}
+	credentials := map[string]interface{}{
+		"address": addr,
+		"auth": map[string]interface{}{
+			"accessor": info.Accessor,
+			"token":    info.ClientToken,
+		},
+		"backends": backends,
+	}
+	if path, ok := backends[string(KV)].(string); ok {
+		// Version 2 reads and writes secrets under data/
+		credentials["kv_version"] = 1
+		if instance.KVVersion == 2 {
+			backends[string(KV)] = path + "/data"
+			credentials["kv_version"] = 2
+		}
+	}
+	if info.SharedSpace == "" {
+		shared := map[string]interface{}{}
+		if !b.disableOrgMount {
+			shared["organization"] = sharedMount(b.mountPrefix, instance.OrganizationGUID).Path
+		}
+		if !b.disableSpaceMount {
+			shared["space"] = sharedMount(b.mountPrefix, instance.SpaceGUID).Path
+		}
+		if len(shared) > 0 {
+			credentials["backends_shared"] = shared
+		}
+	}
+	if b.vaultAdvertiseCACert != "" {
+		credentials["ca_cert"] = b.vaultAdvertiseCACert
+	}
+	if b.vaultNamespace != "" {
+		credentials["namespace"] = b.vaultNamespace
+	}
+	if info.SSHSignedKey != "" {
+		credentials["ssh"] = map[string]interface{}{
+			"signed_key":    info.SSHSignedKey,
+			"serial_number": info.SSHSerialNumber,
+		}
+	}
+	if info.AWSAccessKey != "" {
+		credentials["aws"] = map[string]interface{}{
+			"access_key":     info.AWSAccessKey,
+			"secret_key":     info.AWSSecretKey,
+			"security_token": info.AWSSecurityToken,
+			"lease_id":       info.LeaseID,
 		}
-		return binding, errors.Wrapf(err, "failed to commit binding %s", path)
 	}
+	return credentials
+}
+
+// bindingAddr returns the address of Vault given to the binding, rendered
+// from the advertise address template if there is one. It falls back to
+// vaultAdvertiseAddr if the template renders nothing or fails.
+func (b *Broker) bindingAddr(instanceID string, instance *instanceInfo, info *bindingInfo) string {
+	if b.vaultAdvertiseAddrTemplate == nil {
+		return b.vaultAdvertiseAddr
+	}
+	space := instance.SpaceGUID
+	if info.SharedSpace != "" {
+		space = info.SharedSpace
+	}
+	var buf bytes.Buffer
+	if err := b.vaultAdvertiseAddrTemplate.Execute(&buf, &AdvertiseAddrInput{
+		ServiceInstanceGUID: instanceID,
+		BindingGUID:         info.Binding,
+		OrganizationGUID:    instance.OrganizationGUID,
+		SpaceGUID:           space,
+		DefaultAddr:         b.vaultAdvertiseAddr,
+	}); err != nil {
+		b.log.Printf("[WARN] failed to render the vault address of binding %s, using %s: %s",
+			info.Binding, b.vaultAdvertiseAddr, err)
+		return b.vaultAdvertiseAddr
+	}
+	if addr := strings.TrimSpace(buf.String()); addr != "" {
+		return normalizeAddr(addr)
+	}
+	return b.vaultAdvertiseAddr
+}
+
+// wrappedCredentials returns the credentials of a binding whose credentials
+// are wrapped. The wrapping token is returned as is and never unwrapped by the
+// broker, since it can only be unwrapped once.
+func (b *Broker) wrappedCredentials(addr string, w *api.SecretWrapInfo) map[string]interface{} {
+	credentials := map[string]interface{}{
+		"address": addr,
+		"wrap_info": map[string]interface{}{
+			"token":         w.Token,
+			"ttl":           w.TTL,
+			"creation_time": w.CreationTime.Format(time.RFC3339),
+			"unwrap_path":   WrappingUnwrapPath,
+		},
+	}
+	if b.vaultAdvertiseCACert != "" {
+		credentials["ca_cert"] = b.vaultAdvertiseCACert
+	}
+	if b.vaultNamespace != "" {
+		credentials["namespace"] = b.vaultNamespace
+	}
+	return credentials
+}
+
+// WrappingUnwrapPath is the path at which applications unwrap wrapped
+// credentials, with the wrapping token as their token.
+const WrappingUnwrapPath = "sys/wrapping/unwrap"
+
+// wrapData wraps the data in a response-wrapping token which expires after the
+// TTL.
+func (b *Broker) wrapData(data map[string]interface{}, ttl time.Duration) (*api.SecretWrapInfo, error) {
+	r := b.vault().NewRequest("POST", "/v1/sys/wrapping/wrap")
+	r.WrapTTL = fmt.Sprintf("%ds", int(ttl/time.Second))
+	if err := r.SetJSONBody(data); err != nil {
+		return nil, err
+	}
+	resp, err := b.vault().RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.WrapInfo == nil || secret.WrapInfo.Token == "" {
+		return nil, errors.New("wrapping returned no wrapping token")
+	}
+	return secret.WrapInfo, nil
+}
+
+// GetInstance returns the plan of an existing instance, and the organization
+// and space it belongs to and its extra mounts as its parameters. The instance
+// is read from Vault if the cache does not have it.
+func (b *Broker) GetInstance(ctx context.Context, instanceID string) (instanceSpec, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+	logger.Printf("[INFO] fetching instance %s", instanceID)
+
+	// Create the spec to return
+	var spec instanceSpec
+
+	// Get the instance for this instanceID
+	instance, err := b.lookupInstance(ctx, instanceID)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to fetch instance %s", instanceID)
+	}
+	if instance == nil {
+		logger.Printf("[WARN] no instance exists with ID %s", instanceID)
+		return spec, brokerapi.ErrInstanceDoesNotExist
+	}
+	plan, err := b.findPlan(instance.PlanID)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to fetch instance %s", instanceID)
+	}
+
+	spec.ServiceID = b.serviceID
+	spec.PlanID = b.planID(plan)
+	spec.DashboardURL, err = b.instanceDashboardURL(instanceID, instance)
+	if err != nil {
+		return spec, b.error(err)
+	}
+	spec.Parameters = map[string]interface{}{
+		"organization_guid": instance.OrganizationGUID,
+		"space_guid":        instance.SpaceGUID,
+	}
+	if len(instance.ExtraMounts) > 0 {
+		spec.Parameters["extra_mounts"] = instance.ExtraMounts
+	}
+	spec.CreatedAt = timestamp(instance.CreatedAt)
+	spec.UpdatedAt = timestamp(instance.UpdatedAt)
+	return spec, nil
+}
+
+// GetBinding returns the credentials of an existing binding, the same as those
+// returned when it was bound. The binding, and the instance if the cache does
+// not have it, are read from Vault, so they are found even while the broker
+// restores its state.
+func (b *Broker) GetBinding(ctx context.Context, instanceID, bindingID string) (bindingSpec, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID, "binding_id", bindingID)
+	logger.Printf("[INFO] fetching binding %s of instance %s", bindingID, instanceID)
+
+	// Create the binding to return
+	var binding bindingSpec
+
+	// Get the instance for this instanceID
+	instance, err := b.lookupInstance(ctx, instanceID)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to fetch binding %s", bindingID)
+	}
+	if instance == nil {
+		logger.Printf("[WARN] no instance exists with ID %s", instanceID)
+		return binding, brokerapi.ErrInstanceDoesNotExist
+	}
+	plan, err := b.findPlan(instance.PlanID)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to fetch binding %s", bindingID)
+	}
+
+	// Read the binding info
+	key := metadataKey(instanceID, bindingID)
+	path := b.store.Path(key)
+	logger.Printf("[DEBUG] reading bind from %s", path)
+	data, err := b.store.Read(key)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to read bind info at %q", path)
+	}
+	if data == nil {
+		logger.Printf("[WARN] no binding exists with ID %s", bindingID)
+		return binding, brokerapi.ErrBindingDoesNotExist
+	}
+	info, _, err := b.openBindingInfo(data)
+	if err != nil {
+		return binding, b.wErrorf(err, "failed to decode binding info for %s", path)
+	}
+
+	binding.Credentials = b.platformCredentials(instanceID, instance, plan, info)
+	binding.CreatedAt = timestamp(info.CreatedAt)
+	binding.UpdatedAt = timestamp(info.UpdatedAt)
+	return binding, nil
+}
+
+// lookupInstance returns the instance from the cache, or else reads it from
+// Vault without caching it, for example while the broker restores its state or
+// after restoring it failed. It returns nil if the instance does not exist.
+func (b *Broker) lookupInstance(ctx context.Context, instanceID string) (*instanceInfo, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+	logger.Printf("[DEBUG] looking up instance %s from cache", instanceID)
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if ok {
+		return instance, nil
+	}
+	return b.readInstance(instanceID)
+}
+
+// Unbind is used to detach an applicaiton from a tenant in Vault.
+func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	err := b.unbind(ctx, instanceID, bindingID, details)
+	e := b.instanceEvent(eventUnbind, instanceID)
+	e.BindingID = bindingID
+	b.emitEvent(ctx, e, err)
+	return err
+}
+
+func (b *Broker) unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	logger := b.requestLog(ctx).With("instance_id", instanceID, "binding_id", bindingID)
+	logger.Printf("[INFO] unbinding service %s for instance %s as requested by %s",
+		bindingID, instanceID, actorOrUnknown(contextIdentity(ctx)))
+
+	ctx, cancel := b.operationContext(ctx)
+	defer cancel()
+
+	// Serialize with other operations on this instance
+	b.instanceMutex.Lock(instanceID)
+	defer b.instanceMutex.Unlock(instanceID)
+	if err := b.checkContext(ctx, "unbind", bindingID); err != nil {
+		return err
+	}
+	if b.dryRun {
+		b.dryRunUnbind(instanceID, bindingID)
+		return nil
+	}
+
+	// Read the binding info
+	key := metadataKey(instanceID, bindingID)
+	path := b.store.Path(key)
+	logger.Printf("[DEBUG] reading %s", path)
+	data, err := b.store.Read(key)
+	if err != nil {
+		return b.wErrorf(err, "failed to read binding info for %s", path)
+	}
+	if data == nil {
+		logger.Printf("[WARN] missing bind info for unbind for %s", path)
+		return brokerapi.ErrBindingDoesNotExist
+	}
+
+	// Decode the binding info
+	logger.Printf("[DEBUG] decoding binding info for %s", path)
+	info, _, err := b.openBindingInfo(data)
+	if err != nil {
+		return b.wErrorf(err, "failed to decode binding info for %s", path)
+	}
+
+	// Revoke the token. Once it is revoked, the binding info is deleted even
+	// if the unbind was aborted, so the two never disagree.
+	if err := b.checkContext(ctx, "unbind", bindingID); err != nil {
+		return err
+	}
+	if err := b.revokeBinding(instanceID, bindingID, info); err != nil {
+		return b.error(err)
+	}
+
+	// Done
+	return nil
+}
+
+// revokeBinding revokes the binding's token, deletes its binding info, and
+// stops renewing the token.
+func (b *Broker) revokeBinding(instanceID, bindingID string, info *bindingInfo) error {
+	logger := b.log.With("instance_id", instanceID, "binding_id", bindingID)
+	key := metadataKey(instanceID, bindingID)
+	path := b.store.Path(key)
+
+	a := info.Accessor
+	logger.Printf("[DEBUG] revoking accessor %s for path %s", a, path)
+	if err := b.vault().Auth().Token().RevokeAccessor(a); err != nil {
+		if !isInvalidAccessorError(err) {
+			return errors.Wrapf(err, "failed to revoke accessor %s", a)
+		}
+		// The token is already gone, so finish cleaning up the binding
+		logger.Printf("[WARN] accessor %s was already revoked: %s", a, err)
+	}
+
+	// Revoke the lease of the binding's secret
+	if info.LeaseID != "" {
+		logger.Printf("[DEBUG] revoking lease %s for path %s", info.LeaseID, path)
+		if err := b.vault().Sys().Revoke(info.LeaseID); err != nil {
+			if !isInvalidLeaseError(err) {
+				return errors.Wrapf(err, "failed to revoke lease %s", info.LeaseID)
+			}
+			logger.Printf("[WARN] lease %s was already revoked: %s", info.LeaseID, err)
+		}
+	}
+
+	// Delete the credentials stored in CredHub
+	if info.CredhubRef != "" {
+		if b.credhub == nil {
+			logger.Printf("[WARN] credhub is not configured, leaving credentials %s of binding %s in credhub",
+				info.CredhubRef, bindingID)
+		} else {
+			logger.Printf("[DEBUG] deleting credentials %s from credhub", info.CredhubRef)
+			if err := b.credhub.Delete(info.CredhubRef); err != nil {
+				return errors.Wrapf(err, "failed to delete credentials %s from credhub", info.CredhubRef)
+			}
+		}
+	}
+
+	// Delete the alias which attached the token to the instance's entity
+	if info.EntityAliasID != "" {
+		if err := b.deleteEntityAlias(info.EntityAliasID); err != nil {
+			return err
+		}
+	}
+
+	// Delete the binding info
+	logger.Printf("[DEBUG] deleting binding info at %s", path)
+	if err := b.store.Delete(key); err != nil {
+		return errors.Wrapf(err, "failed to delete binding info at %s", path)
+	}
+
+	// Delete the bind if it exists, stopping its renewal
+	b.removeBinding(bindingID)
+	return nil
+}
+
+// revokeInstanceBindings revokes every binding of the instance which is
+// stored in Vault, and stops renewing any other cached binding of it.
+func (b *Broker) revokeInstanceBindings(ctx context.Context, instanceID string) error {
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+
+	bindingIDs, err := b.listDir(ctx, metadataKey(instanceID))
+	if err != nil {
+		return errors.Wrapf(err, "failed to list bindings of %s", instanceID)
+	}
+	for _, bindingID := range trimKeys(bindingIDs) {
+		key := metadataKey(instanceID, bindingID)
+		path := b.store.Path(key)
+		logger.Printf("[DEBUG] reading %s", path)
+		data, err := b.store.Read(key)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read binding info for %s", path)
+		}
+		if data == nil {
+			continue
+		}
+		info, _, err := b.openBindingInfo(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode binding info for %s", path)
+		}
+		logger.Printf("[INFO] revoking binding %s of instance %s", bindingID, instanceID)
+		if err := b.revokeBinding(instanceID, bindingID, info); err != nil {
+			return err
+		}
+	}
+
+	b.bindLock.Lock()
+	var cached []string
+	for bindingID, info := range b.binds {
+		if info.instanceID == instanceID {
+			cached = append(cached, bindingID)
+		}
+	}
+	b.bindLock.Unlock()
+	for _, bindingID := range cached {
+		b.removeBinding(bindingID)
+	}
+	return nil
+}
+
+// addBinding adds the binding to the cache and schedules its token for
+// renewal, replacing any binding with the same ID.
+func (b *Broker) addBinding(bindingID string, info *bindingInfo) {
+	// Spread out the first renewals. This helps prevent a thundering herd in
+	// the event a broker is restarted with a lot of bindings.
+	delay := renewJitterDelay(b.renewJitterWindow())
+
+	b.bindLock.Lock()
+	defer b.bindLock.Unlock()
+	b.binds[bindingID] = info
+	b.renewals.remove(bindingID)
+	if info.TTL <= 0 && info.NumUses == 0 {
+		// Tokens with a TTL expire on their own, and tokens with limited
+		// uses are meant to be used up rather than kept alive
+		b.renewals.add(bindingID, info.ClientToken, info.Accessor, delay)
+	}
+	if info.LeaseID != "" && info.LeaseRenewable {
+		b.renewals.addLease(bindingID, info.LeaseID, delay)
+	}
+}
+
+// removeBinding removes the binding from the cache if it exists and stops
+// renewing its token. It is safe to call more than once.
+func (b *Broker) removeBinding(bindingID string) {
+	logger := b.log.With("binding_id", bindingID)
+	logger.Printf("[DEBUG] removing binding %s from cache", bindingID)
+	b.bindLock.Lock()
+	defer b.bindLock.Unlock()
+
+	delete(b.binds, bindingID)
+	b.renewals.remove(bindingID)
+}
+
+// Update is used to move an instance to a different plan. The backends of the
+// new plan are mounted and the instance policy is rewritten. Backends which
+// are not part of the new plan are only removed if the broker is configured to
+// unmount them.
+func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, async bool) (brokerapi.UpdateServiceSpec, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+	logger.Printf("[INFO] updating service for instance %s", instanceID)
+
+	// Create the spec to return
+	var spec brokerapi.UpdateServiceSpec
+
+	// Nothing to do if the plan is not changing
+	if details.PlanID == "" || details.PlanID == details.PreviousValues.PlanID {
+		logger.Printf("[DEBUG] plan for instance %s is unchanged", instanceID)
+		return spec, nil
+	}
+
+	// Nothing was provisioned in a dry run, so there is no instance to find
+	if b.dryRun {
+		plan, err := b.findPlan(details.PlanID)
+		if err != nil {
+			return spec, b.wErrorf(err, "failed to update %s", instanceID)
+		}
+		b.dryRunUpdate(instanceID, plan)
+		return spec, nil
+	}
+
+	ctx, cancel := b.operationContext(ctx)
+	defer cancel()
+
+	// Serialize with other operations on this instance, which may record
+	// changes to it such as the spaces it is shared with, so that the
+	// instance read below is the latest
+	b.instanceMutex.Lock(instanceID)
+	defer b.instanceMutex.Unlock(instanceID)
+	if err := b.checkContext(ctx, "update", instanceID); err != nil {
+		return spec, err
+	}
+
+	// Get the instance for this instanceID, restoring it if the cache does
+	// not have it yet
+	logger.Printf("[DEBUG] looking up instance %s from cache", instanceID)
+	b.instancesLock.Lock()
+	instance, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		if err := b.restoreInstance(ctx, instanceID); err != nil {
+			return spec, b.wErrorf(err, "failed to restore instance %s", instanceID)
+		}
+		b.instancesLock.Lock()
+		instance, ok = b.instances[instanceID]
+		b.instancesLock.Unlock()
+	}
+	if !ok {
+		logger.Printf("[WARN] no instance exists with ID %s", instanceID)
+		return spec, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	// Find the previous and target plans. The previous plan is the one
+	// recorded for the instance, since that is what was mounted. Instances
+	// whose plan was dropped from the catalog can still move off it, and
+	// their previous mounts are found in the mount table instead.
+	previous, err := b.findPlan(instance.PlanID)
+	if err != nil {
+		logger.Printf("[WARN] instance %s has plan %q which is not in the catalog, updating it anyway: %s",
+			instanceID, instance.PlanID, err)
+		previous = nil
+	}
+	plan, err := b.findPlan(details.PlanID)
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to update %s", instanceID)
+	}
+	if plan.SealWrap && b.sealWrapErr != nil {
+		return spec, b.wErrorf(b.sealWrapErr, "failed to update %s", instanceID)
+	}
+	if previous == plan {
+		logger.Printf("[DEBUG] plan for instance %s is unchanged", instanceID)
+		return spec, nil
+	}
+
+	// Fetch the mount table once for the whole operation
+	if err := b.checkContext(ctx, "update", instanceID); err != nil {
+		return spec, err
+	}
+	table, err := b.listMounts()
+	if err != nil {
+		return spec, b.wErrorf(err, "failed to list mounts")
+	}
+
+	// Mount the backends for the new plan. An existing KV mount keeps its
+	// version.
+	_, kvMounted := table[mountPath(b.mountPrefix, instanceID, KV.PathType())]
+	mounts := instanceMounts(b.mountPrefix, instanceID, plan)
+	b.describeMounts(mounts, instanceID, instance.OrganizationGUID, instance.SpaceGUID)
+	logger.Printf("[DEBUG] creating mounts %s", mountsToKV(mounts, ", "))
+	if err := b.idempotentMount(table, mounts); err != nil {
+		return spec, b.wErrorf(err, "failed to create mounts %s", mountsToKV(mounts, ", "))
+	}
+	if err := b.putTransitKey(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+	if err := b.putSSHCA(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+	if err := b.putAWSRole(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+	if err := b.putPKIRole(instanceID, plan); err != nil {
+		return spec, b.error(err)
+	}
+
+	// Rewrite the policies to match the new plan
+	if err := b.checkContext(ctx, "update", instanceID); err != nil {
+		return spec, err
+	}
+	if err := b.putPolicy(instanceID, instance.OrganizationGUID, instance.SpaceGUID, plan); err != nil {
+		return spec, b.error(err)
+	}
+	if len(instance.SharedSpaces) > 0 {
+		if err := b.putSharedPolicy(instanceID, plan); err != nil {
+			return spec, b.error(err)
+		}
+	}
+
+	// Remove the backends that are no longer part of the plan
+	if b.unmountOnUpdate {
+		keep := make(map[string]struct{}, len(mounts))
+		for _, m := range mounts {
+			keep[m.Path] = struct{}{}
+		}
+
+		var unmounts []string
+		for _, path := range b.previousMountPaths(table, instanceID, previous) {
+			if _, ok := keep[path]; !ok {
+				unmounts = append(unmounts, path)
+			}
+		}
+
+		logger.Printf("[DEBUG] removing mounts %s", strings.Join(unmounts, ", "))
+		if err := b.idempotentUnmount(table, unmounts); err != nil {
+			return spec, b.wErrorf(err, "failed to remove mounts")
+		}
+	}
+
+	// Record the new plan
+	if err := b.checkContext(ctx, "update", instanceID); err != nil {
+		return spec, err
+	}
+	updated := *instance
+	updated.PlanID = b.planID(plan)
+	if !kvMounted {
+		updated.KVVersion = plan.kvMountVersion()
+	}
+	updated.UpdatedAt = time.Now().UTC()
+	if err := b.writeInstance(instanceID, &updated); err != nil {
+		return spec, b.error(err)
+	}
+
+	// Done
+	return spec, nil
+}
+
+// previousMountPaths returns the paths of the instance's secret engines under
+// the previous plan. If the plan is not known, they are the engine paths of
+// the instance which are in the mount table. Extra mounts are never included,
+// since their names cannot be engine paths.
+func (b *Broker) previousMountPaths(table mountTable, instanceID string, previous *Plan) []string {
+	if previous != nil {
+		return mountPaths(instanceMounts(b.mountPrefix, instanceID, previous))
+	}
+	var paths []string
+	for t := range secretEngineTypes {
+		path := mountPath(b.mountPrefix, instanceID, t.PathType())
+		if _, ok := table[path]; ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Not implemented, only used for async
+func (b *Broker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	logger := b.requestLog(ctx).With("instance_id", instanceID)
+	logger.Printf("[INFO] returning last operation for instance %s", instanceID)
+	return brokerapi.LastOperation{}, nil
+}
+
+// putTokenRole writes the periodic token role "cf-instanceID" which bindings
+// for the instance create their tokens against.
+func (b *Broker) putTokenRole(instanceID string) error {
+	path := "/auth/token/roles/cf-" + instanceID
+	b.log.Printf("[DEBUG] creating new token role for %s", path)
+	if _, err := b.vault().Logical().Write(path, b.tokenRoleData(instanceID)); err != nil {
+		return errors.Wrapf(err, "failed to create token role for %s", path)
+	}
+	return nil
+}
+
+// migrateTokenRoles rewrites the token roles of the cached instances which do
+// not allow the policies or entity aliases the broker is configured with.
+// Failures are only logged, since binding self-heal or a drift repair can
+// still fix the role later.
+func (b *Broker) migrateTokenRoles(ctx context.Context) error {
+	if len(b.defaultBindPolicies) == 0 && len(b.bindAllowedPolicies) == 0 && !b.bindIdentity {
+		return nil
+	}
+
+	b.instancesLock.Lock()
+	instanceIDs := make([]string, 0, len(b.instances))
+	for id := range b.instances {
+		instanceIDs = append(instanceIDs, id)
+	}
+	b.instancesLock.Unlock()
+	sort.Strings(instanceIDs)
+
+	updated := 0
+	for _, instanceID := range instanceIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := "auth/token/roles/cf-" + instanceID
+		role, err := b.vault().Logical().Read(path)
+		if err != nil {
+			b.log.Printf("[WARN] failed to read token role %s: %s", path, err)
+			continue
+		}
+		if role == nil || b.tokenRoleAllows(instanceID, role.Data) {
+			continue
+		}
+		if err := b.putTokenRole(instanceID); err != nil {
+			b.log.Printf("[WARN] %s", err)
+			continue
+		}
+		updated++
+	}
+	if updated > 0 {
+		b.log.Printf("[INFO] updated the token roles of %d instances", updated)
+	}
+	return nil
+}
+
+// tokenRoleAllows returns true if the settings of the instance's token role, as
+// read from Vault, already allow the policies and entity aliases which
+// tokenRoleData would write.
+func (b *Broker) tokenRoleAllows(instanceID string, data map[string]interface{}) bool {
+	contains := func(key string, values []string) bool {
+		allowed := make(map[string]struct{})
+		switch v := data[key].(type) {
+		case []interface{}:
+			for _, s := range v {
+				allowed[fmt.Sprint(s)] = struct{}{}
+			}
+		case string:
+			for _, s := range strings.Split(v, ",") {
+				allowed[strings.TrimSpace(s)] = struct{}{}
+			}
+		}
+		for _, s := range values {
+			if _, ok := allowed[s]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	if !contains("allowed_policies", b.roleAllowedPolicies(instanceID)) {
+		return false
+	}
+	return !b.bindIdentity || contains("allowed_entity_aliases", []string{entityAliasName(instanceID, "*")})
+}
+
+// tokenRoleData returns the settings of the token role of the instance.
+func (b *Broker) tokenRoleData(instanceID string) map[string]interface{} {
+	data := map[string]interface{}{
+		"allowed_policies": strings.Join(b.roleAllowedPolicies(instanceID), ","),
+		"period":           VaultPeriodicTTL,
+		"renewable":        true,
+	}
+	if b.tokenMaxTTL > 0 {
+		data["token_explicit_max_ttl"] = int64(b.tokenMaxTTL.Seconds())
+	}
+	if b.tokenNumUses > 0 {
+		data["token_num_uses"] = b.tokenNumUses
+	}
+	if b.tokenNoDefaultPolicy {
+		data["token_no_default_policy"] = true
+	}
+	if b.bindIdentity {
+		data["allowed_entity_aliases"] = entityAliasName(instanceID, "*")
+	}
+	return data
+}
+
+// roleAllowedPolicies returns the policies the token role of the instance
+// allows binding tokens to have.
+func (b *Broker) roleAllowedPolicies(instanceID string) []string {
+	policies := []string{"cf-" + instanceID}
+	b.instancesLock.Lock()
+	if info := b.instances[instanceID]; info != nil && len(info.SharedSpaces) > 0 {
+		policies = append(policies, sharedPolicyName(instanceID))
+	}
+	b.instancesLock.Unlock()
+	policies = append(policies, b.defaultBindPolicies...)
+	return append(policies, b.bindAllowedPolicies...)
+}
+
+// bindTokenPolicies returns the policies of a new binding token: the
+// instance's policy, the default bind policies, and the additional policies
+// requested in the bind parameters. Bindings from a space the instance is
+// shared with get the instance's shared policy instead of its policy.
+func (b *Broker) bindTokenPolicies(instanceID string, params *bindParameters, sharedSpace string) []string {
+	policies := []string{"cf-" + instanceID}
+	if sharedSpace != "" {
+		policies = []string{sharedPolicyName(instanceID)}
+	}
+	policies = append(policies, b.defaultBindPolicies...)
+	return append(policies, params.AdditionalPolicies...)
+}
+
+// bindTokenMetadata returns the metadata of a new binding token, which ties
+// the token to its binding, instance, organization, and space. The names of
+// the instance, organization, and space are included if they can be looked
+// up.
+func (b *Broker) bindTokenMetadata(instanceID, bindingID string, instance *instanceInfo) map[string]string {
+	metadata := map[string]string{
+		"cf-instance-id": instanceID,
+		"cf-binding-id":  bindingID,
+		"cf-org-guid":    instance.OrganizationGUID,
+		"cf-space-guid":  instance.SpaceGUID,
+	}
+	if b.nameResolver == nil {
+		return metadata
+	}
+
+	// Names which cannot be looked up fall back to the GUIDs already present
+	names, _ := b.lookupNames(instanceID, instance.OrganizationGUID, instance.SpaceGUID)
+	for key, name := range map[string][2]string{
+		"cf-instance-name": {names.Instance, instanceID},
+		"cf-org-name":      {names.Organization, instance.OrganizationGUID},
+		"cf-space-name":    {names.Space, instance.SpaceGUID},
+	} {
+		if name[0] != "" && name[0] != name[1] {
+			metadata[key] = name[0]
+		}
+	}
+	return metadata
+}
+
+// createBindToken creates the token for a binding against the instance's
+// token role.
+func (b *Broker) createBindToken(instanceID, bindingID, actor string, instance *instanceInfo, params *bindParameters, sharedSpace string) (*api.Secret, error) {
+	roleName := "cf-" + instanceID
+	renewable := true
+	req := &api.TokenCreateRequest{
+		Policies:    b.bindTokenPolicies(instanceID, params, sharedSpace),
+		Metadata:    b.bindTokenMetadata(instanceID, bindingID, instance),
+		DisplayName: "cf-bind-" + bindingID,
+		Renewable:   &renewable,
+	}
+	if actor != "" {
+		// The metadata shows up in Vault's audit log
+		req.Metadata["cf-originating-identity"] = actor
+	}
+	if sharedSpace != "" {
+		req.Metadata["cf-shared-space-id"] = sharedSpace
+	}
+	if params.ttl > 0 {
+		// The role is periodic, so the token would be renewable forever
+		// without an explicit max TTL
+		req.TTL = params.ttl.String()
+		req.ExplicitMaxTTL = params.ttl.String()
+	}
+	if params.NumUses > 0 {
+		// Vault uses the smaller of this and the role's token_num_uses
+		req.NumUses = params.NumUses
+	}
+	b.log.Printf("[DEBUG] creating token with role %s", roleName)
+	if b.bindIdentity {
+		return b.createTokenWithEntityAlias(req, roleName, entityAliasName(instanceID, bindingID))
+	}
+	return b.vault().Auth().Token().CreateWithRole(req, roleName)
+}
+
+// checkTokenSecret returns an error if the response to a token creation has
+// no token, which Vault and proxies in front of it can return without an error.
+func checkTokenSecret(secret *api.Secret) error {
+	switch {
+	case secret == nil:
+		return errors.New("vault returned no secret")
+	case secret.Auth == nil:
+		return errors.New("vault returned a secret without auth")
+	case secret.Auth.ClientToken == "":
+		return errors.New("vault returned a secret without a token")
+	}
+	return nil
+}
+
+// putTransitKey creates the plan's transit key in the instance's transit
+// mount, if the plan has one, and sets its rotation period. Creating a key
+// which already exists leaves it unchanged, so retries are safe.
+func (b *Broker) putTransitKey(instanceID string, plan *Plan) error {
+	k := plan.TransitKey
+	if k == nil {
+		return nil
+	}
+	path := mountPath(b.mountPrefix, instanceID, Transit.PathType(), "keys", k.Name)
+	b.log.Printf("[DEBUG] creating transit key %s of type %s", path, k.Type)
+	if _, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"type": k.Type,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to create transit key %s", path)
+	}
+	if k.autoRotatePeriod > 0 {
+		if _, err := b.vault().Logical().Write(path+"/config", map[string]interface{}{
+			"auto_rotate_period": int64(k.autoRotatePeriod / time.Second),
+		}); err != nil {
+			return errors.Wrapf(err, "failed to configure transit key %s", path)
+		}
+	}
+	return nil
+}
+
+// SSHRoleName is the role of each instance's SSH engine which signs the
+// public keys of its bindings.
+const SSHRoleName = "cf-bind"
+
+// putSSHCA generates the CA of the instance's SSH mount, if the plan has the
+// SSH engine, and writes the role which signs user certificates for its
+// bindings, limited to sshAllowedUsers and sshCertTTL. An existing CA is kept,
+// so retries are safe.
+func (b *Broker) putSSHCA(instanceID string, plan *Plan) error {
+	if !plan.hasEngine(SSH) {
+		return nil
+	}
+	mount := mountPath(b.mountPrefix, instanceID, SSH.PathType())
+
+	path := mount + "/config/ca"
+	b.log.Printf("[DEBUG] generating SSH CA %s", path)
+	if _, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"generate_signing_key": true,
+	}); err != nil && !isSSHCAConfiguredError(err) {
+		return errors.Wrapf(err, "failed to generate SSH CA %s", path)
+	}
+
+	path = mount + "/roles/" + SSHRoleName
+	b.log.Printf("[DEBUG] creating SSH role %s", path)
+	ttl := int64(b.sshCertTTL / time.Second)
+	if _, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"key_type":                "ca",
+		"allow_user_certificates": true,
+		"allow_host_certificates": false,
+		"allowed_users":           strings.Join(b.sshAllowedUsers, ","),
+		"default_user":            b.sshDefaultUser(),
+		"ttl":                     ttl,
+		"max_ttl":                 ttl,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to create SSH role %s", path)
+	}
+	return nil
+}
+
+// sshDefaultUser returns the user which SSH certificates are valid for if a
+// signing request names none.
+func (b *Broker) sshDefaultUser() string {
+	if len(b.sshAllowedUsers) == 0 {
+		return ""
+	}
+	return b.sshAllowedUsers[0]
+}
+
+// signSSHKey signs the public key with the CA of the instance's SSH mount as a
+// user certificate for sshAllowedUsers, returning the signed certificate and
+// its serial number.
+func (b *Broker) signSSHKey(instanceID, publicKey string) (string, string, error) {
+	path := mountPath(b.mountPrefix, instanceID, SSH.PathType(), "sign", SSHRoleName)
+	b.log.Printf("[DEBUG] signing SSH key with %s", path)
+	secret, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"public_key":       publicKey,
+		"cert_type":        "user",
+		"valid_principals": strings.Join(b.sshAllowedUsers, ","),
+		"ttl":              int64(b.sshCertTTL / time.Second),
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to sign SSH key with %s", path)
+	}
+	if secret == nil {
+		return "", "", fmt.Errorf("signing SSH key with %s returned no certificate", path)
+	}
+	signed, _ := secret.Data["signed_key"].(string)
+	if signed == "" {
+		return "", "", fmt.Errorf("signing SSH key with %s returned no certificate", path)
+	}
+	serial, _ := secret.Data["serial_number"].(string)
+	return signed, serial, nil
+}
+
+// PKIRoleName is the role of each instance's PKI engine which issues the
+// certificates of its bindings.
+const PKIRoleName = "cf-bind"
+
+// putPKIRole generates the root CA of the instance's PKI mount, if the plan has
+// the PKI engine, and writes the role which issues certificates for
+// pkiAllowedDomains. An existing CA is kept, so retries are safe.
+func (b *Broker) putPKIRole(instanceID string, plan *Plan) error {
+	if !plan.hasEngine(PKI) {
+		return nil
+	}
+	mount := mountPath(b.mountPrefix, instanceID, PKI.PathType())
+
+	path := mount + "/cert/ca"
+	secret, err := b.vault().Logical().Read(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read PKI CA %s", path)
+	}
+	var ca string
+	if secret != nil {
+		ca, _ = secret.Data["certificate"].(string)
+	}
+	if ca == "" {
+		path = mount + "/root/generate/internal"
+		b.log.Printf("[DEBUG] generating PKI CA %s", path)
+		if _, err := b.vault().Logical().Write(path, map[string]interface{}{
+			"common_name": "cf-" + instanceID,
+			"ttl":         int64(b.pkiCATTL / time.Second),
+		}); err != nil {
+			return errors.Wrapf(err, "failed to generate PKI CA %s", path)
+		}
+	}
+
+	path = mount + "/roles/" + PKIRoleName
+	b.log.Printf("[DEBUG] creating PKI role %s", path)
+	ttl := int64(b.pkiCertTTL / time.Second)
+	if _, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"allowed_domains":  strings.Join(b.pkiAllowedDomains, ","),
+		"allow_subdomains": true,
+		"ttl":              ttl,
+		"max_ttl":          ttl,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to create PKI role %s", path)
+	}
+	return nil
+}
+
+// AWSRoleName is the role of each instance's AWS engine which generates the
+// credentials of its bindings.
+const AWSRoleName = "cf-bind"
+
+// putAWSRole configures the root credentials of the instance's AWS mount, if
+// the plan has the AWS engine, and writes the role which generates credentials
+// for its bindings by assuming the configured IAM role.
+func (b *Broker) putAWSRole(instanceID string, plan *Plan) error {
+	if !plan.hasEngine(AWS) {
+		return nil
+	}
+	mount := mountPath(b.mountPrefix, instanceID, AWS.PathType())
+
+	path := mount + "/config/root"
+	data := map[string]interface{}{
+		"region": b.awsRegion,
+	}
+	if b.awsAccessKeyID != "" {
+		data["access_key"] = b.awsAccessKeyID
+		data["secret_key"] = b.awsSecretAccessKey
+	}
+	b.log.Printf("[DEBUG] configuring AWS engine %s", path)
+	if _, err := b.vault().Logical().Write(path, data); err != nil {
+		return errors.Wrapf(err, "failed to configure AWS engine %s", path)
+	}
+
+	path = mount + "/roles/" + AWSRoleName
+	b.log.Printf("[DEBUG] creating AWS role %s", path)
+	if _, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"credential_type": "assumed_role",
+		"role_arns":       b.awsRoleARN,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to create AWS role %s", path)
+	}
+	return nil
+}
+
+// generateAWSCredentials generates AWS credentials with the instance's AWS
+// mount and records them and their lease in the binding info.
+func (b *Broker) generateAWSCredentials(instanceID string, info *bindingInfo) error {
+	path := mountPath(b.mountPrefix, instanceID, AWS.PathType(), "sts", AWSRoleName)
+	b.log.Printf("[DEBUG] generating AWS credentials with %s", path)
+	secret, err := b.vault().Logical().Write(path, map[string]interface{}{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to generate AWS credentials with %s", path)
+	}
+	if secret == nil {
+		return fmt.Errorf("generating AWS credentials with %s returned no credentials", path)
+	}
+	accessKey, _ := secret.Data["access_key"].(string)
+	secretKey, _ := secret.Data["secret_key"].(string)
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("generating AWS credentials with %s returned no credentials", path)
+	}
+	info.AWSAccessKey = accessKey
+	info.AWSSecretKey = secretKey
+	info.AWSSecurityToken, _ = secret.Data["security_token"].(string)
+	info.LeaseID = secret.LeaseID
+	info.LeaseRenewable = secret.Renewable
+	return nil
+}
 
-	// Setup Renew timer
-	info.stopCh = make(chan struct{})
-	go b.renewAuth(info.ClientToken, info.Accessor, info.stopCh)
+// isSSHCAConfiguredError reports whether the error was returned by Vault
+// because the SSH mount already has a CA.
+func isSSHCAConfiguredError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "keys are already configured")
+}
 
-	// Store the info
-	b.log.Printf("[DEBUG] saving bind %s to cache", bindingID)
-	b.bindLock.Lock()
-	b.binds[bindingID] = info
-	b.bindLock.Unlock()
+// isUnknownRoleError reports whether the error was returned by Vault because
+// the token role does not exist.
+func isUnknownRoleError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "unknown role")
+}
 
-	// Save the credentials
-	binding.Credentials = map[string]interface{}{
-		"address": b.vaultAdvertiseAddr,
-		"auth": map[string]interface{}{
-			"accessor": secret.Auth.Accessor,
-			"token":    secret.Auth.ClientToken,
-		},
-		"backends": map[string]interface{}{
-			"generic": "cf/" + instanceID + "/secret",
-			"transit": "cf/" + instanceID + "/transit",
-		},
-		"backends_shared": map[string]interface{}{
-			"organization": "cf/" + instance.OrganizationGUID + "/secret",
-			"space":        "cf/" + instance.SpaceGUID + "/secret",
-		},
+// isInvalidAccessorError reports whether the error was returned by Vault
+// because the token accessor does not exist, for example because the token was
+// revoked out-of-band or expired.
+func isInvalidAccessorError(err error) bool {
+	if err == nil {
+		return false
 	}
-	return binding, nil
+	switch vaultErrorCode(err) {
+	case 400, 404:
+	default:
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "invalid accessor") || strings.Contains(msg, "not found")
 }
 
-// Unbind is used to detach an applicaiton from a tenant in Vault.
-func (b *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
-	b.log.Printf("[INFO] unbinding service %s for instance %s",
-		bindingID, instanceID)
+// isInvalidLeaseError reports whether the error was returned by Vault because
+// the lease does not exist, for example because it expired or was revoked.
+func isInvalidLeaseError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch vaultErrorCode(err) {
+	case 400, 404:
+	default:
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "invalid lease") || strings.Contains(msg, "not found")
+}
 
-	// Read the binding info
-	path := "cf/broker/" + instanceID + "/" + bindingID
-	b.log.Printf("[DEBUG] reading %s", path)
-	secret, err := b.vaultClient.Logical().Read(path)
-	if err != nil {
-		return b.wErrorf(err, "failed to read binding info for %s", path)
+// operationContext returns the context for a broker operation, applying the
+// default operation timeout if the given context has no deadline.
+func (b *Broker) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || b.operationTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	if secret == nil || len(secret.Data) == 0 {
-		return b.errorf("missing bind info for unbind for %s", path)
+	return context.WithTimeout(ctx, b.operationTimeout)
+}
+
+// checkContext returns an error if the context of the operation was cancelled
+// or timed out. The Vault client cannot cancel requests in flight, so
+// operations check their context between calls to Vault instead, and a call
+// which is in flight when the context ends still runs until it finishes or
+// hits the client's own timeout.
+func (b *Broker) checkContext(ctx context.Context, op, id string) error {
+	if err := ctx.Err(); err != nil {
+		return b.wErrorf(err, "%s of %s aborted", op, id)
 	}
+	return nil
+}
 
-	// Decode the binding info
-	b.log.Printf("[DEBUG] decoding binding info for %s", path)
-	info, err := decodeBindingInfo(secret.Data)
+// putPolicy renders the policy for the given instance and writes it to Vault as
+// "cf-instanceID".
+func (b *Broker) putPolicy(instanceID, orgGUID, spaceGUID string, plan *Plan) error {
+	policy, err := b.policyDocument(instanceID, orgGUID, spaceGUID, plan)
 	if err != nil {
-		return b.wErrorf(err, "failed to decode binding info for %s", path)
+		return err
 	}
 
-	// Revoke the token
-	a := info.Accessor
-	b.log.Printf("[DEBUG] revoking accessor %s for path %s", a, path)
-	if err := b.vaultClient.Auth().Token().RevokeAccessor(a); err != nil {
-		return b.wErrorf(err, "failed to revoke accessor %s", a)
+	policyName := "cf-" + instanceID
+	b.log.Printf("[DEBUG] creating new policy %s", policyName)
+	if err := b.vault().Sys().PutPolicy(policyName, policy); err != nil {
+		return errors.Wrapf(err, "failed to create policy %s", policyName)
 	}
+	return nil
+}
 
-	// Delete the binding info
-	b.log.Printf("[DEBUG] deleting binding info at %s", path)
-	if _, err := b.vaultClient.Logical().Delete(path); err != nil {
-		return b.wErrorf(err, "failed to delete binding info at %s", path)
+// vaultMounts returns every mount the instance needs, leaving out the shared
+// organization and space mounts if they are disabled.
+func (b *Broker) vaultMounts(instanceID, orgGUID, spaceGUID string, plan *Plan) []Mount {
+	if b.disableOrgMount {
+		orgGUID = ""
 	}
+	if b.disableSpaceMount {
+		spaceGUID = ""
+	}
+	return vaultMounts(b.mountPrefix, instanceID, orgGUID, spaceGUID, plan)
+}
 
-	// Delete the bind if it exists, stopping any renewers
-	b.log.Printf("[DEBUG] removing binding %s from cache", bindingID)
-	b.bindLock.Lock()
-	existing, ok := b.binds[bindingID]
-	if ok {
-		delete(b.binds, bindingID)
-		if existing.stopCh != nil {
-			close(existing.stopCh)
-		}
+// policyDocument renders the policy for the given instance.
+func (b *Broker) policyDocument(instanceID, orgGUID, spaceGUID string, plan *Plan) (string, error) {
+	var buf bytes.Buffer
+	inp := ServicePolicyTemplateInput{
+		Prefix:    b.mountPrefix,
+		ServiceID: instanceID,
+		SpaceID:   spaceGUID,
+		OrgID:     orgGUID,
+		ReadOnly:  plan.ReadOnly,
+
+		NoSpaceMount: b.disableSpaceMount,
+		NoOrgMount:   b.disableOrgMount,
+
+		ServiceCapabilities: b.serviceCapabilities,
+		SpaceCapabilities:   b.spaceCapabilities,
+		OrgCapabilities:     b.orgCapabilities,
+
+		EnginePaths: enginePolicyPaths(b.mountPrefix, instanceID, plan),
 	}
-	b.bindLock.Unlock()
 
-	// Done
-	return nil
+	b.log.Printf("[DEBUG] generating policy for %s", instanceID)
+	if err := b.generatePolicy(&buf, &inp); err != nil {
+		return "", errors.Wrapf(err, "failed to generate policy for %s", instanceID)
+	}
+	return buf.String(), nil
 }
 
-// Not implemented, only used for multiple plans
-func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, async bool) (brokerapi.UpdateServiceSpec, error) {
-	b.log.Printf("[INFO] updating service for instance %s", instanceID)
-	return brokerapi.UpdateServiceSpec{}, nil
+// generatePolicy renders a policy with the custom policy template if there
+// is one, and with the built-in template otherwise.
+func (b *Broker) generatePolicy(w io.Writer, inp *ServicePolicyTemplateInput) error {
+	if b.policyTemplate != nil {
+		return b.policyTemplate.Execute(w, inp)
+	}
+	return GeneratePolicy(w, inp)
 }
 
-// Not implemented, only used for async
-func (b *Broker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
-	b.log.Printf("[INFO] returning last operation for instance %s", instanceID)
-	return brokerapi.LastOperation{}, nil
-}
+// mountTable is a snapshot of the mount table in Vault, keyed by mount path
+// without leading or trailing slashes. It is fetched once per operation and
+// kept up to date as the operation mounts and unmounts backends.
+type mountTable map[string]*api.MountOutput
 
-// idempotentMount takes a list of mounts and their desired paths and mounts the
-// backend at that path. The key is the path and the value is the type of
-// backend to mount.
-func (b *Broker) idempotentMount(m map[string]string) error {
+// listMounts fetches the current mount table from Vault.
+func (b *Broker) listMounts() (mountTable, error) {
 	b.mountMutex.Lock()
 	defer b.mountMutex.Unlock()
-	result, err := b.vaultClient.Sys().ListMounts()
+	return b.listMountsLocked()
+}
+
+// listMountsLocked fetches the current mount table from Vault. The caller must
+// hold mountMutex.
+func (b *Broker) listMountsLocked() (mountTable, error) {
+	result, err := b.vault().Sys().ListMounts()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Strip all leading and trailing things
-	mounts := make(map[string]struct{})
-	for k := range result {
+	mounts := make(mountTable, len(result))
+	for k, v := range result {
 		k = strings.Trim(k, "/")
-		mounts[k] = struct{}{}
+		mounts[k] = v
 	}
+	return mounts, nil
+}
 
-	for k, v := range m {
-		k = strings.Trim(k, "/")
-		if _, ok := mounts[k]; ok {
+// idempotentMount takes a list of mounts and mounts each backend at its path if
+// and only if nothing is mounted there according to the given mount table,
+// which is updated with the new mounts. If the table is nil, it is fetched from
+// Vault. Since other operations may have changed the mount table since it was
+// fetched, it is re-fetched if mounting fails to check whether the backend now
+// exists.
+func (b *Broker) idempotentMount(mounts mountTable, l []Mount) error {
+	b.mountMutex.Lock()
+	defer b.mountMutex.Unlock()
+
+	if mounts == nil {
+		var err error
+		if mounts, err = b.listMountsLocked(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range l {
+		k := strings.Trim(m.Path, "/")
+		config := b.mountConfig(m)
+		if existing, ok := mounts[k]; ok {
+			if b.mountReconcile && mountConfigDiffers(existing, config) {
+				b.log.Printf("[INFO] reconciling lease TTLs of existing mount %s", k)
+				if err := b.vault().Sys().TuneMount(k, config); err != nil {
+					return err
+				}
+			}
+			if b.mountReconcile && existing.Local != m.Local {
+				// Only remounting changes this, which would destroy the data
+				b.log.Printf("[WARN] existing mount %s has local %t instead of %t, leaving it unchanged",
+					k, existing.Local, m.Local)
+			}
 			continue
 		}
-		if err := b.vaultClient.Sys().Mount(k, &api.MountInput{
-			Type: v,
-		}); err != nil {
-			return err
+		input := &mountInput{
+			MountInput: api.MountInput{
+				Type:        string(m.Type),
+				Description: m.Description,
+				Config:      config,
+				Local:       m.Local,
+			},
+			SealWrap: m.SealWrap,
+		}
+		if m.KVVersion == 2 {
+			input.Type = "kv"
+			input.Options = map[string]string{"version": "2"}
+		}
+		if err := b.mount(k, input); err != nil {
+			current, lerr := b.listMountsLocked()
+			if lerr != nil {
+				return err
+			}
+			if _, ok := current[k]; !ok {
+				return err
+			}
+			for ck, cv := range current {
+				mounts[ck] = cv
+			}
+			continue
+		}
+		mounts[k] = &api.MountOutput{
+			Type:  input.Type,
+			Local: input.Local,
 		}
 	}
 	return nil
 }
 
-// idempotentUnmount takes a list of mount paths and removes them if and only
-// if they currently exist.
-func (b *Broker) idempotentUnmount(l []string) error {
-	b.mountMutex.Lock()
-	defer b.mountMutex.Unlock()
-	result, err := b.vaultClient.Sys().ListMounts()
+// checkSealWrap returns an error if Vault cannot seal-wrap mounts.
+func (b *Broker) checkSealWrap() error {
+	enterprise, version, err := vaultEnterprise(b.vault())
 	if err != nil {
+		return errors.Wrap(err, "failed to read the version of vault")
+	}
+	if !enterprise {
+		return fmt.Errorf("seal_wrap requires Vault Enterprise, but vault is version %s", version)
+	}
+	return nil
+}
+
+// mountInput is the request to create a mount, with the seal_wrap option and
+// the engine options which our Vault client does not know about.
+type mountInput struct {
+	api.MountInput
+	SealWrap bool              `json:"seal_wrap,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+// mount creates a mount at the given path.
+func (b *Broker) mount(path string, input *mountInput) error {
+	r := b.vault().NewRequest("POST", "/v1/sys/mounts/"+path)
+	if err := r.SetJSONBody(input); err != nil {
 		return err
 	}
+	resp, err := b.vault().RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
 
-	// Strip all leading and trailing things
-	mounts := make(map[string]struct{})
-	for k := range result {
-		k = strings.Trim(k, "/")
-		mounts[k] = struct{}{}
+// mountConfig returns the mount configuration for the given mount, falling
+// back to the broker-wide lease TTLs.
+func (b *Broker) mountConfig(m Mount) api.MountConfigInput {
+	var config api.MountConfigInput
+
+	defaultTTL := m.DefaultLeaseTTL
+	if defaultTTL == 0 {
+		defaultTTL = b.mountDefaultLeaseTTL
+	}
+	if defaultTTL > 0 {
+		config.DefaultLeaseTTL = fmt.Sprintf("%ds", int64(defaultTTL/time.Second))
+	}
+
+	maxTTL := m.MaxLeaseTTL
+	if maxTTL == 0 {
+		maxTTL = b.mountMaxLeaseTTL
+	}
+	if maxTTL > 0 {
+		config.MaxLeaseTTL = fmt.Sprintf("%ds", int64(maxTTL/time.Second))
+	}
+	return config
+}
+
+// mountConfigDiffers reports whether the configured lease TTLs of an existing
+// mount differ from the desired configuration. TTLs which are not set in the
+// desired configuration are ignored.
+func mountConfigDiffers(existing *api.MountOutput, desired api.MountConfigInput) bool {
+	if existing == nil {
+		return false
+	}
+	differs := func(current int, want string) bool {
+		if want == "" {
+			return false
+		}
+		return fmt.Sprintf("%ds", current) != want
+	}
+	return differs(existing.Config.DefaultLeaseTTL, desired.DefaultLeaseTTL) ||
+		differs(existing.Config.MaxLeaseTTL, desired.MaxLeaseTTL)
+}
+
+// idempotentUnmount takes a list of mount paths and removes them if and only
+// if they exist according to the given mount table, which is updated to
+// remove them. If the table is nil, it is fetched from Vault.
+func (b *Broker) idempotentUnmount(mounts mountTable, l []string) error {
+	b.mountMutex.Lock()
+	defer b.mountMutex.Unlock()
+
+	if mounts == nil {
+		var err error
+		if mounts, err = b.listMountsLocked(); err != nil {
+			return err
+		}
 	}
 
 	for _, k := range l {
@@ -636,85 +3267,425 @@ func (b *Broker) idempotentUnmount(l []string) error {
 		if _, ok := mounts[k]; !ok {
 			continue
 		}
-		if err := b.vaultClient.Sys().Unmount(k); err != nil {
+		if err := b.vault().Sys().Unmount(k); err != nil {
 			return err
 		}
+		delete(mounts, k)
 	}
 	return nil
 }
 
-// renewAuth renews the given token. It is designed to be called as a goroutine
-// and will log any errors it encounters.
+// renewAuth renews the broker's token until stopCh is closed. It logs any
+// errors it encounters. If renewal gives up while the token is still valid, it
+// is restarted after a backoff.
 func (b *Broker) renewAuth(token, accessor string, stopCh <-chan struct{}) {
-	// Sleep for a random number of milliseconds. This helps prevent a thundering
-	// herd in the event a broker is restarted with a lot of bindings.
-	time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
+	logger := b.log.With("accessor", accessor)
 
-	// Use renew-self instead of lookup here because we want the freshest renew
-	// and we can find out if it's renewable or not.
-	secret, err := b.vaultClient.Auth().Token().RenewTokenAsSelf(token, 0)
-	if err != nil {
-		b.log.Printf("[ERR] renew-token (%s): error looking up self: %s", accessor, err)
-		return
+	backoff := renewRetryMin
+	for {
+		// Use renew-self instead of lookup here because we want the freshest
+		// renew and we can find out if it's renewable or not.
+		secret, err := b.vault().Auth().Token().RenewTokenAsSelf(token, b.renewIncrement)
+		if err != nil {
+			if vaultErrorCode(err) == 403 {
+				logger.Printf("[WARN] renew-token (%s): token is no longer valid, stopping renewal: %s", accessor, err)
+				b.renewalFailed("broker", renewFailedInvalid)
+				return
+			}
+			logger.Printf("[ERR] renew-token (%s): error looking up self, retrying in %s: %s", accessor, backoff, err)
+			b.renewalFailed("broker", renewFailedLookup)
+			if !b.sleepOrStop(backoff, stopCh) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		if secret == nil || secret.Auth == nil || !secret.Auth.Renewable {
+			logger.Printf("[WARN] renew-token (%s): token is not renewable, stopping renewal", accessor)
+			return
+		}
+		atomic.StoreInt32(&b.tokenRenewalHealthy, 1)
+
+		lease := time.Duration(secret.Auth.LeaseDuration) * time.Second
+		renewed, stopped := b.renewToken(token, accessor, lease, stopCh)
+		if stopped {
+			return
+		}
+
+		// Renewal gave up. Start over as long as the token is still valid,
+		// resetting the backoff if the last renewals were making progress.
+		if renewed {
+			backoff = renewRetryMin
+		}
+		logger.Printf("[WARN] renew-token (%s): renewal stopped, restarting in %s", accessor, backoff)
+		if !b.sleepOrStop(backoff, stopCh) {
+			return
+		}
+		backoff = nextBackoff(backoff)
 	}
+}
 
-	renewer, err := b.vaultClient.NewRenewer(&api.RenewerInput{
-		Secret: secret,
-	})
-	if err != nil {
-		b.log.Printf("[ERR] renew-token (%s): failed to create renewer: %s", accessor, err)
-		return
+// renewToken renews the broker's token at half of its lease, which is given,
+// requesting renewIncrement each time, until renewal fails or the token comes
+// within the grace of expiring, which happens once it reaches its max TTL. It
+// reports whether the token was renewed at least once and whether it returned
+// because renewal was stopped.
+func (b *Broker) renewToken(token, accessor string, lease time.Duration, stopCh <-chan struct{}) (renewed, stopped bool) {
+	logger := b.log.With("accessor", accessor)
+	grace := b.renewGrace
+	if grace <= 0 {
+		grace = renewTokenGrace
 	}
-	go renewer.Renew()
-	defer renewer.Stop()
 
 	for {
-		select {
-		case err := <-renewer.DoneCh():
-			if err != nil {
-				b.log.Printf("[ERR] renew-token (%s): failed: %s", accessor, err)
+		delay := lease / 2
+		if delay <= grace {
+			return renewed, false
+		}
+		if !b.sleepOrStop(delay, stopCh) {
+			return renewed, true
+		}
+
+		secret, err := b.vault().Auth().Token().RenewTokenAsSelf(token, b.renewIncrement)
+		if err != nil {
+			logger.Printf("[ERR] renew-token (%s): failed: %s", accessor, err)
+			b.renewalFailed("broker", renewFailedDone)
+			return renewed, false
+		}
+		if secret == nil || secret.Auth == nil || !secret.Auth.Renewable {
+			logger.Printf("[WARN] renew-token (%s): token is no longer renewable", accessor)
+			return renewed, false
+		}
+
+		renewed = true
+		atomic.StoreInt32(&b.tokenRenewalHealthy, 1)
+		lease = time.Duration(secret.Auth.LeaseDuration) * time.Second
+		logger.Printf("[INFO] renew-token (%s): successfully renewed token (%s)", accessor, lease)
+	}
+}
+
+// renewVaultToken is a convenience wrapper around renewAuth which looks up
+// metadata about the token attached to this broker and starts renewing it.
+// Failures to look up or renew the token are retried with an exponential
+// backoff, and then on a slow schedule, until the broker is stopped or stopCh
+// is closed.
+func (b *Broker) renewVaultToken(stopCh <-chan struct{}) {
+	failures := 0
+	retry := func(action string, err error) bool {
+		failures++
+		delay := tokenRetryDelay(failures)
+		b.log.Printf("[ERR] renew-token: failed to %s client vault token, retrying in %s: %s", action, delay, err)
+		if failures == renewRetryAttempts {
+			b.log.Printf("[ERR] renew-token: failed %d times in a row, retrying every %s until it succeeds", failures, renewRetryMax)
+		}
+		b.renewalFailed("broker", renewFailedLookup)
+		return b.sleepOrStop(delay, stopCh)
+	}
+
+	for {
+		secret, err := b.vault().Auth().Token().LookupSelf()
+		if err == nil && secret == nil {
+			err = errors.New("lookup-self came back empty")
+		}
+		if err != nil {
+			if !retry("lookup", err) {
+				return
 			}
-			b.log.Printf("[WARN] renew-token (%s): renewer stopped: token probably expired!", accessor)
+			continue
+		}
+
+		if renew, reason := shouldRenewToken(secret.Data); !renew {
+			b.log.Printf("[INFO] renew-token: vault token %s so doesn't need to be renewed, stopping renewal process", reason)
 			return
-		case renewal := <-renewer.RenewCh():
-			remaining := "no auth data"
-			if renewal.Secret != nil && renewal.Secret.Auth != nil {
-				seconds := renewal.Secret.Auth.LeaseDuration
-				remaining = (time.Duration(seconds) * time.Second).String()
+		}
+
+		secret, err = b.vault().Auth().Token().RenewSelf(b.renewIncrement)
+		if err == nil && (secret == nil || secret.Auth == nil) {
+			err = errors.New("renew-self came back with empty auth")
+		}
+		if err != nil {
+			if !retry("renew", err) {
+				return
 			}
-			b.log.Printf("[INFO] renew-token (%s): successfully renewed token (%s)", accessor, remaining)
-		case <-stopCh:
-			b.log.Printf("[INFO] renew-token (%s): stopping renewer: unbind requested", accessor)
+			continue
+		}
+
+		if failures > 0 {
+			b.log.Printf("[INFO] renew-token: renewed client vault token after %d failures", failures)
+		}
+		failures = 0
+		atomic.StoreInt32(&b.tokenRenewalHealthy, 1)
+
+		if b.vaultLogin == nil {
+			b.renewAuth(secret.Auth.ClientToken, secret.Auth.Accessor, stopCh)
 			return
-		case <-b.stopCh:
+		}
+
+		// Tokens obtained by logging in are renewed until they can no longer
+		// be extended and are then replaced by logging in again.
+		if !b.renewUntilDone(secret, stopCh) {
+			return
+		}
+		if !b.relogin(stopCh) {
 			return
 		}
 	}
 }
 
-// renewVaultToken is a convenience wrapper around renewAuth which looks up
-// metadata about the token attached to this broker and starts the renewer.
-func (b *Broker) renewVaultToken() {
-	secret, err := b.vaultClient.Auth().Token().LookupSelf()
+// tokenRetryDelay returns how long to wait before retrying to renew the
+// broker's token after the given number of consecutive failures: an
+// exponential backoff for the first renewRetryAttempts failures, and then
+// renewRetryMax, so that the broker keeps trying without flooding Vault.
+func tokenRetryDelay(failures int) time.Duration {
+	if failures >= renewRetryAttempts {
+		return renewRetryMax
+	}
+	d := renewRetryMin
+	for i := 1; i < failures; i++ {
+		d = nextBackoff(d)
+	}
+	return d
+}
+
+// restartTokenRenewal stops renewing the broker's previous token, if any, and
+// starts renewing its current token.
+func (b *Broker) restartTokenRenewal() {
+	b.tokenLock.Lock()
+	defer b.tokenLock.Unlock()
+
+	if b.tokenStopCh != nil {
+		close(b.tokenStopCh)
+	}
+	stopCh := make(chan struct{})
+	b.tokenStopCh = stopCh
+	b.goRenewer(func() { b.renewVaultToken(stopCh) })
+}
+
+// vault returns the client to talk to Vault with. Callers must not change its
+// token, see setVaultToken.
+func (b *Broker) vault() *api.Client {
+	b.vaultLock.RLock()
+	defer b.vaultLock.RUnlock()
+	return b.vaultClient
+}
+
+// vaultToken returns the broker's current token.
+func (b *Broker) vaultToken() string {
+	return b.vault().Token()
+}
+
+// setVaultToken replaces the broker's token. Requests being built with the
+// previous client may still read its token, so the client is copied rather
+// than changed, and requests started afterwards use the new token.
+func (b *Broker) setVaultToken(token string) {
+	b.vaultLock.Lock()
+	defer b.vaultLock.Unlock()
+	client := *b.vaultClient
+	client.SetToken(token)
+	b.vaultClient = &client
+}
+
+// reloadVaultToken replaces the broker's token and restarts its renewal. The
+// renewals of binding tokens are not affected. It reports whether the token
+// changed.
+func (b *Broker) reloadVaultToken(token string) bool {
+	if token == "" || token == b.vaultToken() {
+		return false
+	}
+	b.log.Printf("[INFO] replacing the broker's vault token")
+	b.setVaultToken(token)
+	if b.vaultRenewToken {
+		b.restartTokenRenewal()
+	}
+	return true
+}
+
+// renewUntilDone renews the broker's token until renewal gives up, which
+// happens once the token reaches its max TTL. It returns false if the broker
+// or renewal was stopped.
+func (b *Broker) renewUntilDone(secret *api.Secret, stopCh <-chan struct{}) bool {
+	lease := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	_, stopped := b.renewToken(secret.Auth.ClientToken, secret.Auth.Accessor, lease, stopCh)
+	return !stopped
+}
+
+// relogin logs in to Vault again and replaces the broker's token, retrying
+// with an exponential backoff. It returns false if the broker or renewal was
+// stopped.
+func (b *Broker) relogin(stopCh <-chan struct{}) bool {
+	backoff := renewRetryMin
+	for {
+		b.log.Printf("[INFO] renew-token: logging in to vault for a new token")
+		token, err := b.vaultLogin()
+		if err == nil {
+			b.setVaultToken(token)
+			return true
+		}
+
+		b.log.Printf("[ERR] renew-token: failed to login to vault, retrying in %s: %s", backoff, err)
+		if !b.sleepOrStop(backoff, stopCh) {
+			return false
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// shouldRenewToken inspects the data returned by a token lookup and reports
+// whether the token needs to be renewed. If it does not, the reason is
+// returned.
+func shouldRenewToken(data map[string]interface{}) (bool, string) {
+	if expireTime, ok := data["expire_time"]; ok && expireTime == nil {
+		return false, "will never expire"
+	}
+	if renewable, ok := data["renewable"].(bool); ok && !renewable {
+		return false, "is not renewable"
+	}
+	return true, ""
+}
+
+// sleepOrStop sleeps for the given duration. It returns false if the broker or
+// the given stop channel is stopped first.
+func (b *Broker) sleepOrStop(d time.Duration, stopCh <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stopCh:
+		return false
+	case <-b.stopCh:
+		return false
+	}
+}
+
+// renewJitterWindow returns the window over which first renewals are spread,
+// scaling it with the number of bindings if none is configured.
+func (b *Broker) renewJitterWindow() time.Duration {
+	if b.renewJitter > 0 {
+		return b.renewJitter
+	}
+	b.bindLock.Lock()
+	n := len(b.binds)
+	b.bindLock.Unlock()
+
+	window := time.Duration(n) * renewJitterPerBinding
+	if window < renewJitterMin {
+		window = renewJitterMin
+	}
+	return window
+}
+
+// renewJitterDelay returns a random delay in [0, window).
+func renewJitterDelay(window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	return time.Duration(jitterRand.Int63n(int64(window)))
+}
+
+// nextBackoff doubles the given backoff, up to renewRetryMax.
+func nextBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d > renewRetryMax {
+		d = renewRetryMax
+	}
+	return d
+}
+
+// writeBindingInfo stores the binding info at the given path, encrypted with
+// the binding transit key if one is configured.
+func (b *Broker) writeBindingInfo(key string, info *bindingInfo) error {
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode binding json")
+	}
+	data := map[string]interface{}{
+		"json": string(payload),
+	}
+	if b.bindingTransitKey != "" {
+		ciphertext, err := b.encryptBindingInfo(payload)
+		if err != nil {
+			return err
+		}
+		data = map[string]interface{}{
+			"ciphertext": ciphertext,
+		}
+	}
+	if err := b.store.Write(key, data); err != nil {
+		return errors.Wrapf(err, "failed to commit binding %s", b.store.Path(key))
+	}
+	return nil
+}
+
+// openBindingInfo decodes stored binding info, decrypting it if it was
+// encrypted. Binding info stored in plaintext, for example before encryption
+// was enabled, has no ciphertext and is decoded as is. It returns true if the
+// info was encrypted.
+func (b *Broker) openBindingInfo(m map[string]interface{}) (*bindingInfo, bool, error) {
+	data, ok := m["ciphertext"]
+	if !ok {
+		info, err := decodeBindingInfo(m)
+		return info, false, err
+	}
+
+	ciphertext, ok := data.(string)
+	if !ok {
+		return nil, true, fmt.Errorf("ciphertext is %T, not string", data)
+	}
+	payload, err := b.decryptBindingInfo(ciphertext)
+	if err != nil {
+		return nil, true, err
+	}
+	info, err := decodeBindingInfo(map[string]interface{}{
+		"json": string(payload),
+	})
+	return info, true, err
+}
+
+// encryptBindingInfo encrypts the payload with the binding transit key.
+func (b *Broker) encryptBindingInfo(payload []byte) (string, error) {
+	path := b.bindingTransitMount + "/encrypt/" + b.bindingTransitKey
+	secret, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString(payload),
+	})
 	if err != nil {
-		b.log.Printf("[ERR] renew-token: failed to lookup client vault token: %s", err)
-		return
+		return "", errors.Wrapf(err, "failed to encrypt binding info with %s", path)
+	}
+	if secret == nil {
+		return "", fmt.Errorf("no ciphertext returned by %s", path)
 	}
-	if expireTime, ok := secret.Data["expire_time"]; ok && expireTime == nil {
-		b.log.Printf("[INFO] renew-token: vault token will never expire so doesn't need to be renewed, stopping renewal process")
-		return
+	ciphertext, ok := secret.Data["ciphertext"].(string)
+	if !ok {
+		return "", fmt.Errorf("ciphertext returned by %s is %T, not string", path, secret.Data["ciphertext"])
 	}
+	return ciphertext, nil
+}
 
-	secret, err = b.vaultClient.Auth().Token().RenewSelf(0)
+// decryptBindingInfo decrypts a ciphertext created by encryptBindingInfo.
+func (b *Broker) decryptBindingInfo(ciphertext string) ([]byte, error) {
+	if b.bindingTransitKey == "" {
+		return nil, fmt.Errorf("binding info is encrypted but BINDING_TRANSIT_KEY is not set")
+	}
+	path := b.bindingTransitMount + "/decrypt/" + b.bindingTransitKey
+	secret, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
 	if err != nil {
-		b.log.Printf("[ERR] renew-token: failed to renew client vault token: %s", err)
-		return
+		return nil, errors.Wrapf(err, "failed to decrypt binding info with %s", path)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no plaintext returned by %s", path)
+	}
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("plaintext returned by %s is %T, not string", path, secret.Data["plaintext"])
 	}
-	if secret.Auth == nil {
-		b.log.Printf("[ERR] renew-token: renew-self came back with empty auth")
-		return
+	payload, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode plaintext returned by %s", path)
 	}
-	b.renewAuth(secret.Auth.ClientToken, secret.Auth.Accessor, nil)
+	return payload, nil
 }
 
 func decodeBindingInfo(m map[string]interface{}) (*bindingInfo, error) {
@@ -753,18 +3724,22 @@ func decodeInstanceInfo(m map[string]interface{}) (*instanceInfo, error) {
 	return &info, nil
 }
 
-func mapToKV(m map[string]string, joiner string) string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
+// vaultErrorCode returns the HTTP status code of an error returned by the Vault
+// API client, or 0 if the error does not carry one.
+func vaultErrorCode(err error) int {
+	if err == nil {
+		return 0
 	}
-	sort.Strings(keys)
-
-	r := make([]string, len(keys))
-	for i, k := range keys {
-		r[i] = fmt.Sprintf("%s=%s", k, m[k])
+	msg := err.Error()
+	i := strings.Index(msg, "Code: ")
+	if i < 0 {
+		return 0
+	}
+	var code int
+	if _, err := fmt.Sscanf(msg[i:], "Code: %d", &code); err != nil {
+		return 0
 	}
-	return strings.Join(r, joiner)
+	return code
 }
 
 // error wraps the given error into the logger and returns it. Vault likes to
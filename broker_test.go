@@ -3,13 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"text/template"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/pivotal-cf/brokerapi"
@@ -19,7 +26,7 @@ func TestBroker_Start_Stop(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
 
-	if err := env.Broker.Start(); err != nil {
+	if err := env.Broker.Start(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 	if err := env.Broker.Stop(); err != nil {
@@ -27,6 +34,131 @@ func TestBroker_Start_Stop(t *testing.T) {
 	}
 }
 
+func TestBroker_ReloadVaultToken(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	if err := env.Broker.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer env.Broker.Stop()
+
+	env.Broker.tokenLock.Lock()
+	stopCh := env.Broker.tokenStopCh
+	env.Broker.tokenLock.Unlock()
+
+	if !env.Broker.reloadVaultToken("new-token") {
+		t.Fatal("expected the token to change")
+	}
+	if env.Broker.vaultToken() != "new-token" {
+		t.Fatalf("expected %q but received %q", "new-token", env.Broker.vaultToken())
+	}
+	select {
+	case <-stopCh:
+	default:
+		t.Fatal("expected the renewal of the previous token to be stopped")
+	}
+
+	if env.Broker.reloadVaultToken("new-token") {
+		t.Fatal("expected the token to be unchanged")
+	}
+}
+
+func TestBroker_Restore_Threshold(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.restoreConcurrency = 4
+
+	// The fake server does not know the "broken" instance, so one of the three
+	// restores fails
+	if err := env.Broker.restore(context.Background(), []string{"foo", "broken"}); err == nil {
+		t.Fatal("expected the restore to fail")
+	}
+
+	env.Broker.restoreFailureThreshold = 0.5
+	if err := env.Broker.restore(context.Background(), []string{"foo", "broken"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := env.Broker.instances["foo"]; !ok {
+		t.Fatal("expected instance foo to be restored")
+	}
+}
+
+func TestBroker_Start_Cancel(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Cancel the start while instance foo is restored
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "GET" && r.URL.Path == "/v1/cf/broker/foo" && r.URL.RawQuery == "" {
+			cancel()
+		}
+	})
+
+	err := env.Broker.Start(ctx)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected the start to be cancelled but got %v", err)
+	}
+	if env.Requests.contains("GET /v1/cf/broker/foo?list=true") {
+		t.Fatal("expected the bindings of instance foo to not be listed")
+	}
+	if env.Requests.contains("GET /v1/cf/broker/foo/foo") {
+		t.Fatal("expected the bindings of instance foo to not be restored")
+	}
+}
+
+func TestBroker_Start_CancelWait(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Vault never becomes ready, so the start waits until it is cancelled
+	env.Broker.vaultStartupWait = time.Minute
+	env.Broker.vaultStartupPollInterval = 5 * time.Millisecond
+	env.Broker.healthProbeInterval = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := env.Broker.Start(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected %v but received %v", context.DeadlineExceeded, err)
+	}
+	if env.Broker.running || env.Broker.stopCh != nil {
+		t.Fatal("expected the broker to not be running")
+	}
+	if n := atomic.LoadInt32(&env.Broker.renewersActive); n != 0 {
+		t.Fatalf("expected no renewers but %d are running", n)
+	}
+}
+
+func TestBroker_Start_Failed(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The binding encryption key cannot be created, so nothing is left
+	// running
+	env.Broker.bindingTransitMount = "transit"
+	env.Broker.bindingTransitKey = "unknown"
+	env.Broker.healthProbeInterval = time.Minute
+	if err := env.Broker.Start(context.Background()); err == nil {
+		t.Fatal("expected the start to fail")
+	}
+	if env.Broker.running || env.Broker.stopCh != nil {
+		t.Fatal("expected the broker to not be running")
+	}
+	if n := atomic.LoadInt32(&env.Broker.renewersActive); n != 0 {
+		t.Fatalf("expected no renewers but %d are running", n)
+	}
+}
+
+func TestTrimKeys(t *testing.T) {
+	keys := trimKeys([]string{"foo", "foo/", "/bar/"})
+	if !reflect.DeepEqual(keys, []string{"foo", "bar"}) {
+		t.Fatalf("expected [foo bar] but received %v", keys)
+	}
+}
+
 func TestBroker_Services(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
@@ -35,6 +167,141 @@ func TestBroker_Services(t *testing.T) {
 	if len(services) != 1 {
 		t.Fatalf("expected 1 service but received %d", len(services))
 	}
+	if services[0].Metadata != nil || services[0].Plans[0].Metadata != nil {
+		t.Fatalf("expected no metadata but received %+v", services[0])
+	}
+}
+
+func TestBroker_Services_Metadata(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.serviceMetadata = &brokerapi.ServiceMetadata{
+		DisplayName: "Vault",
+		ImageUrl:    "https://example.com/vault.png",
+	}
+	env.Broker.plans[0].Bullets = []string{"KV secrets", "Transit encryption"}
+
+	services := env.Broker.Services(env.Context)
+	b, err := json.Marshal(services[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Metadata map[string]interface{} `json:"metadata"`
+		Plans    []struct {
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"plans"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"displayName": "Vault",
+		"imageUrl":    "https://example.com/vault.png",
+	}
+	if !reflect.DeepEqual(decoded.Metadata, expected) {
+		t.Fatalf("expected %v but received %v", expected, decoded.Metadata)
+	}
+	expected = map[string]interface{}{
+		"bullets": []interface{}{"KV secrets", "Transit encryption"},
+	}
+	if !reflect.DeepEqual(decoded.Plans[0].Metadata, expected) {
+		t.Fatalf("expected %v but received %v", expected, decoded.Plans[0].Metadata)
+	}
+}
+
+func TestBroker_Services_Costs(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	if free := env.Broker.Services(env.Context)[0].Plans[0].Free; free == nil || !*free {
+		t.Fatal("expected the plan to be free by default")
+	}
+
+	env.Broker.plans[0].Free = brokerapi.FreeValue(false)
+	env.Broker.plans[0].Costs = []PlanCost{
+		{Amount: map[string]float64{"usd": 99.5}, Unit: "MONTHLY"},
+	}
+	plan := env.Broker.Services(env.Context)[0].Plans[0]
+	if plan.Free == nil || *plan.Free {
+		t.Fatal("expected the plan not to be free")
+	}
+	expected := &brokerapi.ServicePlanMetadata{
+		Costs: []brokerapi.ServicePlanCost{
+			{Amount: map[string]float64{"usd": 99.5}, Unit: "MONTHLY"},
+		},
+	}
+	if !reflect.DeepEqual(plan.Metadata, expected) {
+		t.Fatalf("expected %+v but received %+v", expected, plan.Metadata)
+	}
+}
+
+func TestBroker_Services_Plans(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans = append(env.Broker.plans, &Plan{
+		Name:    "kv-only",
+		Engines: []SecretEngineType{KV},
+	})
+
+	services := env.Broker.Services(env.Context)
+	if len(services[0].Plans) != 2 {
+		t.Fatalf("expected 2 plans but received %d", len(services[0].Plans))
+	}
+	if services[0].Plans[1].ID != "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only" {
+		t.Fatalf("unexpected plan ID %s", services[0].Plans[1].ID)
+	}
+
+	plan, err := env.Broker.findPlan("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Name != "shared" {
+		t.Fatalf("expected the default plan but received %s", plan.Name)
+	}
+	plan, err = env.Broker.findPlan(services[0].Plans[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Name != "kv-only" {
+		t.Fatalf("expected kv-only but received %s", plan.Name)
+	}
+	if _, err := env.Broker.findPlan("nope"); err == nil {
+		t.Fatal("expected an error for an unknown plan")
+	}
+
+	details := brokerapi.ProvisionDetails{
+		PlanID:           services[0].Plans[1].ID,
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{
+		PlanID: services[0].Plans[1].ID,
+	}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_Deprovision_RecordedPlan(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The instance has no recorded plan, so it uses the default plan instead
+	// of the one in the request
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{
+		PlanID: "unknown-plan",
+	}, env.Async); err != nil {
+		t.Fatal(err)
+	}
 }
 
 func TestBroker_Provision_Deprovision(t *testing.T) {
@@ -53,6 +320,10 @@ func TestBroker_Provision_Deprovision(t *testing.T) {
 		t.Fatalf("%+v differs from %+v", provSpec, brokerapi.ProvisionedServiceSpec{})
 	}
 
+	if n := env.Requests.count("GET /v1/sys/mounts"); n != 1 {
+		t.Fatalf("expected the mount table to be listed once but was listed %d times", n)
+	}
+
 	deProvSpec, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async)
 	if err != nil {
 		t.Fatal(err)
@@ -60,79 +331,2307 @@ func TestBroker_Provision_Deprovision(t *testing.T) {
 	if !reflect.DeepEqual(deProvSpec, brokerapi.DeprovisionServiceSpec{}) {
 		t.Fatalf("%+v differs from %+v", deProvSpec, brokerapi.DeprovisionServiceSpec{})
 	}
+
+	// The instance's bindings are revoked and deleted
+	if !env.Requests.contains("POST /v1/auth/token/revoke-accessor") {
+		t.Fatal("expected the binding's token to be revoked")
+	}
+	if !env.Requests.contains("DELETE /v1/cf/broker/instance-id/binding-id") {
+		t.Fatal("expected the binding info to be deleted")
+	}
 }
 
-func TestBroker_Bind_Unbind(t *testing.T) {
+func TestBroker_Provision_ExtraMounts(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
 
-	// Seed the broker with the results of provisioning an instance
-	// so binding can succeed.
-	env.Broker.instances["instance-id"] = &instanceInfo{
-		SpaceGUID:        "space-guid",
-		OrganizationGUID: "organization-guid",
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		RawParameters:    []byte(`{"extra_mounts": [{"name": "config", "type": "generic"}]}`),
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("POST /v1/sys/mounts/cf/instance-id/config") {
+		t.Fatal("expected the extra mount to be mounted")
+	}
+	expected := []ExtraMount{{Name: "config", Type: KV}}
+	if extras := env.Broker.instances["instance-id"].ExtraMounts; !reflect.DeepEqual(extras, expected) {
+		t.Fatalf("expected %v to be recorded but received %v", expected, extras)
 	}
 
-	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	// Provisioning again with different parameters conflicts
+	details.RawParameters = nil
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != brokerapi.ErrInstanceAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrInstanceAlreadyExists, err)
+	}
+
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("DELETE /v1/sys/mounts/cf/instance-id/config") {
+		t.Fatal("expected the extra mount to be removed")
+	}
+}
+
+func TestBroker_Provision_Timestamps(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var written map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/v1/cf/broker/instance-id" {
+			json.NewDecoder(r.Body).Decode(&written)
+		}
+	})
+
+	before := time.Now()
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	info := env.Broker.instances["instance-id"]
+	if info.CreatedAt.Before(before) || !info.UpdatedAt.Equal(info.CreatedAt) {
+		t.Fatalf("expected the provision time to be recorded but received %v and %v", info.CreatedAt, info.UpdatedAt)
+	}
+	stored, err := decodeInstanceInfo(written)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if binding.SyslogDrainURL != "" {
-		t.Fatalf("expected empty SyslogDrainURL but received %s", binding.SyslogDrainURL)
+	if !stored.CreatedAt.Equal(info.CreatedAt) {
+		t.Fatalf("expected %v to be stored but received %v", info.CreatedAt, stored.CreatedAt)
 	}
-	if binding.RouteServiceURL != "" {
-		t.Fatalf("expected empty RouteServiceURL but received %s", binding.RouteServiceURL)
+
+	// Instances stored before the timestamps were recorded have none
+	stored, err = decodeInstanceInfo(map[string]interface{}{
+		"json": `{"OrganizationGUID": "organization-guid", "SpaceGUID": "space-guid"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
-	if len(binding.VolumeMounts) != 0 {
-		t.Fatalf("expected no VolumeMounts but received %+v", binding.VolumeMounts)
+	if !stored.CreatedAt.IsZero() || !stored.UpdatedAt.IsZero() {
+		t.Fatalf("expected no timestamps but received %v and %v", stored.CreatedAt, stored.UpdatedAt)
 	}
-	credMap, ok := binding.Credentials.(map[string]interface{})
-	if !ok {
-		t.Fatalf("expected a credential map but received %+v", binding.Credentials)
+}
+
+func TestBroker_Provision_TransitKey(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	key := &TransitKey{Name: "app", Type: "ed25519", AutoRotatePeriod: "720h"}
+	if err := key.validate(); err != nil {
+		t.Fatal(err)
 	}
-	shared, ok := credMap["backends_shared"]
-	if !ok {
-		t.Fatalf("expected backends_shared but they're not in %+v", credMap)
+	env.Broker.plans[0].TransitKey = key
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
 	}
-	sharedMap, ok := shared.(map[string]interface{})
-	if !ok {
-		t.Fatalf("expected a backends_shared map but received %+v", shared)
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
 	}
-	if sharedMap["organization"] != "cf/organization-guid/secret" {
-		t.Fatalf("expected cf/space-guid/secret but received %s", sharedMap["organization"])
+	if !env.Requests.contains("PUT /v1/cf/instance-id/transit/keys/app") {
+		t.Fatal("expected the transit key to be created")
 	}
-	if sharedMap["space"] != "cf/space-guid/secret" {
-		t.Fatalf("expected cf/space-guid/secret but received %s", sharedMap["space"])
+	if !env.Requests.contains("PUT /v1/cf/instance-id/transit/keys/app/config") {
+		t.Fatal("expected the transit key rotation to be configured")
 	}
+}
 
-	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+func TestBroker_Provision_SSH(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].Engines = []SecretEngineType{KV, SSH}
+	env.Broker.sshAllowedUsers = []string{"vcap", "app"}
+	env.Broker.sshCertTTL = time.Hour
+	var role map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.URL.Path == "/v1/cf/instance-id/ssh/roles/cf-bind" {
+			json.NewDecoder(r.Body).Decode(&role)
+		}
+	})
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{
+		"POST /v1/sys/mounts/cf/instance-id/ssh",
+		"PUT /v1/cf/instance-id/ssh/config/ca",
+		"PUT /v1/cf/instance-id/ssh/roles/cf-bind",
+	} {
+		if !env.Requests.contains(r) {
+			t.Errorf("expected %s", r)
+		}
+	}
+
+	// The role only signs user certificates for the configured users, which
+	// expire
+	expected := map[string]interface{}{
+		"key_type":                "ca",
+		"allow_user_certificates": true,
+		"allow_host_certificates": false,
+		"allowed_users":           "vcap,app",
+		"default_user":            "vcap",
+		"ttl":                     float64(3600),
+		"max_ttl":                 float64(3600),
+	}
+	if !reflect.DeepEqual(role, expected) {
+		t.Fatalf("expected role %v but received %v", expected, role)
+	}
+
+	// The existing CA is kept
+	if err := env.Broker.putSSHCA(env.InstanceID, env.Broker.plans[0]); err != nil {
 		t.Fatal(err)
 	}
 }
 
-func TestBroker_Update(t *testing.T) {
+func TestBroker_Provision_PKI(t *testing.T) {
 	env, closer := defaultEnvironment(t)
 	defer closer()
 
-	spec, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, env.Async)
-	if err != nil {
+	env.Broker.plans[0].Engines = []SecretEngineType{KV, PKI}
+	env.Broker.pkiAllowedDomains = []string{"apps.example.com"}
+	env.Broker.pkiCertTTL = 72 * time.Hour
+	env.Broker.pkiCATTL = 720 * time.Hour
+	var ca, role map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/cf/instance-id/pki/root/generate/internal":
+			json.NewDecoder(r.Body).Decode(&ca)
+		case "/v1/cf/instance-id/pki/roles/cf-bind":
+			json.NewDecoder(r.Body).Decode(&role)
+		}
+	})
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(spec, brokerapi.UpdateServiceSpec{}) {
-		t.Fatalf("%+v differs from %+v", spec, brokerapi.UpdateServiceSpec{})
+	for _, r := range []string{
+		"POST /v1/sys/mounts/cf/instance-id/pki",
+		"PUT /v1/cf/instance-id/pki/root/generate/internal",
+		"PUT /v1/cf/instance-id/pki/roles/cf-bind",
+	} {
+		if !env.Requests.contains(r) {
+			t.Errorf("expected %s", r)
+		}
+	}
+	if ca["ttl"] != float64(720*3600) {
+		t.Fatalf("expected the CA TTL but received %v", ca)
+	}
+
+	// The role only issues certificates for the configured domains, which
+	// expire
+	expected := map[string]interface{}{
+		"allowed_domains":  "apps.example.com",
+		"allow_subdomains": true,
+		"ttl":              float64(72 * 3600),
+		"max_ttl":          float64(72 * 3600),
+	}
+	if !reflect.DeepEqual(role, expected) {
+		t.Fatalf("expected role %v but received %v", expected, role)
+	}
+
+	// The existing CA is kept
+	if err := env.Broker.putPKIRole(env.InstanceID, env.Broker.plans[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := env.Requests.count("PUT /v1/cf/instance-id/pki/root/generate/internal"); n != 1 {
+		t.Fatalf("expected the CA to be generated once but it was generated %d times", n)
+	}
+}
+
+func TestBroker_Provision_SealWrap(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].SealWrap = true
+	env.Broker.plans[0].Local = true
+
+	bodies := make(map[string]map[string]interface{})
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method != "POST" || !strings.HasPrefix(r.URL.Path, "/v1/sys/mounts/") {
+			return
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		bodies[strings.TrimPrefix(r.URL.Path, "/v1/sys/mounts/")] = body
+	})
+
+	// Plans with seal_wrap are refused if Vault cannot seal-wrap
+	env.Broker.sealWrapErr = errors.New("seal_wrap requires Vault Enterprise")
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err == nil {
+		t.Fatal("expected an error for seal_wrap without Vault Enterprise")
+	}
+	if len(bodies) != 0 {
+		t.Fatalf("expected nothing to be mounted but received %v", bodies)
+	}
+
+	env.Broker.sealWrapErr = nil
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	instance := bodies["cf/instance-id/secret"]
+	if instance["seal_wrap"] != true || instance["local"] != true {
+		t.Fatalf("expected a seal-wrapped local mount but received %v", instance)
+	}
+
+	// The shared mounts are not the plan's
+	org := bodies["cf/organization-guid/secret"]
+	if org["seal_wrap"] != nil || org["local"] != false {
+		t.Fatalf("expected a default mount but received %v", org)
+	}
+}
+
+func TestBroker_KVVersion(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].KVVersion = 2
+
+	var body map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/v1/sys/mounts/cf/instance-id/secret" {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	options := map[string]interface{}{"version": "2"}
+	if body["type"] != "kv" || !reflect.DeepEqual(body["options"], options) {
+		t.Fatalf("expected a version 2 kv mount but received %v", body)
+	}
+	if v := env.Broker.instances["instance-id"].KVVersion; v != 2 {
+		t.Fatalf("expected the instance to record version 2 but received %d", v)
+	}
+
+	credentials := func() map[string]interface{} {
+		binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+			t.Fatal(err)
+		}
+		return binding.Credentials.(map[string]interface{})
+	}
+
+	// Version 2 points the generic backend at its data
+	c := credentials()
+	if c["kv_version"] != 2 || c["backends"].(map[string]interface{})["generic"] != "cf/instance-id/secret/data" {
+		t.Fatalf("expected version 2 credentials but received %v", c)
+	}
+
+	// Instances created with version 1 keep it, whatever the plan says
+	env.Broker.instances["instance-id"].KVVersion = 0
+	c = credentials()
+	if c["kv_version"] != 1 || c["backends"].(map[string]interface{})["generic"] != "cf/instance-id/secret" {
+		t.Fatalf("expected version 1 credentials but received %v", c)
+	}
+}
+
+func TestBroker_Provision_AWS(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].Engines = []SecretEngineType{KV, AWS}
+	env.Broker.awsRoleARN = "arn:aws:iam::123456789012:role/app"
+	env.Broker.awsRegion = "eu-west-1"
+	var policy string
+	env.Requests.setHook(func(r *http.Request) {
+		if r.URL.Path == "/v1/sys/policy/cf-instance-id" {
+			var body struct {
+				Rules string `json:"rules"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			policy = body.Rules
+		}
+	})
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{
+		"POST /v1/sys/mounts/cf/instance-id/aws",
+		"PUT /v1/cf/instance-id/aws/config/root",
+		"PUT /v1/cf/instance-id/aws/roles/cf-bind",
+	} {
+		if !env.Requests.contains(r) {
+			t.Errorf("expected %s", r)
+		}
+	}
+
+	// Bindings may not change the engine's configuration
+	for _, s := range []string{
+		"path \"cf/instance-id/aws/config/*\" {\n  capabilities = [\"deny\"]",
+		"path \"cf/instance-id/aws/roles/*\" {\n  capabilities = [\"deny\"]",
+	} {
+		if !strings.Contains(policy, s) {
+			t.Errorf("expected the policy to contain %q but received\n%s", s, policy)
+		}
+	}
+}
+
+func TestBroker_Provision_InvalidParameters(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+		RawParameters:    []byte(`{"mounts": []}`),
+	}
+	_, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response but received %#v", err)
+	}
+	if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+		t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+	}
+	if env.Requests.contains("PUT /v1/sys/policy/cf-instance-id") {
+		t.Fatal("expected nothing to be created for invalid parameters")
+	}
+}
+
+func TestBroker_Provision_InvalidIDs(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	cases := []struct {
+		name       string
+		instanceID string
+		orgGUID    string
+		spaceGUID  string
+	}{
+		{"quote", "x/*\" { capabilities = [\"sudo\"] }\npath \"sys/*", env.OrganizationGUID, env.SpaceGUID},
+		{"newline", env.InstanceID, "org\nguid", env.SpaceGUID},
+		{"slash", env.InstanceID, env.OrganizationGUID, "../sys"},
+		{"dots", "..", env.OrganizationGUID, env.SpaceGUID},
+		{"empty", env.InstanceID, env.OrganizationGUID, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			details := brokerapi.ProvisionDetails{
+				OrganizationGUID: tc.orgGUID,
+				SpaceGUID:        tc.spaceGUID,
+			}
+			_, err := env.Broker.Provision(env.Context, tc.instanceID, details, env.Async)
+			failure, ok := err.(*brokerapi.FailureResponse)
+			if !ok {
+				t.Fatalf("expected a failure response but received %#v", err)
+			}
+			if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+				t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+			}
+		})
+	}
+	if env.Requests.contains("PUT /v1/sys/policy/") {
+		t.Fatal("expected no policy to be written for invalid IDs")
+	}
+}
+
+func TestBroker_Provision_TokenRole(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.tokenMaxTTL = 30 * 24 * time.Hour
+	env.Broker.tokenNumUses = 100
+	env.Broker.tokenNoDefaultPolicy = true
+
+	var role map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/v1/auth/token/roles/cf-instance-id" {
+			if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	_, err := env.Broker.Provision(env.Context, env.InstanceID, brokerapi.ProvisionDetails{
+		OrganizationGUID: env.OrganizationGUID,
+		SpaceGUID:        env.SpaceGUID,
+	}, env.Async)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"allowed_policies":        "cf-instance-id",
+		"period":                  float64(VaultPeriodicTTL),
+		"renewable":               true,
+		"token_explicit_max_ttl":  float64(30 * 24 * 60 * 60),
+		"token_num_uses":          float64(100),
+		"token_no_default_policy": true,
+	}
+	if !reflect.DeepEqual(role, expected) {
+		t.Fatalf("expected %v but received %v", expected, role)
+	}
+}
+
+func TestBroker_Provision_Rollback(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Mounting the instance backends fails, since the fake server does not
+	// implement them for this instance
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, "failing-instance-id", details, env.Async); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+
+	for _, r := range []string{
+		"DELETE /v1/auth/token/roles/cf-failing-instance-id",
+		"DELETE /v1/sys/policy/cf-failing-instance-id",
+	} {
+		if !env.Requests.contains(r) {
+			t.Errorf("expected rollback request %q", r)
+		}
+	}
+	if _, ok := env.Broker.instances["failing-instance-id"]; ok {
+		t.Fatal("expected the failed instance not to be saved")
+	}
+}
+
+func TestBroker_Provision_Cancelled(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Cancel the provision while the policy is being written
+	ctx, cancel := context.WithCancel(env.Context)
+	defer cancel()
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/v1/sys/policy/cf-instance-id" {
+			cancel()
+		}
+	})
+
+	_, err := env.Broker.Provision(ctx, env.InstanceID, brokerapi.ProvisionDetails{
+		OrganizationGUID: env.OrganizationGUID,
+		SpaceGUID:        env.SpaceGUID,
+	}, env.Async)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected the provision to be cancelled but received %v", err)
+	}
+
+	// Nothing after the policy was created, and the policy was rolled back
+	if env.Requests.contains("PUT /v1/auth/token/roles/cf-instance-id") {
+		t.Fatal("expected the token role to not be created")
+	}
+	if env.Requests.contains("POST /v1/sys/mounts/cf/instance-id/secret") {
+		t.Fatal("expected the backends to not be mounted")
+	}
+	if !env.Requests.contains("DELETE /v1/sys/policy/cf-instance-id") {
+		t.Fatal("expected the policy to be rolled back")
+	}
+	if _, ok := env.Broker.instances[env.InstanceID]; ok {
+		t.Fatal("expected the instance to not be cached")
+	}
+}
+
+func TestBroker_OperationContext(t *testing.T) {
+	b := &Broker{operationTimeout: time.Minute}
+
+	ctx, cancel := b.operationContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Fatal("expected the default timeout to be applied")
+	}
+
+	parent, parentCancel := context.WithTimeout(context.Background(), time.Hour)
+	defer parentCancel()
+	ctx, cancel = b.operationContext(parent)
+	defer cancel()
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) < 59*time.Minute {
+		t.Fatal("expected the existing deadline to be kept")
+	}
+}
+
+func TestBroker_Provision_Existing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	// Identical details succeed without recreating anything
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	// The dashboard URL is returned for existing instances too
+	env.Broker.dashboardURL = template.Must(template.New("dashboard").Parse(
+		"https://vault.example.com/ui/vault/secrets/{{.Prefix}}/{{.ServiceInstanceGUID}}?namespace={{.Namespace}}"))
+	env.Broker.vaultNamespace = "team"
+	spec, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "https://vault.example.com/ui/vault/secrets/cf/instance-id?namespace=team"; spec.DashboardURL != expected {
+		t.Fatalf("expected %q but received %q", expected, spec.DashboardURL)
+	}
+
+	// A different plan conflicts
+	env.Broker.plans = append(env.Broker.plans, &Plan{
+		Name:    "kv-only",
+		Engines: []SecretEngineType{KV},
+	})
+	planDetails := details
+	planDetails.PlanID = "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only"
+	_, err = env.Broker.Provision(env.Context, env.InstanceID, planDetails, env.Async)
+	if err != brokerapi.ErrInstanceAlreadyExists {
+		t.Fatalf("expected ErrInstanceAlreadyExists but received %v", err)
+	}
+
+	// Different details conflict
+	details.SpaceGUID = "other-space-guid"
+	_, err = env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	if err != brokerapi.ErrInstanceAlreadyExists {
+		t.Fatalf("expected ErrInstanceAlreadyExists but received %v", err)
+	}
+}
+
+func TestBroker_Bind_Unbind(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Seed the broker with the results of provisioning an instance
+	// so binding can succeed.
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binding.SyslogDrainURL != "" {
+		t.Fatalf("expected empty SyslogDrainURL but received %s", binding.SyslogDrainURL)
+	}
+	if binding.RouteServiceURL != "" {
+		t.Fatalf("expected empty RouteServiceURL but received %s", binding.RouteServiceURL)
+	}
+	if len(binding.VolumeMounts) != 0 {
+		t.Fatalf("expected no VolumeMounts but received %+v", binding.VolumeMounts)
+	}
+	credMap, ok := binding.Credentials.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a credential map but received %+v", binding.Credentials)
+	}
+	shared, ok := credMap["backends_shared"]
+	if !ok {
+		t.Fatalf("expected backends_shared but they're not in %+v", credMap)
+	}
+	sharedMap, ok := shared.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected a backends_shared map but received %+v", shared)
+	}
+	if sharedMap["organization"] != "cf/organization-guid/secret" {
+		t.Fatalf("expected cf/space-guid/secret but received %s", sharedMap["organization"])
+	}
+	if sharedMap["space"] != "cf/space-guid/secret" {
+		t.Fatalf("expected cf/space-guid/secret but received %s", sharedMap["space"])
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_Bind_Unbind_Stress(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	// Every binding's renewal must be stopped once it is unbound
+	for i := 0; i < 100; i++ {
+		if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+			t.Fatal(err)
+		}
+		if !renewing(&env.Broker.renewals, env.BindingID) {
+			t.Fatalf("expected bind %d to be renewed", i)
+		}
+		if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+			t.Fatal(err)
+		}
+		if renewing(&env.Broker.renewals, env.BindingID) {
+			t.Fatalf("expected the renewal of bind %d to be stopped", i)
+		}
+	}
+
+	// Rebinding without an unbind replaces the renewal
+	for i := 0; i < 2; i++ {
+		if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := env.Broker.renewals.queue.Len(); n != 1 {
+		t.Fatalf("expected 1 scheduled renewal but found %d", n)
+	}
+
+	env.Broker.bindLock.Lock()
+	defer env.Broker.bindLock.Unlock()
+	if len(env.Broker.binds) != 1 {
+		t.Fatalf("expected 1 cached binding but found %d", len(env.Broker.binds))
+	}
+}
+
+func TestBroker_Unbind_Twice(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	// Platforms retry unbinds, so the same binding may be unbound twice at once
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Stopping the renewal again does nothing
+	env.Broker.removeBinding(env.BindingID)
+	if renewing(&env.Broker.renewals, env.BindingID) {
+		t.Fatal("expected the renewal to be stopped")
+	}
+}
+
+func TestBroker_Unbind_RevokedAccessor(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.addBinding("revoked-binding-id", &bindingInfo{
+		Binding:  "revoked-binding-id",
+		Accessor: "revoked-accessor",
+	})
+
+	// A token which is already revoked does not prevent the unbind
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, "revoked-binding-id", brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("DELETE /v1/cf/broker/instance-id/revoked-binding-id") {
+		t.Fatal("expected the binding info to be deleted")
+	}
+	if _, ok := env.Broker.binds["revoked-binding-id"]; ok {
+		t.Fatal("expected the binding to be removed from the cache")
+	}
+	if renewing(&env.Broker.renewals, "revoked-binding-id") {
+		t.Fatal("expected the renewal to be stopped")
+	}
+
+	// Other errors still fail the unbind
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, "failing-binding-id", brokerapi.UnbindDetails{}); err == nil {
+		t.Fatal("expected an error for a failed revocation")
+	}
+	if env.Requests.contains("DELETE /v1/cf/broker/instance-id/failing-binding-id") {
+		t.Fatal("expected the binding info to be kept")
+	}
+}
+
+func TestBroker_Bind_Parameters(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.bindAllowedPolicies = []string{"ci"}
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	var role, token map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		var v *map[string]interface{}
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/v1/auth/token/roles/cf-instance-id":
+			v = &role
+		case r.Method == "POST" && r.URL.Path == "/v1/auth/token/create/cf-instance-id":
+			v = &token
+		default:
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// Policies which are not allowed are rejected
+	details := brokerapi.BindDetails{
+		RawParameters: []byte(`{"additional_policies": ["admin"]}`),
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, details); err == nil {
+		t.Fatal("expected an error for a policy which is not allowed")
+	}
+	if token != nil {
+		t.Fatal("expected no token to be created")
+	}
+
+	// The role of the instance is updated to allow the policy at startup
+	if err := env.Broker.migrateTokenRoles(env.Context); err != nil {
+		t.Fatal(err)
+	}
+	if role["allowed_policies"] != "cf-instance-id,ci" {
+		t.Fatalf("expected the role to allow the policy but received %v", role["allowed_policies"])
+	}
+
+	details.RawParameters = []byte(`{"ttl": "1h", "additional_policies": ["ci"]}`)
+	ctx := context.WithValue(env.Context, identityKey{}, "cloudfoundry user admin")
+	if _, err := env.Broker.Bind(ctx, env.InstanceID, env.BindingID, details); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(token["policies"], []interface{}{"cf-instance-id", "ci"}) {
+		t.Fatalf("expected the additional policy but received %v", token["policies"])
+	}
+	if token["ttl"] != "1h0m0s" || token["explicit_max_ttl"] != "1h0m0s" {
+		t.Fatalf("expected a TTL of 1h but received %v and %v", token["ttl"], token["explicit_max_ttl"])
+	}
+	if meta, _ := token["meta"].(map[string]interface{}); meta["cf-originating-identity"] != "cloudfoundry user admin" {
+		t.Fatalf("expected the originating identity in the token metadata but received %v", token["meta"])
+	}
+
+	info := env.Broker.binds[env.BindingID]
+	if info.TTL != time.Hour || !reflect.DeepEqual(info.AdditionalPolicies, []string{"ci"}) {
+		t.Fatalf("expected the parameters to be stored but received %+v", info)
+	}
+	if info.RequestedBy != "cloudfoundry user admin" {
+		t.Fatalf("expected the originating identity to be stored but received %q", info.RequestedBy)
+	}
+	if renewing(&env.Broker.renewals, env.BindingID) {
+		t.Fatal("expected a token with a TTL not to be renewed")
+	}
+}
+
+func TestBroker_Bind_NumUses(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.bindMaxNumUses = 10
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	var token map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/v1/auth/token/create/cf-instance-id" {
+			if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	details := brokerapi.BindDetails{RawParameters: []byte(`{"num_uses": 11}`)}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, details); err == nil {
+		t.Fatal("expected an error for num_uses above the maximum")
+	}
+
+	details.RawParameters = []byte(`{"num_uses": 3}`)
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, details); err != nil {
+		t.Fatal(err)
+	}
+	if token["num_uses"] != float64(3) {
+		t.Fatalf("expected 3 uses but received %v", token["num_uses"])
+	}
+	info := env.Broker.binds[env.BindingID]
+	if info.NumUses != 3 {
+		t.Fatalf("expected the uses to be stored but received %+v", info)
+	}
+	if renewing(&env.Broker.renewals, env.BindingID) {
+		t.Fatal("expected a token with limited uses not to be renewed")
+	}
+
+	// A restored binding keeps its limit and is not renewed either
+	env.Broker.removeBinding(env.BindingID)
+	env.Broker.addBinding(env.BindingID, &bindingInfo{ClientToken: "token", Accessor: "accessor", NumUses: 3})
+	if renewing(&env.Broker.renewals, env.BindingID) {
+		t.Fatal("expected a restored token with limited uses not to be renewed")
+	}
+}
+
+func TestBroker_Bind_DefaultPolicies(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.defaultBindPolicies = []string{"global-config"}
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	var role, token map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		var v *map[string]interface{}
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/v1/auth/token/roles/cf-instance-id":
+			v = &role
+		case r.Method == "POST" && r.URL.Path == "/v1/auth/token/create/cf-instance-id":
+			v = &token
+		default:
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// The role of the instance is updated to allow the policy at startup,
+	// rather than on every bind
+	if err := env.Broker.migrateTokenRoles(env.Context); err != nil {
+		t.Fatal(err)
+	}
+	if role["allowed_policies"] != "cf-instance-id,global-config" {
+		t.Fatalf("expected the role to allow the default policy but received %v", role["allowed_policies"])
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := env.Requests.count("PUT /v1/auth/token/roles/cf-instance-id"); n != 1 {
+		t.Fatalf("expected the role to be written once but it was written %d times", n)
+	}
+	if !reflect.DeepEqual(token["policies"], []interface{}{"cf-instance-id", "global-config"}) {
+		t.Fatalf("expected the default policy but received %v", token["policies"])
+	}
+}
+
+func TestBroker_TokenRoleAllows(t *testing.T) {
+	b := &Broker{
+		defaultBindPolicies: []string{"global-config"},
+		instances:           map[string]*instanceInfo{},
+	}
+	for _, tc := range []struct {
+		data     map[string]interface{}
+		identity bool
+		allows   bool
+	}{
+		{map[string]interface{}{"allowed_policies": []interface{}{"cf-instance-id"}}, false, false},
+		{map[string]interface{}{"allowed_policies": []interface{}{"cf-instance-id", "global-config"}}, false, true},
+		{map[string]interface{}{"allowed_policies": "cf-instance-id,global-config"}, false, true},
+		{map[string]interface{}{"allowed_policies": []interface{}{"cf-instance-id", "global-config"}}, true, false},
+		{map[string]interface{}{
+			"allowed_policies":       []interface{}{"cf-instance-id", "global-config"},
+			"allowed_entity_aliases": []interface{}{"cf-instance-id-*"},
+		}, true, true},
+	} {
+		b.bindIdentity = tc.identity
+		if allows := b.tokenRoleAllows("instance-id", tc.data); allows != tc.allows {
+			t.Errorf("expected %t for %v with identity %t but received %t", tc.allows, tc.data, tc.identity, allows)
+		}
+	}
+}
+
+func TestBroker_Bind_Existing(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	first, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A retry gets the same credentials instead of a second token
+	retried, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(retried.Credentials, first.Credentials) {
+		t.Fatalf("expected %v but received %v", first.Credentials, retried.Credentials)
+	}
+	if n := env.Requests.count("POST /v1/auth/token/create/cf-instance-id"); n != 1 {
+		t.Fatalf("expected 1 token to be created but received %d", n)
+	}
+
+	// Different parameters conflict with the existing binding
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		RawParameters: []byte(`{"ttl": "1h"}`),
+	})
+	if err != brokerapi.ErrBindingAlreadyExists {
+		t.Fatalf("expected %v but received %v", brokerapi.ErrBindingAlreadyExists, err)
+	}
+
+	// While the cache may be missing bindings, the stored ones are found
+	env.Broker.restoreIncomplete = true
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, "stored-binding-id", brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := binding.Credentials.(map[string]interface{})["auth"]
+	if token := auth.(map[string]interface{})["token"]; token != "stored-token" {
+		t.Fatalf("expected the stored token but received %v", token)
+	}
+	if n := env.Requests.count("POST /v1/auth/token/create/cf-instance-id"); n != 1 {
+		t.Fatalf("expected no other token to be created but received %d", n)
+	}
+}
+
+func TestBroker_Bind_MaxBindings(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.maxBindings = 1
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	rejected := func(err error) bool {
+		failure, ok := err.(*brokerapi.FailureResponse)
+		return ok && failure.ValidatedStatusCode(nil) == http.StatusTooManyRequests
+	}
+
+	// The cached bindings count towards the limit
+	env.Broker.binds["other-binding-id"] = &bindingInfo{instanceID: "instance-id"}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); !rejected(err) {
+		t.Fatalf("expected the binding to be rejected but received %v", err)
+	}
+	if env.Requests.contains("POST /v1/auth/token/create/cf-instance-id") {
+		t.Fatal("expected no token to be created")
+	}
+	delete(env.Broker.binds, "other-binding-id")
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// While the cache may be missing bindings, the stored ones are counted
+	env.Broker.restoreIncomplete = true
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, "missing-binding-id", brokerapi.BindDetails{}); !rejected(err) {
+		t.Fatalf("expected the binding to be rejected but received %v", err)
+	}
+	if !env.Requests.contains("GET /v1/cf/broker/instance-id?list=true") {
+		t.Fatal("expected the stored bindings to be listed")
+	}
+
+}
+
+func TestBroker_Bind_AdvertiseAddrTemplate(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.vaultAdvertiseAddrTemplate = template.Must(template.New("advertise").Parse(
+		`{{if eq .SpaceGUID "internal-space"}}vault.internal:8200{{else if eq .OrganizationGUID "other-org"}}{{.DefaultAddr}}/other{{end}}`))
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "internal-space",
+	}
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := binding.Credentials.(map[string]interface{})["address"]; addr != "https://vault.internal:8200/" {
+		t.Fatalf("expected the rendered address but received %v", addr)
+	}
+
+	// Rendered addresses are normalized, and the default address is used if
+	// the template renders nothing
+	for org, expected := range map[string]string{
+		"other-org":         "https://127.0.0.1:8200/other/",
+		"organization-guid": "https://127.0.0.1:8200",
+	} {
+		instance := &instanceInfo{OrganizationGUID: org, SpaceGUID: "space-guid"}
+		if addr := env.Broker.bindingAddr("instance-id", instance, &bindingInfo{Binding: "binding-id"}); addr != expected {
+			t.Errorf("expected %s for %s but received %s", expected, org, addr)
+		}
+	}
+}
+
+func TestBroker_BindIdentity(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	accessor, err := env.Broker.lookupTokenAuthAccessor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessor != "auth_token_1234" {
+		t.Fatalf("expected the accessor of the token auth method but received %q", accessor)
+	}
+	env.Broker.bindIdentity = true
+	env.Broker.tokenAuthAccessor = accessor
+
+	var role, token, alias map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		var m *map[string]interface{}
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/v1/auth/token/roles/cf-instance-id":
+			m = &role
+		case r.Method == "POST" && r.URL.Path == "/v1/auth/token/create/cf-instance-id":
+			m = &token
+		case r.Method == "PUT" && r.URL.Path == "/v1/identity/entity-alias":
+			m = &alias
+		default:
+			return
+		}
+		json.NewDecoder(r.Body).Decode(m)
+	})
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	if err := env.Broker.migrateTokenRoles(env.Context); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is attached to the instance's entity through its own alias
+	if role["allowed_entity_aliases"] != "cf-instance-id-*" {
+		t.Fatalf("expected the role to allow the instance's aliases but received %v", role)
+	}
+	if alias["name"] != "cf-instance-id-binding-id" || alias["canonical_id"] != "entity-id" || alias["mount_accessor"] != accessor {
+		t.Fatalf("unexpected entity alias %v", alias)
+	}
+	if token["entity_alias"] != "cf-instance-id-binding-id" {
+		t.Fatalf("expected the token to be created with its alias but received %v", token)
+	}
+	if id := env.Broker.instances["instance-id"].EntityID; id != "entity-id" {
+		t.Fatalf("expected the entity to be recorded on the instance but received %q", id)
+	}
+	info := env.Broker.binds["binding-id"]
+	if info == nil || info.EntityID != "entity-id" || info.EntityAliasID != "entity-alias-id" {
+		t.Fatalf("expected the entity to be recorded on the binding but received %+v", info)
+	}
+
+	// Unbinding deletes the alias, and deprovisioning the entity
+	if err := env.Broker.revokeBinding(env.InstanceID, env.BindingID, info); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("DELETE /v1/identity/entity-alias/id/entity-alias-id") {
+		t.Fatal("expected the entity alias to be deleted")
+	}
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("DELETE /v1/identity/entity/name/cf-instance-id") {
+		t.Fatal("expected the entity to be deleted")
+	}
+}
+
+func TestBroker_Bind_SSH(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].Engines = []SecretEngineType{KV, SSH}
+	env.Broker.sshAllowedUsers = []string{"vcap"}
+	env.Broker.sshCertTTL = 30 * time.Minute
+	var sign map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.URL.Path == "/v1/cf/instance-id/ssh/sign/cf-bind" {
+			json.NewDecoder(r.Body).Decode(&sign)
+		}
+	})
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	// The public key is required
+	_, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok || failure.ValidatedStatusCode(nil) != http.StatusBadRequest {
+		t.Fatalf("expected a bad request but received %v", err)
+	}
+
+	// Malformed keys are rejected before anything is signed
+	_, err = env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		RawParameters: []byte(`{"ssh_public_key": "ssh-ed25519 AAAA"}`),
+	})
+	if _, ok := err.(*brokerapi.FailureResponse); !ok {
+		t.Fatalf("expected a bad request but received %v", err)
+	}
+	if env.Requests.contains("PUT /v1/cf/instance-id/ssh/sign/cf-bind") {
+		t.Fatal("expected no key to be signed")
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		RawParameters: []byte(`{"ssh_public_key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	expected := map[string]interface{}{
+		"signed_key":    "ssh-ed25519-cert-v01@openssh.com AAAA",
+		"serial_number": "c7:3f:26:25",
+	}
+	if !reflect.DeepEqual(credentials["ssh"], expected) {
+		t.Fatalf("expected %v but received %v", expected, credentials["ssh"])
+	}
+	backends := credentials["backends"].(map[string]interface{})
+	if backends["ssh"] != "cf/instance-id/ssh" {
+		t.Fatalf("expected the ssh backend but received %v", backends)
+	}
+
+	// The key is signed as a user certificate for the configured users
+	expected = map[string]interface{}{
+		"public_key":       "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f",
+		"cert_type":        "user",
+		"valid_principals": "vcap",
+		"ttl":              float64(1800),
+	}
+	if !reflect.DeepEqual(sign, expected) {
+		t.Fatalf("expected signing request %v but received %v", expected, sign)
+	}
+}
+
+func TestBroker_Bind_AWS(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans[0].Engines = []SecretEngineType{KV, AWS}
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	expected := map[string]interface{}{
+		"access_key":     "ASIAEXAMPLE",
+		"secret_key":     "secret",
+		"security_token": "token",
+		"lease_id":       "cf/instance-id/aws/sts/cf-bind/lease-id",
+	}
+	if !reflect.DeepEqual(credentials["aws"], expected) {
+		t.Fatalf("expected %v but received %v", expected, credentials["aws"])
+	}
+
+	// The lease is renewed along with the token
+	env.Broker.renewals.lock.Lock()
+	_, ok := env.Broker.renewals.renewals[leaseKey(env.BindingID)]
+	env.Broker.renewals.lock.Unlock()
+	if !ok {
+		t.Fatal("expected the lease to be renewed")
+	}
+
+	// The lease is revoked on unbind
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, "aws-binding-id", brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("PUT /v1/sys/revoke/cf/instance-id/aws/sts/cf-bind/lease-id") {
+		t.Fatal("expected the lease to be revoked")
+	}
+
+	// An expired lease does not prevent the unbind
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, "expired-binding-id", brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("DELETE /v1/cf/broker/instance-id/expired-binding-id") {
+		t.Fatal("expected the binding info to be deleted")
+	}
+}
+
+func TestBroker_Bind_RecordedPlan(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans = append(env.Broker.plans, &Plan{
+		Name:    "aws",
+		Engines: []SecretEngineType{KV, AWS},
+	})
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	// The instance has no recorded plan, so it uses the default plan instead
+	// of the one in the request and gets no AWS credentials
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.aws",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := binding.Credentials.(map[string]interface{})["aws"]; ok {
+		t.Fatal("expected no AWS credentials for the recorded plan")
+	}
+}
+
+func TestBroker_BindTokenMetadata(t *testing.T) {
+	b := &Broker{log: NewLogger(os.Stdout, LogFormatText, LogLevelDebug)}
+	instance := &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	expected := map[string]string{
+		"cf-instance-id": "instance-id",
+		"cf-binding-id":  "binding-id",
+		"cf-org-guid":    "organization-guid",
+		"cf-space-guid":  "space-guid",
+	}
+	if metadata := b.bindTokenMetadata("instance-id", "binding-id", instance); !reflect.DeepEqual(metadata, expected) {
+		t.Fatalf("expected %v but received %v", expected, metadata)
+	}
+
+	// Names are added where they can be looked up
+	b.nameResolver = fakeNames{}
+	expected["cf-org-name"] = "acme"
+	expected["cf-instance-name"] = "my-vault"
+	if metadata := b.bindTokenMetadata("instance-id", "binding-id", instance); !reflect.DeepEqual(metadata, expected) {
+		t.Fatalf("expected %v but received %v", expected, metadata)
+	}
+}
+
+func TestBroker_DisabledSharedMounts(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.disableOrgMount = true
+	var policy string
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/v1/sys/policy/cf-instance-id" {
+			var body struct {
+				Rules string `json:"rules"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			policy = body.Rules
+		}
+	})
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if env.Requests.contains("POST /v1/sys/mounts/cf/organization-guid/secret") {
+		t.Fatal("expected the organization mount to be skipped")
+	}
+	if !env.Requests.contains("POST /v1/sys/mounts/cf/space-guid/secret") {
+		t.Fatal("expected the space mount to be created")
+	}
+	if strings.Contains(policy, "organization-guid") || !strings.Contains(policy, `path "cf/space-guid/*"`) {
+		t.Fatalf("expected the policy to leave out the organization paths only but received\n%s", policy)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := binding.Credentials.(map[string]interface{})["backends_shared"]
+	expected := map[string]interface{}{"space": "cf/space-guid/secret"}
+	if !reflect.DeepEqual(shared, expected) {
+		t.Fatalf("expected %v but received %v", expected, shared)
+	}
+
+	// Without either shared mount there is nothing to list
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	env.Broker.disableSpaceMount = true
+	binding, err = env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := binding.Credentials.(map[string]interface{})["backends_shared"]; ok {
+		t.Fatalf("expected no backends_shared but received %v", binding.Credentials)
+	}
+}
+
+func TestBroker_Bind_Shared(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	var policy string
+	var role, token map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/policy/cf-instance-id-shared":
+			var body struct {
+				Rules string `json:"rules"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			policy = body.Rules
+		case "/v1/auth/token/roles/cf-instance-id":
+			json.NewDecoder(r.Body).Decode(&role)
+		case "/v1/auth/token/create/cf-instance-id":
+			json.NewDecoder(r.Body).Decode(&token)
+		}
+	})
+
+	// The binding comes from another space which the instance is shared with
+	ctx := context.WithValue(env.Context, platformContextKey{}, &platformContext{
+		Platform:         "cloudfoundry",
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "other-space-guid",
+	})
+	binding, err := env.Broker.Bind(ctx, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(policy, `path "cf/instance-id/*"`) || strings.Contains(policy, "space-guid") {
+		t.Fatalf("expected the shared policy to grant the instance paths only but received\n%s", policy)
+	}
+	if role["allowed_policies"] != "cf-instance-id,cf-instance-id-shared" {
+		t.Fatalf("expected the role to allow the shared policy but received %v", role["allowed_policies"])
+	}
+	if !reflect.DeepEqual(token["policies"], []interface{}{"cf-instance-id-shared"}) {
+		t.Fatalf("expected the token to have the shared policy but received %v", token["policies"])
+	}
+	if shared := env.Broker.instances["instance-id"].SharedSpaces; !reflect.DeepEqual(shared, []string{"other-space-guid"}) {
+		t.Fatalf("expected the space to be recorded but received %v", shared)
+	}
+	if _, ok := binding.Credentials.(map[string]interface{})["backends_shared"]; ok {
+		t.Fatal("expected the shared mounts of the instance's space to be left out")
+	}
+
+	// The shared policy goes with the instance
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if !env.Requests.contains("DELETE /v1/sys/policy/cf-instance-id-shared") {
+		t.Fatal("expected the shared policy to be deleted")
+	}
+}
+
+func TestBroker_Bind_Wrapped(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	var wrapTTL string
+	var wrapped, written map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/sys/wrapping/wrap":
+			wrapTTL = r.Header.Get("X-Vault-Wrap-TTL")
+			json.NewDecoder(r.Body).Decode(&wrapped)
+		case "/v1/cf/broker/instance-id/binding-id":
+			if r.Method == "PUT" {
+				json.NewDecoder(r.Body).Decode(&written)
+			}
+		}
+	})
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{
+		RawParameters: []byte(`{"wrap_ttl": "5m"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapTTL != "300s" {
+		t.Fatalf("expected a wrap TTL of 300s but received %q", wrapTTL)
+	}
+	if auth, _ := wrapped["auth"].(map[string]interface{}); auth["token"] != "ABCD" {
+		t.Fatalf("expected the credentials to be wrapped but received %v", wrapped)
+	}
+
+	// Only the wrapping token is given to the application
+	expected := map[string]interface{}{
+		"address": "https://127.0.0.1:8200",
+		"wrap_info": map[string]interface{}{
+			"token":         "wrapping-token",
+			"ttl":           300,
+			"creation_time": "2018-04-17T11:35:54Z",
+			"unwrap_path":   "sys/wrapping/unwrap",
+		},
+	}
+	if !reflect.DeepEqual(binding.Credentials, expected) {
+		t.Fatalf("expected %v but received %v", expected, binding.Credentials)
+	}
+
+	// Fetching the binding returns the same wrapping token without
+	// unwrapping it
+	var info bindingInfo
+	if err := json.Unmarshal([]byte(written["json"].(string)), &info); err != nil {
+		t.Fatal(err)
+	}
+	credentials := env.Broker.bindingCredentials(env.InstanceID, env.Broker.instances["instance-id"], env.Broker.plans[0], &info)
+	if !reflect.DeepEqual(credentials, expected) {
+		t.Fatalf("expected %v but received %v", expected, credentials)
+	}
+	if env.Requests.contains("POST /v1/sys/wrapping/unwrap") || env.Requests.count("POST /v1/sys/wrapping/wrap") != 1 {
+		t.Fatal("expected the credentials to be wrapped once and never unwrapped")
+	}
+}
+
+func TestBroker_BindingEncryption(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.bindingTransitMount = "transit"
+	env.Broker.bindingTransitKey = "broker"
+
+	var written map[string]interface{}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/v1/cf/broker/instance-id/binding-id" {
+			json.NewDecoder(r.Body).Decode(&written)
+		}
+	})
+
+	info := &bindingInfo{Binding: "binding-id", ClientToken: "token", Accessor: "accessor"}
+	if err := env.Broker.writeBindingInfo("instance-id/binding-id", info); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := written["json"]; ok {
+		t.Fatalf("expected no plaintext to be stored but received %v", written)
+	}
+	if strings.Contains(fmt.Sprint(written["ciphertext"]), `"ClientToken"`) {
+		t.Fatalf("expected the token to be encrypted but received %v", written)
+	}
+
+	// Encrypted info is decrypted
+	opened, encrypted, err := env.Broker.openBindingInfo(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encrypted || !reflect.DeepEqual(opened, info) {
+		t.Fatalf("expected encrypted %+v but received %t %+v", info, encrypted, opened)
+	}
+
+	// Plaintext info stored before encryption was enabled is still read
+	opened, encrypted, err = env.Broker.openBindingInfo(map[string]interface{}{
+		"json": `{"Binding": "binding-id", "ClientToken": "token", "Accessor": "accessor"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted || !reflect.DeepEqual(opened, info) {
+		t.Fatalf("expected plaintext %+v but received %t %+v", info, encrypted, opened)
+	}
+
+	// Encrypted info cannot be read once encryption is disabled
+	env.Broker.bindingTransitKey = ""
+	if _, _, err := env.Broker.openBindingInfo(written); err == nil {
+		t.Fatal("expected an error without the binding transit key")
+	}
+}
+
+func TestIsInvalidAccessorError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		ok   bool
+	}{
+		{
+			"nil",
+			nil,
+			false,
+		},
+		{
+			"invalid-accessor",
+			errors.New("Error making API request.\n\nURL: POST https://127.0.0.1:8200/v1/auth/token/revoke-accessor\nCode: 400. Errors:\n\n* 1 error occurred:\n\n* invalid accessor"),
+			true,
+		},
+		{
+			"not-found",
+			errors.New("Error making API request.\n\nURL: POST https://127.0.0.1:8200/v1/auth/token/revoke-accessor\nCode: 404. Errors:\n\n* not found"),
+			true,
+		},
+		{
+			"server-error",
+			errors.New("Error making API request.\n\nURL: POST https://127.0.0.1:8200/v1/auth/token/revoke-accessor\nCode: 500. Errors:\n\n* invalid accessor"),
+			false,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			if ok := isInvalidAccessorError(tc.err); ok != tc.ok {
+				t.Errorf("expected %t but received %t", tc.ok, ok)
+			}
+		})
+	}
+}
+
+func TestBroker_Bind_Credentials(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	// The CA certificate and namespace are omitted unless configured
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"address": "https://127.0.0.1:8200",
+		"auth": map[string]interface{}{
+			"accessor": "",
+			"token":    "ABCD",
+		},
+		"backends": map[string]interface{}{
+			"generic": "cf/instance-id/secret",
+			"transit": "cf/instance-id/transit",
+		},
+		"backends_shared": map[string]interface{}{
+			"organization": "cf/organization-guid/secret",
+			"space":        "cf/space-guid/secret",
+		},
+		"kv_version": 1,
+	}
+	if !reflect.DeepEqual(binding.Credentials, expected) {
+		t.Fatalf("expected %#v but received %#v", expected, binding.Credentials)
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Broker.vaultAdvertiseCACert = "-----BEGIN CERTIFICATE-----\n..."
+	env.Broker.vaultNamespace = "team-a"
+	binding, err = env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["ca_cert"] = "-----BEGIN CERTIFICATE-----\n..."
+	expected["namespace"] = "team-a"
+	if !reflect.DeepEqual(binding.Credentials, expected) {
+		t.Fatalf("expected %#v but received %#v", expected, binding.Credentials)
+	}
+}
+
+func TestBroker_Bind_Deprovision_Concurrent(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+			if err != nil && err != brokerapi.ErrInstanceDoesNotExist {
+				errCh <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		t.Error(err)
+	}
+	if _, ok := env.Broker.instances["instance-id"]; ok {
+		t.Fatal("expected the instance to be deprovisioned")
+	}
+}
+
+func TestBroker_Bind_MissingInstance(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	_, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != brokerapi.ErrInstanceDoesNotExist {
+		t.Fatalf("expected ErrInstanceDoesNotExist but received %v", err)
+	}
+	if !env.Requests.contains("GET /v1/cf/broker/instance-id") {
+		t.Fatal("expected the instance to be looked up in vault")
+	}
+
+	// Instances which are stored but not cached are restored
+	_, err = env.Broker.Bind(env.Context, "foo", env.BindingID, brokerapi.BindDetails{})
+	if err == brokerapi.ErrInstanceDoesNotExist {
+		t.Fatal("expected instance foo to be restored")
+	}
+	if info := env.Broker.instances["foo"]; info == nil || info.SpaceGUID != "space-guid" {
+		t.Fatalf("expected instance foo to be cached but received %+v", info)
+	}
+}
+
+func TestBroker_Bind_InvalidIDs(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	sharedCtx := context.WithValue(env.Context, platformContextKey{}, &platformContext{
+		Platform:  "cloudfoundry",
+		SpaceGUID: "other-space\" {}\npath \"sys/*",
+	})
+	cases := []struct {
+		name      string
+		ctx       context.Context
+		bindingID string
+	}{
+		{"quote", env.Context, "binding\"-id"},
+		{"newline", env.Context, "binding\nid"},
+		{"shared-space", sharedCtx, env.BindingID},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := env.Broker.Bind(tc.ctx, env.InstanceID, tc.bindingID, brokerapi.BindDetails{})
+			failure, ok := err.(*brokerapi.FailureResponse)
+			if !ok {
+				t.Fatalf("expected a failure response but received %#v", err)
+			}
+			if code := failure.ValidatedStatusCode(nil); code != http.StatusBadRequest {
+				t.Fatalf("expected %d but received %d", http.StatusBadRequest, code)
+			}
+		})
+	}
+	if env.Requests.contains("POST /v1/auth/token/create/cf-instance-id") {
+		t.Fatal("expected no token to be created for invalid IDs")
+	}
+}
+
+func TestCheckTokenSecret(t *testing.T) {
+	for _, secret := range []*api.Secret{
+		nil,
+		&api.Secret{},
+		&api.Secret{Auth: &api.SecretAuth{}},
+	} {
+		if err := checkTokenSecret(secret); err == nil {
+			t.Errorf("expected an error for %#v", secret)
+		}
+	}
+	if err := checkTokenSecret(&api.Secret{Auth: &api.SecretAuth{ClientToken: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBroker_Bind_NoAuth(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	// A Vault which answers the token creation without a token
+	for _, body := range []string{`null`, `{"auth": null}`} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/auth/token/create/cf-instance-id" {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write([]byte(body))
+		}))
+		client, err := api.NewClient(&api.Config{Address: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.Broker.vaultClient = client
+
+		if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err == nil {
+			t.Errorf("expected an error for a response of %s", body)
+		}
+		ts.Close()
+	}
+	if _, ok := env.Broker.binds[env.BindingID]; ok {
+		t.Fatal("expected no binding to be stored")
+	}
+}
+
+func TestBroker_Bind_SelfHeal(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["healing-instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	// Without self-healing, the missing role fails the bind
+	if _, err := env.Broker.Bind(env.Context, "healing-instance-id", env.BindingID, brokerapi.BindDetails{}); err == nil {
+		t.Fatal("expected bind to fail with a missing role")
+	}
+	if env.Requests.contains("PUT /v1/auth/token/roles/cf-healing-instance-id") {
+		t.Fatal("expected the role to not be recreated")
+	}
+
+	env.Broker.bindSelfHeal = true
+	if _, err := env.Broker.Bind(env.Context, "healing-instance-id", env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{
+		"PUT /v1/sys/policy/cf-healing-instance-id",
+		"PUT /v1/auth/token/roles/cf-healing-instance-id",
+	} {
+		if !env.Requests.contains(r) {
+			t.Errorf("expected %s to be requested", r)
+		}
+	}
+	if n := env.Requests.count("POST /v1/auth/token/create/cf-healing-instance-id"); n != 3 {
+		t.Fatalf("expected 3 token create attempts but received %d", n)
+	}
+}
+
+func TestBroker_Unbind_MissingBinding(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	err := env.Broker.Unbind(env.Context, env.InstanceID, "missing-binding-id", brokerapi.UnbindDetails{})
+	if err != brokerapi.ErrBindingDoesNotExist {
+		t.Fatalf("expected ErrBindingDoesNotExist but received %v", err)
+	}
+}
+
+func TestBroker_Update(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	spec, err := env.Broker.Update(env.Context, env.InstanceID, brokerapi.UpdateDetails{}, env.Async)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(spec, brokerapi.UpdateServiceSpec{}) {
+		t.Fatalf("%+v differs from %+v", spec, brokerapi.UpdateServiceSpec{})
+	}
+}
+
+func TestBroker_Update_Plan(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans = append(env.Broker.plans, &Plan{
+		Name:    "full",
+		Engines: []SecretEngineType{KV, Transit, PKI},
+	})
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	details := brokerapi.UpdateDetails{
+		PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.full",
+		PreviousValues: brokerapi.PreviousValues{
+			PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.shared",
+		},
+	}
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if planID := env.Broker.instances["instance-id"].PlanID; planID != details.PlanID {
+		t.Fatalf("expected the new plan %s to be recorded but received %q", details.PlanID, planID)
+	}
+	if env.Broker.instances["instance-id"].UpdatedAt.IsZero() {
+		t.Fatal("expected the update time to be recorded")
+	}
+
+	// The recorded plan is the previous plan, even if the platform claims
+	// otherwise
+	writes := env.Requests.count("PUT /v1/cf/broker/instance-id")
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if n := env.Requests.count("PUT /v1/cf/broker/instance-id"); n != writes {
+		t.Fatal("expected an update to the recorded plan to be a no-op")
+	}
+
+	// Moving to the same plan is a no-op, even for an unknown instance
+	details.PreviousValues.PlanID = details.PlanID
+	if _, err := env.Broker.Update(env.Context, "unknown-instance", details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving an unknown instance is an error, once it is looked up in vault
+	details.PreviousValues.PlanID = ""
+	delete(env.Broker.instances, "instance-id")
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, details, env.Async); err != brokerapi.ErrInstanceDoesNotExist {
+		t.Fatalf("expected ErrInstanceDoesNotExist but received %v", err)
+	}
+	if !env.Requests.contains("GET /v1/cf/broker/instance-id") {
+		t.Fatal("expected the instance to be looked up in vault")
+	}
+}
+
+func TestBroker_Update_RetiredPlan(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The instance has every engine the broker mounts for instances, and an
+	// extra mount, under a plan which is no longer in the catalog
+	var unmounted []string
+	vaultURL, err := url.Parse(env.Broker.vault().Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(vaultURL)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/sys/mounts":
+			w.Write([]byte(`{
+				"cf/instance-id/secret/": {"type": "kv"},
+				"cf/instance-id/transit/": {"type": "transit"},
+				"cf/instance-id/pki/": {"type": "pki"},
+				"cf/instance-id/extra/": {"type": "kv"}
+			}`))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/v1/sys/mounts/"):
+			unmounted = append(unmounted, strings.TrimPrefix(r.URL.Path, "/v1/sys/mounts/"))
+			w.WriteHeader(204)
+		default:
+			proxy.ServeHTTP(w, r)
+		}
+	}))
+	defer ts.Close()
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Broker.vaultClient = client
+	env.Broker.unmountOnUpdate = true
+	env.Broker.plans = append(env.Broker.plans, &Plan{
+		Name:    "kv",
+		Engines: []SecretEngineType{KV},
+	})
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+		PlanID:           "0654695e-0760-a1d4-1cad-5dd87b75ed99.retired",
+	}
+
+	details := brokerapi.UpdateDetails{PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv"}
+	if _, err := env.Broker.Update(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	if planID := env.Broker.instances["instance-id"].PlanID; planID != details.PlanID {
+		t.Fatalf("expected the new plan %s to be recorded but received %q", details.PlanID, planID)
+	}
+	expected := []string{"cf/instance-id/pki", "cf/instance-id/transit"}
+	if !reflect.DeepEqual(unmounted, expected) {
+		t.Fatalf("expected %v to be removed but removed %v", expected, unmounted)
+	}
+}
+
+func TestBroker_Update_Bind_Concurrent(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans = append(env.Broker.plans, &Plan{
+		Name:    "transit",
+		Engines: []SecretEngineType{KV, Transit},
+	})
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		SpaceGUID:        "space-guid",
+		OrganizationGUID: "organization-guid",
+	}
+
+	// Hold the update while it mounts the new backends, and bind from a
+	// space the instance is shared with in the meantime
+	mounting := make(chan struct{})
+	var once sync.Once
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method == "POST" && r.URL.Path == "/v1/sys/mounts/cf/instance-id/transit" {
+			once.Do(func() { close(mounting) })
+			time.Sleep(100 * time.Millisecond)
+		}
+	})
+
+	details := brokerapi.UpdateDetails{
+		PlanID: "0654695e-0760-a1d4-1cad-5dd87b75ed99.transit",
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := env.Broker.Update(env.Context, env.InstanceID, details, env.Async)
+		errCh <- err
+	}()
+	<-mounting
+	ctx := context.WithValue(env.Context, platformContextKey{}, &platformContext{
+		Platform:         "cloudfoundry",
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "other-space-guid",
+	})
+	go func() {
+		_, err := env.Broker.Bind(ctx, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+		errCh <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither operation lost the other's change to the instance
+	env.Broker.instancesLock.Lock()
+	instance := env.Broker.instances["instance-id"]
+	env.Broker.instancesLock.Unlock()
+	if instance.PlanID != details.PlanID {
+		t.Fatalf("expected the plan %s but received %q", details.PlanID, instance.PlanID)
+	}
+	if !reflect.DeepEqual(instance.SharedSpaces, []string{"other-space-guid"}) {
+		t.Fatalf("expected the instance to be shared with other-space-guid but received %v", instance.SharedSpaces)
+	}
+}
+
+func TestBroker_LastOperation(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	lastOperation, err := env.Broker.LastOperation(env.Context, env.InstanceID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lastOperation, brokerapi.LastOperation{}) {
+		t.Fatalf("%+v differs from %+v", lastOperation, brokerapi.LastOperation{})
+	}
+}
+
+func TestBroker_MountConfig(t *testing.T) {
+	b := &Broker{
+		mountDefaultLeaseTTL: time.Hour,
+		mountMaxLeaseTTL:     24 * time.Hour,
+	}
+
+	config := b.mountConfig(Mount{Path: "cf/foo/secret", Type: KV})
+	if config.DefaultLeaseTTL != "3600s" || config.MaxLeaseTTL != "86400s" {
+		t.Fatalf("expected broker TTLs but received %+v", config)
+	}
+
+	config = b.mountConfig(Mount{Path: "cf/foo/secret", Type: KV, MaxLeaseTTL: 2 * time.Hour})
+	if config.DefaultLeaseTTL != "3600s" || config.MaxLeaseTTL != "7200s" {
+		t.Fatalf("expected mount max TTL but received %+v", config)
+	}
+
+	existing := &api.MountOutput{Config: api.MountConfigOutput{DefaultLeaseTTL: 3600, MaxLeaseTTL: 86400}}
+	if mountConfigDiffers(existing, b.mountConfig(Mount{})) {
+		t.Fatal("expected matching TTLs to not differ")
+	}
+	if !mountConfigDiffers(existing, config) {
+		t.Fatal("expected a different max TTL to differ")
+	}
+	if mountConfigDiffers(existing, (&Broker{}).mountConfig(Mount{})) {
+		t.Fatal("expected unset TTLs to be ignored")
+	}
+}
+
+func TestBroker_RemoveUnusedSharedMounts(t *testing.T) {
+	var unmounted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v1/sys/mounts":
+			w.Write([]byte(`{
+				"cf/org-a/secret/": {"type": "kv"},
+				"cf/space-a/secret/": {"type": "kv"},
+				"cf/space-b/secret/": {"type": "kv"}
+			}`))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/v1/sys/mounts/"):
+			unmounted = append(unmounted, strings.TrimPrefix(r.URL.Path, "/v1/sys/mounts/"))
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Broker{
+		log:         NewLogger(os.Stdout, LogFormatText, LogLevelDebug),
+		vaultClient: client,
+		mountPrefix: "cf",
+		instances: map[string]*instanceInfo{
+			"instance-1": {OrganizationGUID: "org-a", SpaceGUID: "space-a"},
+			"instance-2": {OrganizationGUID: "org-a", SpaceGUID: "space-b"},
+		},
+	}
+
+	// The organization is still used by instance-2
+	if err := b.removeUnusedSharedMounts("instance-1", "org-a", "space-a"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unmounted, []string{"cf/space-a/secret"}) {
+		t.Fatalf("expected only the space mount to be removed but removed %v", unmounted)
+	}
+
+	// Nothing is removed if the instances may be incomplete
+	unmounted = nil
+	delete(b.instances, "instance-1")
+	b.restoreIncomplete = true
+	if err := b.removeUnusedSharedMounts("instance-2", "org-a", "space-b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(unmounted) != 0 {
+		t.Fatalf("expected no mounts to be removed but removed %v", unmounted)
+	}
+
+	// The last instance removes both
+	b.restoreIncomplete = false
+	if err := b.removeUnusedSharedMounts("instance-2", "org-a", "space-b"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(unmounted, []string{"cf/space-b/secret", "cf/org-a/secret"}) {
+		t.Fatalf("expected the space and organization mounts to be removed but removed %v", unmounted)
+	}
+}
+
+func TestBroker_Relogin(t *testing.T) {
+	client, err := api.NewClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("expiring-token")
+
+	logins := 0
+	b := &Broker{
+		log:         NewLogger(os.Stdout, LogFormatText, LogLevelDebug),
+		vaultClient: client,
+		vaultLogin: func() (string, error) {
+			logins++
+			return "new-token", nil
+		},
+	}
+	if !b.relogin(nil) {
+		t.Fatal("expected relogin to succeed")
+	}
+	if logins != 1 {
+		t.Fatalf("expected 1 login but received %d", logins)
+	}
+	if b.vaultToken() != "new-token" {
+		t.Fatalf("expected %q but received %q", "new-token", b.vaultToken())
+	}
+	if client.Token() != "expiring-token" {
+		t.Fatal("expected the client in use to keep its token")
+	}
+}
+
+func TestBroker_RenewToken_Increment(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	increments := make(chan int, 10)
+	env.Requests.setHook(func(r *http.Request) {
+		if r.URL.Path == "/v1/auth/token/renew-self" {
+			var body struct {
+				Increment int `json:"increment"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			increments <- body.Increment
+		}
+	})
+	env.Broker.renewIncrement = 7200
+	env.Broker.renewGrace = 100 * time.Millisecond
+	env.Broker.stopCh = make(chan struct{})
+
+	// The token is renewed at half of its lease with the increment, and then
+	// not again until the renewed lease of an hour is half over
+	stopCh := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		renewed, stopped := env.Broker.renewToken("token", "accessor", 400*time.Millisecond, stopCh)
+		done <- renewed && stopped
+	}()
+	select {
+	case increment := <-increments:
+		if increment != 7200 {
+			t.Fatalf("expected an increment of 7200 but received %d", increment)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the token to be renewed")
+	}
+	close(stopCh)
+	if !<-done {
+		t.Fatal("expected the token to be renewed before renewal was stopped")
+	}
+	if n := env.Requests.count("PUT /v1/auth/token/renew-self"); n != 1 {
+		t.Fatalf("expected 1 renewal but received %d", n)
+	}
+
+	// Tokens within the grace of expiring are not renewed
+	if renewed, stopped := env.Broker.renewToken("token", "accessor", 150*time.Millisecond, nil); renewed || stopped {
+		t.Fatalf("expected renewal to give up but received renewed %t and stopped %t", renewed, stopped)
+	}
+}
+
+func TestShouldRenewToken(t *testing.T) {
+	cases := []struct {
+		name  string
+		data  map[string]interface{}
+		renew bool
+	}{
+		{
+			"never-expires",
+			map[string]interface{}{"expire_time": nil, "renewable": true},
+			false,
+		},
+		{
+			"not-renewable",
+			map[string]interface{}{"expire_time": "2018-04-17T11:35:54Z", "renewable": false},
+			false,
+		},
+		{
+			"renewable",
+			map[string]interface{}{"expire_time": "2018-04-17T11:35:54Z", "renewable": true},
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			renew, reason := shouldRenewToken(tc.data)
+			if renew != tc.renew {
+				t.Errorf("expected %t but received %t (%s)", tc.renew, renew, reason)
+			}
+		})
+	}
+}
+
+func TestTokenRetryDelay(t *testing.T) {
+	expected := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		renewRetryMax,
+		renewRetryMax,
+	}
+	for i, e := range expected {
+		if d := tokenRetryDelay(i + 1); d != e {
+			t.Fatalf("expected %s after %d failures but received %s", e, i+1, d)
+		}
+	}
+}
+
+func TestRenewJitterDelay(t *testing.T) {
+	for _, window := range []time.Duration{time.Nanosecond, time.Millisecond, 5 * time.Second, time.Hour} {
+		for i := 0; i < 1000; i++ {
+			if d := renewJitterDelay(window); d < 0 || d >= window {
+				t.Fatalf("expected a delay in [0, %s) but received %s", window, d)
+			}
+		}
+	}
+	if d := renewJitterDelay(0); d != 0 {
+		t.Fatalf("expected no delay but received %s", d)
 	}
 }
 
-func TestBroker_LastOperation(t *testing.T) {
-	env, closer := defaultEnvironment(t)
-	defer closer()
+func TestBroker_RenewJitterWindow(t *testing.T) {
+	b := &Broker{binds: make(map[string]*bindingInfo)}
+	if w := b.renewJitterWindow(); w != renewJitterMin {
+		t.Fatalf("expected %s but received %s", renewJitterMin, w)
+	}
 
-	lastOperation, err := env.Broker.LastOperation(env.Context, env.InstanceID, "")
-	if err != nil {
-		t.Fatal(err)
+	for i := 0; i < 1000; i++ {
+		b.binds[fmt.Sprintf("binding-%d", i)] = &bindingInfo{}
 	}
-	if !reflect.DeepEqual(lastOperation, brokerapi.LastOperation{}) {
-		t.Fatalf("%+v differs from %+v", lastOperation, brokerapi.LastOperation{})
+	if w := b.renewJitterWindow(); w != 10*time.Second {
+		t.Fatalf("expected %s but received %s", 10*time.Second, w)
+	}
+
+	b.renewJitter = time.Minute
+	if w := b.renewJitterWindow(); w != time.Minute {
+		t.Fatalf("expected %s but received %s", time.Minute, w)
+	}
+}
+
+func TestVaultErrorCode(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{
+			"nil",
+			nil,
+			0,
+		},
+		{
+			"no-code",
+			errors.New("connection refused"),
+			0,
+		},
+		{
+			"code",
+			errors.New("Error making API request.\n\nURL: PUT https://127.0.0.1:8200/v1/auth/token/renew-self\nCode: 403. Errors:\n\n* permission denied"),
+			403,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			if code := vaultErrorCode(tc.err); code != tc.code {
+				t.Errorf("expected %d but received %d", tc.code, code)
+			}
+		})
 	}
 }
 
@@ -144,11 +2643,57 @@ type Environment struct {
 	SpaceGUID        string
 	OrganizationGUID string
 	Async            bool
+	Requests         *requestLog
+}
+
+// requestLog records the requests received by the fake Vault server as
+// "METHOD URL" strings.
+type requestLog struct {
+	lock     sync.Mutex
+	requests []string
+
+	// hook, if set, is called with each request before it is handled.
+	hook func(r *http.Request)
+}
+
+func (l *requestLog) add(r *http.Request) {
+	l.lock.Lock()
+	l.requests = append(l.requests, r.Method+" "+r.URL.String())
+	hook := l.hook
+	l.lock.Unlock()
+
+	if hook != nil {
+		hook(r)
+	}
+}
+
+func (l *requestLog) setHook(hook func(r *http.Request)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.hook = hook
+}
+
+func (l *requestLog) contains(s string) bool {
+	return l.count(s) > 0
+}
+
+func (l *requestLog) count(s string) int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	n := 0
+	for _, r := range l.requests {
+		if r == s {
+			n++
+		}
+	}
+	return n
 }
 
 func defaultEnvironment(t *testing.T) (*Environment, func()) {
+	requests := &requestLog{}
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.add(r)
 
 		reqURL := r.URL.String()
 
@@ -173,8 +2718,23 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
+		// Tokens are revoked except for revoked-accessor, which was revoked
+		// out-of-band, and failing-accessor, which Vault fails to revoke.
 		case reqURL == "/v1/auth/token/revoke-accessor" && r.Method == "POST":
-			w.WriteHeader(204)
+			var body struct {
+				Accessor string `json:"accessor"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			switch body.Accessor {
+			case "revoked-accessor":
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errors": ["1 error occurred:\n\n* invalid accessor"]}`))
+			case "failing-accessor":
+				w.WriteHeader(500)
+				w.Write([]byte(`{"errors": ["internal error"]}`))
+			default:
+				w.WriteHeader(204)
+			}
 			return
 
 		case reqURL == "/v1/auth/token/create/cf-instance-id" && r.Method == "POST":
@@ -195,6 +2755,67 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
+		// Bindings given identities attach their tokens to the entity of
+		// instance-id through an alias in the token auth method.
+		case reqURL == "/v1/sys/auth" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"token/": {
+					"type": "token",
+					"accessor": "auth_token_1234"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/identity/entity/name/cf-instance-id" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"id": "entity-id", "name": "cf-instance-id"}}`))
+			return
+
+		case reqURL == "/v1/identity/entity/name/cf-instance-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/identity/entity-alias" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"id": "entity-alias-id", "canonical_id": "entity-id"}}`))
+			return
+
+		case reqURL == "/v1/identity/entity-alias/id/entity-alias-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		// The role for healing-instance-id was deleted out-of-band and is
+		// unknown until it is written again.
+		case reqURL == "/v1/auth/token/create/cf-healing-instance-id" && r.Method == "POST":
+			if !requests.contains("PUT /v1/auth/token/roles/cf-healing-instance-id") {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errors": ["unknown role cf-healing-instance-id"]}`))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"auth": {
+					"client_token": "EFGH",
+					"accessor": "healed-accessor",
+					"lease_duration": 3600,
+					"renewable": true
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/auth/token/roles/cf-healing-instance-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/policy/cf-healing-instance-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/cf/broker/healing-instance-id/binding-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/auth/token/roles/cf-instance-id" && r.Method == "PUT":
 			w.WriteHeader(200)
 			w.Write([]byte(`{
@@ -212,6 +2833,14 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/auth/token/roles/cf-failing-instance-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/auth/token/roles/cf-failing-instance-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
 		// The following calls to cf/broker are all for the generic KV store (v1).
 		case reqURL == "/v1/cf/broker?list=true" && r.Method == "GET":
 			w.WriteHeader(200)
@@ -252,6 +2881,23 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
+		case reqURL == "/v1/cf/broker/instance-id?list=true" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"auth": null,
+				"data": {
+					"keys": ["binding-id"]
+				},
+				"lease_duration": 2764800,
+				"lease_id": "",
+				"renewable": false
+			}`))
+			return
+
+		case reqURL == "/v1/cf/broker/foo/foo" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/cf/broker/foo/foo" && r.Method == "GET":
 			w.WriteHeader(200)
 			w.Write([]byte(`{
@@ -265,6 +2911,18 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
+		case reqURL == "/v1/cf/broker/instance-id" && r.Method == "GET":
+			w.WriteHeader(404)
+			return
+
+		case reqURL == "/v1/cf/broker/failing-instance-id" && r.Method == "GET":
+			w.WriteHeader(404)
+			return
+
+		case reqURL == "/v1/cf/broker/unknown-instance" && r.Method == "GET":
+			w.WriteHeader(404)
+			return
+
 		case reqURL == "/v1/cf/broker/instance-id" && r.Method == "PUT":
 			w.WriteHeader(204)
 			return
@@ -290,10 +2948,111 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			}`))
 			return
 
+		case reqURL == "/v1/cf/broker/instance-id/stored-binding-id" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"json": "{\"Organization\": \"organization-guid\", \"Space\": \"space-guid\", \"Binding\": \"stored-binding-id\", \"ClientToken\": \"stored-token\", \"Accessor\": \"stored-accessor\"}"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/cf/broker/instance-id/revoked-binding-id" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"json": "{\"Binding\": \"revoked-binding-id\", \"Accessor\": \"revoked-accessor\"}"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/cf/broker/instance-id/failing-binding-id" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"json": "{\"Binding\": \"failing-binding-id\", \"Accessor\": \"failing-accessor\"}"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/cf/broker/instance-id/revoked-binding-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		// The AWS credentials of aws-binding-id have a lease, while the lease
+		// of expired-binding-id has already been revoked by Vault.
+		case reqURL == "/v1/cf/broker/instance-id/aws-binding-id" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"json": "{\"Binding\": \"aws-binding-id\", \"Accessor\": \"accessor\", \"LeaseID\": \"cf/instance-id/aws/sts/cf-bind/lease-id\", \"LeaseRenewable\": true}"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/cf/broker/instance-id/expired-binding-id" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"json": "{\"Binding\": \"expired-binding-id\", \"Accessor\": \"accessor\", \"LeaseID\": \"revoked-lease\"}"
+				}
+			}`))
+			return
+
+		case (reqURL == "/v1/cf/broker/instance-id/aws-binding-id" || reqURL == "/v1/cf/broker/instance-id/expired-binding-id") && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/cf/broker/instance-id/binding-id" && r.Method == "DELETE":
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/cf/broker/instance-id/missing-binding-id" && r.Method == "GET":
+			w.WriteHeader(404)
+			return
+
+		case reqURL == "/v1/sys/audit" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"existing/": {"type": "file", "path": "existing/", "options": {"file_path": "stdout"}}
+			}`))
+			return
+
+		case reqURL == "/v1/sys/audit/cf-broker" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/audit/forbidden" && r.Method == "PUT":
+			w.WriteHeader(403)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+
+		// The extra mount for instance-id is listed once it was mounted.
+		case reqURL == "/v1/sys/mounts" && r.Method == "GET" &&
+			requests.contains("POST /v1/sys/mounts/cf/instance-id/config"):
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"cf/instance-id/config/": {
+					"type": "generic",
+					"description": "",
+					"config": {
+						"default_lease_ttl": 0,
+						"max_lease_ttl": 0
+					}
+				}
+			}`))
+			return
+
+		// The policy of instance-id is missing, but its token role exists.
+		case reqURL == "/v1/sys/policy/cf-instance-id" && r.Method == "GET":
+			w.WriteHeader(404)
+			return
+
+		case reqURL == "/v1/auth/token/roles/cf-instance-id" && r.Method == "GET":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"allowed_policies": ["cf-instance-id"]}}`))
+			return
+
 		// This call is for listing mounts themselves.
 		case reqURL == "/v1/sys/mounts" && r.Method == "GET":
 			w.WriteHeader(200)
@@ -335,6 +3094,26 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/sys/mounts/cf/instance-id/pki" && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/instance-id/ssh" && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/instance-id/aws" && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/instance-id/config" && r.Method == "POST":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/mounts/cf/instance-id/config" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/sys/mounts/cf/organization-guid/secret" && r.Method == "POST":
 			w.WriteHeader(204)
 			return
@@ -351,6 +3130,141 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 			w.WriteHeader(204)
 			return
 
+		case reqURL == "/v1/sys/policy/cf-instance-id-shared" && (r.Method == "PUT" || r.Method == "DELETE"):
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/policy/cf-failing-instance-id" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/sys/policy/cf-failing-instance-id" && r.Method == "DELETE":
+			w.WriteHeader(204)
+			return
+
+		// The binding encryption key "encrypts" by prefixing the plaintext.
+		case reqURL == "/v1/transit/keys/broker" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/transit/encrypt/broker" && r.Method == "PUT":
+			var body struct {
+				Plaintext string `json:"plaintext"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"data": {"ciphertext": "vault:v1:%s"}}`, body.Plaintext)
+			return
+
+		case reqURL == "/v1/transit/decrypt/broker" && r.Method == "PUT":
+			var body struct {
+				Ciphertext string `json:"ciphertext"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			w.WriteHeader(200)
+			fmt.Fprintf(w, `{"data": {"plaintext": "%s"}}`, strings.TrimPrefix(body.Ciphertext, "vault:v1:"))
+			return
+
+		case strings.HasPrefix(reqURL, "/v1/cf/instance-id/transit/keys/") && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		// The SSH CA can only be generated once
+		case reqURL == "/v1/cf/instance-id/ssh/config/ca" && r.Method == "PUT":
+			if requests.count("PUT /v1/cf/instance-id/ssh/config/ca") > 1 {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errors": ["keys are already configured; delete them before reconfiguring"]}`))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"public_key": "ssh-rsa AAAA"}}`))
+			return
+
+		case reqURL == "/v1/cf/instance-id/ssh/roles/cf-bind" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		// The PKI CA is only present once it has been generated
+		case reqURL == "/v1/cf/instance-id/pki/cert/ca" && r.Method == "GET":
+			w.WriteHeader(200)
+			if requests.contains("PUT /v1/cf/instance-id/pki/root/generate/internal") {
+				w.Write([]byte(`{"data": {"certificate": "-----BEGIN CERTIFICATE-----"}}`))
+				return
+			}
+			w.Write([]byte(`{"data": {"certificate": ""}}`))
+			return
+
+		case reqURL == "/v1/cf/instance-id/pki/root/generate/internal" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"certificate": "-----BEGIN CERTIFICATE-----"}}`))
+			return
+
+		case reqURL == "/v1/cf/instance-id/pki/roles/cf-bind" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/cf/instance-id/ssh/sign/cf-bind" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"data": {
+					"signed_key": "ssh-ed25519-cert-v01@openssh.com AAAA",
+					"serial_number": "c7:3f:26:25"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/cf/instance-id/aws/config/root" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/cf/instance-id/aws/roles/cf-bind" && r.Method == "PUT":
+			w.WriteHeader(204)
+			return
+
+		case reqURL == "/v1/cf/instance-id/aws/sts/cf-bind" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"lease_id": "cf/instance-id/aws/sts/cf-bind/lease-id",
+				"lease_duration": 3600,
+				"renewable": true,
+				"data": {
+					"access_key": "ASIAEXAMPLE",
+					"secret_key": "secret",
+					"security_token": "token"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/sys/wrapping/wrap" && r.Method == "POST":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"wrap_info": {
+					"token": "wrapping-token",
+					"ttl": 300,
+					"creation_time": "2018-04-17T11:35:54Z"
+				}
+			}`))
+			return
+
+		case reqURL == "/v1/sys/renew" && r.Method == "PUT":
+			w.WriteHeader(200)
+			w.Write([]byte(`{
+				"lease_id": "cf/instance-id/aws/sts/cf-bind/lease-id",
+				"lease_duration": 3600,
+				"renewable": true
+			}`))
+			return
+
+		// Leases are revoked except for revoked-lease, which has expired
+		case strings.HasPrefix(reqURL, "/v1/sys/revoke/") && r.Method == "PUT":
+			if reqURL == "/v1/sys/revoke/revoked-lease" {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"errors": ["invalid lease"]}`))
+				return
+			}
+			w.WriteHeader(204)
+			return
+
 		case reqURL == "/v1/auth/token/lookup-self" && r.Method == "GET":
 			w.WriteHeader(200)
 			w.Write([]byte(`{
@@ -401,25 +3315,35 @@ func defaultEnvironment(t *testing.T) (*Environment, func()) {
 		t.Fatal(err)
 	}
 
-	return &Environment{
-		Context: context.Background(),
-		Broker: &Broker{
-			log:                log.New(os.Stdout, "", 0),
-			vaultClient:        client,
-			serviceID:          "0654695e-0760-a1d4-1cad-5dd87b75ed99",
-			serviceName:        "hashicorp-vault",
-			serviceDescription: "HashiCorp Vault Service Broker",
-			planName:           "shared",
-			planDescription:    "Secure access to Vault's storage and transit backends",
-			vaultAdvertiseAddr: "https://127.0.0.1:8200",
-			vaultRenewToken:    true,
-			instances:          make(map[string]*instanceInfo),
-			binds:              make(map[string]*bindingInfo),
+	b := &Broker{
+		log:                NewLogger(os.Stdout, LogFormatText, LogLevelDebug),
+		vaultClient:        client,
+		serviceID:          "0654695e-0760-a1d4-1cad-5dd87b75ed99",
+		serviceName:        "hashicorp-vault",
+		serviceDescription: "HashiCorp Vault Service Broker",
+		plans: []*Plan{
+			{
+				Name:        "shared",
+				Description: "Secure access to Vault's storage and transit backends",
+				Engines:     DefaultPlanEngines,
+			},
 		},
+		vaultAdvertiseAddr: "https://127.0.0.1:8200",
+		vaultRenewToken:    true,
+		mountPrefix:        "cf",
+		instances:          make(map[string]*instanceInfo),
+		binds:              make(map[string]*bindingInfo),
+	}
+	b.store = newKVStore(b.vault, "cf/broker", 1)
+
+	return &Environment{
+		Context:          context.Background(),
+		Broker:           b,
 		InstanceID:       "instance-id",
 		BindingID:        "binding-id",
 		SpaceGUID:        "space-guid",
 		OrganizationGUID: "organization-guid",
 		Async:            false,
+		Requests:         requests,
 	}, ts.Close
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// capabilityProbe is the name used in place of an instance ID when checking
+// the capabilities the broker's token has on the paths of instances.
+const capabilityProbe = "capabilities-check"
+
+// capabilityCheck is a path the broker's token needs capabilities on. Pattern
+// describes the paths it stands for in error messages.
+type capabilityCheck struct {
+	Path         string
+	Pattern      string
+	Capabilities []string
+}
+
+// requiredCapabilities returns the paths and capabilities the broker needs to
+// provision instances and bind to them.
+func (b *Broker) requiredCapabilities() []capabilityCheck {
+	crud := []string{"create", "update", "delete"}
+	checks := []capabilityCheck{
+		{"sys/mounts", "sys/mounts", []string{"read"}},
+		{"sys/mounts/" + mountPath(b.mountPrefix, capabilityProbe), "sys/mounts/" + b.mountPrefix + "/*", crud},
+		{"sys/policy/cf-" + capabilityProbe, "sys/policy/cf-*", crud},
+		{"auth/token/roles/cf-" + capabilityProbe, "auth/token/roles/cf-*", crud},
+		{"auth/token/create/cf-" + capabilityProbe, "auth/token/create/cf-*", []string{"update"}},
+		{"auth/token/revoke-accessor", "auth/token/revoke-accessor", []string{"update"}},
+	}
+
+	// The metadata store is only known once the broker is started
+	if s, ok := b.store.(*kvStore); ok {
+		pattern := s.mount + "/*"
+		if s.version == 1 {
+			checks = append(checks, capabilityCheck{s.apiPath("data", capabilityProbe), pattern,
+				[]string{"create", "read", "update", "delete", "list"}})
+		} else {
+			checks = append(checks,
+				capabilityCheck{s.apiPath("data", capabilityProbe), s.mount + "/data/*",
+					[]string{"create", "read", "update"}},
+				capabilityCheck{s.apiPath("metadata", capabilityProbe), s.mount + "/metadata/*",
+					[]string{"delete", "list"}})
+		}
+	}
+	return checks
+}
+
+// checkCapabilities checks that the broker's token has every capability it
+// needs, so that a token with a policy which is too narrow fails at startup
+// rather than on the first provision. The error lists every missing
+// capability.
+func (b *Broker) checkCapabilities() error {
+	var missing []string
+	for _, c := range b.requiredCapabilities() {
+		granted, err := b.vault().Sys().CapabilitiesSelf(c.Path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to look up the capabilities of the broker's token on %s", c.Path)
+		}
+		if lacking := lackingCapabilities(granted, c.Capabilities); len(lacking) > 0 {
+			missing = append(missing, fmt.Sprintf("%s on %s", strings.Join(lacking, ", "), c.Pattern))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the broker's token is missing capabilities: %s", strings.Join(missing, "; "))
+	}
+	return nil
+}
+
+// lackingCapabilities returns the required capabilities which were not
+// granted, in order. The root capability grants all of them, and deny none.
+func lackingCapabilities(granted, required []string) []string {
+	has := make(map[string]struct{}, len(granted))
+	for _, c := range granted {
+		if c == "root" {
+			return nil
+		}
+		if c == "deny" {
+			has = nil
+			break
+		}
+		has[c] = struct{}{}
+	}
+	var lacking []string
+	for _, c := range required {
+		if _, ok := has[c]; !ok {
+			lacking = append(lacking, c)
+		}
+	}
+	sort.Strings(lacking)
+	return lacking
+}
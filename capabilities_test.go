@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestLackingCapabilities(t *testing.T) {
+	required := []string{"update", "create", "delete"}
+	cases := []struct {
+		granted  []string
+		expected []string
+	}{
+		{[]string{"create", "update", "delete", "read"}, nil},
+		{[]string{"root"}, nil},
+		{[]string{"read", "update"}, []string{"create", "delete"}},
+		{[]string{"deny"}, []string{"create", "delete", "update"}},
+		{nil, []string{"create", "delete", "update"}},
+	}
+	for _, tc := range cases {
+		if lacking := lackingCapabilities(tc.granted, required); !reflect.DeepEqual(lacking, tc.expected) {
+			t.Errorf("expected %v for %v but received %v", tc.expected, tc.granted, lacking)
+		}
+	}
+}
+
+func TestBroker_CheckCapabilities(t *testing.T) {
+	// The token may do everything except create and delete token roles
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/capabilities-self" {
+			w.WriteHeader(404)
+			return
+		}
+		var body struct {
+			Path string `json:"path"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		capabilities := `["create", "read", "update", "delete", "list"]`
+		if strings.HasPrefix(body.Path, "auth/token/roles/") {
+			capabilities = `["update"]`
+		}
+		w.Write([]byte(`{"capabilities": ` + capabilities + `}`))
+	}))
+	defer ts.Close()
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Broker{
+		vaultClient: client,
+		mountPrefix: "cf",
+		store:       newKVStore(func() *api.Client { return client }, "cf/broker", 1),
+	}
+	err = b.checkCapabilities()
+	if err == nil {
+		t.Fatal("expected an error for missing capabilities")
+	}
+	if !strings.HasSuffix(err.Error(), "missing capabilities: create, delete on auth/token/roles/cf-*") {
+		t.Fatalf("unexpected error %q", err)
+	}
+}
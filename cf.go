@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cfClient is a minimal client for the Cloud Foundry v2 API which
+// authenticates with UAA using client credentials.
+type cfClient struct {
+	apiURL     string
+	httpClient *http.Client
+	tokens     *uaaTokenSource
+}
+
+// newCFClient returns a client for the Cloud Foundry API at the given URL.
+func newCFClient(apiURL, clientID, clientSecret string) *cfClient {
+	c := &cfClient{
+		apiURL:     strings.TrimRight(apiURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	c.tokens = &uaaTokenSource{
+		httpClient:   c.httpClient,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		discover:     c.tokenEndpoint,
+	}
+	return c
+}
+
+// tokenEndpoint returns the URL of the UAA which the API advertises.
+func (c *cfClient) tokenEndpoint() (string, error) {
+	var info struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+	if err := getInfo(c.httpClient, c.apiURL, "/v2/info", &info); err != nil {
+		return "", err
+	}
+	return info.TokenEndpoint, nil
+}
+
+// ListBindings returns the GUIDs of the service bindings and service keys of
+// the service instance with the given GUID. Both are bindings from the
+// broker's point of view.
+func (c *cfClient) ListBindings(instanceID string) ([]string, error) {
+	q := url.Values{}
+	q.Set("q", "service_instance_guid:"+instanceID)
+	q.Set("results-per-page", "100")
+
+	var guids []string
+	for _, resource := range []string{"service_bindings", "service_keys"} {
+		next := "/v2/" + resource + "?" + q.Encode()
+		for next != "" {
+			var page struct {
+				NextURL   string `json:"next_url"`
+				Resources []struct {
+					Metadata struct {
+						GUID string `json:"guid"`
+					} `json:"metadata"`
+				} `json:"resources"`
+			}
+			if err := c.get(next, &page); err != nil {
+				return nil, err
+			}
+			for _, r := range page.Resources {
+				guids = append(guids, r.Metadata.GUID)
+			}
+			next = page.NextURL
+		}
+	}
+	return guids, nil
+}
+
+// OrganizationName returns the name of the organization with the given GUID.
+func (c *cfClient) OrganizationName(guid string) (string, error) {
+	return c.name("organizations", guid)
+}
+
+// SpaceName returns the name of the space with the given GUID.
+func (c *cfClient) SpaceName(guid string) (string, error) {
+	return c.name("spaces", guid)
+}
+
+// ServiceInstanceName returns the name of the service instance with the given
+// GUID. The platform may not know the instance yet while it is provisioned.
+func (c *cfClient) ServiceInstanceName(guid string) (string, error) {
+	return c.name("service_instances", guid)
+}
+
+// name returns the name of the resource with the given GUID.
+func (c *cfClient) name(resource, guid string) (string, error) {
+	var r struct {
+		Entity struct {
+			Name string `json:"name"`
+		} `json:"entity"`
+	}
+	if err := c.get("/v2/"+resource+"/"+url.PathEscape(guid), &r); err != nil {
+		return "", err
+	}
+	return r.Entity.Name, nil
+}
+
+// get performs an authenticated GET against the API and decodes the JSON
+// response into out.
+func (c *cfClient) get(path string, out interface{}) error {
+	token, err := c.tokens.Token()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", c.apiURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get %s: unexpected status %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCFClient_ListBindings(t *testing.T) {
+	tokens := 0
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/info":
+			w.Write([]byte(`{"token_endpoint": "` + ts.URL + `/uaa"}`))
+			return
+		case r.URL.Path == "/uaa/oauth/token" && r.Method == "POST":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "broker" || pass != "secret" {
+				w.WriteHeader(401)
+				return
+			}
+			tokens++
+			w.Write([]byte(`{"access_token": "uaa-token", "expires_in": 3600}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "bearer uaa-token" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.URL.Query().Get("q") != "service_instance_guid:instance-id" {
+			w.WriteHeader(400)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v2/service_bindings" && r.URL.Query().Get("page") == "":
+			w.Write([]byte(`{"next_url": "/v2/service_bindings?q=service_instance_guid:instance-id&page=2", "resources": [{"metadata": {"guid": "binding-1"}}]}`))
+		case r.URL.Path == "/v2/service_bindings":
+			w.Write([]byte(`{"next_url": null, "resources": [{"metadata": {"guid": "binding-2"}}]}`))
+		case r.URL.Path == "/v2/service_keys":
+			w.Write([]byte(`{"next_url": null, "resources": [{"metadata": {"guid": "key-1"}}]}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	c := newCFClient(ts.URL+"/", "broker", "secret")
+	for i := 0; i < 2; i++ {
+		bindings, err := c.ListBindings("instance-id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"binding-1", "binding-2", "key-1"}
+		if !reflect.DeepEqual(bindings, expected) {
+			t.Fatalf("expected %v but received %v", expected, bindings)
+		}
+	}
+	if tokens != 1 {
+		t.Fatalf("expected the UAA token to be cached but it was fetched %d times", tokens)
+	}
+}
+
+func TestCFClient_ListBindings_Error(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	c := newCFClient(ts.URL, "broker", "secret")
+	if _, err := c.ListBindings("instance-id"); err == nil {
+		t.Fatal("expected an error when the API is unavailable")
+	}
+}
+
+func TestCFClient_Names(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/info":
+			w.Write([]byte(`{"token_endpoint": "` + ts.URL + `/uaa"}`))
+		case "/uaa/oauth/token":
+			w.Write([]byte(`{"access_token": "uaa-token", "expires_in": 3600}`))
+		case "/v2/organizations/organization-guid":
+			w.Write([]byte(`{"metadata": {"guid": "organization-guid"}, "entity": {"name": "acme"}}`))
+		case "/v2/spaces/space-guid":
+			w.Write([]byte(`{"metadata": {"guid": "space-guid"}, "entity": {"name": "production"}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	c := newCFClient(ts.URL, "broker", "secret")
+	if name, err := c.OrganizationName("organization-guid"); err != nil || name != "acme" {
+		t.Fatalf("expected acme but received %q, %v", name, err)
+	}
+	if name, err := c.SpaceName("space-guid"); err != nil || name != "production" {
+		t.Fatalf("expected production but received %q, %v", name, err)
+	}
+	if _, err := c.ServiceInstanceName("instance-id"); err == nil {
+		t.Fatal("expected an error for an unknown instance")
+	}
+}
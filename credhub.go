@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// credhubClient is a minimal client for the CredHub API which authenticates
+// with UAA using client credentials, with a TLS client certificate, or both.
+// It stores the credentials of bindings so that applications get a reference
+// to them instead of the credentials.
+type credhubClient struct {
+	url        string
+	clientID   string
+	httpClient *http.Client
+
+	// tokens is nil if the client only authenticates with its certificate.
+	tokens *uaaTokenSource
+}
+
+// newCredhubClient returns a client for the CredHub API at the given URL. The
+// TLS configuration, if any, holds the CA of CredHub and the client
+// certificate. Without a client secret, no UAA token is sent.
+func newCredhubClient(credhubURL, clientID, clientSecret string, tlsConfig *tls.Config) *credhubClient {
+	c := &credhubClient{
+		url:        strings.TrimRight(credhubURL, "/"),
+		clientID:   clientID,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if tlsConfig != nil {
+		c.httpClient.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		}
+	}
+	if clientSecret != "" {
+		c.tokens = &uaaTokenSource{
+			httpClient:   c.httpClient,
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			discover:     c.tokenEndpoint,
+		}
+	}
+	return c
+}
+
+// credhubTLSConfig returns the TLS configuration of the CredHub client from
+// the paths of the CA certificate which CredHub's certificate is verified
+// with, and of the client certificate and key. It returns nil if none is set.
+func credhubTLSConfig(caCert, clientCert, clientKey string) (*tls.Config, error) {
+	if caCert == "" && clientCert == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caCert != "" {
+		pemBytes, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CREDHUB_CA_CERT: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("CREDHUB_CA_CERT %s contains no PEM certificates", caCert)
+		}
+	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CREDHUB_CLIENT_CERT or CREDHUB_CLIENT_KEY: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tokenEndpoint returns the URL of the UAA which CredHub advertises as its
+// auth server.
+func (c *credhubClient) tokenEndpoint() (string, error) {
+	var info struct {
+		AuthServer struct {
+			URL string `json:"url"`
+		} `json:"auth-server"`
+	}
+	if err := getInfo(c.httpClient, c.url, "/info", &info); err != nil {
+		return "", err
+	}
+	return info.AuthServer.URL, nil
+}
+
+// credhubRef returns the CredHub name of the binding's credentials, which is
+// given to the platform as the "credhub-ref" of the binding. It follows the
+// "/c/<client>/<service>/<binding>/credentials" convention which the platform
+// expects of brokers.
+func (c *credhubClient) credhubRef(serviceName, bindingID string) string {
+	return "/c/" + c.clientID + "/" + serviceName + "/" + bindingID + "/credentials"
+}
+
+// SetJSON writes the value as the JSON credential with the given name,
+// replacing any previous value.
+func (c *credhubClient) SetJSON(name string, value interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"name":  name,
+		"type":  "json",
+		"value": value,
+	})
+	if err != nil {
+		return err
+	}
+	return c.do("PUT", "/api/v1/data", body, http.StatusOK)
+}
+
+// Delete deletes the credential with the given name. Deleting a credential
+// which does not exist succeeds.
+func (c *credhubClient) Delete(name string) error {
+	return c.do("DELETE", "/api/v1/data?name="+url.QueryEscape(name), nil, http.StatusNoContent, http.StatusNotFound)
+}
+
+// do performs an authenticated request against the API, which must return one
+// of the expected statuses.
+func (c *credhubClient) do(method, path string, body []byte, expected ...int) error {
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.tokens != nil {
+		token, err := c.tokens.Token()
+		if err != nil {
+			return fmt.Errorf("failed to authenticate to credhub: %s", err)
+		}
+		req.Header.Set("Authorization", "bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("failed to %s %s: credhub rejected the broker's credentials with status %d", method, path, resp.StatusCode)
+	}
+	return fmt.Errorf("failed to %s %s: unexpected status %d", method, path, resp.StatusCode)
+}
+
+// platformCredentials returns the credentials of a binding given to the
+// platform: a reference to them if they are stored in CredHub, or else the
+// credentials themselves.
+func (b *Broker) platformCredentials(instanceID string, instance *instanceInfo, plan *Plan, info *bindingInfo) map[string]interface{} {
+	if info.CredhubRef != "" {
+		return map[string]interface{}{"credhub-ref": info.CredhubRef}
+	}
+	return b.bindingCredentials(instanceID, instance, plan, info)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// fakeCredhub is a CredHub server which keeps JSON credentials in memory.
+type fakeCredhub struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	credentials map[string]map[string]interface{}
+	failing     bool
+}
+
+func newFakeCredhub() *fakeCredhub {
+	c := &fakeCredhub{credentials: make(map[string]map[string]interface{})}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/info":
+			w.Write([]byte(`{"auth-server": {"url": "` + c.URL + `/uaa"}}`))
+			return
+		case r.URL.Path == "/uaa/oauth/token" && r.Method == "POST":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "broker" || pass != "secret" {
+				w.WriteHeader(401)
+				return
+			}
+			w.Write([]byte(`{"access_token": "uaa-token", "expires_in": 3600}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "bearer uaa-token" {
+			w.WriteHeader(401)
+			return
+		}
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		switch {
+		case c.failing:
+			w.WriteHeader(500)
+		case r.URL.Path == "/api/v1/data" && r.Method == "PUT":
+			var body struct {
+				Name  string                 `json:"name"`
+				Type  string                 `json:"type"`
+				Value map[string]interface{} `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Type != "json" {
+				w.WriteHeader(400)
+				return
+			}
+			c.credentials[body.Name] = body.Value
+			w.Write([]byte(`{"name": "` + body.Name + `", "type": "json"}`))
+		case r.URL.Path == "/api/v1/data" && r.Method == "DELETE":
+			name := r.URL.Query().Get("name")
+			if _, ok := c.credentials[name]; !ok {
+				w.WriteHeader(404)
+				return
+			}
+			delete(c.credentials, name)
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return c
+}
+
+func (c *fakeCredhub) get(name string) map[string]interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.credentials[name]
+}
+
+func TestCredhubClient(t *testing.T) {
+	ts := newFakeCredhub()
+	defer ts.Close()
+
+	c := newCredhubClient(ts.URL+"/", "broker", "secret", nil)
+	name := c.credhubRef("hashicorp-vault", "binding-id")
+	if name != "/c/broker/hashicorp-vault/binding-id/credentials" {
+		t.Fatalf("unexpected credential name %q", name)
+	}
+
+	value := map[string]interface{}{"token": "ABCD"}
+	if err := c.SetJSON(name, value); err != nil {
+		t.Fatal(err)
+	}
+	if stored := ts.get(name); !reflect.DeepEqual(stored, value) {
+		t.Fatalf("expected %v but received %v", value, stored)
+	}
+
+	// Deleting is idempotent
+	for i := 0; i < 2; i++ {
+		if err := c.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ts.get(name) != nil {
+		t.Fatal("expected the credential to be deleted")
+	}
+
+	// Bad client credentials are reported
+	c = newCredhubClient(ts.URL, "broker", "wrong", nil)
+	if err := c.SetJSON(name, value); err == nil {
+		t.Fatal("expected an error for bad client credentials")
+	}
+}
+
+func TestCredhubClient_TLS(t *testing.T) {
+	certFile, keyFile := writeKeyPair(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(mustParseCertificate(t, clientCert.Certificate[0]))
+
+	// CredHub verifies the client certificate instead of a UAA token
+	forbidden := false
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "":
+			w.WriteHeader(400)
+		case forbidden:
+			w.WriteHeader(403)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caFile, err := ioutil.TempFile("", "credhub-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	caFile.Close()
+
+	// Both the CA and the client certificate are needed
+	config, err := credhubTLSConfig(caFile.Name(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCredhubClient(ts.URL, "broker", "", config)
+	if err := c.SetJSON("/c/broker/name", map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error without a client certificate")
+	}
+	config, err = credhubTLSConfig(caFile.Name(), certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = newCredhubClient(ts.URL, "broker", "", config)
+	if err := c.SetJSON("/c/broker/name", map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected credentials are reported as such
+	forbidden = true
+	err = c.SetJSON("/c/broker/name", map[string]interface{}{})
+	if err == nil || !strings.Contains(err.Error(), "rejected the broker's credentials") {
+		t.Fatalf("expected an error about the credentials but received %v", err)
+	}
+
+	// Invalid files are reported
+	if _, err := credhubTLSConfig(keyFile, "", ""); err == nil {
+		t.Fatal("expected an error for a CA file without certificates")
+	}
+	if _, err := credhubTLSConfig("", certFile, certFile); err == nil {
+		t.Fatal("expected an error for an invalid client key")
+	}
+}
+
+func mustParseCertificate(t *testing.T, der []byte) *x509.Certificate {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestBroker_Bind_CredhubRef(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	ts := newFakeCredhub()
+	defer ts.Close()
+	env.Broker.credhub = newCredhubClient(ts.URL, "broker", "secret", nil)
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The platform only gets the reference to the credentials
+	ref := "/c/broker/hashicorp-vault/binding-id/credentials"
+	expected := map[string]interface{}{"credhub-ref": ref}
+	if !reflect.DeepEqual(binding.Credentials, expected) {
+		t.Fatalf("expected %v but received %v", expected, binding.Credentials)
+	}
+	stored := ts.get(ref)
+	if auth, ok := stored["auth"].(map[string]interface{}); !ok || auth["token"] != "ABCD" {
+		t.Fatalf("expected the credentials to be stored in credhub but received %v", stored)
+	}
+
+	// Unbinding deletes the credentials
+	info := env.Broker.binds["binding-id"]
+	if err := env.Broker.revokeBinding(env.InstanceID, env.BindingID, info); err != nil {
+		t.Fatal(err)
+	}
+	if ts.get(ref) != nil {
+		t.Fatal("expected the credentials to be deleted from credhub")
+	}
+
+	// The token is revoked if the credentials cannot be stored
+	ts.lock.Lock()
+	ts.failing = true
+	ts.lock.Unlock()
+	revoked := env.Requests.count("POST /v1/auth/token/revoke-accessor")
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, "other-binding-id", brokerapi.BindDetails{}); err == nil {
+		t.Fatal("expected an error when credhub fails")
+	}
+	if n := env.Requests.count("POST /v1/auth/token/revoke-accessor"); n != revoked+1 {
+		t.Fatal("expected the token to be revoked")
+	}
+	if env.Requests.contains("PUT /v1/cf/broker/instance-id/other-binding-id") {
+		t.Fatal("expected no binding info to be stored")
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// attachDebugRoutes adds the net/http/pprof profiling endpoints to the router.
+// They reveal a lot about the broker, so they are only added when enabled.
+func attachDebugRoutes(router *mux.Router) {
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+}
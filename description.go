@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// The name lookup modes. In best-effort mode, names which cannot be looked up
+// are replaced by their GUIDs, while in strict mode provisioning fails.
+const (
+	NameLookupBestEffort = "best-effort"
+	NameLookupStrict     = "strict"
+)
+
+// nameLookupAttempts is how many times a name is looked up before giving up,
+// and DefaultNameLookupRetryDelay the delay before the first retry, which
+// doubles with each retry.
+const (
+	nameLookupAttempts          = 3
+	DefaultNameLookupRetryDelay = 500 * time.Millisecond
+)
+
+// MountDescriptionInput is used as input to the mount description template.
+type MountDescriptionInput struct {
+	// Organization, Space, and Instance are the names of the organization,
+	// space, and service instance the mount belongs to, or their GUIDs if the
+	// names cannot be looked up. Space and Instance are empty for the mount
+	// shared by the organization, and Instance for the mount shared by the
+	// space.
+	Organization string
+	Space        string
+	Instance     string
+
+	// OrganizationGUID, SpaceGUID, and ServiceInstanceGUID are the unique IDs
+	// of the same, and empty in the same cases.
+	OrganizationGUID    string
+	SpaceGUID           string
+	ServiceInstanceGUID string
+}
+
+// nameResolver looks up the names of platform resources by their GUIDs.
+type nameResolver interface {
+	OrganizationName(guid string) (string, error)
+	SpaceName(guid string) (string, error)
+	ServiceInstanceName(guid string) (string, error)
+}
+
+// describeMounts sets the description of each mount of the instance from the
+// mount description template, if there is one. Mounts whose description
+// cannot be rendered are left without one. It returns the error of
+// lookupNames, in which case the descriptions use the GUIDs in place of the
+// names which could not be looked up.
+func (b *Broker) describeMounts(mounts []Mount, instanceID, orgGUID, spaceGUID string) error {
+	if b.mountDescription == nil || len(mounts) == 0 {
+		return nil
+	}
+	names, lookupErr := b.lookupNames(instanceID, orgGUID, spaceGUID)
+	orgPath := sharedMount(b.mountPrefix, orgGUID).Path
+	spacePath := sharedMount(b.mountPrefix, spaceGUID).Path
+
+	for i := range mounts {
+		input := names
+		switch mounts[i].Path {
+		case orgPath:
+			input.Space, input.SpaceGUID = "", ""
+			fallthrough
+		case spacePath:
+			input.Instance, input.ServiceInstanceGUID = "", ""
+		}
+		var buf bytes.Buffer
+		if err := b.mountDescription.Execute(&buf, &input); err != nil {
+			b.log.Printf("[WARN] failed to render description of mount %s: %s", mounts[i].Path, err)
+			continue
+		}
+		mounts[i].Description = strings.TrimSpace(buf.String())
+	}
+	return lookupErr
+}
+
+// lookupNames returns the names of the instance and its organization and
+// space, falling back to their GUIDs for any name which cannot be looked up.
+// Failed lookups are retried, and the organization or space names which still
+// cannot be looked up are returned as an error. The instance's name is not,
+// since the platform may not know the instance yet while it is provisioned.
+func (b *Broker) lookupNames(instanceID, orgGUID, spaceGUID string) (MountDescriptionInput, error) {
+	names := MountDescriptionInput{
+		Organization:        orgGUID,
+		Space:               spaceGUID,
+		Instance:            instanceID,
+		OrganizationGUID:    orgGUID,
+		SpaceGUID:           spaceGUID,
+		ServiceInstanceGUID: instanceID,
+	}
+	if b.nameResolver == nil {
+		return names, nil
+	}
+	var result *multierror.Error
+	for _, n := range []struct {
+		kind   string
+		guid   string
+		name   *string
+		lookup func(string) (string, error)
+	}{
+		{"organization", orgGUID, &names.Organization, b.nameResolver.OrganizationName},
+		{"space", spaceGUID, &names.Space, b.nameResolver.SpaceName},
+		{"service instance", instanceID, &names.Instance, b.nameResolver.ServiceInstanceName},
+	} {
+		if n.guid == "" {
+			continue
+		}
+		name, err := b.lookupName(n.lookup, n.guid)
+		if err != nil {
+			b.log.Printf("[WARN] failed to look up name of %s %s, using its GUID: %s", n.kind, n.guid, err)
+			if n.kind != "service instance" {
+				result = multierror.Append(result, errors.Wrapf(err, "failed to look up name of %s %s", n.kind, n.guid))
+			}
+			continue
+		}
+		if name != "" {
+			*n.name = name
+		}
+	}
+	return names, result.ErrorOrNil()
+}
+
+// lookupName looks up a name, retrying up to nameLookupAttempts times with
+// backoff, since the platform's API may fail transiently.
+func (b *Broker) lookupName(lookup func(string) (string, error), guid string) (string, error) {
+	delay := b.nameLookupRetryDelay
+	for attempt := 1; ; attempt++ {
+		name, err := lookup(guid)
+		if err == nil || attempt == nameLookupAttempts {
+			return name, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// fakeNames resolves the names of the organization-guid organization and the
+// instance-id instance, and fails to resolve any other name.
+type fakeNames struct{}
+
+func (fakeNames) OrganizationName(guid string) (string, error) {
+	if guid == "organization-guid" {
+		return "acme", nil
+	}
+	return "", errors.New("not found")
+}
+
+func (fakeNames) SpaceName(guid string) (string, error) {
+	return "", errors.New("not found")
+}
+
+func (fakeNames) ServiceInstanceName(guid string) (string, error) {
+	if guid == "instance-id" {
+		return "my-vault", nil
+	}
+	return "", errors.New("not found")
+}
+
+func TestBroker_DescribeMounts(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Broker{
+		log:              NewLogger(os.Stdout, LogFormatText, LogLevelDebug),
+		mountPrefix:      "cf",
+		mountDescription: config.MountDescriptionTemplate,
+	}
+	plan := &Plan{Engines: []SecretEngineType{KV}}
+	mounts := vaultMounts("cf", "instance-id", "organization-guid", "space-guid", plan)
+
+	// Without a name resolver, the GUIDs are used
+	b.describeMounts(mounts, "instance-id", "organization-guid", "space-guid")
+	expected := []string{
+		"CF org=organization-guid",
+		"CF org=organization-guid space=space-guid",
+		"CF org=organization-guid space=space-guid instance=instance-id",
+	}
+	for i, m := range mounts {
+		if m.Description != expected[i] {
+			t.Errorf("expected %q for %s but received %q", expected[i], m.Path, m.Description)
+		}
+	}
+
+	// Names which are found replace the GUIDs
+	b.nameResolver = fakeNames{}
+	b.describeMounts(mounts, "instance-id", "organization-guid", "space-guid")
+	expected = []string{
+		"CF org=acme",
+		"CF org=acme space=space-guid",
+		"CF org=acme space=space-guid instance=my-vault",
+	}
+	for i, m := range mounts {
+		if m.Description != expected[i] {
+			t.Errorf("expected %q for %s but received %q", expected[i], m.Path, m.Description)
+		}
+	}
+
+	// Custom templates may use the GUIDs as well
+	b.mountDescription = template.Must(template.New("mount").Parse("{{.Instance}} ({{.ServiceInstanceGUID}})"))
+	b.describeMounts(mounts[2:], "instance-id", "organization-guid", "space-guid")
+	if d := mounts[2].Description; d != "my-vault (instance-id)" {
+		t.Fatalf("unexpected description %q", d)
+	}
+}
+
+// flakyNames fails to resolve names until it has been asked failures times.
+type flakyNames struct {
+	failures int
+	calls    int
+}
+
+func (f *flakyNames) lookup(guid string) (string, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return "", errors.New("service unavailable")
+	}
+	return "name-of-" + guid, nil
+}
+
+func (f *flakyNames) OrganizationName(guid string) (string, error)    { return f.lookup(guid) }
+func (f *flakyNames) SpaceName(guid string) (string, error)           { return f.lookup(guid) }
+func (f *flakyNames) ServiceInstanceName(guid string) (string, error) { return f.lookup(guid) }
+
+func TestBroker_LookupNames(t *testing.T) {
+	b := &Broker{log: NewLogger(os.Stdout, LogFormatText, LogLevelDebug)}
+
+	// Transient failures are retried
+	names := &flakyNames{failures: nameLookupAttempts - 1}
+	b.nameResolver = names
+	input, err := b.lookupNames("instance-id", "organization-guid", "space-guid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input.Organization != "name-of-organization-guid" || input.Space != "name-of-space-guid" || input.Instance != "name-of-instance-id" {
+		t.Fatalf("unexpected names %+v", input)
+	}
+
+	// Persistent failures fall back to the GUIDs and are reported, except
+	// for the instance which the platform may not know yet
+	b.nameResolver = fakeNames{}
+	input, err = b.lookupNames("instance-id", "organization-guid", "space-guid")
+	if err == nil || !strings.Contains(err.Error(), "space space-guid") || strings.Contains(err.Error(), "instance") {
+		t.Fatalf("expected an error for the space only but received %v", err)
+	}
+	if input.Organization != "acme" || input.Space != "space-guid" {
+		t.Fatalf("unexpected names %+v", input)
+	}
+	if _, err := b.lookupNames("unknown-instance", "organization-guid", ""); err != nil {
+		t.Fatalf("expected no error for the instance but received %s", err)
+	}
+}
+
+func TestBroker_Provision_NameLookupStrict(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// The space name of fakeNames cannot be looked up
+	env.Broker.mountDescription = template.Must(template.New("mount").Parse("{{.Space}}"))
+	env.Broker.nameResolver = fakeNames{}
+	env.Broker.nameLookupStrict = true
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	_, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async)
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok || failure.ValidatedStatusCode(nil) != http.StatusServiceUnavailable {
+		t.Fatalf("expected the provision to be rejected but received %v", err)
+	}
+	if env.Requests.contains("PUT /v1/sys/policy/cf-instance-id") {
+		t.Fatal("expected nothing to be created")
+	}
+
+	// In best-effort mode the GUID is used instead
+	env.Broker.nameLookupStrict = false
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+}
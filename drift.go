@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// checkDrift compares each restored instance with Vault and logs a warning for
+// every policy, token role, and mount which is missing, for example because it
+// was removed out-of-band. If repair is true, the missing pieces are created
+// again. It returns the number of discrepancies found.
+func (b *Broker) checkDrift(repair bool) (int, error) {
+	b.log.Printf("[DEBUG] checking instances for drift")
+
+	table, err := b.listMounts()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list mounts")
+	}
+
+	b.instancesLock.Lock()
+	instances := make(map[string]*instanceInfo, len(b.instances))
+	for id, info := range b.instances {
+		instances[id] = info
+	}
+	b.instancesLock.Unlock()
+
+	drift := 0
+	for instanceID, info := range instances {
+		found, err := b.checkInstanceDrift(instanceID, info, table, repair)
+		drift += len(found)
+		if err != nil {
+			b.log.Printf("[ERR] drift: failed to check instance %s: %s", instanceID, err)
+		}
+	}
+
+	if drift > 0 {
+		b.log.Printf("[WARN] drift: found %d discrepancies between %d instances and vault", drift, len(instances))
+	} else {
+		b.log.Printf("[INFO] drift: %d instances match vault", len(instances))
+	}
+	return drift, nil
+}
+
+// checkInstanceDrift checks a single instance against Vault and the given
+// mount table, returning a description of each discrepancy found.
+func (b *Broker) checkInstanceDrift(instanceID string, info *instanceInfo, table mountTable, repair bool) ([]string, error) {
+	logger := b.log.With("instance_id", instanceID)
+	plan, err := b.findPlan(info.PlanID)
+	if err != nil {
+		return nil, err
+	}
+	var drift []string
+	found := func(format string, v ...interface{}) {
+		d := fmt.Sprintf(format, v...)
+		logger.Printf("[WARN] drift: %s of instance %s", d, instanceID)
+		drift = append(drift, d)
+	}
+
+	// Check the policy, which must match the one the broker would write
+	policyName := "cf-" + instanceID
+	policy, err := b.vault().Sys().GetPolicy(policyName)
+	if err != nil {
+		return drift, errors.Wrapf(err, "failed to read policy %s", policyName)
+	}
+	expected, err := b.policyDocument(instanceID, info.OrganizationGUID, info.SpaceGUID, plan)
+	if err != nil {
+		return drift, err
+	}
+	if policy != expected {
+		if policy == "" {
+			found("policy %s is missing", policyName)
+		} else {
+			found("policy %s differs from the plan", policyName)
+		}
+		if repair {
+			if err := b.putPolicy(instanceID, info.OrganizationGUID, info.SpaceGUID, plan); err != nil {
+				return drift, err
+			}
+		}
+	}
+
+	// Check the token role
+	rolePath := "auth/token/roles/cf-" + instanceID
+	role, err := b.vault().Logical().Read(rolePath)
+	if err != nil {
+		return drift, errors.Wrapf(err, "failed to read token role %s", rolePath)
+	}
+	if role == nil {
+		found("token role %s is missing", rolePath)
+		if repair {
+			if err := b.putTokenRole(instanceID); err != nil {
+				return drift, err
+			}
+		}
+	}
+
+	// Check the mounts
+	var missing []Mount
+	mounts := b.vaultMounts(instanceID, info.OrganizationGUID, info.SpaceGUID, plan)
+	mounts = append(mounts, extraMounts(b.mountPrefix, instanceID, plan, info.ExtraMounts)...)
+	for _, m := range mounts {
+		existing, ok := table[strings.Trim(m.Path, "/")]
+		switch {
+		case !ok:
+			found("mount %s is missing", m.Path)
+			missing = append(missing, m)
+		case !mountTypeMatches(existing.Type, m.Type):
+			// Replacing the mount would destroy its data, so only report it
+			found("mount %s has type %s instead of %s", m.Path, existing.Type, m.Type)
+		}
+	}
+	if repair && len(missing) > 0 {
+		b.describeMounts(missing, instanceID, info.OrganizationGUID, info.SpaceGUID)
+		if err := b.idempotentMount(table, missing); err != nil {
+			return drift, errors.Wrapf(err, "failed to create mounts %s", mountsToKV(missing, ", "))
+		}
+	}
+	return drift, nil
+}
+
+// mountTypeMatches returns true if a mount of the given type in the mount table
+// is of the engine type. Vault lists "generic" mounts as "kv".
+func mountTypeMatches(existing string, t SecretEngineType) bool {
+	return existing == string(t) || (t == KV && existing == "kv")
+}
+
+// reconcileReport is what reconciling an instance found and repaired.
+type reconcileReport struct {
+	InstanceID string   `json:"instance_id"`
+	Drift      []string `json:"drift"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// reconcileInstances re-creates the policy, token role, and mounts which the
+// given instances, or all cached instances if none are given, are missing in
+// Vault, and rewrites policies which differ from the plan. Mounts of the
+// wrong type are only reported, since replacing them would destroy their data.
+// It returns a report per instance, sorted by ID.
+func (b *Broker) reconcileInstances(instanceIDs ...string) ([]reconcileReport, error) {
+	if len(instanceIDs) == 0 {
+		b.instancesLock.Lock()
+		for id := range b.instances {
+			instanceIDs = append(instanceIDs, id)
+		}
+		b.instancesLock.Unlock()
+	}
+	sort.Strings(instanceIDs)
+
+	table, err := b.listMounts()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list mounts")
+	}
+
+	reports := make([]reconcileReport, 0, len(instanceIDs))
+	for _, instanceID := range instanceIDs {
+		report := reconcileReport{InstanceID: instanceID, Drift: []string{}}
+		if drift, err := b.reconcileInstance(instanceID, table); err != nil {
+			b.log.Printf("[ERR] drift: failed to reconcile instance %s: %s", instanceID, err)
+			report.Error = err.Error()
+		} else if drift != nil {
+			report.Drift = drift
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// reconcileInstance repairs the drift of a single instance, serialized with
+// the other operations on it.
+func (b *Broker) reconcileInstance(instanceID string, table mountTable) ([]string, error) {
+	b.instanceMutex.Lock(instanceID)
+	defer b.instanceMutex.Unlock(instanceID)
+
+	b.instancesLock.Lock()
+	info, ok := b.instances[instanceID]
+	b.instancesLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("instance %s does not exist", instanceID)
+	}
+	return b.checkInstanceDrift(instanceID, info, table, true)
+}
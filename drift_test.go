@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestBroker_CheckDrift(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	// The policy and the four mounts of the default plan are missing
+	drift, err := env.Broker.checkDrift(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift != 5 {
+		t.Fatalf("expected 5 discrepancies but found %d", drift)
+	}
+	if env.Requests.contains("PUT /v1/sys/policy/cf-instance-id") {
+		t.Fatal("expected the policy to not be repaired")
+	}
+
+	if _, err := env.Broker.checkDrift(true); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []string{
+		"PUT /v1/sys/policy/cf-instance-id",
+		"POST /v1/sys/mounts/cf/instance-id/secret",
+		"POST /v1/sys/mounts/cf/instance-id/transit",
+	} {
+		if !env.Requests.contains(r) {
+			t.Errorf("expected %s to repair the drift", r)
+		}
+	}
+	if env.Requests.contains("PUT /v1/auth/token/roles/cf-instance-id") {
+		t.Fatal("expected the existing token role to be left alone")
+	}
+}
+
+func TestMountTypeMatches(t *testing.T) {
+	if !mountTypeMatches("kv", KV) || !mountTypeMatches("generic", KV) {
+		t.Fatal("expected kv mounts to match the KV engine")
+	}
+	if mountTypeMatches("kv", Transit) {
+		t.Fatal("expected kv mounts to not match the transit engine")
+	}
+}
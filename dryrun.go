@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// dryRunProvision logs what provisioning the instance would create in Vault,
+// without creating any of it.
+func (b *Broker) dryRunProvision(instanceID, orgGUID, spaceGUID string, plan *Plan, params *provisionParameters) error {
+	logger := b.log.With("instance_id", instanceID)
+	logger.Printf("[INFO] dry-run: provisioning %s with plan %s changes nothing in vault", instanceID, plan.Name)
+
+	policy, err := b.policyDocument(instanceID, orgGUID, spaceGUID, plan)
+	if err != nil {
+		return b.error(err)
+	}
+	logger.Printf("[INFO] dry-run: would create policy cf-%s:\n%s", instanceID, policy)
+	logger.Printf("[INFO] dry-run: would create token role %s with %s",
+		"auth/token/roles/cf-"+instanceID, dryRunJSON(b.tokenRoleData(instanceID)))
+
+	mounts := b.vaultMounts(instanceID, orgGUID, spaceGUID, plan)
+	mounts = append(mounts, extraMounts(b.mountPrefix, instanceID, plan, params.ExtraMounts)...)
+	b.describeMounts(mounts, instanceID, orgGUID, spaceGUID)
+	for _, m := range mounts {
+		logger.Printf("[INFO] dry-run: would create mount %s of type %s unless it exists, described as %q",
+			m.Path, m.Type, m.Description)
+	}
+	if plan.TransitKey != nil {
+		logger.Printf("[INFO] dry-run: would create transit key %s", plan.TransitKey.Name)
+	}
+	if plan.hasEngine(SSH) {
+		logger.Printf("[INFO] dry-run: would generate the SSH CA and role %s", SSHRoleName)
+	}
+	if plan.hasEngine(AWS) {
+		logger.Printf("[INFO] dry-run: would configure the AWS engine and role %s for %s", AWSRoleName, b.awsRoleARN)
+	}
+	logger.Printf("[INFO] dry-run: would store instance metadata at %s", b.store.Path(metadataKey(instanceID)))
+	return nil
+}
+
+// dryRunUpdate logs what moving the instance to the plan would change in
+// Vault, without changing any of it.
+func (b *Broker) dryRunUpdate(instanceID string, plan *Plan) {
+	logger := b.log.With("instance_id", instanceID)
+	logger.Printf("[INFO] dry-run: updating %s to plan %s changes nothing in vault", instanceID, plan.Name)
+	logger.Printf("[INFO] dry-run: would create missing mounts %s",
+		mountsToKV(instanceMounts(b.mountPrefix, instanceID, plan), ", "))
+	logger.Printf("[INFO] dry-run: would rewrite policy cf-%s for the plan", instanceID)
+	if b.unmountOnUpdate {
+		logger.Printf("[INFO] dry-run: would remove the mounts of the previous plan which plan %s lacks", plan.Name)
+	}
+	logger.Printf("[INFO] dry-run: would store instance metadata at %s", b.store.Path(metadataKey(instanceID)))
+}
+
+// dryRunDeprovision logs what deprovisioning the instance would remove from
+// Vault, without removing any of it.
+func (b *Broker) dryRunDeprovision(instanceID string, plan *Plan, extras []ExtraMount) {
+	logger := b.log.With("instance_id", instanceID)
+	logger.Printf("[INFO] dry-run: deprovisioning %s changes nothing in vault", instanceID)
+	logger.Printf("[INFO] dry-run: would revoke the bindings stored under %s", b.store.Path(metadataKey(instanceID)))
+	mounts := mountPaths(append(instanceMounts(b.mountPrefix, instanceID, plan),
+		extraMounts(b.mountPrefix, instanceID, plan, extras)...))
+	logger.Printf("[INFO] dry-run: would remove mounts %s", strings.Join(mounts, ", "))
+	logger.Printf("[INFO] dry-run: would delete token role auth/token/roles/cf-%s and policy cf-%s", instanceID, instanceID)
+	logger.Printf("[INFO] dry-run: would delete instance metadata at %s", b.store.Path(metadataKey(instanceID)))
+}
+
+// dryRunBind logs what binding to the instance would create in Vault, without
+// creating any of it. The returned binding has no token, only the address of
+// Vault and a dry_run marker.
+func (b *Broker) dryRunBind(instanceID, bindingID string, plan *Plan, params *bindParameters) brokerapi.Binding {
+	logger := b.log.With("instance_id", instanceID, "binding_id", bindingID)
+	logger.Printf("[INFO] dry-run: binding %s changes nothing in vault", bindingID)
+
+	data := map[string]interface{}{
+		"policies": b.bindTokenPolicies(instanceID, params, ""),
+	}
+	if params.ttl > 0 {
+		data["ttl"] = params.ttl.String()
+	}
+	if params.NumUses > 0 {
+		data["num_uses"] = params.NumUses
+	}
+	logger.Printf("[INFO] dry-run: would create a token with role cf-%s and %s", instanceID, dryRunJSON(data))
+	if params.SSHPublicKey != "" {
+		logger.Printf("[INFO] dry-run: would sign ssh_public_key with role %s", SSHRoleName)
+	}
+	if plan.hasEngine(AWS) {
+		logger.Printf("[INFO] dry-run: would generate AWS credentials with role %s", AWSRoleName)
+	}
+	if params.wrapTTL > 0 {
+		logger.Printf("[INFO] dry-run: would wrap the credentials for %s", params.wrapTTL)
+	}
+	logger.Printf("[INFO] dry-run: would store binding metadata at %s", b.store.Path(metadataKey(instanceID, bindingID)))
+
+	return brokerapi.Binding{
+		Credentials: map[string]interface{}{
+			"address": b.vaultAdvertiseAddr,
+			"dry_run": true,
+		},
+	}
+}
+
+// dryRunUnbind logs what unbinding would remove from Vault, without removing
+// any of it.
+func (b *Broker) dryRunUnbind(instanceID, bindingID string) {
+	logger := b.log.With("instance_id", instanceID, "binding_id", bindingID)
+	logger.Printf("[INFO] dry-run: unbinding %s changes nothing in vault", bindingID)
+	path := b.store.Path(metadataKey(instanceID, bindingID))
+	logger.Printf("[INFO] dry-run: would revoke the token and lease of the binding stored at %s and delete it", path)
+}
+
+// dryRunJSON renders data for dry-run logs.
+func dryRunJSON(data map[string]interface{}) string {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return "<unprintable>"
+	}
+	return string(out)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestBroker_DryRun(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+	env.Broker.dryRun = true
+	env.Broker.vaultRenewToken = false
+
+	// Anything but a read would change Vault
+	var lock sync.Mutex
+	var writes []string
+	env.Requests.setHook(func(r *http.Request) {
+		if r.Method != "GET" {
+			lock.Lock()
+			writes = append(writes, r.Method+" "+r.URL.String())
+			lock.Unlock()
+		}
+	})
+
+	if err := env.Broker.Start(env.Context); err != nil {
+		t.Fatal(err)
+	}
+	defer env.Broker.Stop()
+	if env.Requests.contains("GET /v1/cf/broker?list=true") {
+		t.Fatal("expected nothing to be restored")
+	}
+
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	binding, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	if credentials["dry_run"] != true || credentials["auth"] != nil {
+		t.Fatalf("expected dry-run credentials without a token but received %v", credentials)
+	}
+
+	if err := env.Broker.Unbind(env.Context, env.InstanceID, env.BindingID, brokerapi.UnbindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Broker.Deprovision(env.Context, env.InstanceID, brokerapi.DeprovisionDetails{}, env.Async); err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(writes) > 0 {
+		t.Fatalf("expected no changes to vault but received %v", writes)
+	}
+}
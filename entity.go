@@ -0,0 +1,153 @@
+package main
+
+import (
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// entityName returns the name of the Vault Identity entity of the instance,
+// which the tokens of all its bindings are attached to.
+func entityName(instanceID string) string {
+	return "cf-" + instanceID
+}
+
+// entityAliasName returns the name of the entity alias of the binding's token.
+// The instance's token role allows the aliases "cf-instanceID-*".
+func entityAliasName(instanceID, bindingID string) string {
+	return "cf-" + instanceID + "-" + bindingID
+}
+
+// lookupTokenAuthAccessor returns the accessor of the token auth method, which
+// entity aliases of binding tokens are created against.
+func (b *Broker) lookupTokenAuthAccessor() (string, error) {
+	auths, err := b.vault().Sys().ListAuth()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list auth methods")
+	}
+	m, ok := auths["token/"]
+	if !ok || m.Accessor == "" {
+		return "", errors.New("the token auth method has no accessor")
+	}
+	return m.Accessor, nil
+}
+
+// instanceEntity returns the instance with the ID of its entity, creating the
+// entity and recording its ID on the instance if it has none yet.
+func (b *Broker) instanceEntity(instanceID string, instance *instanceInfo) (*instanceInfo, error) {
+	if instance.EntityID != "" {
+		return instance, nil
+	}
+
+	// Writing the entity by name creates it, or updates it if it was left
+	// behind by an earlier attempt, in which case Vault returns nothing
+	path := "identity/entity/name/" + entityName(instanceID)
+	b.log.Printf("[DEBUG] creating entity %s", path)
+	secret, err := b.vault().Logical().Write(path, map[string]interface{}{
+		"metadata": map[string]string{
+			"cf-instance-id": instanceID,
+			"cf-org-guid":    instance.OrganizationGUID,
+			"cf-space-guid":  instance.SpaceGUID,
+		},
+	})
+	if err == nil && (secret == nil || secret.Data == nil) {
+		secret, err = b.vault().Logical().Read(path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create entity %s", path)
+	}
+	var id string
+	if secret != nil {
+		id, _ = secret.Data["id"].(string)
+	}
+	if id == "" {
+		return nil, errors.Errorf("vault returned no ID for entity %s", path)
+	}
+
+	b.log.Printf("[INFO] recording entity %s of instance %s", id, instanceID)
+	updated := *instance
+	updated.EntityID = id
+	if err := b.writeInstance(instanceID, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// createEntityAlias creates the alias of the binding's token in the token auth
+// method, attached to the given entity, and returns its ID.
+func (b *Broker) createEntityAlias(instanceID, bindingID, entityID string) (string, error) {
+	name := entityAliasName(instanceID, bindingID)
+	b.log.Printf("[DEBUG] creating entity alias %s for entity %s", name, entityID)
+	secret, err := b.vault().Logical().Write("identity/entity-alias", map[string]interface{}{
+		"name":           name,
+		"canonical_id":   entityID,
+		"mount_accessor": b.tokenAuthAccessor,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create entity alias %s", name)
+	}
+	var id string
+	if secret != nil {
+		id, _ = secret.Data["id"].(string)
+	}
+	if id == "" {
+		return "", errors.Errorf("vault returned no ID for entity alias %s", name)
+	}
+	return id, nil
+}
+
+// deleteEntityAlias deletes the entity alias with the given ID. Deleting an
+// alias which does not exist succeeds.
+func (b *Broker) deleteEntityAlias(id string) error {
+	path := "identity/entity-alias/id/" + id
+	b.log.Printf("[DEBUG] deleting entity alias %s", path)
+	if _, err := b.vault().Logical().Delete(path); err != nil {
+		return errors.Wrapf(err, "failed to delete entity alias %s", path)
+	}
+	return nil
+}
+
+// deleteInstanceEntity deletes the entity of the instance along with any alias
+// left on it.
+func (b *Broker) deleteInstanceEntity(instanceID string) error {
+	path := "identity/entity/name/" + entityName(instanceID)
+	b.log.Printf("[DEBUG] deleting entity %s", path)
+	if _, err := b.vault().Logical().Delete(path); err != nil {
+		return errors.Wrapf(err, "failed to delete entity %s", path)
+	}
+	return nil
+}
+
+// tokenCreateRequest adds the entity alias, which the vendored Vault client
+// does not support, to a token creation request.
+type tokenCreateRequest struct {
+	*api.TokenCreateRequest
+	EntityAlias string `json:"entity_alias,omitempty"`
+}
+
+// createTokenWithEntityAlias creates a token against the role, attached to the
+// entity of the given alias.
+func (b *Broker) createTokenWithEntityAlias(req *api.TokenCreateRequest, roleName, alias string) (*api.Secret, error) {
+	r := b.vault().NewRequest("POST", "/v1/auth/token/create/"+roleName)
+	if err := r.SetJSONBody(&tokenCreateRequest{TokenCreateRequest: req, EntityAlias: alias}); err != nil {
+		return nil, err
+	}
+	resp, err := b.vault().RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return api.ParseSecret(resp.Body)
+}
+
+// abandonEntityAlias deletes the alias of a binding which failed, if one was
+// created. Failures are only logged, since the alias is unused without a token.
+func (b *Broker) abandonEntityAlias(logger *Logger, id string) {
+	if id == "" {
+		return
+	}
+	if err := b.deleteEntityAlias(id); err != nil {
+		logger.Printf("[WARN] %s", err)
+	}
+}
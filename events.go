@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// The types of lifecycle events.
+const (
+	eventProvision   = "provision"
+	eventDeprovision = "deprovision"
+	eventBind        = "bind"
+	eventUnbind      = "unbind"
+)
+
+// eventSinkTimeout bounds the delivery of a single event.
+const eventSinkTimeout = 10 * time.Second
+
+// lifecycleEvent is emitted to the event sink when an instance or binding is
+// created or deleted, whether or not the operation succeeded.
+type lifecycleEvent struct {
+	Type             string    `json:"type"`
+	InstanceID       string    `json:"instance_id"`
+	BindingID        string    `json:"binding_id,omitempty"`
+	OrganizationGUID string    `json:"organization_guid,omitempty"`
+	SpaceGUID        string    `json:"space_guid,omitempty"`
+	RequestID        string    `json:"request_id,omitempty"`
+	Timestamp        time.Time `json:"timestamp"`
+	Outcome          string    `json:"outcome"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// parseEventSinkURL parses the URL of an event sink. Events are POSTed to
+// http and https URLs, and written as lines of JSON to tcp and udp addresses,
+// such as those of a syslog or log shipper input.
+func parseEventSinkURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, must be http, https, tcp, or udp", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", s)
+	}
+	return u, nil
+}
+
+// eventSink delivers lifecycle events in the background. Events are queued so
+// that a slow or unavailable sink never blocks the broker's operations, and
+// events which do not fit in the queue are dropped and counted.
+type eventSink struct {
+	url    *url.URL
+	client *http.Client
+	events chan lifecycleEvent
+	log    *Logger
+
+	// conn is the connection to a tcp or udp sink. It is dialed on demand
+	// and only used by run.
+	conn net.Conn
+
+	dropped int64
+	failed  int64
+}
+
+// newEventSink returns a sink for the given URL which queues up to buffer
+// events.
+func newEventSink(u *url.URL, buffer int, log *Logger) *eventSink {
+	return &eventSink{
+		url:    u,
+		client: &http.Client{Timeout: eventSinkTimeout},
+		events: make(chan lifecycleEvent, buffer),
+		log:    log,
+	}
+}
+
+// emit queues the event without blocking, dropping it if the queue is full.
+func (s *eventSink) emit(e lifecycleEvent) {
+	select {
+	case s.events <- e:
+	default:
+		if atomic.AddInt64(&s.dropped, 1) == 1 {
+			s.log.Printf("[WARN] events: queue is full, dropping events")
+		}
+	}
+}
+
+// run delivers queued events until stopCh is closed. Failed deliveries are
+// logged and counted, and not retried.
+func (s *eventSink) run(stopCh <-chan struct{}) {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	for {
+		select {
+		case e := <-s.events:
+			if err := s.deliver(e); err != nil {
+				atomic.AddInt64(&s.failed, 1)
+				s.log.Printf("[WARN] events: failed to deliver %s event of %s: %s", e.Type, e.InstanceID, err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// deliver sends a single event to the sink.
+func (s *eventSink) deliver(e lifecycleEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if s.url.Scheme == "http" || s.url.Scheme == "https" {
+		resp, err := s.client.Post(s.url.String(), "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("event sink returned %s", resp.Status)
+		}
+		return nil
+	}
+
+	if s.conn == nil {
+		if s.conn, err = net.DialTimeout(s.url.Scheme, s.url.Host, eventSinkTimeout); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(eventSinkTimeout))
+	if _, err := s.conn.Write(append(payload, '\n')); err != nil {
+		// Dial again for the next event
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// writeMetrics writes the number of dropped and undelivered events.
+func (s *eventSink) writeMetrics(w io.Writer) {
+	writeMetric(w, "vault_service_broker_events_dropped_total", "counter",
+		"Number of lifecycle events dropped because the queue was full.",
+		float64(atomic.LoadInt64(&s.dropped)), nil)
+	writeMetric(w, "vault_service_broker_events_failed_total", "counter",
+		"Number of lifecycle events which could not be delivered to the event sink.",
+		float64(atomic.LoadInt64(&s.failed)), nil)
+}
+
+// emitEvent queues a lifecycle event with the outcome of the operation, if an
+// event sink is configured. Nothing is emitted in a dry run, since nothing
+// changed.
+func (b *Broker) emitEvent(ctx context.Context, e lifecycleEvent, err error) {
+	if b.events == nil || b.dryRun {
+		return
+	}
+	e.RequestID = contextRequestID(ctx)
+	e.Timestamp = time.Now().UTC()
+	e.Outcome = "succeeded"
+	if err != nil {
+		e.Outcome = "failed"
+		e.Error = err.Error()
+	}
+	b.events.emit(e)
+}
+
+// instanceEvent returns an event of the given type for the instance, with its
+// organization and space if it is cached.
+func (b *Broker) instanceEvent(eventType, instanceID string) lifecycleEvent {
+	e := lifecycleEvent{Type: eventType, InstanceID: instanceID}
+	b.instancesLock.Lock()
+	if info, ok := b.instances[instanceID]; ok {
+		e.OrganizationGUID = info.OrganizationGUID
+		e.SpaceGUID = info.SpaceGUID
+	}
+	b.instancesLock.Unlock()
+	return e
+}
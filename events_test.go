@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestParseEventSinkURL(t *testing.T) {
+	for _, s := range []string{"https://events.example.com/vault", "tcp://127.0.0.1:5140", "udp://syslog:514"} {
+		if _, err := parseEventSinkURL(s); err != nil {
+			t.Errorf("expected %s to be valid but received %s", s, err)
+		}
+	}
+	for _, s := range []string{"events.example.com", "ftp://events.example.com", "https://", "tcp:///path"} {
+		if _, err := parseEventSinkURL(s); err == nil {
+			t.Errorf("expected %s to be invalid", s)
+		}
+	}
+}
+
+func TestEventSink_HTTP(t *testing.T) {
+	received := make(chan lifecycleEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e lifecycleEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected JSON but received %q", ct)
+		}
+		received <- e
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	sink := newEventSink(u, 10, NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go sink.run(stopCh)
+
+	sink.emit(lifecycleEvent{Type: eventBind, InstanceID: "instance-id", BindingID: "binding-id", Outcome: "succeeded"})
+	e := <-received
+	if e.Type != eventBind || e.InstanceID != "instance-id" || e.BindingID != "binding-id" || e.Outcome != "succeeded" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestEventSink_TCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	u, _ := url.Parse("tcp://" + l.Addr().String())
+	sink := newEventSink(u, 10, NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go sink.run(stopCh)
+
+	sink.emit(lifecycleEvent{Type: eventProvision, InstanceID: "instance-id"})
+	sink.emit(lifecycleEvent{Type: eventDeprovision, InstanceID: "instance-id"})
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{eventProvision, eventDeprovision} {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e lifecycleEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != expected {
+			t.Fatalf("expected a %s event but received %+v", expected, e)
+		}
+	}
+}
+
+func TestEventSink_Dropped(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	sink := newEventSink(u, 1, NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug))
+
+	// Nothing delivers the events, so the second one does not fit
+	sink.emit(lifecycleEvent{Type: eventBind})
+	sink.emit(lifecycleEvent{Type: eventUnbind})
+
+	var buf bytes.Buffer
+	sink.writeMetrics(&buf)
+	if !strings.Contains(buf.String(), "vault_service_broker_events_dropped_total 1\n") {
+		t.Fatalf("expected 1 dropped event but received\n%s", buf.String())
+	}
+}
+
+func TestBroker_Events(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	u, _ := url.Parse("http://127.0.0.1:1")
+	sink := newEventSink(u, 10, env.Broker.log)
+	env.Broker.events = sink
+
+	details := brokerapi.ProvisionDetails{
+		SpaceGUID:        env.SpaceGUID,
+		OrganizationGUID: env.OrganizationGUID,
+	}
+	if _, err := env.Broker.Provision(env.Context, env.InstanceID, details, env.Async); err != nil {
+		t.Fatal(err)
+	}
+	e := <-sink.events
+	if e.Type != eventProvision || e.Outcome != "succeeded" || e.SpaceGUID != "space-guid" || e.Timestamp.IsZero() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// Failures are emitted with their error
+	if _, err := env.Broker.Bind(env.Context, "unknown-instance", env.BindingID, brokerapi.BindDetails{}); err == nil {
+		t.Fatal("expected an error for an unknown instance")
+	}
+	e = <-sink.events
+	if e.Type != eventBind || e.BindingID != "binding-id" || e.Outcome != "failed" || e.Error == "" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	// Nothing is emitted in a dry run
+	env.Broker.dryRun = true
+	if _, err := env.Broker.Bind(env.Context, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sink.events); n != 0 {
+		t.Fatalf("expected no events but received %d", n)
+	}
+}
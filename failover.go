@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// failoverTransport sends requests to the first of several Vault addresses
+// which is reachable and able to serve them. The address which last served a
+// request is tried first, so requests stick to one node until it fails.
+//
+// A request is only sent to the next address if the current one could not be
+// connected to, or responded 503 because it is sealed or is a standby without
+// an active node. In both cases Vault has not acted on the request, so writes
+// are never applied twice.
+type failoverTransport struct {
+	addrs []*url.URL
+	next  http.RoundTripper
+
+	// lock protects current
+	lock    sync.Mutex
+	current int
+}
+
+// newFailoverTransport returns a transport failing over between the given
+// addresses. Only the scheme and host of each address are used.
+func newFailoverTransport(addrs []string, next http.RoundTripper) (*failoverTransport, error) {
+	t := &failoverTransport{next: next}
+	for _, addr := range addrs {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		t.addrs = append(t.addrs, u)
+	}
+	return t, nil
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	start := t.current
+	t.lock.Unlock()
+
+	for i := 0; ; i++ {
+		idx := (start + i) % len(t.addrs)
+
+		// Round trippers must not modify the original request
+		r := new(http.Request)
+		*r = *req
+		u := *req.URL
+		u.Scheme = t.addrs[idx].Scheme
+		u.Host = t.addrs[idx].Host
+		r.URL = &u
+		r.Host = ""
+		if i > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(r)
+		last := i == len(t.addrs)-1 || (req.Body != nil && req.GetBody == nil)
+		if last || !shouldFailover(resp, err) {
+			if err == nil {
+				t.lock.Lock()
+				t.current = idx
+				t.lock.Unlock()
+			}
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+}
+
+// shouldFailover reports whether a request which resulted in the given
+// response or error should be sent to another address.
+func shouldFailover(resp *http.Response, err error) bool {
+	if err != nil {
+		opErr, ok := err.(*net.OpError)
+		return ok && opErr.Op == "dial"
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable
+}
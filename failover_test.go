@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// failoverServer returns a fake Vault which responds to every request with the
+// given status code and records the request bodies.
+func failoverServer(code int) (*httptest.Server, *[]string) {
+	var lock sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+		w.WriteHeader(code)
+		w.Write([]byte(`{}`))
+	}))
+	return ts, &bodies
+}
+
+func TestNewVaultClient_Failover(t *testing.T) {
+	// The first address refuses connections, the second is sealed
+	down, _ := failoverServer(200)
+	down.Close()
+	sealed, sealedBodies := failoverServer(503)
+	defer sealed.Close()
+	active, activeBodies := failoverServer(200)
+	defer active.Close()
+
+	client, err := newVaultClient(&Configuration{
+		VaultAddr:  down.URL,
+		VaultAddrs: []string{down.URL, sealed.URL, active.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetMaxRetries(0)
+
+	// The write, including its body, reaches the active node
+	if _, err := client.Logical().Write("secret/foo", map[string]interface{}{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`{"a":"b"}` + "\n"}
+	if !reflect.DeepEqual(*sealedBodies, expected) {
+		t.Fatalf("expected %q but received %q", expected, *sealedBodies)
+	}
+	if !reflect.DeepEqual(*activeBodies, expected) {
+		t.Fatalf("expected %q but received %q", expected, *activeBodies)
+	}
+
+	// Later requests go straight to the active node
+	if _, err := client.Logical().Read("secret/foo"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sealedBodies) != 1 {
+		t.Fatalf("expected the sealed node to be skipped but it received %d requests", len(*sealedBodies))
+	}
+	if len(*activeBodies) != 2 {
+		t.Fatalf("expected 2 requests to the active node but received %d", len(*activeBodies))
+	}
+}
+
+func TestNewVaultClient_Failover_AllDown(t *testing.T) {
+	sealed1, _ := failoverServer(503)
+	defer sealed1.Close()
+	sealed2, _ := failoverServer(503)
+	defer sealed2.Close()
+
+	client, err := newVaultClient(&Configuration{
+		VaultAddr:  sealed1.URL,
+		VaultAddrs: []string{sealed1.URL, sealed2.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetMaxRetries(0)
+
+	if _, err := client.Logical().Read("secret/foo"); vaultErrorCode(err) != 503 {
+		t.Fatalf("expected a 503 error but received %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+)
+
+// configFlags are the command line flags which override settings, and the
+// environment variable each of them overrides. Secrets such as VAULT_TOKEN
+// have no flag, because command lines are visible to other users.
+var configFlags = []struct {
+	name string
+	env  string
+}{
+	{"port", "PORT"},
+	{"bind-address", "BIND_ADDRESS"},
+	{"broker-tls-cert", "BROKER_TLS_CERT"},
+	{"broker-tls-key", "BROKER_TLS_KEY"},
+	{"service-id", "SERVICE_ID"},
+	{"service-name", "SERVICE_NAME"},
+	{"service-description", "SERVICE_DESCRIPTION"},
+	{"vault-addr", "VAULT_ADDR"},
+	{"vault-advertise-addr", "VAULT_ADVERTISE_ADDR"},
+	{"vault-auth-method", "VAULT_AUTH_METHOD"},
+	{"vault-namespace", "VAULT_NAMESPACE"},
+	{"mount-prefix", "MOUNT_PREFIX"},
+	{"log-format", "LOG_FORMAT"},
+	{"log-level", "LOG_LEVEL"},
+}
+
+// parseFlags parses the command line. The flags which are given override their
+// environment variables, so that parseConfig sees them in place of the
+// environment and the defaults. It returns true if the version was requested.
+func parseFlags(args []string, output io.Writer) (bool, error) {
+	fs := flag.NewFlagSet("vault-service-broker", flag.ContinueOnError)
+	fs.SetOutput(output)
+	version := fs.Bool("version", false, "print the version and exit")
+	for _, f := range configFlags {
+		fs.String(f.name, "", fmt.Sprintf("overrides %s", f.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return false, err
+	}
+	if fs.NArg() > 0 {
+		return false, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, cf := range configFlags {
+			if cf.name == f.Name && err == nil {
+				err = os.Setenv(cf.env, f.Value.String())
+			}
+		}
+	})
+	return *version, err
+}
+
+// versionString describes the build of the broker.
+func versionString() string {
+	build := currentBuild()
+	if build.GitCommit != "" {
+		return fmt.Sprintf("vault-service-broker v%s-%s (%s %s/%s)", build.Version, build.GitCommit, build.GoVersion, runtime.GOOS, runtime.GOARCH)
+	}
+	return fmt.Sprintf("vault-service-broker v%s (%s %s/%s)", build.Version, build.GoVersion, runtime.GOOS, runtime.GOARCH)
+}
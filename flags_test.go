@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("PORT", "9000")
+	os.Setenv("SERVICE_NAME", "vault")
+
+	version, err := parseFlags([]string{"-port", "9001", "-vault-addr=http://vault:8200"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version {
+		t.Fatal("expected no version request")
+	}
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddr != ":9001" {
+		t.Fatalf("expected %q but received %q", ":9001", config.ListenAddr)
+	}
+	if config.VaultAddr != "http://vault:8200/" {
+		t.Fatalf("expected %q but received %q", "http://vault:8200/", config.VaultAddr)
+	}
+	if config.ServiceName != "vault" {
+		t.Fatalf("expected %q but received %q", "vault", config.ServiceName)
+	}
+	if config.ServiceID != "0654695e-0760-a1d4-1cad-5dd87b75ed99" {
+		t.Fatalf("expected the default service ID but received %q", config.ServiceID)
+	}
+}
+
+func TestParseFlags_Version(t *testing.T) {
+	os.Clearenv()
+
+	version, err := parseFlags([]string{"-version"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !version {
+		t.Fatal("expected a version request")
+	}
+	if s := versionString(); !strings.Contains(s, Version) {
+		t.Fatalf("expected %q to contain %q", s, Version)
+	}
+
+	defer func(commit string) { GitCommit = commit }(GitCommit)
+	GitCommit = "abc1234"
+	if s := versionString(); !strings.Contains(s, "v"+Version+"-abc1234") {
+		t.Fatalf("expected %q to contain the commit", s)
+	}
+}
+
+func TestParseFlags_Invalid(t *testing.T) {
+	os.Clearenv()
+
+	if _, err := parseFlags([]string{"-vault-token", "secret"}, ioutil.Discard); err == nil {
+		t.Fatal("expected an error for an unknown flag")
+	}
+	if _, err := parseFlags([]string{"serve"}, ioutil.Discard); err == nil {
+		t.Fatal("expected an error for an argument")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/vault/api"
+)
+
+// vaultReady reports whether Vault is initialized, unsealed, and reachable. If
+// it is not, the returned error says why.
+func vaultReady(client *api.Client) error {
+	health, err := client.Sys().Health()
+	switch {
+	case vaultErrorCode(err) == 501:
+		return errors.New("vault is not initialized")
+	case vaultErrorCode(err) == 503:
+		return errors.New("vault is sealed")
+	case err != nil:
+		return err
+	case !health.Initialized:
+		return errors.New("vault is not initialized")
+	case health.Sealed:
+		return errors.New("vault is sealed")
+	}
+	return nil
+}
+
+// vaultEnterprise reports whether Vault is an Enterprise build, whose version
+// has a suffix such as "+ent", and returns the version.
+func vaultEnterprise(client *api.Client) (bool, string, error) {
+	health, err := client.Sys().Health()
+	if err != nil {
+		return false, "", err
+	}
+	return strings.Contains(health.Version, "+ent"), health.Version, nil
+}
+
+// waitForVault polls Vault's health every interval until it is ready, giving
+// up after maxWait or when the context is cancelled. A maxWait of zero checks
+// once without waiting.
+func waitForVault(ctx context.Context, client *api.Client, logger *Logger, maxWait, interval time.Duration) error {
+	deadline := time.Now().Add(maxWait)
+	for {
+		err := vaultReady(client)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("vault at %s was not ready after %s: %s", client.Address(), maxWait, err)
+		}
+		logger.Printf("[WARN] waiting for vault at %s, retrying in %s: %s", client.Address(), interval, err)
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// vaultHealth is the result of the background health probe of Vault.
+type vaultHealth struct {
+	lock     sync.Mutex
+	err      error
+	checked  time.Time
+	failures uint64
+}
+
+// probeVault checks that Vault is ready and that the broker's token is still
+// valid.
+func (b *Broker) probeVault() error {
+	if err := vaultReady(b.vault()); err != nil {
+		return err
+	}
+	if _, err := b.vault().Auth().Token().LookupSelf(); err != nil {
+		return fmt.Errorf("failed to look up the broker's token: %s", err)
+	}
+	return nil
+}
+
+// healthProbeLoop probes Vault every healthProbeInterval until the broker is
+// stopped, starting right away.
+func (b *Broker) healthProbeLoop() {
+	for {
+		b.recordHealth(b.probeVault())
+		if !b.sleepOrStop(b.healthProbeInterval, nil) {
+			return
+		}
+	}
+}
+
+// recordHealth stores the result of a probe, logging when Vault becomes
+// unhealthy and when it recovers.
+func (b *Broker) recordHealth(err error) {
+	h := &b.vaultHealth
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	switch {
+	case err != nil && h.err == nil:
+		b.log.Printf("[WARN] health probe failed: %s", err)
+	case err != nil:
+		b.log.Printf("[DEBUG] health probe failed again: %s", err)
+	case h.err != nil:
+		b.log.Printf("[INFO] health probe succeeded, vault is reachable again")
+	}
+	if err != nil {
+		h.failures++
+	}
+	h.err = err
+	h.checked = time.Now().UTC()
+}
+
+// healthStatus is the response of the health endpoint.
+type healthStatus struct {
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+
+	// TokenRenewal is "ok" while the last renewal of the broker's token
+	// succeeded and "failing" otherwise, if the broker renews its token. It
+	// does not change the status code, since the token may still be valid.
+	TokenRenewal string `json:"token_renewal,omitempty"`
+}
+
+// tokenRenewalStatus returns the TokenRenewal of the health status.
+func (b *Broker) tokenRenewalStatus() string {
+	if !b.vaultRenewToken {
+		return ""
+	}
+	if atomic.LoadInt32(&b.tokenRenewalHealthy) == 1 {
+		return "ok"
+	}
+	return "failing"
+}
+
+// attachHealthRoutes adds the health endpoint to the router. It is served
+// without credentials, for load balancers and orchestrators.
+func attachHealthRoutes(router *mux.Router, b *Broker) {
+	router.HandleFunc("/healthz", b.handleHealthz).Methods("GET")
+}
+
+// handleHealthz returns the result of the last health probe, with 503 if it
+// failed or has not run yet. Without the probe, it only reports that the
+// broker is up.
+func (b *Broker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	renewal := b.tokenRenewalStatus()
+	if b.healthProbeInterval <= 0 {
+		respondJSON(w, http.StatusOK, healthStatus{Status: "ok", TokenRenewal: renewal})
+		return
+	}
+
+	h := &b.vaultHealth
+	h.lock.Lock()
+	err, checked := h.err, h.checked
+	h.lock.Unlock()
+
+	switch {
+	case checked.IsZero():
+		respondJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "unknown", TokenRenewal: renewal})
+	case err != nil:
+		respondJSON(w, http.StatusServiceUnavailable, healthStatus{
+			Status:       "unhealthy",
+			Error:        err.Error(),
+			CheckedAt:    &checked,
+			TokenRenewal: renewal,
+		})
+	default:
+		respondJSON(w, http.StatusOK, healthStatus{Status: "ok", CheckedAt: &checked, TokenRenewal: renewal})
+	}
+}
+
+// writeHealthMetrics writes the result of the last health probe and the
+// number of failed probes, if the probe is enabled.
+func (b *Broker) writeHealthMetrics(w io.Writer) {
+	if b.healthProbeInterval <= 0 {
+		return
+	}
+	h := &b.vaultHealth
+	h.lock.Lock()
+	healthy := !h.checked.IsZero() && h.err == nil
+	failures := h.failures
+	h.lock.Unlock()
+
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	writeMetric(w, "vault_service_broker_vault_healthy", "gauge",
+		"Whether the last health probe of Vault and the broker's token succeeded.", value, nil)
+	writeMetric(w, "vault_service_broker_vault_probe_failures_total", "counter",
+		"Number of failed health probes of Vault and the broker's token.", float64(failures), nil)
+}
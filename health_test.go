@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// healthServer returns a fake Vault whose health endpoint responds with the
+// given status codes in turn, repeating the last one.
+func healthServer(codes ...int) *httptest.Server {
+	var lock sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/sys/health" {
+			w.WriteHeader(404)
+			return
+		}
+		lock.Lock()
+		code := codes[0]
+		if len(codes) > 1 {
+			codes = codes[1:]
+		}
+		lock.Unlock()
+
+		w.WriteHeader(code)
+		w.Write([]byte(`{"initialized": true, "sealed": false, "standby": false}`))
+	}))
+}
+
+func healthClient(t *testing.T, addr string) *api.Client {
+	config := api.DefaultConfig()
+	config.Address = addr
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestWaitForVault(t *testing.T) {
+	ts := healthServer(501, 503, 503, 200)
+	defer ts.Close()
+
+	logger := NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug)
+	if err := waitForVault(context.Background(), healthClient(t, ts.URL), logger, time.Second, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitForVault_Standby(t *testing.T) {
+	ts := healthServer(429)
+	defer ts.Close()
+
+	logger := NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug)
+	if err := waitForVault(context.Background(), healthClient(t, ts.URL), logger, 0, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVaultEnterprise(t *testing.T) {
+	for version, expected := range map[string]bool{
+		"1.2.3":      false,
+		"1.2.3+ent":  true,
+		"1.2.3+prem": false,
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"initialized": true, "version": "` + version + `"}`))
+		}))
+		enterprise, v, err := vaultEnterprise(healthClient(t, ts.URL))
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enterprise != expected || v != version {
+			t.Errorf("expected %t for %s but received %t for %s", expected, version, enterprise, v)
+		}
+	}
+}
+
+func TestWaitForVault_Timeout(t *testing.T) {
+	ts := healthServer(503)
+	defer ts.Close()
+
+	logger := NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug)
+	err := waitForVault(context.Background(), healthClient(t, ts.URL), logger, 20*time.Millisecond, 5*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "vault is sealed") {
+		t.Fatalf("expected a sealed error but received %v", err)
+	}
+}
+
+func TestWaitForVault_Cancel(t *testing.T) {
+	ts := healthServer(503)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	logger := NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug)
+	start := time.Now()
+	err := waitForVault(ctx, healthClient(t, ts.URL), logger, time.Minute, 5*time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected %v but received %v", context.DeadlineExceeded, err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("expected the wait to stop when cancelled but it took %s", d)
+	}
+}
+
+func TestBroker_HealthProbe(t *testing.T) {
+	var lock sync.Mutex
+	tokenValid := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.URL.Path == "/v1/sys/health":
+			w.Write([]byte(`{"initialized": true, "sealed": false}`))
+		case r.URL.Path == "/v1/auth/token/lookup-self" && tokenValid:
+			w.Write([]byte(`{"data": {"id": "token"}}`))
+		default:
+			w.WriteHeader(403)
+		}
+	}))
+	defer ts.Close()
+
+	b := &Broker{
+		log:                 NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug),
+		vaultClient:         healthClient(t, ts.URL),
+		healthProbeInterval: time.Minute,
+	}
+	healthz := func() int {
+		w := httptest.NewRecorder()
+		b.handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code
+	}
+	metrics := func() string {
+		var buf bytes.Buffer
+		b.writeHealthMetrics(&buf)
+		return buf.String()
+	}
+
+	if c := healthz(); c != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d before the first probe but received %d", http.StatusServiceUnavailable, c)
+	}
+
+	b.recordHealth(b.probeVault())
+	if c := healthz(); c != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, c)
+	}
+	if m := metrics(); !strings.Contains(m, "vault_service_broker_vault_healthy 1\n") {
+		t.Fatalf("expected a healthy metric but received\n%s", m)
+	}
+
+	// A revoked token makes the broker unhealthy
+	lock.Lock()
+	tokenValid = false
+	lock.Unlock()
+	b.recordHealth(b.probeVault())
+	if c := healthz(); c != http.StatusServiceUnavailable {
+		t.Fatalf("expected %d but received %d", http.StatusServiceUnavailable, c)
+	}
+	m := metrics()
+	if !strings.Contains(m, "vault_service_broker_vault_healthy 0\n") ||
+		!strings.Contains(m, "vault_service_broker_vault_probe_failures_total 1\n") {
+		t.Fatalf("expected an unhealthy metric and one failure but received\n%s", m)
+	}
+
+	// Without the probe, the endpoint only reports that the broker is up
+	b.healthProbeInterval = 0
+	if c := healthz(); c != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, c)
+	}
+	if m := metrics(); m != "" {
+		t.Fatalf("expected no metrics but received\n%s", m)
+	}
+}
+
+func TestBroker_Healthz_TokenRenewal(t *testing.T) {
+	b := &Broker{vaultRenewToken: true}
+	renewal := func() string {
+		w := httptest.NewRecorder()
+		b.handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d but received %d", http.StatusOK, w.Code)
+		}
+		var status healthStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status.TokenRenewal
+	}
+
+	if r := renewal(); r != "failing" {
+		t.Fatalf("expected failing before the first renewal but received %q", r)
+	}
+	atomic.StoreInt32(&b.tokenRenewalHealthy, 1)
+	if r := renewal(); r != "ok" {
+		t.Fatalf("expected ok but received %q", r)
+	}
+	b.renewalFailed("broker", renewFailedLookup)
+	if r := renewal(); r != "failing" {
+		t.Fatalf("expected failing but received %q", r)
+	}
+
+	// Brokers which do not renew their token leave it out
+	b.vaultRenewToken = false
+	if r := renewal(); r != "" {
+		t.Fatalf("expected no token renewal status but received %q", r)
+	}
+}
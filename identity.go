@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// OriginatingIdentityHeader is the header in which the platform identifies
+// the user that triggered a request.
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// originatingIdentity returns a description of the user that triggered the
+// request, for example "cloudfoundry user 683ea748-...". It returns an empty
+// string if the header is missing or malformed.
+func originatingIdentity(r *http.Request) string {
+	parts := strings.SplitN(strings.TrimSpace(r.Header.Get(OriginatingIdentityHeader)), " ", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	platform, value := parts[0], parts[1]
+
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return ""
+	}
+	var identity map[string]interface{}
+	if err := json.Unmarshal(raw, &identity); err != nil {
+		return ""
+	}
+
+	if userID, ok := identity["user_id"].(string); ok && userID != "" {
+		return platform + " user " + userID
+	}
+	return platform + " " + string(raw)
+}
+
+// identityKey is the context key of the originating identity.
+type identityKey struct{}
+
+// withOriginatingIdentity stores the originating identity of each request in
+// its context, where the broker methods called by brokerapi can find it.
+func withOriginatingIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := originatingIdentity(r); id != "" {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contextIdentity returns the originating identity stored in the context by
+// withOriginatingIdentity, or an empty string if there is none.
+func contextIdentity(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
+
+// actorOrUnknown describes the actor for logging.
+func actorOrUnknown(actor string) string {
+	if actor == "" {
+		return "unknown"
+	}
+	return actor
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginatingIdentity(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		e      string
+	}{
+		{
+			"missing",
+			"",
+			"",
+		},
+		{
+			"cloudfoundry",
+			"cloudfoundry eyJ1c2VyX2lkIjoiNjgzZWE3NDgtMzA5Mi00ZmY0LWI2NTYtMzljYWNjNGQ1MzYwIn0=",
+			"cloudfoundry user 683ea748-3092-4ff4-b656-39cacc4d5360",
+		},
+		{
+			"no-user-id",
+			"kubernetes eyJ1c2VybmFtZSI6ImR1a2UifQ==",
+			`kubernetes {"username":"duke"}`,
+		},
+		{
+			"bad-encoding",
+			"cloudfoundry !!!",
+			"",
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tc.header != "" {
+				r.Header.Set(OriginatingIdentityHeader, tc.header)
+			}
+			if id := originatingIdentity(r); id != tc.e {
+				t.Errorf("expected %q to be %q", id, tc.e)
+			}
+		})
+	}
+}
+
+func TestWithOriginatingIdentity(t *testing.T) {
+	var id string
+	handler := withOriginatingIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = contextIdentity(r.Context())
+	}))
+
+	r := httptest.NewRequest("PUT", "/v2/service_instances/instance-id/service_bindings/binding-id", nil)
+	r.Header.Set(OriginatingIdentityHeader, "cloudfoundry eyJ1c2VyX2lkIjoiYWRtaW4ifQ==")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if id != "cloudfoundry user admin" {
+		t.Fatalf("expected the identity in the context but received %q", id)
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v2/catalog", nil))
+	if id != "" {
+		t.Fatalf("expected no identity but received %q", id)
+	}
+}
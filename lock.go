@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+// keyedMutex is a set of mutexes identified by a key, such as an instance ID.
+// Locking one key never blocks callers holding a different key. The zero value
+// is ready to use.
+type keyedMutex struct {
+	lock  sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks the mutex for the given key, blocking until it is available.
+func (k *keyedMutex) Lock(key string) {
+	k.lock.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedMutexEntry)
+	}
+	e, ok := k.locks[key]
+	if !ok {
+		e = &keyedMutexEntry{}
+		k.locks[key] = e
+	}
+	e.refs++
+	k.lock.Unlock()
+
+	e.Lock()
+}
+
+// Unlock unlocks the mutex for the given key. The mutex is forgotten once no
+// callers hold or are waiting on it.
+func (k *keyedMutex) Unlock(key string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	e, ok := k.locks[key]
+	if !ok {
+		panic("keyedMutex: unlock of unlocked key " + key)
+	}
+	e.refs--
+	if e.refs == 0 {
+		delete(k.locks, key)
+	}
+	e.Unlock()
+}
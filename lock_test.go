@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var k keyedMutex
+
+	// Different keys do not block each other
+	k.Lock("a")
+	k.Lock("b")
+	k.Unlock("b")
+
+	// The same key blocks until unlocked
+	var wg sync.WaitGroup
+	acquired := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		k.Lock("a")
+		close(acquired)
+		k.Unlock("a")
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected the second lock to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	k.Unlock("a")
+	wg.Wait()
+
+	if len(k.locks) != 0 {
+		t.Fatalf("expected all locks to be released but found %d", len(k.locks))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// LogFormatText writes log lines as "[LEVEL] message".
+	LogFormatText = "text"
+
+	// LogFormatJSON writes log lines as JSON objects with "level" and
+	// "message" keys and any fields attached to the logger.
+	LogFormatJSON = "json"
+)
+
+const (
+	// LogLevelDebug, LogLevelInfo, LogLevelWarn, and LogLevelError are the
+	// log levels, from the most to the least verbose.
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// logLevels maps the "[LEVEL]" prefixes used at log sites to the level
+// written in JSON.
+var logLevels = map[string]string{
+	"DEBUG": LogLevelDebug,
+	"INFO":  LogLevelInfo,
+	"WARN":  LogLevelWarn,
+	"ERR":   LogLevelError,
+}
+
+// logSeverities orders the log levels by severity.
+var logSeverities = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+// Logger writes leveled log lines. The level of a line is given by a
+// "[LEVEL]" prefix of the message, so log sites read the same in every
+// format. The zero value is not usable; create a Logger with NewLogger.
+type Logger struct {
+	lock     *sync.Mutex
+	out      io.Writer
+	json     bool
+	severity int
+	fields   []interface{}
+}
+
+// NewLogger returns a logger writing to out in the given format. Lines below
+// the given level are dropped.
+func NewLogger(out io.Writer, format, level string) *Logger {
+	return &Logger{
+		lock:     new(sync.Mutex),
+		out:      out,
+		json:     format == LogFormatJSON,
+		severity: logSeverities[level],
+	}
+}
+
+// With returns a logger which adds the given key/value pairs to every line.
+// Fields are only written in the JSON format; text lines are unchanged.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{
+		lock:     l.lock,
+		out:      l.out,
+		json:     l.json,
+		severity: l.severity,
+		fields:   fields,
+	}
+}
+
+// Printf formats and writes a log line.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+}
+
+// Fatalf writes a log line and exits.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.output(fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+func (l *Logger) output(msg string) {
+	level, text := splitLevel(msg)
+	if logSeverities[level] < l.severity {
+		return
+	}
+
+	var line []byte
+	if l.json {
+		line = l.formatJSON(level, text)
+	} else {
+		line = []byte(msg)
+	}
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line = append(line, '\n')
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(line)
+}
+
+// formatJSON encodes the message, its level and the logger's fields as a JSON
+// object.
+func (l *Logger) formatJSON(level, msg string) []byte {
+	entry := make(map[string]interface{}, len(l.fields)/2+2)
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		entry[fmt.Sprint(l.fields[i])] = l.fields[i+1]
+	}
+	entry["level"] = level
+	entry["message"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"level":   level,
+			"message": msg,
+		})
+	}
+	return line
+}
+
+// splitLevel splits the "[LEVEL]" prefix from the message. Messages without a
+// known prefix are logged at the info level.
+func splitLevel(msg string) (string, string) {
+	msg = strings.TrimRight(msg, "\n")
+	if !strings.HasPrefix(msg, "[") {
+		return LogLevelInfo, msg
+	}
+	end := strings.Index(msg, "]")
+	if end < 0 {
+		return LogLevelInfo, msg
+	}
+	level, ok := logLevels[msg[1:end]]
+	if !ok {
+		return LogLevelInfo, msg
+	}
+	return level, strings.TrimSpace(msg[end+1:])
+}
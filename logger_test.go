@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLogger_Text(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogFormatText, LogLevelDebug).With("instance_id", "instance-id")
+
+	logger.Printf("[INFO] provisioning instance %s", "instance-id")
+	if buf.String() != "[INFO] provisioning instance instance-id\n" {
+		t.Fatalf("expected the text format to be unchanged but received %q", buf.String())
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogFormatJSON, LogLevelDebug)
+
+	logger.With("instance_id", "instance-id").With("binding_id", "binding-id").
+		Printf("[ERR] failed to bind %s", "binding-id")
+	logger.Printf("no level")
+
+	dec := json.NewDecoder(&buf)
+	expected := []map[string]interface{}{
+		{
+			"level":       "error",
+			"message":     "failed to bind binding-id",
+			"instance_id": "instance-id",
+			"binding_id":  "binding-id",
+		},
+		{
+			"level":   "info",
+			"message": "no level",
+		},
+	}
+	for _, e := range expected {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(entry, e) {
+			t.Fatalf("expected %v but received %v", e, entry)
+		}
+	}
+}
+
+func TestLogger_Level(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogFormatText, LogLevelWarn)
+
+	logger.Printf("[DEBUG] dropped")
+	logger.Printf("[INFO] dropped")
+	logger.Printf("no level is info and dropped")
+	logger.Printf("[WARN] kept")
+	logger.With("instance_id", "instance-id").Printf("[ERR] kept")
+
+	if buf.String() != "[WARN] kept\n[ERR] kept\n" {
+		t.Fatalf("expected only warnings and errors but received %q", buf.String())
+	}
+}
@@ -1,35 +1,94 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
+	"time"
 
 	"code.cloudfoundry.org/lager"
-	"github.com/hashicorp/vault/api"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-multierror"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
 )
 
 func main() {
 	// Setup the logger - intentionally do not log date or time because it will
-	// be prefixed in the log output by CF.
-	logger := log.New(os.Stdout, "", 0)
+	// be prefixed in the log output by CF. The format is only known once the
+	// configuration is read.
+	logger := NewLogger(os.Stdout, LogFormatText, LogLevelInfo)
+
+	showVersion, err := parseFlags(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		logger.Fatalf("[ERR] failed to parse flags: %s", err)
+	}
+	if showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
 
 	config, err := parseConfig()
 	if err != nil {
-		logger.Fatal("[ERR] failed to read configuration", err)
+		logger.Fatalf("[ERR] failed to read configuration: %s", err)
+	}
+	logger = NewLogger(os.Stdout, config.LogFormat, config.LogLevel)
+	for _, w := range config.Warnings() {
+		logger.Printf("[WARN] %s", w)
 	}
 
 	// Setup the vault client
-	vaultClient, err := api.NewClient(nil)
+	reauth := &reauthTransport{}
+	vaultClient, err := newVaultClient(config, reauth.wrap)
+	if err != nil {
+		logger.Fatalf("[ERR] failed to create vault api client: %s", err)
+	}
+	logger.Printf("[INFO] vault client retries failed requests %d times and times out after %s",
+		config.VaultMaxRetries, config.VaultClientTimeout)
+	if len(config.VaultAddrs) > 1 {
+		logger.Printf("[INFO] failing over between vault addresses %s", strings.Join(config.VaultAddrs, ", "))
+	}
+
+	// Authenticate to Vault
+	logger.Printf("[INFO] authenticating to vault using the %s auth method", config.VaultAuthMethod)
+	vaultLogin, err := newVaultLogin(config)
 	if err != nil {
-		logger.Fatal("[ERR] failed to create vault api client", err)
+		logger.Fatalf("[ERR] failed to setup vault login: %s", err)
+	}
+	if vaultLogin == nil {
+		vaultClient.SetToken(config.VaultToken)
+	} else {
+		// Logging in needs Vault to be unsealed, so wait for it here rather
+		// than in Start
+		if config.VaultStartupWait > 0 {
+			if err := waitForVault(context.Background(), vaultClient, logger, config.VaultStartupWait, config.VaultStartupPollInterval); err != nil {
+				logger.Fatalf("[ERR] %s", err)
+			}
+		}
+		token, err := vaultLogin()
+		if err != nil {
+			logger.Fatalf("[ERR] failed to authenticate to vault: %s", err)
+		}
+		vaultClient.SetToken(token)
 	}
 
 	// Setup the broker
@@ -42,15 +101,134 @@ func main() {
 		serviceDescription: config.ServiceDescription,
 		serviceTags:        config.ServiceTags,
 
-		planName:        config.PlanName,
-		planDescription: config.PlanDescription,
+		serviceMetadata: config.serviceMetadata(),
+
+		plans: config.Plans,
 
 		vaultAdvertiseAddr: config.VaultAdvertiseAddr,
 		vaultRenewToken:    config.VaultRenew,
+		vaultLogin:         vaultLogin,
+		bindSelfHeal:       config.BindSelfHeal,
+		operationTimeout:   config.OperationTimeout,
+		unmountOnUpdate:    config.PlanUpdateUnmount,
+
+		vaultAdvertiseAddrTemplate: config.AdvertiseAddrTemplate,
+
+		checkTokenCapabilities: config.VaultCheckToken,
+
+		dryRun: config.DryRun,
+
+		vaultAdvertiseCACert: config.VaultCACertPEM,
+		vaultNamespace:       config.VaultNamespace,
+
+		renewJitter:    config.RenewJitter,
+		renewIncrement: config.RenewIncrement,
+		stopTimeout:    config.RenewerStopTimeout,
+
+		bindAllowedPolicies: config.BindAllowedPolicies,
+		defaultBindPolicies: config.DefaultBindPolicies,
+		bindMaxNumUses:      config.BindMaxNumUses,
+		maxBindings:         config.MaxBindingsPerInstance,
+
+		bindIdentity:      config.BindIdentity,
+		tokenAuthAccessor: config.TokenAuthMountAccessor,
+
+		serviceCapabilities: config.PolicyServiceCapabilities,
+		spaceCapabilities:   config.PolicySpaceCapabilities,
+		orgCapabilities:     config.PolicyOrgCapabilities,
+
+		dashboardURL: config.DashboardURLTemplate,
+
+		mountDescription: config.MountDescriptionTemplate,
+		policyTemplate:   config.PolicyTemplate,
+
+		nameLookupStrict:     config.NameLookupMode == NameLookupStrict,
+		nameLookupRetryDelay: DefaultNameLookupRetryDelay,
+
+		bindingTransitMount: config.BindingTransitMount,
+		bindingTransitKey:   config.BindingTransitKey,
+
+		auditPath: config.VaultAuditPath,
+
+		driftCheck:  config.DriftCheck || config.DriftRepair,
+		driftRepair: config.DriftRepair,
+
+		vaultStartupWait:         config.VaultStartupWait,
+		vaultStartupPollInterval: config.VaultStartupPollInterval,
+		healthProbeInterval:      config.VaultHealthProbeInterval,
+
+		tokenMaxTTL:          config.TokenMaxTTL,
+		tokenNumUses:         config.TokenNumUses,
+		tokenNoDefaultPolicy: config.TokenNoDefaultPolicy,
+
+		reconcileInterval: config.ReconcileInterval,
+
+		mountPrefix:          config.MountPrefix,
+		mountDefaultLeaseTTL: config.MountDefaultLeaseTTL,
+		mountMaxLeaseTTL:     config.MountMaxLeaseTTL,
+		mountReconcile:       config.MountReconcile,
+		sharedMountCleanup:   config.SharedMountCleanup,
+		disableOrgMount:      !config.EnableOrgMount,
+		disableSpaceMount:    !config.EnableSpaceMount,
+
+		backendPath:    config.BrokerBackendPath,
+		backendVersion: config.BrokerBackendVersion,
+
+		awsRoleARN:         config.AWSRoleARN,
+		awsRegion:          config.AWSRegion,
+		awsAccessKeyID:     config.AWSAccessKeyID,
+		awsSecretAccessKey: config.AWSSecretAccessKey,
+
+		sshAllowedUsers: config.SSHAllowedUsers,
+		sshCertTTL:      config.SSHCertTTL,
+
+		pkiAllowedDomains: config.PKIAllowedDomains,
+		pkiCertTTL:        config.PKICertTTL,
+		pkiCATTL:          config.PKICATTL,
+
+		restoreConcurrency:      config.RestoreConcurrency,
+		restoreFailureThreshold: config.RestoreFailureThreshold,
+	}
+	reauth.setLogin(broker.vaultToken, broker.setVaultToken, vaultLogin, logger)
+	if config.VaultEnableAudit {
+		broker.audit = newAuditOptions(config.VaultAuditType, config.VaultAuditOptions)
+	}
+	if config.EventSink != nil {
+		broker.events = newEventSink(config.EventSink, config.EventSinkBuffer, logger)
+	}
+	if config.BindCredhubRef {
+		broker.credhub = newCredhubClient(config.CredhubURL, config.CredhubClientID, config.CredhubClientSecret, config.CredhubTLSConfig)
+	}
+	if config.CFAPIURL != "" {
+		cf := newCFClient(config.CFAPIURL, config.CFClientID, config.CFClientSecret)
+		broker.bindingLister = cf
+		broker.nameResolver = cf
 	}
-	if err := broker.Start(); err != nil {
-		logger.Fatalf("[ERR] failed to start broker: %s", err)
+	// Start the broker, aborting if the broker is stopped while it restores
+	// its instances and bindings
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+	startCtx, cancelStart := context.WithCancel(context.Background())
+	startCh := make(chan error, 1)
+	go func() {
+		startCh <- broker.Start(startCtx)
+	}()
+	select {
+	case err := <-startCh:
+		if err != nil {
+			logger.Fatalf("[ERR] failed to start broker: %s", err)
+		}
+	case s := <-signalCh:
+		logger.Printf("[INFO] received signal %s while starting, aborting", s)
+		cancelStart()
+		if err := <-startCh; err != nil {
+			logger.Fatalf("[ERR] failed to start broker: %s", err)
+		}
+		// The broker finished starting before it noticed the cancellation
+		broker.Stop()
+		os.Exit(0)
 	}
+	cancelStart()
 
 	// Parse the broker credentials
 	creds := brokerapi.BrokerCredentials{
@@ -58,27 +236,98 @@ func main() {
 		Password: config.SecurityUserPassword,
 	}
 
-	// Setup the HTTP handler
-	handler := brokerapi.New(broker, lager.NewLogger("vault-broker"), creds)
+	// Setup the HTTP handler, serving the broker API, the admin API, the
+	// metrics, and the profiling endpoints if enabled behind the same basic
+	// auth credentials
+	router := mux.NewRouter()
+	attachOSBRoutes(router, broker)
+	brokerapi.AttachRoutes(router, broker, lager.NewLogger("vault-broker"))
+	attachAdminRoutes(router, broker)
+	attachMetricsRoutes(router, broker)
+	if config.DebugPprof {
+		logger.Printf("[WARN] serving profiling endpoints at /debug/pprof/")
+		attachDebugRoutes(router)
+	}
+	handler := auth.NewWrapper(creds.Username, creds.Password).Wrap(withRequestID(&apiVersionChecker{
+		next: withOriginatingIdentity(withPlatformContext(router)),
+		min:  config.BrokerAPIMinVersionID,
+		log:  logger,
+	}))
+
+	// Serve the health check without credentials, for load balancers and
+	// orchestrators
+	root := mux.NewRouter()
+	attachHealthRoutes(root, broker)
+	root.PathPrefix("/").Handler(handler)
+	handler = root
+
+	// Limit the rate of requests, including those with bad credentials
+	handler = &rateLimiter{
+		next:  handler,
+		read:  newTokenBucket(config.RateLimitRead, config.RateLimitReadBurst),
+		write: newTokenBucket(config.RateLimitWrite, config.RateLimitWriteBurst),
+		log:   logger,
+	}
+
+	// Listen to incoming connection, terminating TLS if a certificate is
+	// configured
+	server := &http.Server{
+		Addr:    config.ListenAddr,
+		Handler: handler,
 
-	// Listen to incoming connection
+		// Keep slow clients from holding connections open indefinitely
+		ReadTimeout:  config.ServerReadTimeout,
+		WriteTimeout: config.ServerWriteTimeout,
+		IdleTimeout:  config.ServerIdleTimeout,
+	}
 	serverCh := make(chan struct{}, 1)
 	go func() {
-		logger.Printf("[INFO] starting server on %s", config.Port)
-		if err := http.ListenAndServe(config.Port, handler); err != nil {
+		var err error
+		if config.BrokerTLSCert != "" {
+			server.TLSConfig = &tls.Config{MinVersion: config.BrokerTLSMinVersionID}
+			logger.Printf("[INFO] starting TLS server on %s", config.ListenAddr)
+			err = server.ListenAndServeTLS(config.BrokerTLSCert, config.BrokerTLSKey)
+		} else {
+			logger.Printf("[INFO] starting server on %s", config.ListenAddr)
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("[ERR] server exited with: %s", err)
 		}
 		close(serverCh)
 	}()
 
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	quiesceCh := make(chan os.Signal, 1)
+	signal.Notify(quiesceCh, syscall.SIGUSR1)
 
-	select {
-	case <-serverCh:
-	case s := <-signalCh:
-		logger.Printf("[INFO] received signal %s", s)
+WAIT:
+	for {
+		select {
+		case <-serverCh:
+			break WAIT
+		case s := <-signalCh:
+			logger.Printf("[INFO] received signal %s", s)
+			break WAIT
+		case <-reloadCh:
+			logger.Printf("[INFO] received SIGHUP, reloading the vault token")
+			reloadVaultToken(config, vaultLogin, broker, logger)
+		case <-quiesceCh:
+			logger.Printf("[INFO] received SIGUSR1")
+			broker.Quiesce()
+		}
+	}
+
+	// Reject new instances and bindings, and let the requests in flight
+	// finish while the broker keeps renewing tokens
+	broker.Quiesce()
+	logger.Printf("[INFO] waiting up to %s for requests in flight", config.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Printf("[WARN] failed to finish requests in flight: %s", err)
 	}
+	cancel()
 
 	if err := broker.Stop(); err != nil {
 		logger.Fatalf("[ERR] faild to stop broker: %s", err)
@@ -87,69 +336,146 @@ func main() {
 	os.Exit(0)
 }
 
-// normalizeAddr takes a string that represents a URL and ensures it has a
-// scheme (defaulting to https), and ensures the path ends in a trailing slash.
-func normalizeAddr(s string) string {
-	if s == "" {
-		return s
+// reloadVaultToken gives the broker a new token, by logging in again or by
+// reading VAULT_TOKEN_FILE. A token given in VAULT_TOKEN cannot be reloaded.
+func reloadVaultToken(config *Configuration, login func() (string, error), broker *Broker, logger *Logger) {
+	var token string
+	var err error
+	switch {
+	case login != nil:
+		token, err = login()
+	case config.VaultTokenFile != "":
+		token, err = readVaultTokenFile(config.VaultTokenFile)
+	default:
+		logger.Printf("[WARN] the token in VAULT_TOKEN cannot be reloaded, use VAULT_TOKEN_FILE instead")
+		return
 	}
-
-	u, err := url.Parse(s)
 	if err != nil {
-		return s
+		logger.Printf("[ERR] failed to reload the vault token: %s", err)
+		return
 	}
+	if !broker.reloadVaultToken(token) {
+		logger.Printf("[INFO] the vault token is unchanged")
+	}
+}
 
-	if u.Scheme == "" {
-		u.Scheme = "https"
+// listenAddr combines the host to bind to and the port into the address to
+// listen on. An empty host listens on all interfaces.
+func listenAddr(host, port string) (string, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid BIND_ADDRESS %q: must be a host name or IP address without a port", host)
+	}
+	port = strings.TrimPrefix(port, ":")
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid PORT %q", port)
 	}
+	return net.JoinHostPort(host, port), nil
+}
 
-	if strings.Contains(u.Scheme, ".") {
-		u.Host = u.Scheme
-		if u.Opaque != "" {
-			u.Host = u.Host + ":" + u.Opaque
-			u.Opaque = ""
-		}
-		u.Scheme = "https"
+// normalizeAddr takes a string that represents a URL and ensures it has a
+// scheme (defaulting to https), and ensures the path ends in a trailing slash.
+// Addresses without a scheme may be a host, a host and port, or an IPv6
+// address with or without brackets.
+func normalizeAddr(s string) string {
+	if s == "" {
+		return s
 	}
 
-	if u.Host == "" {
-		split := strings.SplitN(u.Path, "/", 2)
-		switch len(split) {
-		case 0:
-		case 1:
-			u.Host = split[0]
-			u.Path = "/"
-		case 2:
-			u.Host = split[0]
-			u.Path = split[1]
+	// Without a scheme, url.Parse would read the host of "host:port" as the
+	// scheme, so add one first
+	if !strings.Contains(s, "://") {
+		if ip := net.ParseIP(s); ip != nil && strings.Contains(s, ":") {
+			s = "[" + s + "]"
 		}
+		s = "https://" + s
 	}
 
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
 	u.Path = strings.TrimRight(u.Path, "/") + "/"
 
 	return u.String()
 }
 
+// parseConfig reads the configuration from the environment and validates it.
+// The returned error lists every problem found, rather than only the first.
 func parseConfig() (*Configuration, error) {
+	var result *multierror.Error
 	config := &Configuration{}
 	if err := envconfig.Process("", config); err != nil {
-		return nil, err
+		if _, ok := err.(*envconfig.ParseError); !ok {
+			return nil, err
+		}
+		// envconfig stops at the first value it fails to parse, so parse
+		// each field on its own to find all of them
+		config, result = parseConfigFields()
 	}
-	if err := config.Validate(); err != nil {
+
+	result = multierror.Append(result, config.Validate())
+	if err := result.ErrorOrNil(); err != nil {
 		return nil, err
 	}
 	return config, nil
 }
 
+// parseConfigFields reads each field of the configuration from the environment
+// on its own. It returns the configuration with the fields which could be
+// parsed, and an error for each which could not.
+func parseConfigFields() (*Configuration, *multierror.Error) {
+	var result *multierror.Error
+	config := &Configuration{}
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" || field.Tag.Get("ignored") == "true" {
+			continue
+		}
+		single := reflect.New(reflect.StructOf([]reflect.StructField{
+			{Name: field.Name, Type: field.Type, Tag: field.Tag},
+		}))
+		if err := envconfig.Process("", single.Interface()); err != nil {
+			if parseErr, ok := err.(*envconfig.ParseError); ok {
+				err = fmt.Errorf("invalid %s %q: %s", parseErr.KeyName, parseErr.Value, parseErr.Err)
+			}
+			result = multierror.Append(result, err)
+			continue
+		}
+		v.Field(i).Set(single.Elem().Field(0))
+	}
+	return config, result
+}
+
 type Configuration struct {
 	// Required
 	SecurityUserName     string `envconfig:"security_user_name"`
 	SecurityUserPassword string `envconfig:"security_user_password"`
 	VaultToken           string `envconfig:"vault_token"`
 
+	// Vault authentication and TLS
+	VaultAuthMethod string `envconfig:"vault_auth_method" default:"token"`
+	VaultAuthMount  string `envconfig:"vault_auth_mount"`
+	VaultCertRole   string `envconfig:"vault_cert_role"`
+	VaultRoleID     string `envconfig:"vault_role_id"`
+	VaultSecretID   string `envconfig:"vault_secret_id"`
+	VaultK8sRole    string `envconfig:"vault_k8s_role"`
+	VaultCACert     string `envconfig:"vault_cacert"`
+	VaultCAPath     string `envconfig:"vault_capath"`
+	VaultClientCert string `envconfig:"vault_client_cert"`
+	VaultClientKey  string `envconfig:"vault_client_key"`
+	VaultSkipVerify bool   `envconfig:"vault_skip_verify" default:"false"`
+	VaultTokenFile  string `envconfig:"vault_token_file"`
+	VaultNamespace  string `envconfig:"vault_namespace"`
+	BindCACert      bool   `envconfig:"bind_ca_cert" default:"false"`
+
+	VaultK8sTokenPath string `envconfig:"vault_k8s_token_path" default:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+
 	// Optional
 	CredhubURL         string   `envconfig:"credhub_url"`
 	Port               string   `envconfig:"port" default:":8000"`
+	BindAddress        string   `envconfig:"bind_address"`
 	ServiceID          string   `envconfig:"service_id" default:"0654695e-0760-a1d4-1cad-5dd87b75ed99"`
 	VaultAddr          string   `envconfig:"vault_addr" default:"https://127.0.0.1:8200"`
 	VaultAdvertiseAddr string   `envconfig:"vault_advertise_addr"`
@@ -157,30 +483,704 @@ type Configuration struct {
 	ServiceDescription string   `envconfig:"service_description" default:"HashiCorp Vault Service Broker"`
 	PlanName           string   `envconfig:"plan_name" default:"shared"`
 	PlanDescription    string   `envconfig:"plan_description" default:"Secure access to Vault's storage and transit backends"`
+	PlansJSON          string   `envconfig:"plans"`
+	PlanUpdateUnmount  bool     `envconfig:"plan_update_unmount" default:"false"`
+	PlanReadOnly       bool     `envconfig:"plan_read_only" default:"false"`
+	PlanSealWrap       bool     `envconfig:"plan_seal_wrap" default:"false"`
+	PlanLocal          bool     `envconfig:"plan_local" default:"false"`
+	PlanKVVersion      int      `envconfig:"plan_kv_version" default:"1"`
+	BindSelfHeal       bool     `envconfig:"bind_self_heal" default:"false"`
 	ServiceTags        []string `envconfig:"service_tags"`
 	VaultRenew         bool     `envconfig:"vault_renew" default:"true"`
+	VaultCheckToken    bool     `envconfig:"vault_check_token" default:"true"`
+	LogFormat          string   `envconfig:"log_format" default:"text"`
+	LogLevel           string   `envconfig:"log_level" default:"info"`
+
+	ServiceDisplayName      string   `envconfig:"service_display_name"`
+	ServiceImageURL         string   `envconfig:"service_image_url"`
+	ServiceDocumentationURL string   `envconfig:"service_documentation_url"`
+	ServiceSupportURL       string   `envconfig:"service_support_url"`
+	PlanDisplayName         string   `envconfig:"plan_display_name"`
+	PlanBullets             []string `envconfig:"plan_bullets"`
+	PlanFree                bool     `envconfig:"plan_free" default:"true"`
+	PlanCosts               string   `envconfig:"plan_costs"`
+
+	BrokerTLSCert       string `envconfig:"broker_tls_cert"`
+	BrokerTLSKey        string `envconfig:"broker_tls_key"`
+	BrokerTLSMinVersion string `envconfig:"broker_tls_min_version" default:"1.2"`
+
+	BrokerAPIMinVersion string `envconfig:"broker_api_min_version" default:"2.0"`
+
+	OperationTimeout time.Duration `envconfig:"operation_timeout" default:"60s"`
+
+	ServerReadTimeout  time.Duration `envconfig:"server_read_timeout" default:"30s"`
+	ServerWriteTimeout time.Duration `envconfig:"server_write_timeout" default:"120s"`
+	ServerIdleTimeout  time.Duration `envconfig:"server_idle_timeout" default:"120s"`
+
+	RenewJitter    time.Duration `envconfig:"renew_jitter"`
+	RenewIncrement int           `envconfig:"renew_increment" default:"0"`
+
+	BindAllowedPolicies []string `envconfig:"bind_allowed_policies"`
+	DefaultBindPolicies []string `envconfig:"default_bind_policies"`
+	BindMaxNumUses      int      `envconfig:"bind_max_num_uses" default:"0"`
+
+	MaxBindingsPerInstance int `envconfig:"max_bindings_per_instance" default:"0"`
+
+	PolicyServiceCapabilities []string `envconfig:"policy_service_capabilities"`
+	PolicySpaceCapabilities   []string `envconfig:"policy_space_capabilities"`
+	PolicyOrgCapabilities     []string `envconfig:"policy_org_capabilities"`
+	PolicyTemplatePath        string   `envconfig:"policy_template_path"`
+
+	DashboardURL string `envconfig:"dashboard_url"`
+
+	MountDescription string `envconfig:"mount_description" default:"CF org={{.Organization}}{{if .Space}} space={{.Space}}{{end}}{{if .Instance}} instance={{.Instance}}{{end}}"`
+
+	TransitKeyName             string `envconfig:"transit_key_name"`
+	TransitKeyType             string `envconfig:"transit_key_type"`
+	TransitKeyAutoRotatePeriod string `envconfig:"transit_key_auto_rotate_period"`
+
+	BindingTransitMount string `envconfig:"binding_transit_mount" default:"transit"`
+	BindingTransitKey   string `envconfig:"binding_transit_key"`
+
+	DriftCheck  bool `envconfig:"drift_check" default:"false"`
+	DriftRepair bool `envconfig:"drift_repair" default:"false"`
+
+	DebugPprof bool `envconfig:"debug_pprof" default:"false"`
+
+	VaultEnableAudit  bool              `envconfig:"vault_enable_audit" default:"false"`
+	VaultAuditType    string            `envconfig:"vault_audit_type" default:"file"`
+	VaultAuditPath    string            `envconfig:"vault_audit_path" default:"cf-broker"`
+	VaultAuditOptions map[string]string `envconfig:"vault_audit_options"`
+
+	ShutdownTimeout    time.Duration `envconfig:"shutdown_timeout" default:"30s"`
+	RenewerStopTimeout time.Duration `envconfig:"renewer_stop_timeout" default:"10s"`
+
+	RateLimitRead       float64 `envconfig:"rate_limit_read" default:"100"`
+	RateLimitReadBurst  int     `envconfig:"rate_limit_read_burst" default:"200"`
+	RateLimitWrite      float64 `envconfig:"rate_limit_write" default:"20"`
+	RateLimitWriteBurst int     `envconfig:"rate_limit_write_burst" default:"50"`
+
+	VaultMaxRetries    int           `envconfig:"vault_max_retries" default:"0"`
+	VaultClientTimeout time.Duration `envconfig:"vault_client_timeout" default:"60s"`
+
+	VaultStartupWait         time.Duration `envconfig:"vault_startup_wait" default:"5m"`
+	VaultStartupPollInterval time.Duration `envconfig:"vault_startup_poll_interval" default:"5s"`
+	VaultHealthProbeInterval time.Duration `envconfig:"vault_health_probe_interval" default:"30s"`
+
+	TokenMaxTTL          time.Duration `envconfig:"token_max_ttl"`
+	TokenNumUses         int           `envconfig:"token_num_uses" default:"0"`
+	TokenNoDefaultPolicy bool          `envconfig:"token_no_default_policy" default:"false"`
+
+	MountPrefix          string        `envconfig:"mount_prefix" default:"cf"`
+	MountDefaultLeaseTTL time.Duration `envconfig:"mount_default_lease_ttl"`
+	MountMaxLeaseTTL     time.Duration `envconfig:"mount_max_lease_ttl"`
+	MountReconcile       bool          `envconfig:"mount_reconcile" default:"false"`
+	SharedMountCleanup   bool          `envconfig:"shared_mount_cleanup" default:"false"`
+	EnableOrgMount       bool          `envconfig:"enable_org_mount" default:"true"`
+	EnableSpaceMount     bool          `envconfig:"enable_space_mount" default:"true"`
+
+	DryRun bool `envconfig:"dry_run" default:"false"`
+
+	BrokerBackendPath    string `envconfig:"broker_backend_path"`
+	BrokerBackendVersion int    `envconfig:"broker_backend_version" default:"1"`
+
+	AWSRoleARN         string `envconfig:"aws_role_arn"`
+	AWSRegion          string `envconfig:"aws_region" default:"us-east-1"`
+	AWSAccessKeyID     string `envconfig:"aws_access_key_id"`
+	AWSSecretAccessKey string `envconfig:"aws_secret_access_key"`
+
+	SSHAllowedUsers []string      `envconfig:"ssh_allowed_users"`
+	SSHCertTTL      time.Duration `envconfig:"ssh_cert_ttl" default:"1h"`
+
+	PKIAllowedDomains []string      `envconfig:"pki_allowed_domains"`
+	PKICertTTL        time.Duration `envconfig:"pki_cert_ttl" default:"72h"`
+	PKICATTL          time.Duration `envconfig:"pki_ca_ttl" default:"720h"`
+
+	CFAPIURL          string        `envconfig:"cf_api_url"`
+	CFClientID        string        `envconfig:"cf_client_id"`
+	CFClientSecret    string        `envconfig:"cf_client_secret"`
+	ReconcileInterval time.Duration `envconfig:"reconcile_interval" default:"10m"`
+	NameLookupMode    string        `envconfig:"name_lookup_mode" default:"best-effort"`
+
+	RestoreConcurrency      int     `envconfig:"restore_concurrency" default:"10"`
+	RestoreFailureThreshold float64 `envconfig:"restore_failure_threshold" default:"0"`
+
+	EventSinkURL    string `envconfig:"event_sink_url"`
+	EventSinkBuffer int    `envconfig:"event_sink_buffer" default:"1000"`
+
+	BindIdentity           bool   `envconfig:"bind_identity" default:"false"`
+	TokenAuthMountAccessor string `envconfig:"token_auth_mount_accessor"`
+
+	VaultAdvertiseAddrTemplate string `envconfig:"vault_advertise_addr_template"`
+
+	BindCredhubRef      bool   `envconfig:"bind_credhub_ref" default:"false"`
+	CredhubClientID     string `envconfig:"credhub_client_id"`
+	CredhubClientSecret string `envconfig:"credhub_client_secret"`
+
+	CredhubCACert     string `envconfig:"credhub_ca_cert"`
+	CredhubClientCert string `envconfig:"credhub_client_cert"`
+	CredhubClientKey  string `envconfig:"credhub_client_key"`
+
+	// CredhubTLSConfig is built from CredhubCACert, CredhubClientCert, and
+	// CredhubClientKey, or nil if none of them is set.
+	CredhubTLSConfig *tls.Config `ignored:"true"`
+
+	// VaultCACertPEM is read from VaultCACert when BindCACert is set.
+	VaultCACertPEM string `ignored:"true"`
+
+	// DashboardURLTemplate is parsed from DashboardURL, or nil if it is empty.
+	DashboardURLTemplate *template.Template `ignored:"true"`
+
+	// AdvertiseAddrTemplate is parsed from VaultAdvertiseAddrTemplate, or
+	// nil if it is empty.
+	AdvertiseAddrTemplate *template.Template `ignored:"true"`
+
+	// MountDescriptionTemplate is parsed from MountDescription, or nil if it
+	// is empty.
+	MountDescriptionTemplate *template.Template `ignored:"true"`
+
+	// PolicyTemplate is read from PolicyTemplatePath, or nil if it is empty.
+	PolicyTemplate *template.Template `ignored:"true"`
+
+	// BrokerTLSMinVersionID is parsed from BrokerTLSMinVersion.
+	BrokerTLSMinVersionID uint16 `ignored:"true"`
+
+	// BrokerAPIMinVersionID is parsed from BrokerAPIMinVersion.
+	BrokerAPIMinVersionID apiVersion `ignored:"true"`
+
+	// EventSink is parsed from EventSinkURL, or nil if it is empty.
+	EventSink *url.URL `ignored:"true"`
+
+	// ListenAddr is the address the server listens on, built from BindAddress
+	// and Port.
+	ListenAddr string `ignored:"true"`
+
+	// VaultAddrs is parsed from the comma-separated VaultAddr, which is set to
+	// the first address.
+	VaultAddrs []string `ignored:"true"`
+
+	// Plans is parsed from PlansJSON, or built from PlanName and
+	// PlanDescription when no plans are given.
+	Plans []*Plan `ignored:"true"`
+}
+
+// Warnings returns the problems with the configuration which do not prevent
+// the broker from starting but are likely mistakes.
+func (c *Configuration) Warnings() []string {
+	var warnings []string
+	if period := VaultPeriodicTTL * time.Second; c.TokenMaxTTL > 0 && c.TokenMaxTTL < period {
+		warnings = append(warnings, fmt.Sprintf("TOKEN_MAX_TTL (%s) is shorter than the token period (%s), "+
+			"so binding tokens expire before their first period ends", c.TokenMaxTTL, period))
+	}
+	if c.TokenNumUses > 0 {
+		warnings = append(warnings, "TOKEN_NUM_USES is set, but the broker's renewals of a binding token "+
+			"count as uses and the token is shared by all instances of an app")
+	}
+	if c.TokenNoDefaultPolicy {
+		warnings = append(warnings, "TOKEN_NO_DEFAULT_POLICY is set, so binding tokens cannot renew or look "+
+			"up themselves unless another policy, such as one in DEFAULT_BIND_POLICIES, allows it, "+
+			"and the broker fails to renew them")
+	}
+	return warnings
+}
+
+// serviceMetadata returns the service metadata to show in the marketplace, or
+// nil if none is configured.
+func (c *Configuration) serviceMetadata() *brokerapi.ServiceMetadata {
+	m := &brokerapi.ServiceMetadata{
+		DisplayName:      c.ServiceDisplayName,
+		ImageUrl:         c.ServiceImageURL,
+		DocumentationUrl: c.ServiceDocumentationURL,
+		SupportUrl:       c.ServiceSupportURL,
+	}
+	if *m == (brokerapi.ServiceMetadata{}) {
+		return nil
+	}
+	return m
+}
+
+// tlsVersions are the supported values of BROKER_TLS_MIN_VERSION.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
 }
 
+// vaultAuthMount returns the path the auth method is mounted at, which
+// defaults to the name of the method.
+func (c *Configuration) vaultAuthMount() string {
+	if c.VaultAuthMount != "" {
+		return strings.Trim(c.VaultAuthMount, "/")
+	}
+	return c.VaultAuthMethod
+}
+
+// Validate checks the configuration and fills in the values derived from it.
+// It returns a *multierror.Error listing every problem found.
 func (c *Configuration) Validate() error {
+	var result *multierror.Error
+
 	// Ensure required parameters were provided
 	if c.SecurityUserName == "" {
-		return errors.New("missing SECURITY_USER_NAME")
+		result = multierror.Append(result, errors.New("missing SECURITY_USER_NAME"))
 	}
 	if c.SecurityUserPassword == "" {
-		return errors.New("missing SECURITY_USER_PASSWORD")
+		result = multierror.Append(result, errors.New("missing SECURITY_USER_PASSWORD"))
+	}
+	if (c.VaultClientCert == "") != (c.VaultClientKey == "") {
+		result = multierror.Append(result, errors.New("VAULT_CLIENT_CERT and VAULT_CLIENT_KEY must be set together"))
+	}
+	if (c.BrokerTLSCert == "") != (c.BrokerTLSKey == "") {
+		result = multierror.Append(result, errors.New("BROKER_TLS_CERT and BROKER_TLS_KEY must be set together"))
 	}
-	if c.VaultToken == "" {
-		return errors.New("missing VAULT_TOKEN")
+	if c.VaultTokenFile != "" {
+		if c.VaultAuthMethod != AuthMethodToken {
+			result = multierror.Append(result, errors.New("VAULT_TOKEN_FILE requires VAULT_AUTH_METHOD token"))
+		} else if c.VaultToken != "" {
+			result = multierror.Append(result, errors.New("VAULT_TOKEN and VAULT_TOKEN_FILE must not both be set"))
+		} else if token, err := readVaultTokenFile(c.VaultTokenFile); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid VAULT_TOKEN_FILE: %s", err))
+		} else {
+			c.VaultToken = token
+		}
+	}
+	switch c.VaultAuthMethod {
+	case AuthMethodToken:
+		if c.VaultToken == "" && c.VaultTokenFile == "" {
+			result = multierror.Append(result, errors.New("missing VAULT_TOKEN"))
+		}
+	case AuthMethodCert:
+		if c.VaultToken != "" {
+			result = multierror.Append(result, errors.New("VAULT_TOKEN must not be set when VAULT_AUTH_METHOD is cert"))
+		}
+		if c.VaultClientCert == "" {
+			result = multierror.Append(result, errors.New("missing VAULT_CLIENT_CERT and VAULT_CLIENT_KEY for cert auth"))
+		}
+	case AuthMethodAppRole:
+		if c.VaultToken != "" {
+			result = multierror.Append(result, errors.New("VAULT_TOKEN must not be set when VAULT_AUTH_METHOD is approle"))
+		}
+		if c.VaultRoleID == "" {
+			result = multierror.Append(result, errors.New("missing VAULT_ROLE_ID for approle auth"))
+		}
+	case AuthMethodKubernetes:
+		if c.VaultToken != "" {
+			result = multierror.Append(result, errors.New("VAULT_TOKEN must not be set when VAULT_AUTH_METHOD is kubernetes"))
+		}
+		if c.VaultK8sRole == "" {
+			result = multierror.Append(result, errors.New("missing VAULT_K8S_ROLE for kubernetes auth"))
+		}
+	default:
+		result = multierror.Append(result, fmt.Errorf("unsupported VAULT_AUTH_METHOD %q", c.VaultAuthMethod))
+	}
+
+	if c.MountDefaultLeaseTTL < 0 {
+		result = multierror.Append(result, errors.New("MOUNT_DEFAULT_LEASE_TTL must not be negative"))
+	}
+	if c.MountMaxLeaseTTL < 0 {
+		result = multierror.Append(result, errors.New("MOUNT_MAX_LEASE_TTL must not be negative"))
+	}
+	if c.MountMaxLeaseTTL > 0 && c.MountDefaultLeaseTTL > c.MountMaxLeaseTTL {
+		result = multierror.Append(result, errors.New("MOUNT_DEFAULT_LEASE_TTL must not exceed MOUNT_MAX_LEASE_TTL"))
+	}
+	if c.CFAPIURL != "" {
+		if c.CFClientID == "" || c.CFClientSecret == "" {
+			result = multierror.Append(result, errors.New("missing CF_CLIENT_ID or CF_CLIENT_SECRET for CF_API_URL"))
+		}
+		if c.ReconcileInterval <= 0 {
+			result = multierror.Append(result, errors.New("RECONCILE_INTERVAL must be positive"))
+		}
+	}
+	if c.NameLookupMode != NameLookupBestEffort && c.NameLookupMode != NameLookupStrict {
+		result = multierror.Append(result, fmt.Errorf("NAME_LOOKUP_MODE must be %s or %s", NameLookupBestEffort, NameLookupStrict))
+	}
+	if c.EventSinkURL != "" {
+		u, err := parseEventSinkURL(c.EventSinkURL)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid EVENT_SINK_URL: %s", err))
+		}
+		c.EventSink = u
+	}
+	if c.EventSinkBuffer < 1 {
+		result = multierror.Append(result, errors.New("EVENT_SINK_BUFFER must be positive"))
+	}
+	if c.TokenAuthMountAccessor != "" && !c.BindIdentity {
+		result = multierror.Append(result, errors.New("TOKEN_AUTH_MOUNT_ACCESSOR requires BIND_IDENTITY"))
+	}
+	if c.BindCredhubRef && (c.CredhubURL == "" || c.CredhubClientID == "" || (c.CredhubClientSecret == "" && c.CredhubClientCert == "")) {
+		result = multierror.Append(result, errors.New("BIND_CREDHUB_REF requires CREDHUB_URL, CREDHUB_CLIENT_ID, and CREDHUB_CLIENT_SECRET or CREDHUB_CLIENT_CERT"))
+	}
+	if (c.CredhubClientCert == "") != (c.CredhubClientKey == "") {
+		result = multierror.Append(result, errors.New("CREDHUB_CLIENT_CERT and CREDHUB_CLIENT_KEY must be set together"))
+	} else if tlsConfig, err := credhubTLSConfig(c.CredhubCACert, c.CredhubClientCert, c.CredhubClientKey); err != nil {
+		result = multierror.Append(result, err)
+	} else {
+		c.CredhubTLSConfig = tlsConfig
+	}
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		result = multierror.Append(result, fmt.Errorf("unsupported LOG_FORMAT %q", c.LogFormat))
+	}
+	c.LogLevel = strings.ToLower(c.LogLevel)
+	if _, ok := logSeverities[c.LogLevel]; !ok {
+		result = multierror.Append(result, fmt.Errorf("unsupported LOG_LEVEL %q", c.LogLevel))
+	}
+	if c.OperationTimeout < 0 {
+		result = multierror.Append(result, errors.New("OPERATION_TIMEOUT must not be negative"))
+	}
+	if c.ServerReadTimeout < 0 || c.ServerWriteTimeout < 0 || c.ServerIdleTimeout < 0 {
+		result = multierror.Append(result, errors.New("SERVER_READ_TIMEOUT, SERVER_WRITE_TIMEOUT, and SERVER_IDLE_TIMEOUT must not be negative"))
+	}
+	if c.ServerWriteTimeout > 0 && c.OperationTimeout > 0 && c.ServerWriteTimeout <= c.OperationTimeout {
+		// The response to an operation which succeeded would be cut off
+		result = multierror.Append(result, fmt.Errorf("SERVER_WRITE_TIMEOUT must be longer than OPERATION_TIMEOUT (%s)", c.OperationTimeout))
+	}
+	if c.RenewJitter < 0 {
+		result = multierror.Append(result, errors.New("RENEW_JITTER must not be negative"))
+	}
+	if c.RenewIncrement < 0 {
+		result = multierror.Append(result, errors.New("RENEW_INCREMENT must not be negative"))
+	}
+	if c.VaultMaxRetries < 0 {
+		result = multierror.Append(result, errors.New("VAULT_MAX_RETRIES must not be negative"))
+	}
+	if c.VaultClientTimeout <= 0 {
+		result = multierror.Append(result, errors.New("VAULT_CLIENT_TIMEOUT must be positive"))
+	}
+	if c.VaultStartupWait < 0 {
+		result = multierror.Append(result, errors.New("VAULT_STARTUP_WAIT must not be negative"))
+	}
+	if c.VaultStartupPollInterval <= 0 {
+		result = multierror.Append(result, errors.New("VAULT_STARTUP_POLL_INTERVAL must be positive"))
+	}
+	if c.VaultHealthProbeInterval < 0 {
+		result = multierror.Append(result, errors.New("VAULT_HEALTH_PROBE_INTERVAL must not be negative"))
+	}
+	if c.TokenMaxTTL < 0 {
+		result = multierror.Append(result, errors.New("TOKEN_MAX_TTL must not be negative"))
+	}
+	if c.TokenMaxTTL > 0 && c.TokenMaxTTL < time.Second {
+		result = multierror.Append(result, errors.New("TOKEN_MAX_TTL must be at least 1s"))
+	}
+	if c.TokenNumUses < 0 {
+		result = multierror.Append(result, errors.New("TOKEN_NUM_USES must not be negative"))
+	}
+	if c.BindMaxNumUses < 0 {
+		result = multierror.Append(result, errors.New("BIND_MAX_NUM_USES must not be negative"))
+	}
+	if c.MaxBindingsPerInstance < 0 {
+		result = multierror.Append(result, errors.New("MAX_BINDINGS_PER_INSTANCE must not be negative"))
+	}
+	for _, p := range c.BindAllowedPolicies {
+		if p == "" || p == "root" {
+			result = multierror.Append(result, fmt.Errorf("BIND_ALLOWED_POLICIES must not contain %q", p))
+		}
+	}
+	for i, p := range c.DefaultBindPolicies {
+		c.DefaultBindPolicies[i] = strings.TrimSpace(p)
+		if c.DefaultBindPolicies[i] == "" || c.DefaultBindPolicies[i] == "root" {
+			result = multierror.Append(result, fmt.Errorf("DEFAULT_BIND_POLICIES must not contain %q", p))
+		}
+	}
+	for _, caps := range []struct {
+		name string
+		list []string
+	}{
+		{"POLICY_SERVICE_CAPABILITIES", c.PolicyServiceCapabilities},
+		{"POLICY_SPACE_CAPABILITIES", c.PolicySpaceCapabilities},
+		{"POLICY_ORG_CAPABILITIES", c.PolicyOrgCapabilities},
+	} {
+		for i, capability := range caps.list {
+			caps.list[i] = strings.ToLower(strings.TrimSpace(capability))
+			if _, ok := policyCapabilities[caps.list[i]]; !ok {
+				result = multierror.Append(result, fmt.Errorf("%s must only contain create, read, update, patch, delete, list, sudo, and deny, not %q", caps.name, capability))
+			}
+		}
+	}
+	if c.VaultEnableAudit {
+		if _, ok := auditDeviceTypes[c.VaultAuditType]; !ok {
+			result = multierror.Append(result, fmt.Errorf("VAULT_AUDIT_TYPE must be one of file, socket, and syslog, not %q", c.VaultAuditType))
+		}
+		c.VaultAuditPath = strings.Trim(c.VaultAuditPath, "/")
+		if c.VaultAuditPath == "" {
+			result = multierror.Append(result, errors.New("VAULT_AUDIT_PATH must not be empty"))
+		}
+	}
+	if c.ShutdownTimeout < 0 {
+		result = multierror.Append(result, errors.New("SHUTDOWN_TIMEOUT must not be negative"))
+	}
+	if c.RenewerStopTimeout < 0 {
+		result = multierror.Append(result, errors.New("RENEWER_STOP_TIMEOUT must not be negative"))
+	}
+	if c.RateLimitRead < 0 || c.RateLimitWrite < 0 {
+		result = multierror.Append(result, errors.New("RATE_LIMIT_READ and RATE_LIMIT_WRITE must not be negative"))
+	}
+	if (c.RateLimitRead > 0 && c.RateLimitReadBurst < 1) || (c.RateLimitWrite > 0 && c.RateLimitWriteBurst < 1) {
+		result = multierror.Append(result, errors.New("RATE_LIMIT_READ_BURST and RATE_LIMIT_WRITE_BURST must be at least 1"))
+	}
+	if c.RestoreConcurrency < 1 {
+		result = multierror.Append(result, errors.New("RESTORE_CONCURRENCY must be at least 1"))
+	}
+	if c.RestoreFailureThreshold < 0 || c.RestoreFailureThreshold > 1 {
+		result = multierror.Append(result, errors.New("RESTORE_FAILURE_THRESHOLD must be between 0 and 1"))
 	}
 
 	// If these values aren't perfect, we can fix them
 	if !strings.HasPrefix(c.Port, ":") {
 		c.Port = ":" + c.Port
 	}
+	if addr, err := listenAddr(c.BindAddress, c.Port); err != nil {
+		result = multierror.Append(result, err)
+	} else {
+		c.ListenAddr = addr
+	}
+	c.VaultAddrs = nil
+	for _, addr := range strings.Split(c.VaultAddr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.VaultAddrs = append(c.VaultAddrs, normalizeAddr(addr))
+		}
+	}
+	if len(c.VaultAddrs) == 0 {
+		result = multierror.Append(result, errors.New("missing VAULT_ADDR"))
+	} else {
+		c.VaultAddr = c.VaultAddrs[0]
+	}
 	if c.VaultAdvertiseAddr == "" {
 		c.VaultAdvertiseAddr = c.VaultAddr
 	}
-	c.VaultAddr = normalizeAddr(c.VaultAddr)
 	c.VaultAdvertiseAddr = normalizeAddr(c.VaultAdvertiseAddr)
-	return nil
+	c.MountPrefix = strings.Trim(c.MountPrefix, "/")
+	if c.MountPrefix == "" {
+		result = multierror.Append(result, errors.New("MOUNT_PREFIX must not be empty"))
+	}
+	c.BrokerBackendPath = strings.Trim(c.BrokerBackendPath, "/")
+	if c.BrokerBackendPath == "" {
+		c.BrokerBackendPath = mountPath(c.MountPrefix, "broker")
+	}
+	if c.BrokerBackendVersion != 1 && c.BrokerBackendVersion != 2 {
+		result = multierror.Append(result, fmt.Errorf("BROKER_BACKEND_VERSION must be 1 or 2, not %d", c.BrokerBackendVersion))
+	}
+	c.VaultNamespace = strings.Trim(c.VaultNamespace, "/")
+	c.BindingTransitMount = strings.Trim(c.BindingTransitMount, "/")
+	if c.BindingTransitKey != "" {
+		if c.BindingTransitMount == "" {
+			result = multierror.Append(result, errors.New("BINDING_TRANSIT_MOUNT must not be empty"))
+		}
+		if !extraMountNameRe.MatchString(c.BindingTransitKey) {
+			result = multierror.Append(result, fmt.Errorf("BINDING_TRANSIT_KEY %q may only contain letters, digits, '-', and '_'", c.BindingTransitKey))
+		}
+	}
+
+	// Read the CA certificate given to clients
+	if c.BindCACert {
+		if c.VaultCACert == "" {
+			result = multierror.Append(result, errors.New("missing VAULT_CACERT for BIND_CA_CERT"))
+		} else if pemBytes, err := ioutil.ReadFile(c.VaultCACert); err != nil {
+			result = multierror.Append(result, fmt.Errorf("failed to read VAULT_CACERT: %s", err))
+		} else if block, _ := pem.Decode(pemBytes); block == nil || block.Type != "CERTIFICATE" {
+			result = multierror.Append(result, errors.New("VAULT_CACERT does not contain a PEM-encoded certificate"))
+		} else {
+			c.VaultCACertPEM = string(pemBytes)
+		}
+	}
+
+	// Check the broker's own certificate, so a bad one fails at startup
+	// rather than when the server starts listening
+	version, ok := tlsVersions[c.BrokerTLSMinVersion]
+	if !ok {
+		result = multierror.Append(result, fmt.Errorf("unsupported BROKER_TLS_MIN_VERSION %q", c.BrokerTLSMinVersion))
+	}
+	c.BrokerTLSMinVersionID = version
+	if v, err := parseAPIVersion(c.BrokerAPIMinVersion); err != nil {
+		result = multierror.Append(result, fmt.Errorf("invalid BROKER_API_MIN_VERSION: %s", err))
+	} else {
+		c.BrokerAPIMinVersionID = v
+	}
+	if c.BrokerTLSCert != "" && c.BrokerTLSKey != "" {
+		if _, err := tls.LoadX509KeyPair(c.BrokerTLSCert, c.BrokerTLSKey); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid BROKER_TLS_CERT or BROKER_TLS_KEY: %s", err))
+		}
+	}
+
+	for _, u := range []struct{ name, value string }{
+		{"SERVICE_IMAGE_URL", c.ServiceImageURL},
+		{"SERVICE_DOCUMENTATION_URL", c.ServiceDocumentationURL},
+		{"SERVICE_SUPPORT_URL", c.ServiceSupportURL},
+	} {
+		if parsed, err := url.Parse(u.value); u.value != "" && (err != nil || parsed.Scheme == "") {
+			result = multierror.Append(result, fmt.Errorf("%s must be an absolute URL", u.name))
+		}
+	}
+
+	// Parse the dashboard URL template, and render it once so that unknown
+	// fields fail at startup
+	c.DashboardURLTemplate = nil
+	if c.DashboardURL != "" {
+		tmpl, err := template.New("dashboard").Option("missingkey=error").Parse(c.DashboardURL)
+		if err == nil {
+			err = tmpl.Execute(ioutil.Discard, &DashboardURLInput{})
+		}
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid DASHBOARD_URL: %s", err))
+		} else {
+			c.DashboardURLTemplate = tmpl
+		}
+	}
+
+	// Parse the advertise address template the same way
+	c.AdvertiseAddrTemplate = nil
+	if c.VaultAdvertiseAddrTemplate != "" {
+		tmpl, err := template.New("advertise").Option("missingkey=error").Parse(c.VaultAdvertiseAddrTemplate)
+		if err == nil {
+			err = tmpl.Execute(ioutil.Discard, &AdvertiseAddrInput{})
+		}
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid VAULT_ADVERTISE_ADDR_TEMPLATE: %s", err))
+		} else {
+			c.AdvertiseAddrTemplate = tmpl
+		}
+	}
+
+	// Read and check the custom policy template
+	c.PolicyTemplate = nil
+	if c.PolicyTemplatePath != "" {
+		text, err := ioutil.ReadFile(c.PolicyTemplatePath)
+		if err == nil {
+			c.PolicyTemplate, err = ParsePolicyTemplate(string(text))
+		}
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid POLICY_TEMPLATE_PATH: %s", err))
+		}
+	}
+
+	// Parse the mount description template the same way
+	c.MountDescriptionTemplate = nil
+	if c.MountDescription != "" {
+		tmpl, err := template.New("mount").Option("missingkey=error").Parse(c.MountDescription)
+		if err == nil {
+			err = tmpl.Execute(ioutil.Discard, &MountDescriptionInput{})
+		}
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid MOUNT_DESCRIPTION: %s", err))
+		} else {
+			c.MountDescriptionTemplate = tmpl
+		}
+	}
+
+	// Build the plans
+	if c.PlansJSON == "" {
+		c.Plans = []*Plan{
+			{
+				Name:        c.PlanName,
+				Description: c.PlanDescription,
+				Engines:     DefaultPlanEngines,
+				DisplayName: c.PlanDisplayName,
+				Bullets:     c.PlanBullets,
+				ReadOnly:    c.PlanReadOnly,
+				SealWrap:    c.PlanSealWrap,
+				Local:       c.PlanLocal,
+				KVVersion:   c.PlanKVVersion,
+			},
+		}
+		if c.PlanKVVersion < 1 || c.PlanKVVersion > 2 {
+			result = multierror.Append(result, fmt.Errorf("PLAN_KV_VERSION must be 1 or 2"))
+		}
+		if !c.PlanFree {
+			c.Plans[0].Free = &c.PlanFree
+		}
+		if c.PlanCosts != "" {
+			costs, err := parsePlanCosts(c.PlanCosts)
+			if err != nil {
+				result = multierror.Append(result, fmt.Errorf("invalid PLAN_COSTS: %s", err))
+			}
+			c.Plans[0].Costs = costs
+		}
+		if err := c.Plans[0].validateCosts(); err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid PLAN_COSTS: %s", err))
+		}
+		if c.TransitKeyName != "" {
+			c.Plans[0].TransitKey = &TransitKey{
+				Name:             c.TransitKeyName,
+				Type:             c.TransitKeyType,
+				AutoRotatePeriod: c.TransitKeyAutoRotatePeriod,
+			}
+			if err := c.Plans[0].validateTransitKey(); err != nil {
+				result = multierror.Append(result, fmt.Errorf("invalid TRANSIT_KEY_NAME: %s", err))
+			}
+		}
+	} else {
+		plans, err := parsePlans(c.PlansJSON)
+		if err != nil {
+			result = multierror.Append(result, fmt.Errorf("invalid PLANS: %s", err))
+		}
+		c.Plans = plans
+	}
+
+	// Check the AWS settings when a plan generates AWS credentials
+	for _, p := range c.Plans {
+		if !p.hasEngine(AWS) {
+			continue
+		}
+		if !awsRoleARNRe.MatchString(c.AWSRoleARN) {
+			result = multierror.Append(result, fmt.Errorf("AWS_ROLE_ARN %q must be the ARN of an IAM role for plan %q", c.AWSRoleARN, p.Name))
+		}
+		if !awsRegionRe.MatchString(c.AWSRegion) {
+			result = multierror.Append(result, fmt.Errorf("invalid AWS_REGION %q", c.AWSRegion))
+		}
+		if (c.AWSAccessKeyID == "") != (c.AWSSecretAccessKey == "") {
+			result = multierror.Append(result, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set together"))
+		}
+		break
+	}
+
+	// Check the SSH settings when a plan signs SSH certificates
+	for _, p := range c.Plans {
+		if !p.hasEngine(SSH) {
+			continue
+		}
+		if len(c.SSHAllowedUsers) == 0 {
+			result = multierror.Append(result, fmt.Errorf("SSH_ALLOWED_USERS is required for plan %q", p.Name))
+		}
+		for _, u := range c.SSHAllowedUsers {
+			if u == "" || strings.Contains(u, "*") {
+				result = multierror.Append(result, fmt.Errorf("invalid user %q in SSH_ALLOWED_USERS", u))
+			}
+		}
+		if c.SSHCertTTL <= 0 {
+			result = multierror.Append(result, fmt.Errorf("SSH_CERT_TTL %s must be positive", c.SSHCertTTL))
+		}
+		break
+	}
+
+	// Check the PKI settings when a plan issues certificates
+	for _, p := range c.Plans {
+		if !p.hasEngine(PKI) {
+			continue
+		}
+		if len(c.PKIAllowedDomains) == 0 {
+			result = multierror.Append(result, fmt.Errorf("PKI_ALLOWED_DOMAINS is required for plan %q", p.Name))
+		}
+		for _, d := range c.PKIAllowedDomains {
+			if d == "" || strings.Contains(d, "*") {
+				result = multierror.Append(result, fmt.Errorf("invalid domain %q in PKI_ALLOWED_DOMAINS", d))
+			}
+		}
+		if c.PKICertTTL <= 0 {
+			result = multierror.Append(result, fmt.Errorf("PKI_CERT_TTL %s must be positive", c.PKICertTTL))
+		}
+		if c.PKICATTL <= c.PKICertTTL {
+			result = multierror.Append(result, fmt.Errorf("PKI_CA_TTL %s must be longer than PKI_CERT_TTL %s", c.PKICATTL, c.PKICertTTL))
+		}
+		if c.MountMaxLeaseTTL > 0 && c.PKICATTL > c.MountMaxLeaseTTL {
+			result = multierror.Append(result, fmt.Errorf("PKI_CA_TTL %s must not be longer than MOUNT_MAX_LEASE_TTL %s", c.PKICATTL, c.MountMaxLeaseTTL))
+		}
+		break
+	}
+	return result.ErrorOrNil()
 }
+
+// awsRoleARNRe matches the ARNs of IAM roles, in any partition.
+var awsRoleARNRe = regexp.MustCompile(`^arn:aws[a-z-]*:iam::\d{12}:role/.+$`)
+
+// awsRegionRe matches the names of AWS regions, for example "us-east-1" or
+// "us-gov-west-1".
+var awsRegionRe = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d$`)
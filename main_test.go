@@ -1,9 +1,22 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
 )
 
 func TestNormalizeAddr(t *testing.T) {
@@ -47,6 +60,36 @@ func TestNormalizeAddr(t *testing.T) {
 			"http://www.example.com:8200",
 			"http://www.example.com:8200/",
 		},
+		{
+			"port-path",
+			"vault.example.com:8200/foo/",
+			"https://vault.example.com:8200/foo/",
+		},
+		{
+			"ipv4-port",
+			"127.0.0.1:8200",
+			"https://127.0.0.1:8200/",
+		},
+		{
+			"ipv6",
+			"::1",
+			"https://[::1]/",
+		},
+		{
+			"ipv6-brackets",
+			"[::1]",
+			"https://[::1]/",
+		},
+		{
+			"ipv6-port",
+			"[::1]:8200",
+			"https://[::1]:8200/",
+		},
+		{
+			"ipv6-port-scheme",
+			"http://[fd00::1]:8200/",
+			"http://[fd00::1]:8200/",
+		},
 	}
 
 	for i, tc := range cases {
@@ -112,70 +155,1062 @@ func TestParseConfigDefaults(t *testing.T) {
 	if config.VaultRenew != true {
 		t.Fatal("expected true but received false")
 	}
+	if config.LogLevel != "info" {
+		t.Fatalf("expected %s but received %s", `"info"`, config.LogLevel)
+	}
+	if config.MountPrefix != "cf" {
+		t.Fatalf("expected %s but received %s", `"cf"`, config.MountPrefix)
+	}
+	if len(config.Plans) != 1 || config.Plans[0].Name != "shared" {
+		t.Fatalf("expected the single shared plan but received %+v", config.Plans)
+	}
 }
 
-func TestParseConfigFromEnv(t *testing.T) {
+func TestParseConfigPlans(t *testing.T) {
 	os.Clearenv()
 
 	os.Setenv("SECURITY_USER_NAME", "fizz")
 	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
 	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("PLANS", `[{"name": "kv-only", "engines": ["generic"]}, {"name": "full", "engines": ["generic", "transit", "pki"]}]`)
+	os.Setenv("PKI_ALLOWED_DOMAINS", "apps.example.com")
 
-	os.Setenv("PORT", "8080")
-	os.Setenv("SERVICE_ID", "1234")
-	os.Setenv("VAULT_ADDR", "http://localhost:8200")
-	os.Setenv("VAULT_ADVERTISE_ADDR", "https://some-domain.com")
-	os.Setenv("SERVICE_NAME", "vault")
-	os.Setenv("SERVICE_DESCRIPTION", "Vault, by Hashicorp")
-	os.Setenv("PLAN_NAME", "free")
-	os.Setenv("PLAN_DESCRIPTION", "Can you believe it's opensource?")
-	os.Setenv("SERVICE_TAGS", "hello,world")
-	os.Setenv("VAULT_RENEW", "false")
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Plans) != 2 {
+		t.Fatalf("expected 2 plans but received %d", len(config.Plans))
+	}
+
+	os.Setenv("PLANS", `[{"name": "bad", "engines": ["nope"]}]`)
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an invalid plan")
+	}
+}
+
+func TestParseConfigMountTTLs(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("MOUNT_DEFAULT_LEASE_TTL", "1h")
+	os.Setenv("MOUNT_MAX_LEASE_TTL", "24h")
 
 	config, err := parseConfig()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if config.SecurityUserName != "fizz" {
-		t.Fatalf("expected %s but received %s", `"fizz"`, config.SecurityUserName)
+	if config.MountDefaultLeaseTTL != time.Hour {
+		t.Fatalf("expected %s but received %s", time.Hour, config.MountDefaultLeaseTTL)
 	}
-	if config.SecurityUserPassword != "buzz" {
-		t.Fatalf("expected %s but received %s", `"buzz"`, config.SecurityUserPassword)
+	if config.MountMaxLeaseTTL != 24*time.Hour {
+		t.Fatalf("expected %s but received %s", 24*time.Hour, config.MountMaxLeaseTTL)
 	}
-	if config.VaultToken != "bang" {
-		t.Fatalf("expected %s but received %s", `"bang"`, config.VaultToken)
+
+	os.Setenv("MOUNT_DEFAULT_LEASE_TTL", "48h")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a default TTL above the max TTL")
 	}
-	if config.CredhubURL != "" {
-		t.Fatalf("expected %s but received %s", `""`, config.CredhubURL)
+
+	os.Setenv("MOUNT_DEFAULT_LEASE_TTL", "nope")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an invalid duration")
 	}
-	if config.Port != ":8080" {
-		t.Fatalf("expected %s but received %s", `":8080"`, config.Port)
+}
+
+func TestParseConfigVaultTokenFile(t *testing.T) {
+	os.Clearenv()
+
+	f, err := ioutil.TempFile("", "vault-token")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if config.ServiceID != "1234" {
-		t.Fatalf("expected %s but received %s", `"1234"`, config.ServiceID)
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("file-token\n"); err != nil {
+		t.Fatal(err)
 	}
-	if config.VaultAddr != "http://localhost:8200/" {
-		t.Fatalf("expected %s but received %s", `"http://localhost:8200/"`, config.VaultAddr)
+	f.Close()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN_FILE", f.Name())
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if config.VaultAdvertiseAddr != "https://some-domain.com/" {
-		t.Fatalf("expected %s but received %s", `"https://some-domain.com/"`, config.VaultAdvertiseAddr)
+	if config.VaultToken != "file-token" {
+		t.Fatalf("expected %q but received %q", "file-token", config.VaultToken)
 	}
-	if config.ServiceName != "vault" {
-		t.Fatalf("expected %s but received %s", `"vault"`, config.ServiceName)
+
+	os.Setenv("VAULT_TOKEN", "bang")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for both VAULT_TOKEN and VAULT_TOKEN_FILE")
 	}
-	if config.ServiceDescription != "Vault, by Hashicorp" {
-		t.Fatalf("expected %s but received %s", `"Vault, by Hashicorp"`, config.ServiceDescription)
+}
+
+func TestParseConfigVaultAddrs(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("VAULT_ADDR", "vault-1.example.com:8200, https://vault-2.example.com:8200")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if config.PlanName != "free" {
-		t.Fatalf("expected %s but received %s", `"free"`, config.PlanName)
+	expected := []string{"https://vault-1.example.com:8200/", "https://vault-2.example.com:8200/"}
+	if !reflect.DeepEqual(config.VaultAddrs, expected) {
+		t.Fatalf("expected %q but received %q", expected, config.VaultAddrs)
 	}
-	if config.PlanDescription != "Can you believe it's opensource?" {
-		t.Fatalf("expected %s but received %s", `"Can you believe it's opensource?"`, config.PlanDescription)
+	if config.VaultAddr != expected[0] {
+		t.Fatalf("expected %q but received %q", expected[0], config.VaultAddr)
 	}
-	if len(config.ServiceTags) != 2 {
-		t.Fatalf("expected %d but received %d: %s", 2, len(config.ServiceTags), config.ServiceTags)
+	if config.VaultAdvertiseAddr != expected[0] {
+		t.Fatalf("expected %q but received %q", expected[0], config.VaultAdvertiseAddr)
 	}
-	if config.VaultRenew != false {
-		t.Fatal("expected false but received true")
+
+	os.Setenv("VAULT_ADDR", " , ")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for no addresses")
+	}
+}
+
+func TestParseConfigTokenRole(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := config.Warnings(); len(w) != 0 {
+		t.Fatalf("expected no warnings but received %q", w)
+	}
+
+	os.Setenv("TOKEN_MAX_TTL", "24h")
+	os.Setenv("TOKEN_NUM_USES", "10")
+	os.Setenv("TOKEN_NO_DEFAULT_POLICY", "true")
+	config, err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.TokenMaxTTL != 24*time.Hour {
+		t.Fatalf("expected %s but received %s", 24*time.Hour, config.TokenMaxTTL)
+	}
+	if config.TokenNumUses != 10 {
+		t.Fatalf("expected %d but received %d", 10, config.TokenNumUses)
+	}
+	if w := config.Warnings(); len(w) != 3 {
+		t.Fatalf("expected 3 warnings but received %q", w)
+	}
+
+	os.Setenv("TOKEN_NUM_USES", "-1")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for negative uses")
+	}
+}
+
+func TestParseConfigBindCACert(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("BIND_CA_CERT", "true")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a missing VAULT_CACERT")
+	}
+
+	f, err := ioutil.TempFile("", "vault-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	os.Setenv("VAULT_CACERT", f.Name())
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a CA file without a certificate")
+	}
+
+	caCert := "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n"
+	if _, err := f.WriteString(caCert); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.VaultCACertPEM != caCert {
+		t.Fatalf("expected %q but received %q", caCert, config.VaultCACertPEM)
+	}
+}
+
+func TestParseConfigListenAddr(t *testing.T) {
+	cases := []struct {
+		name        string
+		bindAddress string
+		port        string
+		e           string
+		err         bool
+	}{
+		{"default", "", "", ":8000", false},
+		{"port", "", "9000", ":9000", false},
+		{"port-colon", "", ":9000", ":9000", false},
+		{"ipv4", "127.0.0.1", "9000", "127.0.0.1:9000", false},
+		{"hostname", "localhost", ":9000", "localhost:9000", false},
+		{"ipv6", "::1", "9000", "[::1]:9000", false},
+		{"ipv6-brackets", "[::1]", "9000", "[::1]:9000", false},
+		{"address-with-port", "127.0.0.1:9000", "9000", "", true},
+		{"invalid-port", "", "http", "", true},
+		{"port-out-of-range", "", "70000", "", true},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			os.Clearenv()
+			os.Setenv("SECURITY_USER_NAME", "fizz")
+			os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+			os.Setenv("VAULT_TOKEN", "bang")
+			os.Setenv("BIND_ADDRESS", tc.bindAddress)
+			if tc.port != "" {
+				os.Setenv("PORT", tc.port)
+			}
+
+			config, err := parseConfig()
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error but received %q", config.ListenAddr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ListenAddr != tc.e {
+				t.Errorf("expected %q to be %q", config.ListenAddr, tc.e)
+			}
+		})
+	}
+}
+
+func TestParseConfigServiceMetadata(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := config.serviceMetadata(); m != nil {
+		t.Fatalf("expected no metadata but received %+v", m)
+	}
+
+	os.Setenv("SERVICE_DISPLAY_NAME", "Vault")
+	os.Setenv("SERVICE_SUPPORT_URL", "https://example.com/support")
+	os.Setenv("PLAN_BULLETS", "KV secrets,Transit encryption")
+	config, err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := config.serviceMetadata()
+	if m == nil || m.DisplayName != "Vault" || m.SupportUrl != "https://example.com/support" || m.ImageUrl != "" {
+		t.Fatalf("unexpected metadata %+v", m)
+	}
+	if bullets := config.Plans[0].Bullets; len(bullets) != 2 {
+		t.Fatalf("expected 2 bullets but received %q", bullets)
+	}
+
+	os.Setenv("SERVICE_DOCUMENTATION_URL", "example.com/docs")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a relative URL")
+	}
+}
+
+func TestParseConfigMaxBindings(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxBindingsPerInstance != 0 {
+		t.Fatalf("expected no limit but received %d", config.MaxBindingsPerInstance)
+	}
+
+	os.Setenv("MAX_BINDINGS_PER_INSTANCE", "-1")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a negative limit")
+	}
+}
+
+func TestParseConfigAdvertiseAddrTemplate(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("VAULT_ADVERTISE_ADDR_TEMPLATE", `{{if eq .OrganizationGUID "a"}}vault.internal{{end}}`)
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AdvertiseAddrTemplate == nil {
+		t.Fatal("expected the template to be parsed")
+	}
+
+	os.Setenv("VAULT_ADVERTISE_ADDR_TEMPLATE", "{{.Org}}")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func TestParseConfigNameLookupMode(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NameLookupMode != NameLookupBestEffort {
+		t.Fatalf("expected %s but received %s", NameLookupBestEffort, config.NameLookupMode)
+	}
+
+	os.Setenv("NAME_LOOKUP_MODE", "lenient")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestParseConfigBindIdentity(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("TOKEN_AUTH_MOUNT_ACCESSOR", "auth_token_1234")
+
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an accessor without BIND_IDENTITY")
+	}
+
+	os.Setenv("BIND_IDENTITY", "true")
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.BindIdentity || config.TokenAuthMountAccessor != "auth_token_1234" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+}
+
+func TestParseConfigCredhub(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("BIND_CREDHUB_REF", "true")
+	os.Setenv("CREDHUB_URL", "https://credhub.example.com:8844")
+	os.Setenv("CREDHUB_CLIENT_ID", "broker")
+
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error without a client secret or certificate")
+	}
+
+	certFile, keyFile := writeKeyPair(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	os.Setenv("CREDHUB_CLIENT_CERT", certFile)
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a missing CREDHUB_CLIENT_KEY")
+	}
+
+	// A client certificate replaces the client secret
+	os.Setenv("CREDHUB_CLIENT_KEY", keyFile)
+	os.Setenv("CREDHUB_CA_CERT", certFile)
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.CredhubTLSConfig == nil || len(config.CredhubTLSConfig.Certificates) != 1 || config.CredhubTLSConfig.RootCAs == nil {
+		t.Fatalf("unexpected TLS config %+v", config.CredhubTLSConfig)
+	}
+
+	os.Setenv("CREDHUB_CA_CERT", "/nonexistent")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a missing CREDHUB_CA_CERT")
+	}
+}
+
+func TestParseConfigPlanCosts(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("PLAN_COSTS", `[{"amount": {"usd": 10}, "unit": "MONTHLY"}]`)
+
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for costs on a free plan")
+	}
+
+	os.Setenv("PLAN_FREE", "false")
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := config.Plans[0]
+	if plan.free() || len(plan.Costs) != 1 || plan.Costs[0].Amount["usd"] != 10 {
+		t.Fatalf("expected a plan costing 10 usd but received %+v", plan)
+	}
+
+	os.Setenv("PLAN_COSTS", `{"usd": 10}`)
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for malformed costs")
+	}
+}
+
+func TestParseConfigDashboardURL(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DashboardURLTemplate != nil {
+		t.Fatal("expected no dashboard URL template")
+	}
+
+	os.Setenv("DASHBOARD_URL", "https://vault.example.com/ui/vault/secrets/{{.Prefix}}/{{.ServiceInstanceGUID}}")
+	config, err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DashboardURLTemplate == nil {
+		t.Fatal("expected a dashboard URL template")
+	}
+
+	for _, u := range []string{
+		"https://vault.example.com/{{.ServiceInstanceGUID",
+		"https://vault.example.com/{{.InstanceID}}",
+	} {
+		os.Setenv("DASHBOARD_URL", u)
+		if _, err := parseConfig(); err == nil {
+			t.Fatalf("expected an error for %q", u)
+		}
+	}
+}
+
+func TestParseConfigMountDescription(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("MOUNT_DESCRIPTION", "")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MountDescriptionTemplate != nil {
+		t.Fatal("expected descriptions to be disabled")
+	}
+
+	os.Setenv("MOUNT_DESCRIPTION", "{{.Organization}}/{{.Name}}")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
+
+func TestParseConfigTransitKey(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("TRANSIT_KEY_NAME", "app")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := config.Plans[0].TransitKey
+	if k == nil || k.Name != "app" || k.Type != DefaultTransitKeyType || k.autoRotatePeriod != 0 {
+		t.Fatalf("unexpected transit key %+v", k)
+	}
+
+	os.Setenv("TRANSIT_KEY_AUTO_ROTATE_PERIOD", "30m")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a short rotation period")
+	}
+}
+
+func TestParseConfigDefaultBindPolicies(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("DEFAULT_BIND_POLICIES", "global-config, renew-self")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := []string{"global-config", "renew-self"}; !reflect.DeepEqual(config.DefaultBindPolicies, e) {
+		t.Fatalf("expected %q but received %q", e, config.DefaultBindPolicies)
+	}
+
+	for _, v := range []string{"global-config,", "root"} {
+		os.Setenv("DEFAULT_BIND_POLICIES", v)
+		if _, err := parseConfig(); err == nil {
+			t.Fatalf("expected an error for %q", v)
+		}
+	}
+}
+
+func TestParseConfigBindingTransitKey(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("BINDING_TRANSIT_MOUNT", "/broker-transit/")
+	os.Setenv("BINDING_TRANSIT_KEY", "bindings")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BindingTransitMount != "broker-transit" {
+		t.Fatalf("expected %q but received %q", "broker-transit", config.BindingTransitMount)
+	}
+
+	os.Setenv("BINDING_TRANSIT_KEY", "keys/bindings")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an invalid key name")
+	}
+}
+
+func TestParseConfigAWS(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("PLANS", `[{"name": "aws", "engines": ["aws"]}]`)
+
+	// Plans with the AWS engine need a role
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a missing role")
+	}
+
+	os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/app")
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AWSRegion != "us-east-1" {
+		t.Fatalf("expected the default region but received %q", config.AWSRegion)
+	}
+
+	for k, v := range map[string]string{
+		"AWS_ROLE_ARN":      "arn:aws:iam::123456789012:user/app",
+		"AWS_REGION":        "nowhere",
+		"AWS_ACCESS_KEY_ID": "AKIAEXAMPLE",
+	} {
+		os.Setenv(k, v)
+		if _, err := parseConfig(); err == nil {
+			t.Errorf("expected an error for %s=%q", k, v)
+		}
+		os.Unsetenv(k)
+		os.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/app")
+	}
+}
+
+func TestParseConfigSSH(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("PLANS", `[{"name": "ssh", "engines": ["ssh"]}]`)
+
+	// Plans with the SSH engine need the users to sign certificates for
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for missing users")
+	}
+
+	os.Setenv("SSH_ALLOWED_USERS", "vcap,app")
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.SSHAllowedUsers, []string{"vcap", "app"}) {
+		t.Fatalf("unexpected users %q", config.SSHAllowedUsers)
+	}
+	if config.SSHCertTTL != time.Hour {
+		t.Fatalf("expected the default TTL but received %s", config.SSHCertTTL)
+	}
+
+	for k, v := range map[string]string{
+		"SSH_ALLOWED_USERS": "vcap,*",
+		"SSH_CERT_TTL":      "0s",
+	} {
+		os.Setenv(k, v)
+		if _, err := parseConfig(); err == nil {
+			t.Errorf("expected an error for %s=%q", k, v)
+		}
+		os.Unsetenv(k)
+		os.Setenv("SSH_ALLOWED_USERS", "vcap,app")
+	}
+}
+
+func TestParseConfigPKI(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("PLANS", `[{"name": "pki", "engines": ["pki"]}]`)
+
+	// Plans with the PKI engine need the domains to issue certificates for
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for missing domains")
+	}
+
+	os.Setenv("PKI_ALLOWED_DOMAINS", "apps.example.com,example.org")
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.PKIAllowedDomains, []string{"apps.example.com", "example.org"}) {
+		t.Fatalf("unexpected domains %q", config.PKIAllowedDomains)
+	}
+	if config.PKICertTTL != 72*time.Hour || config.PKICATTL != 720*time.Hour {
+		t.Fatalf("expected the default TTLs but received %s and %s", config.PKICertTTL, config.PKICATTL)
+	}
+
+	for k, v := range map[string]string{
+		"PKI_ALLOWED_DOMAINS": "*.example.com",
+		"PKI_CERT_TTL":        "0s",
+		"PKI_CA_TTL":          "24h",
+		"MOUNT_MAX_LEASE_TTL": "168h",
+	} {
+		os.Setenv(k, v)
+		if _, err := parseConfig(); err == nil {
+			t.Errorf("expected an error for %s=%q", k, v)
+		}
+		os.Unsetenv(k)
+		os.Setenv("PKI_ALLOWED_DOMAINS", "apps.example.com,example.org")
+	}
+}
+
+func TestParseConfigPolicyCapabilities(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+	os.Setenv("POLICY_SPACE_CAPABILITIES", "Read, list")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.PolicySpaceCapabilities, []string{"read", "list"}) {
+		t.Fatalf("expected the capabilities to be normalized but received %q", config.PolicySpaceCapabilities)
+	}
+	if config.PolicyServiceCapabilities != nil || config.PolicyOrgCapabilities != nil {
+		t.Fatal("expected the other capabilities to keep their defaults")
+	}
+
+	os.Setenv("POLICY_ORG_CAPABILITIES", "read,write")
+	if _, err := parseConfig(); err == nil || !strings.Contains(err.Error(), `"write"`) {
+		t.Fatalf("expected an error for the unknown capability but received %v", err)
+	}
+}
+
+func TestParseConfigPolicyTemplate(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.PolicyTemplate != nil {
+		t.Fatal("expected the built-in policy template by default")
+	}
+
+	f, err := ioutil.TempFile("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`path "{{ .Prefix }}/{{ .ServiceID }}/*" { capabilities = ["read"] }`)
+	f.Close()
+
+	os.Setenv("POLICY_TEMPLATE_PATH", f.Name())
+	if config, err = parseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if config.PolicyTemplate == nil {
+		t.Fatal("expected the policy template to be loaded")
+	}
+
+	os.Setenv("POLICY_TEMPLATE_PATH", f.Name()+".missing")
+	if _, err := parseConfig(); err == nil || !strings.Contains(err.Error(), "POLICY_TEMPLATE_PATH") {
+		t.Fatalf("expected an error for the missing file but received %v", err)
+	}
+}
+
+func TestParseConfigServerTimeouts(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerWriteTimeout <= config.OperationTimeout {
+		t.Fatalf("expected the default write timeout %s to exceed the operation timeout %s",
+			config.ServerWriteTimeout, config.OperationTimeout)
+	}
+
+	for k, v := range map[string]string{
+		"SERVER_READ_TIMEOUT":  "-1s",
+		"SERVER_IDLE_TIMEOUT":  "-1s",
+		"SERVER_WRITE_TIMEOUT": "60s",
+	} {
+		os.Setenv(k, v)
+		if _, err := parseConfig(); err == nil {
+			t.Errorf("expected an error for %s=%q", k, v)
+		}
+		os.Unsetenv(k)
+	}
+
+	// Disabling the operation timeout allows any write timeout
+	os.Setenv("OPERATION_TIMEOUT", "0s")
+	os.Setenv("SERVER_WRITE_TIMEOUT", "10s")
+	if _, err := parseConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigBrokerTLS(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BrokerTLSMinVersionID != tls.VersionTLS12 {
+		t.Fatalf("expected %x but received %x", tls.VersionTLS12, config.BrokerTLSMinVersionID)
+	}
+
+	certFile, keyFile := writeKeyPair(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	os.Setenv("BROKER_TLS_CERT", certFile)
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a missing BROKER_TLS_KEY")
+	}
+	os.Setenv("BROKER_TLS_KEY", certFile)
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an invalid BROKER_TLS_KEY")
+	}
+
+	os.Setenv("BROKER_TLS_KEY", keyFile)
+	os.Setenv("BROKER_TLS_MIN_VERSION", "1.1")
+	config, err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BrokerTLSMinVersionID != tls.VersionTLS11 {
+		t.Fatalf("expected %x but received %x", tls.VersionTLS11, config.BrokerTLSMinVersionID)
+	}
+
+	os.Setenv("BROKER_TLS_MIN_VERSION", "1")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an unsupported version")
+	}
+}
+
+func TestParseConfigBrokerAPIMinVersion(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BrokerAPIMinVersionID != (apiVersion{2, 0}) {
+		t.Fatalf("expected 2.0 but received %s", config.BrokerAPIMinVersionID)
+	}
+
+	os.Setenv("BROKER_API_MIN_VERSION", "2.14")
+	config, err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BrokerAPIMinVersionID != (apiVersion{2, 14}) {
+		t.Fatalf("expected 2.14 but received %s", config.BrokerAPIMinVersionID)
+	}
+
+	os.Setenv("BROKER_API_MIN_VERSION", "v2")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an invalid version")
+	}
+}
+
+// writeKeyPair writes a self-signed certificate and its key to temporary files
+// and returns their paths.
+func writeKeyPair(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(prefix, typ string, b []byte) string {
+		f, err := ioutil.TempFile("", prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := pem.Encode(f, &pem.Block{Type: typ, Bytes: b}); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+	return write("broker-cert", "CERTIFICATE", der), write("broker-key", "EC PRIVATE KEY", keyDER)
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("PORT", "http")
+	os.Setenv("VAULT_RENEW", "maybe")
+	os.Setenv("OPERATION_TIMEOUT", "soon")
+	os.Setenv("RESTORE_CONCURRENCY", "0")
+
+	_, err := parseConfig()
+	merr, ok := err.(*multierror.Error)
+	if !ok {
+		t.Fatalf("expected a *multierror.Error but received %#v", err)
+	}
+	expected := []string{
+		"VAULT_RENEW",
+		"OPERATION_TIMEOUT",
+		"SECURITY_USER_NAME",
+		"SECURITY_USER_PASSWORD",
+		"VAULT_TOKEN",
+		"RESTORE_CONCURRENCY",
+		"PORT",
+	}
+	if len(merr.Errors) != len(expected) {
+		t.Fatalf("expected %d errors but received %s", len(expected), err)
+	}
+	for i, e := range expected {
+		if !strings.Contains(merr.Errors[i].Error(), e) {
+			t.Errorf("expected error %d to be about %s but received %q", i, e, merr.Errors[i])
+		}
+	}
+
+	// The environment is left unchanged
+	if v := os.Getenv("VAULT_RENEW"); v != "maybe" {
+		t.Fatalf("expected %q but received %q", "maybe", v)
+	}
+}
+
+func TestParseConfigAuthMethod(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_AUTH_METHOD", "cert")
+	os.Setenv("VAULT_CLIENT_CERT", "/etc/broker.crt")
+	os.Setenv("VAULT_CLIENT_KEY", "/etc/broker.key")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.vaultAuthMount() != "cert" {
+		t.Fatalf("expected %s but received %s", `"cert"`, config.vaultAuthMount())
+	}
+
+	os.Setenv("VAULT_TOKEN", "bang")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error when both a token and cert auth are configured")
+	}
+
+	os.Unsetenv("VAULT_TOKEN")
+	os.Unsetenv("VAULT_CLIENT_KEY")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for a client cert without a key")
+	}
+
+	os.Unsetenv("VAULT_CLIENT_CERT")
+	os.Setenv("VAULT_AUTH_METHOD", "approle")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for approle auth without a role ID")
+	}
+
+	os.Setenv("VAULT_ROLE_ID", "role")
+	os.Setenv("VAULT_SECRET_ID", "secret")
+	if _, err := parseConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("VAULT_TOKEN", "bang")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error when both a token and approle auth are configured")
+	}
+	os.Unsetenv("VAULT_TOKEN")
+
+	os.Setenv("VAULT_AUTH_METHOD", "kubernetes")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for kubernetes auth without a role")
+	}
+
+	os.Setenv("VAULT_K8S_ROLE", "broker")
+	config, err = parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.VaultK8sTokenPath != "/var/run/secrets/kubernetes.io/serviceaccount/token" {
+		t.Fatalf("unexpected service account token path %s", config.VaultK8sTokenPath)
+	}
+
+	os.Setenv("VAULT_AUTH_METHOD", "nope")
+	if _, err := parseConfig(); err == nil {
+		t.Fatal("expected an error for an unsupported auth method")
+	}
+}
+
+func TestParseConfigFromEnv(t *testing.T) {
+	os.Clearenv()
+
+	os.Setenv("SECURITY_USER_NAME", "fizz")
+	os.Setenv("SECURITY_USER_PASSWORD", "buzz")
+	os.Setenv("VAULT_TOKEN", "bang")
+
+	os.Setenv("PORT", "8080")
+	os.Setenv("SERVICE_ID", "1234")
+	os.Setenv("VAULT_ADDR", "http://localhost:8200")
+	os.Setenv("VAULT_ADVERTISE_ADDR", "https://some-domain.com")
+	os.Setenv("SERVICE_NAME", "vault")
+	os.Setenv("SERVICE_DESCRIPTION", "Vault, by Hashicorp")
+	os.Setenv("PLAN_NAME", "free")
+	os.Setenv("PLAN_DESCRIPTION", "Can you believe it's opensource?")
+	os.Setenv("SERVICE_TAGS", "hello,world")
+	os.Setenv("VAULT_RENEW", "false")
+	os.Setenv("MOUNT_PREFIX", "/cf-staging/")
+	os.Setenv("LOG_LEVEL", "DEBUG")
+
+	config, err := parseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SecurityUserName != "fizz" {
+		t.Fatalf("expected %s but received %s", `"fizz"`, config.SecurityUserName)
+	}
+	if config.SecurityUserPassword != "buzz" {
+		t.Fatalf("expected %s but received %s", `"buzz"`, config.SecurityUserPassword)
+	}
+	if config.VaultToken != "bang" {
+		t.Fatalf("expected %s but received %s", `"bang"`, config.VaultToken)
+	}
+	if config.CredhubURL != "" {
+		t.Fatalf("expected %s but received %s", `""`, config.CredhubURL)
+	}
+	if config.Port != ":8080" {
+		t.Fatalf("expected %s but received %s", `":8080"`, config.Port)
+	}
+	if config.ServiceID != "1234" {
+		t.Fatalf("expected %s but received %s", `"1234"`, config.ServiceID)
+	}
+	if config.VaultAddr != "http://localhost:8200/" {
+		t.Fatalf("expected %s but received %s", `"http://localhost:8200/"`, config.VaultAddr)
+	}
+	if config.VaultAdvertiseAddr != "https://some-domain.com/" {
+		t.Fatalf("expected %s but received %s", `"https://some-domain.com/"`, config.VaultAdvertiseAddr)
+	}
+	if config.ServiceName != "vault" {
+		t.Fatalf("expected %s but received %s", `"vault"`, config.ServiceName)
+	}
+	if config.ServiceDescription != "Vault, by Hashicorp" {
+		t.Fatalf("expected %s but received %s", `"Vault, by Hashicorp"`, config.ServiceDescription)
+	}
+	if config.PlanName != "free" {
+		t.Fatalf("expected %s but received %s", `"free"`, config.PlanName)
+	}
+	if config.PlanDescription != "Can you believe it's opensource?" {
+		t.Fatalf("expected %s but received %s", `"Can you believe it's opensource?"`, config.PlanDescription)
+	}
+	if len(config.ServiceTags) != 2 {
+		t.Fatalf("expected %d but received %d: %s", 2, len(config.ServiceTags), config.ServiceTags)
+	}
+	if config.VaultRenew != false {
+		t.Fatal("expected false but received true")
+	}
+	if config.LogLevel != "debug" {
+		t.Fatalf("expected %s but received %s", `"debug"`, config.LogLevel)
+	}
+	if config.MountPrefix != "cf-staging" {
+		t.Fatalf("expected %s but received %s", `"cf-staging"`, config.MountPrefix)
 	}
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// attachMetricsRoutes adds the endpoints serving the broker's metrics in the
+// Prometheus text format and its build to the router.
+func attachMetricsRoutes(router *mux.Router, b *Broker) {
+	router.HandleFunc("/metrics", b.handleMetrics).Methods("GET")
+	router.HandleFunc("/version", handleVersion).Methods("GET")
+}
+
+// handleMetrics writes the current value of every metric.
+func (b *Broker) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writeBuildMetrics(&buf)
+	writeRuntimeMetrics(&buf)
+	b.writeRenewalMetrics(&buf)
+	b.writeHealthMetrics(&buf)
+	if b.events != nil {
+		b.events.writeMetrics(&buf)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// handleVersion returns the build of the broker.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, currentBuild())
+}
+
+// writeBuildMetrics writes the build of the broker as labels of a constant
+// metric, so that it can be joined with the others.
+func writeBuildMetrics(w io.Writer) {
+	build := currentBuild()
+	writeMetric(w, "vault_service_broker_build_info", "gauge", "Build of the broker, with a constant value of 1.",
+		1, map[string]string{
+			"version":   build.Version,
+			"commit":    build.GitCommit,
+			"goversion": build.GoVersion,
+		})
+}
+
+// writeRuntimeMetrics writes the goroutine count and heap usage of the
+// broker process.
+func writeRuntimeMetrics(w io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.",
+		float64(runtime.NumGoroutine()), nil)
+	writeMetric(w, "go_memstats_heap_alloc_bytes", "gauge", "Number of heap bytes allocated and still in use.",
+		float64(mem.HeapAlloc), nil)
+	writeMetric(w, "go_memstats_heap_objects", "gauge", "Number of allocated objects.",
+		float64(mem.HeapObjects), nil)
+	writeMetric(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from the system.",
+		float64(mem.Sys), nil)
+}
+
+// Reasons a renewal fails, for the renewal failures metric.
+const (
+	// renewFailedLookup is a failure to look up or renew the token, which is
+	// retried.
+	renewFailedLookup = "lookup-failed"
+
+	// renewFailedDone is the renewal of the broker's token giving up with an
+	// error, after which it is restarted.
+	renewFailedDone = "done-with-error"
+
+	// renewFailedInvalid is a token or lease which is no longer valid, so its
+	// renewal stops for good.
+	renewFailedInvalid = "invalid"
+)
+
+// renewalFailed counts a failed renewal of the broker's token ("broker"), a
+// binding token ("binding"), or the lease of a binding's secret ("lease").
+func (b *Broker) renewalFailed(kind, reason string) {
+	b.renewalFailures.inc(map[string]string{"kind": kind, "reason": reason})
+	if kind == "broker" {
+		atomic.StoreInt32(&b.tokenRenewalHealthy, 0)
+	}
+}
+
+// writeRenewalMetrics writes the number of failed renewals and of renewers
+// whose last renewal succeeded, so that tokens which silently stop being
+// renewed can be alerted on.
+func (b *Broker) writeRenewalMetrics(w io.Writer) {
+	b.renewalFailures.write(w, "vault_service_broker_renewal_failures_total",
+		"Number of failed renewals of tokens and leases, by kind and reason.")
+
+	name := "vault_service_broker_healthy_renewers"
+	writeHeader(w, name, "gauge", "Number of tokens and leases being renewed whose last renewal succeeded, by kind.")
+	healthy := b.renewals.healthy()
+	for _, kind := range []string{"binding", "lease"} {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(map[string]string{"kind": kind}), healthy[kind])
+	}
+	if b.vaultRenewToken {
+		fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(map[string]string{"kind": "broker"}),
+			atomic.LoadInt32(&b.tokenRenewalHealthy))
+	}
+}
+
+// labeledCounter counts events by their labels. The zero value is ready to
+// use.
+type labeledCounter struct {
+	lock   sync.Mutex
+	counts map[string]float64
+}
+
+// inc counts an event with the given labels.
+func (c *labeledCounter) inc(labels map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]float64)
+	}
+	c.counts[formatLabels(labels)]++
+}
+
+// write writes a sample for each set of labels counted so far, sorted by
+// their labels.
+func (c *labeledCounter) write(w io.Writer, name, help string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	writeHeader(w, name, "counter", help)
+	keys := make([]string, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", name, k, c.counts[k])
+	}
+}
+
+// writeMetric writes a single sample with its HELP and TYPE lines. Labels are
+// written sorted by name.
+func writeMetric(w io.Writer, name, typ, help string, value float64, labels map[string]string) {
+	writeHeader(w, name, typ, help)
+	fmt.Fprintf(w, "%s%s %g\n", name, formatLabels(labels), value)
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// formatLabels renders the labels of a sample, or an empty string if there
+// are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", name, labels[name])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBroker_Metrics(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	router := mux.NewRouter()
+	attachMetricsRoutes(router, env.Broker)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, w.Code)
+	}
+	for _, s := range []string{
+		"\nvault_service_broker_build_info{commit=\"\",goversion=\"" + runtime.Version() + "\",version=\"" + Version + "\"} 1\n",
+		"# TYPE go_goroutines gauge\ngo_goroutines ",
+		"\ngo_memstats_heap_alloc_bytes ",
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("expected the metrics to contain %q but received\n%s", s, w.Body)
+		}
+	}
+}
+
+func TestBroker_RenewalMetrics(t *testing.T) {
+	b := &Broker{vaultRenewToken: true}
+	b.renewals.add("healthy-binding-id", "token", "accessor", time.Hour)
+	b.renewals.add("failing-binding-id", "token", "accessor", time.Hour)
+	b.renewals.addLease("healthy-binding-id", "lease-id", time.Hour)
+	b.renewals.renewals["failing-binding-id"].backoff = nextBackoff(renewRetryMin)
+
+	b.renewalFailed("binding", renewFailedLookup)
+	b.renewalFailed("binding", renewFailedLookup)
+	b.renewalFailed("broker", renewFailedDone)
+
+	var buf bytes.Buffer
+	b.writeRenewalMetrics(&buf)
+	for _, s := range []string{
+		"# TYPE vault_service_broker_renewal_failures_total counter\n",
+		"\nvault_service_broker_renewal_failures_total{kind=\"binding\",reason=\"lookup-failed\"} 2\n",
+		"\nvault_service_broker_renewal_failures_total{kind=\"broker\",reason=\"done-with-error\"} 1\n",
+		"# TYPE vault_service_broker_healthy_renewers gauge\n",
+		"\nvault_service_broker_healthy_renewers{kind=\"binding\"} 1\n",
+		"\nvault_service_broker_healthy_renewers{kind=\"lease\"} 1\n",
+		"\nvault_service_broker_healthy_renewers{kind=\"broker\"} 0\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected the metrics to contain %q but received\n%s", s, buf.String())
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	router := mux.NewRouter()
+	attachMetricsRoutes(router, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, w.Code)
+	}
+
+	var build buildInfo
+	if err := json.NewDecoder(w.Body).Decode(&build); err != nil {
+		t.Fatal(err)
+	}
+	if build != currentBuild() {
+		t.Fatalf("expected %+v but received %+v", currentBuild(), build)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	if l := formatLabels(nil); l != "" {
+		t.Fatalf("expected no labels but received %q", l)
+	}
+	l := formatLabels(map[string]string{"version": "0.2.0", "goversion": `go"1"`})
+	if e := `{goversion="go\"1\"",version="0.2.0"}`; l != e {
+		t.Fatalf("expected %s but received %s", e, l)
+	}
+}
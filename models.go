@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SecretEngineType is the type of a secret engine that the broker mounts in
+// Vault. The value is the type name given to Vault when mounting.
+type SecretEngineType string
+
+const (
+	// KV is the static secret storage ("generic") engine.
+	KV SecretEngineType = "generic"
+
+	// Transit is the "encryption as a service" engine.
+	Transit SecretEngineType = "transit"
+
+	// PKI is the certificate issuing engine.
+	PKI SecretEngineType = "pki"
+
+	// SSH is the SSH certificate signing engine. Each instance gets its own
+	// CA, which signs the public key given when binding.
+	SSH SecretEngineType = "ssh"
+
+	// AWS is the engine which generates AWS credentials by assuming the
+	// configured IAM role.
+	AWS SecretEngineType = "aws"
+)
+
+// secretEngineTypes is the set of engines a plan may request.
+var secretEngineTypes = map[SecretEngineType]struct{}{
+	KV:      struct{}{},
+	Transit: struct{}{},
+	PKI:     struct{}{},
+	SSH:     struct{}{},
+	AWS:     struct{}{},
+}
+
+// secretEngineAliases are other names accepted for the engine types. Vault
+// lists the KV engine as "kv", and "kv-v2" selects version 2 of it.
+var secretEngineAliases = map[string]SecretEngineType{
+	"kv":    KV,
+	"kv-v1": KV,
+	"kv-v2": KV,
+}
+
+// ParseSecretEngineType returns the engine type with the given name or alias,
+// ignoring case, or an error if the broker cannot mount engines of the type.
+// "kv-v2" is the KV engine, whose version is up to the caller; see isKVv2.
+func ParseSecretEngineType(s string) (SecretEngineType, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if t, ok := secretEngineAliases[name]; ok {
+		return t, nil
+	}
+	if t := SecretEngineType(name); t.Valid() {
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown secret engine type %q, must be one of generic, kv, kv-v2, transit, pki, ssh, or aws", s)
+}
+
+// isKVv2 returns true if the engine name asks for version 2 of the KV engine.
+func isKVv2(s string) bool {
+	return strings.ToLower(strings.TrimSpace(s)) == "kv-v2"
+}
+
+// UnmarshalJSON decodes the engine type from its name or one of its aliases,
+// so that plans and provision parameters reject unknown types.
+func (t *SecretEngineType) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseSecretEngineType(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Valid returns true if the broker can mount engines of the type.
+func (t SecretEngineType) Valid() bool {
+	_, ok := secretEngineTypes[t]
+	return ok
+}
+
+// PathType returns the final path segment used when mounting the engine for
+// an instance, for example "<prefix>/<instance_id>/secret".
+func (t SecretEngineType) PathType() string {
+	switch t {
+	case KV:
+		return "secret"
+	default:
+		return string(t)
+	}
+}
+
+// Mount is a secret engine mounted at a path in Vault.
+type Mount struct {
+	Path string
+	Type SecretEngineType
+
+	// DefaultLeaseTTL and MaxLeaseTTL configure the lease TTLs of the mount.
+	// If zero, the broker-wide defaults are used.
+	DefaultLeaseTTL time.Duration
+	MaxLeaseTTL     time.Duration
+
+	// Description is shown with the mount in Vault, to tell which instance
+	// it belongs to.
+	Description string
+
+	// SealWrap and Local are set when the mount is created, and cannot be
+	// changed afterwards.
+	SealWrap bool
+	Local    bool
+
+	// KVVersion is 2 for KV mounts which use version 2 of the engine.
+	KVVersion int
+}
+
+// Plan is a service plan offered by the broker. Each plan determines the set
+// of secret engines mounted for an instance provisioned against it.
+type Plan struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Engines     []SecretEngineType `json:"engines"`
+
+	// DisplayName and Bullets are shown in the marketplace, and are optional.
+	DisplayName string   `json:"display_name"`
+	Bullets     []string `json:"bullets"`
+
+	// TransitKey, if set, is created in the transit engine of each instance.
+	// The plan must include the transit engine.
+	TransitKey *TransitKey `json:"transit_key"`
+
+	// ReadOnly restricts the bindings of the plan's instances to reading the
+	// instance and space paths, so they cannot write shared secrets.
+	ReadOnly bool `json:"read_only"`
+
+	// SealWrap seal-wraps the mounts of the plan's instances, which requires
+	// Vault Enterprise, and Local keeps them out of replication.
+	SealWrap bool `json:"seal_wrap"`
+	Local    bool `json:"local"`
+
+	// KVVersion is the version of the KV engine mounted for the plan's
+	// instances, 1 or 2. It is 1 if unset.
+	KVVersion int `json:"kv_version"`
+
+	// Free is false for plans which are charged for, in which case Costs
+	// describes what they cost in the marketplace. Plans are free if it is
+	// unset.
+	Free  *bool      `json:"free"`
+	Costs []PlanCost `json:"costs"`
+}
+
+// PlanCost is the cost of a plan, such as 10 USD per month.
+type PlanCost struct {
+	Amount map[string]float64 `json:"amount"`
+	Unit   string             `json:"unit"`
+}
+
+// parsePlanCosts decodes the JSON list of costs of a plan.
+func parsePlanCosts(s string) ([]PlanCost, error) {
+	var costs []PlanCost
+	if err := json.Unmarshal([]byte(s), &costs); err != nil {
+		return nil, fmt.Errorf("failed to decode costs: %s", err)
+	}
+	return costs, nil
+}
+
+// free returns true unless the plan is marked as charged for.
+func (p *Plan) free() bool {
+	return p.Free == nil || *p.Free
+}
+
+// validateCosts checks that each cost of the plan has a unit and non-negative
+// amounts, and that only plans which are not free have costs.
+func (p *Plan) validateCosts() error {
+	if len(p.Costs) > 0 && p.free() {
+		return fmt.Errorf("plan %q has costs but is free", p.Name)
+	}
+	for _, c := range p.Costs {
+		if c.Unit == "" {
+			return fmt.Errorf("plan %q has a cost without a unit", p.Name)
+		}
+		if len(c.Amount) == 0 {
+			return fmt.Errorf("plan %q has a cost without an amount", p.Name)
+		}
+		for currency, amount := range c.Amount {
+			if amount < 0 {
+				return fmt.Errorf("plan %q has a negative cost in %s", p.Name, currency)
+			}
+		}
+	}
+	return nil
+}
+
+// TransitKey is a named encryption key created for each instance.
+type TransitKey struct {
+	Name string `json:"name"`
+
+	// Type is the type of the key, "aes256-gcm96" if empty.
+	Type string `json:"type"`
+
+	// AutoRotatePeriod is how often Vault rotates the key, for example
+	// "720h". The key is not rotated automatically if it is empty.
+	AutoRotatePeriod string `json:"auto_rotate_period"`
+
+	autoRotatePeriod time.Duration
+}
+
+// DefaultTransitKeyType is the type of transit keys which do not specify one.
+const DefaultTransitKeyType = "aes256-gcm96"
+
+// transitKeyTypes are the key types supported by the transit engine.
+var transitKeyTypes = map[string]struct{}{
+	"aes128-gcm96":      struct{}{},
+	"aes256-gcm96":      struct{}{},
+	"chacha20-poly1305": struct{}{},
+	"ed25519":           struct{}{},
+	"ecdsa-p256":        struct{}{},
+	"ecdsa-p384":        struct{}{},
+	"ecdsa-p521":        struct{}{},
+	"rsa-2048":          struct{}{},
+	"rsa-3072":          struct{}{},
+	"rsa-4096":          struct{}{},
+}
+
+// validate checks the key and fills in the defaults. Vault does not rotate
+// keys more often than hourly, so shorter periods are rejected.
+func (k *TransitKey) validate() error {
+	if k.Name == "" {
+		return fmt.Errorf("transit key is missing a name")
+	}
+	if !extraMountNameRe.MatchString(k.Name) {
+		return fmt.Errorf("transit key name %q may only contain letters, digits, '-', and '_'", k.Name)
+	}
+	if k.Type == "" {
+		k.Type = DefaultTransitKeyType
+	}
+	if _, ok := transitKeyTypes[k.Type]; !ok {
+		return fmt.Errorf("transit key %q has unknown type %q", k.Name, k.Type)
+	}
+	k.autoRotatePeriod = 0
+	if k.AutoRotatePeriod != "" {
+		d, err := time.ParseDuration(k.AutoRotatePeriod)
+		if err != nil {
+			return fmt.Errorf("transit key %q has invalid auto_rotate_period: %s", k.Name, err)
+		}
+		if d < time.Hour {
+			return fmt.Errorf("transit key %q auto_rotate_period must be at least 1h", k.Name)
+		}
+		k.autoRotatePeriod = d
+	}
+	return nil
+}
+
+// hasEngine returns true if the plan mounts the given engine.
+func (p *Plan) hasEngine(t SecretEngineType) bool {
+	for _, e := range p.Engines {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// validateKVVersion checks the plan's KV version.
+func (p *Plan) validateKVVersion() error {
+	if p.KVVersion < 0 || p.KVVersion > 2 {
+		return fmt.Errorf("plan %q has kv_version %d, but it must be 1 or 2", p.Name, p.KVVersion)
+	}
+	return nil
+}
+
+// kvMountVersion returns the version recorded for an instance whose KV mount
+// is created for the plan: 2 if it uses version 2 and 0 otherwise.
+func (p *Plan) kvMountVersion() int {
+	if p.hasEngine(KV) && p.KVVersion == 2 {
+		return 2
+	}
+	return 0
+}
+
+// validateTransitKey checks the plan's transit key, if it has one.
+func (p *Plan) validateTransitKey() error {
+	if p.TransitKey == nil {
+		return nil
+	}
+	if !p.hasEngine(Transit) {
+		return fmt.Errorf("plan %q has a transit key but no transit engine", p.Name)
+	}
+	return p.TransitKey.validate()
+}
+
+// DefaultPlanEngines are the engines mounted by the plan built from
+// PLAN_NAME and PLAN_DESCRIPTION when no plans are configured.
+var DefaultPlanEngines = []SecretEngineType{KV, Transit}
+
+// parsePlans decodes the JSON list of plans and validates each one.
+func parsePlans(s string) ([]*Plan, error) {
+	var plans []*Plan
+	if err := json.Unmarshal([]byte(s), &plans); err != nil {
+		return nil, fmt.Errorf("failed to decode plans: %s", err)
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("at least one plan is required")
+	}
+
+	// The engine names as given, which were decoded above, tell whether the
+	// plan asks for version 2 of the KV engine
+	var given []struct {
+		Engines []string `json:"engines"`
+	}
+	json.Unmarshal([]byte(s), &given)
+
+	names := make(map[string]struct{}, len(plans))
+	for i, p := range plans {
+		if p == nil || p.Name == "" {
+			return nil, fmt.Errorf("plan %d is missing a name", i)
+		}
+		if _, ok := names[p.Name]; ok {
+			return nil, fmt.Errorf("plan %q is defined more than once", p.Name)
+		}
+		names[p.Name] = struct{}{}
+
+		if len(p.Engines) == 0 {
+			return nil, fmt.Errorf("plan %q has no engines", p.Name)
+		}
+		for _, e := range p.Engines {
+			if !e.Valid() {
+				return nil, fmt.Errorf("plan %q has unknown engine %q", p.Name, e)
+			}
+		}
+		for _, e := range given[i].Engines {
+			if !isKVv2(e) {
+				continue
+			}
+			if p.KVVersion == 1 {
+				return nil, fmt.Errorf("plan %q has engine %q but kv_version 1", p.Name, e)
+			}
+			p.KVVersion = 2
+		}
+		if err := p.validateKVVersion(); err != nil {
+			return nil, err
+		}
+		if err := p.validateCosts(); err != nil {
+			return nil, err
+		}
+		if err := p.validateTransitKey(); err != nil {
+			return nil, err
+		}
+	}
+	return plans, nil
+}
+
+// ExtraMount is a secret engine mounted for an instance in addition to those
+// of its plan, as requested in the provision parameters.
+type ExtraMount struct {
+	Name string           `json:"name"`
+	Type SecretEngineType `json:"type"`
+}
+
+// provisionParameters are the parameters accepted when provisioning an
+// instance.
+type provisionParameters struct {
+	ExtraMounts []ExtraMount `json:"extra_mounts"`
+}
+
+// extraMountNameRe matches the valid names of extra mounts, which become the
+// last segment of their path.
+var extraMountNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// guidRe matches the valid IDs of instances, bindings, organizations, and
+// spaces. They are interpolated into paths and policies, so quotes, slashes,
+// and newlines must not change their meaning.
+var guidRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// checkGUIDs returns an error for the first ID which is not valid. Each ID is
+// given with the kind of object it identifies.
+func checkGUIDs(ids ...[2]string) error {
+	for _, id := range ids {
+		if !guidRe.MatchString(id[1]) || id[1] == "." || id[1] == ".." {
+			return fmt.Errorf("%s ID %q may only contain letters, digits, '-', '_', and '.'", id[0], id[1])
+		}
+	}
+	return nil
+}
+
+// parseProvisionParameters decodes and validates the raw provision
+// parameters. Unknown parameters are rejected.
+func parseProvisionParameters(raw json.RawMessage) (*provisionParameters, error) {
+	var params provisionParameters
+	if len(raw) == 0 {
+		return &params, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&params); err != nil {
+		return nil, fmt.Errorf("invalid parameters: %s", err)
+	}
+
+	// The types as given, which were decoded above, tell whether an extra
+	// mount asks for version 2 of the KV engine
+	var types struct {
+		ExtraMounts []struct {
+			Type string `json:"type"`
+		} `json:"extra_mounts"`
+	}
+	json.Unmarshal(raw, &types)
+
+	// The paths of the plan engines are reserved, so that a plan update
+	// never mounts over an extra mount
+	names := make(map[string]struct{}, len(secretEngineTypes)+len(params.ExtraMounts))
+	for t := range secretEngineTypes {
+		names[t.PathType()] = struct{}{}
+	}
+	for i, m := range params.ExtraMounts {
+		if m.Name == "" {
+			return nil, fmt.Errorf("extra mount %d is missing a name", i)
+		}
+		if !extraMountNameRe.MatchString(m.Name) {
+			return nil, fmt.Errorf("extra mount name %q may only contain letters, digits, '-', and '_'", m.Name)
+		}
+		if _, ok := names[m.Name]; ok {
+			return nil, fmt.Errorf("extra mount name %q is reserved or used more than once", m.Name)
+		}
+		names[m.Name] = struct{}{}
+		if !m.Type.Valid() {
+			return nil, fmt.Errorf("extra mount %q has unknown type %q", m.Name, m.Type)
+		}
+		if t := types.ExtraMounts[i].Type; isKVv2(t) {
+			return nil, fmt.Errorf("extra mount %q may not have type %q, extra KV mounts use version 1", m.Name, t)
+		}
+		if m.Type == AWS {
+			// The AWS engine needs the broker's IAM settings, which are
+			// only applied to the mounts of plans
+			return nil, fmt.Errorf("extra mount %q may not have type %q", m.Name, m.Type)
+		}
+	}
+	if len(params.ExtraMounts) == 0 {
+		params.ExtraMounts = nil
+	}
+	return &params, nil
+}
+
+// bindParameters are the parameters accepted when binding to an instance.
+type bindParameters struct {
+	// TTL, if set, makes the binding's token expire after the given
+	// duration instead of being renewed for as long as the binding exists.
+	TTL string `json:"ttl"`
+
+	// AdditionalPolicies are attached to the binding's token in addition to
+	// the instance's policy.
+	AdditionalPolicies []string `json:"additional_policies"`
+
+	// SSHPublicKey is the public key in authorized_keys format which the
+	// instance's SSH CA signs. It is required by plans with the SSH engine.
+	SSHPublicKey string `json:"ssh_public_key"`
+
+	// WrapTTL, if set, wraps the binding's credentials in a response-wrapping
+	// token which expires after the given duration, and only the wrapping
+	// token is returned.
+	WrapTTL string `json:"wrap_ttl"`
+
+	// NumUses, if set, limits the number of requests the binding's token
+	// can make. Such tokens are not renewed.
+	NumUses int `json:"num_uses"`
+
+	ttl     time.Duration
+	wrapTTL time.Duration
+}
+
+// parseBindParameters decodes and validates the raw bind parameters. Unknown
+// parameters, additional policies which are not in the allowed list, and
+// num_uses above maxNumUses are rejected. A maxNumUses of zero rejects any
+// num_uses.
+func parseBindParameters(raw json.RawMessage, allowedPolicies []string, maxNumUses int) (*bindParameters, error) {
+	var params bindParameters
+	if len(raw) == 0 {
+		return &params, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&params); err != nil {
+		return nil, fmt.Errorf("invalid parameters: %s", err)
+	}
+
+	if params.TTL != "" {
+		ttl, err := time.ParseDuration(params.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl %q: %s", params.TTL, err)
+		}
+		if ttl < time.Second {
+			return nil, fmt.Errorf("ttl %q must be at least 1s", params.TTL)
+		}
+		params.ttl = ttl
+	}
+	if params.WrapTTL != "" {
+		ttl, err := time.ParseDuration(params.WrapTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wrap_ttl %q: %s", params.WrapTTL, err)
+		}
+		if ttl < time.Second {
+			return nil, fmt.Errorf("wrap_ttl %q must be at least 1s", params.WrapTTL)
+		}
+		params.wrapTTL = ttl
+	}
+	if params.NumUses < 0 {
+		return nil, fmt.Errorf("num_uses %d must not be negative", params.NumUses)
+	}
+	if params.NumUses > maxNumUses {
+		if maxNumUses == 0 {
+			return nil, fmt.Errorf("num_uses is not allowed")
+		}
+		return nil, fmt.Errorf("num_uses %d must be at most %d", params.NumUses, maxNumUses)
+	}
+
+	allowed := make(map[string]struct{}, len(allowedPolicies))
+	for _, p := range allowedPolicies {
+		allowed[p] = struct{}{}
+	}
+	for _, p := range params.AdditionalPolicies {
+		if _, ok := allowed[p]; !ok {
+			return nil, fmt.Errorf("policy %q is not allowed in additional_policies", p)
+		}
+	}
+	if len(params.AdditionalPolicies) == 0 {
+		params.AdditionalPolicies = nil
+	}
+
+	if params.SSHPublicKey != "" {
+		key, err := parseSSHPublicKey(params.SSHPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		params.SSHPublicKey = key
+	}
+	return &params, nil
+}
+
+// sshPublicKeyTypes are the types of public keys the SSH CA signs.
+var sshPublicKeyTypes = map[string]struct{}{
+	"ssh-rsa":             struct{}{},
+	"ssh-ed25519":         struct{}{},
+	"ecdsa-sha2-nistp256": struct{}{},
+	"ecdsa-sha2-nistp384": struct{}{},
+	"ecdsa-sha2-nistp521": struct{}{},
+}
+
+// parseSSHPublicKey checks that the key is a public key in authorized_keys
+// format, "<type> <base64 key> [comment]", whose encoded key is of the given
+// type. It returns the key without its comment.
+func parseSSHPublicKey(s string) (string, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("ssh_public_key must be in authorized_keys format")
+	}
+	keyType := fields[0]
+	if _, ok := sshPublicKeyTypes[keyType]; !ok {
+		return "", fmt.Errorf("ssh_public_key has unsupported type %q", keyType)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", fmt.Errorf("ssh_public_key is not valid base64: %s", err)
+	}
+
+	// The encoded key starts with its type as a length-prefixed string
+	if len(blob) < 4 {
+		return "", fmt.Errorf("ssh_public_key is truncated")
+	}
+	n := binary.BigEndian.Uint32(blob)
+	if uint64(len(blob)-4) < uint64(n) || string(blob[4:4+n]) != keyType {
+		return "", fmt.Errorf("ssh_public_key is not a valid %s key", keyType)
+	}
+	return keyType + " " + fields[1], nil
+}
+
+// DefaultMountPrefix is the root path under which the broker mounts its
+// secret engines and stores its metadata when no prefix is configured.
+const DefaultMountPrefix = "cf"
+
+// mountPath joins the path elements under the given mount prefix.
+func mountPath(prefix string, elem ...string) string {
+	return strings.Join(append([]string{prefix}, elem...), "/")
+}
+
+// instanceMounts returns the mounts owned by a single instance provisioned
+// against the given plan.
+func instanceMounts(prefix, instanceID string, p *Plan) []Mount {
+	mounts := make([]Mount, 0, len(p.Engines))
+	for _, e := range p.Engines {
+		m := Mount{
+			Path:     mountPath(prefix, instanceID, e.PathType()),
+			Type:     e,
+			SealWrap: p.SealWrap,
+			Local:    p.Local,
+		}
+		if e == KV {
+			m.KVVersion = p.kvMountVersion()
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+// extraMounts returns the extra mounts of a single instance of the plan.
+func extraMounts(prefix, instanceID string, p *Plan, extras []ExtraMount) []Mount {
+	mounts := make([]Mount, 0, len(extras))
+	for _, e := range extras {
+		mounts = append(mounts, Mount{
+			Path:     mountPath(prefix, instanceID, e.Name),
+			Type:     e.Type,
+			SealWrap: p.SealWrap,
+			Local:    p.Local,
+		})
+	}
+	return mounts
+}
+
+// sharedMount returns the KV mount shared by all instances in the
+// organization or space with the given GUID.
+func sharedMount(prefix, guid string) Mount {
+	return Mount{Path: mountPath(prefix, guid, KV.PathType()), Type: KV}
+}
+
+// vaultMounts returns every mount an instance needs, including the
+// organization and space mounts it shares with other instances. An empty
+// organization or space GUID leaves out its shared mount.
+func vaultMounts(prefix, instanceID, orgGUID, spaceGUID string, p *Plan) []Mount {
+	var mounts []Mount
+	if orgGUID != "" {
+		mounts = append(mounts, sharedMount(prefix, orgGUID))
+	}
+	if spaceGUID != "" {
+		mounts = append(mounts, sharedMount(prefix, spaceGUID))
+	}
+	return append(mounts, instanceMounts(prefix, instanceID, p)...)
+}
+
+// mountsToKV renders the mounts as sorted path=type pairs for logging.
+func mountsToKV(mounts []Mount, joiner string) string {
+	r := make([]string, len(mounts))
+	for i, m := range mounts {
+		r[i] = fmt.Sprintf("%s=%s", m.Path, m.Type)
+	}
+	sort.Strings(r)
+	return strings.Join(r, joiner)
+}
+
+// mountPaths returns the paths of the given mounts.
+func mountPaths(mounts []Mount) []string {
+	paths := make([]string, len(mounts))
+	for i, m := range mounts {
+		paths[i] = m.Path
+	}
+	return paths
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePlans(t *testing.T) {
+	cases := []struct {
+		name string
+		i    string
+		err  bool
+	}{
+		{
+			"valid",
+			`[{"name": "kv-only", "engines": ["generic"]}, {"name": "full", "engines": ["generic", "transit", "pki"]}]`,
+			false,
+		},
+		{
+			"malformed",
+			`{"name": "kv-only"`,
+			true,
+		},
+		{
+			"empty",
+			`[]`,
+			true,
+		},
+		{
+			"missing-name",
+			`[{"engines": ["generic"]}]`,
+			true,
+		},
+		{
+			"duplicate-name",
+			`[{"name": "a", "engines": ["generic"]}, {"name": "a", "engines": ["transit"]}]`,
+			true,
+		},
+		{
+			"no-engines",
+			`[{"name": "a"}]`,
+			true,
+		},
+		{
+			"unknown-engine",
+			`[{"name": "a", "engines": ["nope"]}]`,
+			true,
+		},
+		{
+			"kv-version",
+			`[{"name": "a", "engines": ["generic"], "kv_version": 2}]`,
+			false,
+		},
+		{
+			"invalid-kv-version",
+			`[{"name": "a", "engines": ["generic"], "kv_version": 3}]`,
+			true,
+		},
+		{
+			"engine-aliases",
+			`[{"name": "a", "engines": ["kv", "Transit"]}]`,
+			false,
+		},
+		{
+			"kv-v2-kv-version-1",
+			`[{"name": "a", "engines": ["kv-v2"], "kv_version": 1}]`,
+			true,
+		},
+		{
+			"costs",
+			`[{"name": "a", "engines": ["generic"], "free": false, "costs": [{"amount": {"usd": 10}, "unit": "MONTHLY"}]}]`,
+			false,
+		},
+		{
+			"costs-free",
+			`[{"name": "a", "engines": ["generic"], "costs": [{"amount": {"usd": 10}, "unit": "MONTHLY"}]}]`,
+			true,
+		},
+		{
+			"costs-no-unit",
+			`[{"name": "a", "engines": ["generic"], "free": false, "costs": [{"amount": {"usd": 10}}]}]`,
+			true,
+		},
+		{
+			"costs-negative",
+			`[{"name": "a", "engines": ["generic"], "free": false, "costs": [{"amount": {"usd": -1}, "unit": "MONTHLY"}]}]`,
+			true,
+		},
+		{
+			"transit-key",
+			`[{"name": "a", "engines": ["transit"], "transit_key": {"name": "app", "type": "ed25519", "auto_rotate_period": "720h"}}]`,
+			false,
+		},
+		{
+			"transit-key-default-type",
+			`[{"name": "a", "engines": ["transit"], "transit_key": {"name": "app"}}]`,
+			false,
+		},
+		{
+			"transit-key-no-engine",
+			`[{"name": "a", "engines": ["generic"], "transit_key": {"name": "app"}}]`,
+			true,
+		},
+		{
+			"transit-key-unknown-type",
+			`[{"name": "a", "engines": ["transit"], "transit_key": {"name": "app", "type": "des"}}]`,
+			true,
+		},
+		{
+			"transit-key-short-period",
+			`[{"name": "a", "engines": ["transit"], "transit_key": {"name": "app", "auto_rotate_period": "5m"}}]`,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			_, err := parsePlans(tc.i)
+			if (err != nil) != tc.err {
+				t.Errorf("expected error to be %t, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestSecretEngineType_Valid(t *testing.T) {
+	for _, e := range []SecretEngineType{KV, Transit, PKI, SSH, AWS} {
+		if !e.Valid() {
+			t.Errorf("expected %s to be valid", e)
+		}
+	}
+	for _, e := range []SecretEngineType{"", "kv", "database", "Transit"} {
+		if e.Valid() {
+			t.Errorf("expected %q to be invalid", e)
+		}
+	}
+}
+
+func TestParseSecretEngineType(t *testing.T) {
+	cases := map[string]SecretEngineType{
+		"generic": KV,
+		"transit": Transit,
+		"pki":     PKI,
+		"ssh":     SSH,
+		"aws":     AWS,
+		"kv":      KV,
+		"kv-v1":   KV,
+		"kv-v2":   KV,
+		" KV ":    KV,
+		"Transit": Transit,
+	}
+	for s, expected := range cases {
+		e, err := ParseSecretEngineType(s)
+		if err != nil {
+			t.Errorf("expected %q to be valid but received %s", s, err)
+		} else if e != expected {
+			t.Errorf("expected %q to be %s but received %s", s, expected, e)
+		}
+	}
+	for _, s := range []string{"", "database", "kv-v3", "secret"} {
+		if _, err := ParseSecretEngineType(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestParsePlans_KVv2(t *testing.T) {
+	plans, err := parsePlans(`[{"name": "a", "engines": ["kv-v2", "transit"]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := plans[0]; p.KVVersion != 2 || !reflect.DeepEqual(p.Engines, []SecretEngineType{KV, Transit}) {
+		t.Fatalf("expected version 2 of the KV engine but received %+v", p)
+	}
+}
+
+func TestParseProvisionParameters(t *testing.T) {
+	cases := []struct {
+		name string
+		i    string
+		e    []ExtraMount
+		err  bool
+	}{
+		{
+			"none",
+			``,
+			nil,
+			false,
+		},
+		{
+			"empty",
+			`{"extra_mounts": []}`,
+			nil,
+			false,
+		},
+		{
+			"valid",
+			`{"extra_mounts": [{"name": "config", "type": "generic"}, {"name": "certs", "type": "pki"}]}`,
+			[]ExtraMount{{Name: "config", Type: KV}, {Name: "certs", Type: PKI}},
+			false,
+		},
+		{
+			"unknown-key",
+			`{"extra_mount": [{"name": "config", "type": "generic"}]}`,
+			nil,
+			true,
+		},
+		{
+			"unknown-mount-key",
+			`{"extra_mounts": [{"name": "config", "type": "generic", "path": "x"}]}`,
+			nil,
+			true,
+		},
+		{
+			"missing-name",
+			`{"extra_mounts": [{"type": "generic"}]}`,
+			nil,
+			true,
+		},
+		{
+			"invalid-name",
+			`{"extra_mounts": [{"name": "../broker", "type": "generic"}]}`,
+			nil,
+			true,
+		},
+		{
+			"reserved-name",
+			`{"extra_mounts": [{"name": "transit", "type": "generic"}]}`,
+			nil,
+			true,
+		},
+		{
+			"duplicate-name",
+			`{"extra_mounts": [{"name": "a", "type": "generic"}, {"name": "a", "type": "transit"}]}`,
+			nil,
+			true,
+		},
+		{
+			"unknown-type",
+			`{"extra_mounts": [{"name": "a", "type": "aws"}]}`,
+			nil,
+			true,
+		},
+		{
+			"type-alias",
+			`{"extra_mounts": [{"name": "a", "type": "kv"}]}`,
+			[]ExtraMount{{Name: "a", Type: KV}},
+			false,
+		},
+		{
+			"invalid-type",
+			`{"extra_mounts": [{"name": "a", "type": "database"}]}`,
+			nil,
+			true,
+		},
+		{
+			"kv-v2-type",
+			`{"extra_mounts": [{"name": "a", "type": "kv-v2"}]}`,
+			nil,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			params, err := parseProvisionParameters([]byte(tc.i))
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error to be %t, got %v", tc.err, err)
+			}
+			if err == nil && !reflect.DeepEqual(params.ExtraMounts, tc.e) {
+				t.Errorf("expected %v but received %v", tc.e, params.ExtraMounts)
+			}
+		})
+	}
+}
+
+func TestParseBindParameters(t *testing.T) {
+	allowed := []string{"ci", "audit"}
+	cases := []struct {
+		name     string
+		i        string
+		ttl      time.Duration
+		policies []string
+		err      bool
+	}{
+		{
+			"none",
+			``,
+			0,
+			nil,
+			false,
+		},
+		{
+			"valid",
+			`{"ttl": "1h", "additional_policies": ["ci"]}`,
+			time.Hour,
+			[]string{"ci"},
+			false,
+		},
+		{
+			"unknown-key",
+			`{"max_ttl": "1h"}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"invalid-ttl",
+			`{"ttl": "an hour"}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"short-ttl",
+			`{"ttl": "10ms"}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"disallowed-policy",
+			`{"additional_policies": ["ci", "root"]}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"ssh-public-key",
+			`{"ssh_public_key": "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f user@host"}`,
+			0,
+			nil,
+			false,
+		},
+		{
+			"ssh-public-key-no-key",
+			`{"ssh_public_key": "ssh-ed25519"}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"ssh-public-key-wrong-type",
+			`{"ssh_public_key": "ssh-rsa AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f"}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"ssh-public-key-not-base64",
+			`{"ssh_public_key": "ssh-ed25519 not-base64!"}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"wrap-ttl",
+			`{"wrap_ttl": "5m"}`,
+			0,
+			nil,
+			false,
+		},
+		{
+			"short-wrap-ttl",
+			`{"wrap_ttl": "500ms"}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"num-uses",
+			`{"num_uses": 5}`,
+			0,
+			nil,
+			false,
+		},
+		{
+			"too-many-uses",
+			`{"num_uses": 6}`,
+			0,
+			nil,
+			true,
+		},
+		{
+			"negative-num-uses",
+			`{"num_uses": -1}`,
+			0,
+			nil,
+			true,
+		},
+	}
+
+	for i, tc := range cases {
+		t.Run(fmt.Sprintf("%d_%s", i, tc.name), func(t *testing.T) {
+			params, err := parseBindParameters([]byte(tc.i), allowed, 5)
+			if (err != nil) != tc.err {
+				t.Fatalf("expected error to be %t, got %v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if params.ttl != tc.ttl {
+				t.Errorf("expected %s but received %s", tc.ttl, params.ttl)
+			}
+			if !reflect.DeepEqual(params.AdditionalPolicies, tc.policies) {
+				t.Errorf("expected %q but received %q", tc.policies, params.AdditionalPolicies)
+			}
+		})
+	}
+}
+
+func TestVaultMounts(t *testing.T) {
+	plan := &Plan{Name: "kv-only", Engines: []SecretEngineType{KV}}
+
+	mounts := vaultMounts("cf", "instance-id", "organization-guid", "space-guid", plan)
+	expected := []Mount{
+		{Path: "cf/organization-guid/secret", Type: KV},
+		{Path: "cf/space-guid/secret", Type: KV},
+		{Path: "cf/instance-id/secret", Type: KV},
+	}
+	if !reflect.DeepEqual(mounts, expected) {
+		t.Fatalf("expected %+v but received %+v", expected, mounts)
+	}
+
+	plan.Engines = []SecretEngineType{KV, Transit, PKI, SSH}
+	paths := mountPaths(instanceMounts("cf", "instance-id", plan))
+	expectedPaths := []string{
+		"cf/instance-id/secret",
+		"cf/instance-id/transit",
+		"cf/instance-id/pki",
+		"cf/instance-id/ssh",
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Fatalf("expected %+v but received %+v", expectedPaths, paths)
+	}
+
+	paths = mountPaths(vaultMounts("cf-prod", "instance-id", "organization-guid", "space-guid", plan))
+	expectedPaths = []string{
+		"cf-prod/organization-guid/secret",
+		"cf-prod/space-guid/secret",
+		"cf-prod/instance-id/secret",
+		"cf-prod/instance-id/transit",
+		"cf-prod/instance-id/pki",
+		"cf-prod/instance-id/ssh",
+	}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Fatalf("expected %+v but received %+v", expectedPaths, paths)
+	}
+
+	// Empty GUIDs leave out the shared mounts
+	paths = mountPaths(vaultMounts("cf", "instance-id", "", "space-guid", &Plan{Engines: []SecretEngineType{KV}}))
+	expectedPaths = []string{"cf/space-guid/secret", "cf/instance-id/secret"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Fatalf("expected %+v but received %+v", expectedPaths, paths)
+	}
+}
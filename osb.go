@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// catalogService is a service in the catalog, with the fields of newer
+// versions of the service broker API which brokerapi does not know about.
+type catalogService struct {
+	brokerapi.Service
+	InstancesRetrievable bool `json:"instances_retrievable"`
+	BindingsRetrievable  bool `json:"bindings_retrievable"`
+}
+
+// catalogResponse is the response to a catalog request.
+type catalogResponse struct {
+	Services []catalogService `json:"services"`
+}
+
+// instanceSpec is the response to a request to fetch an instance.
+type instanceSpec struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	DashboardURL string                 `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters"`
+	CreatedAt    *time.Time             `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time             `json:"updated_at,omitempty"`
+}
+
+// bindingSpec is the response to a request to fetch a binding.
+type bindingSpec struct {
+	brokerapi.Binding
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// timestamp returns a pointer to t, or nil if t is zero because it was not
+// recorded, so that it is left out of responses.
+func timestamp(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// attachOSBRoutes adds the service broker API endpoints which brokerapi does
+// not implement to the router. It must be called before
+// brokerapi.AttachRoutes, so that the catalog is served from here.
+func attachOSBRoutes(router *mux.Router, b *Broker) {
+	router.HandleFunc("/v2/catalog", b.handleCatalog).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", b.handleGetInstance).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", b.handleGetBinding).Methods("GET")
+}
+
+// handleCatalog returns the catalog, advertising the endpoints added by
+// attachOSBRoutes.
+func (b *Broker) handleCatalog(w http.ResponseWriter, r *http.Request) {
+	var catalog catalogResponse
+	for _, s := range b.Services(r.Context()) {
+		catalog.Services = append(catalog.Services, catalogService{
+			Service:              s,
+			InstancesRetrievable: true,
+			BindingsRetrievable:  true,
+		})
+	}
+	respondJSON(w, http.StatusOK, catalog)
+}
+
+// handleGetInstance returns the plan and parameters of an existing instance.
+func (b *Broker) handleGetInstance(w http.ResponseWriter, r *http.Request) {
+	spec, err := b.GetInstance(r.Context(), mux.Vars(r)["instance_id"])
+	switch err {
+	case nil:
+		respondJSON(w, http.StatusOK, spec)
+	case brokerapi.ErrInstanceDoesNotExist:
+		respondJSON(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+	default:
+		respondJSON(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+	}
+}
+
+// handleGetBinding returns the credentials of an existing binding.
+func (b *Broker) handleGetBinding(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	binding, err := b.GetBinding(r.Context(), vars["instance_id"], vars["binding_id"])
+	switch err {
+	case nil:
+		respondJSON(w, http.StatusOK, binding)
+	case brokerapi.ErrInstanceDoesNotExist, brokerapi.ErrBindingDoesNotExist:
+		respondJSON(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: err.Error()})
+	default:
+		respondJSON(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"text/template"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func osbRouter(b *Broker) *mux.Router {
+	router := mux.NewRouter()
+	attachOSBRoutes(router, b)
+	brokerapi.AttachRoutes(router, b, lager.NewLogger("vault-broker"))
+	return router
+}
+
+func TestBroker_Catalog(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	w := httptest.NewRecorder()
+	osbRouter(env.Broker).ServeHTTP(w, httptest.NewRequest("GET", "/v2/catalog", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, w.Code)
+	}
+
+	var catalog struct {
+		Services []struct {
+			ID                   string `json:"id"`
+			InstancesRetrievable bool   `json:"instances_retrievable"`
+			BindingsRetrievable  bool   `json:"bindings_retrievable"`
+		} `json:"services"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&catalog); err != nil {
+		t.Fatal(err)
+	}
+	if len(catalog.Services) != 1 || catalog.Services[0].ID != env.Broker.serviceID {
+		t.Fatalf("unexpected catalog %+v", catalog)
+	}
+	if !catalog.Services[0].InstancesRetrievable || !catalog.Services[0].BindingsRetrievable {
+		t.Fatal("expected instances and bindings to be retrievable")
+	}
+}
+
+func TestBroker_GetInstance(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.plans = append(env.Broker.plans, &Plan{
+		Name:    "kv-only",
+		Engines: []SecretEngineType{KV},
+	})
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+		PlanID:           "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only",
+	}
+
+	router := osbRouter(env.Broker)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/instance-id", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var spec instanceSpec
+	if err := json.NewDecoder(w.Body).Decode(&spec); err != nil {
+		t.Fatal(err)
+	}
+	expected := instanceSpec{
+		ServiceID: "0654695e-0760-a1d4-1cad-5dd87b75ed99",
+		PlanID:    "0654695e-0760-a1d4-1cad-5dd87b75ed99.kv-only",
+		Parameters: map[string]interface{}{
+			"organization_guid": "organization-guid",
+			"space_guid":        "space-guid",
+		},
+	}
+	if !reflect.DeepEqual(spec, expected) {
+		t.Fatalf("expected %+v but received %+v", expected, spec)
+	}
+
+	// The dashboard URL is included if one is configured
+	env.Broker.dashboardURL = template.Must(template.New("dashboard").Parse("https://vault.example.com/{{.ServiceInstanceGUID}}"))
+	spec, err := env.Broker.GetInstance(env.Context, "instance-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.DashboardURL != "https://vault.example.com/instance-id" {
+		t.Fatalf("unexpected dashboard URL %q", spec.DashboardURL)
+	}
+
+	// Instances without a recorded plan are on the default plan
+	env.Broker.instances["instance-id"].PlanID = ""
+	spec, err = env.Broker.GetInstance(env.Context, "instance-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.PlanID != "0654695e-0760-a1d4-1cad-5dd87b75ed99.shared" {
+		t.Fatalf("expected the default plan but received %s", spec.PlanID)
+	}
+
+	// The timestamps are included once they are recorded
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	env.Broker.instances["instance-id"].CreatedAt = created
+	spec, err = env.Broker.GetInstance(env.Context, "instance-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.CreatedAt == nil || !spec.CreatedAt.Equal(created) || spec.UpdatedAt != nil {
+		t.Fatalf("expected only the creation time %v but received %v and %v", created, spec.CreatedAt, spec.UpdatedAt)
+	}
+
+	// Instances which are stored in Vault but not cached are found
+	spec, err = env.Broker.GetInstance(env.Context, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Parameters["organization_guid"] != "organization-guid" || spec.Parameters["space_guid"] != "space-guid" {
+		t.Fatalf("expected the stored instance but received %+v", spec.Parameters)
+	}
+	if _, ok := env.Broker.instances["foo"]; ok {
+		t.Fatal("expected the stored instance not to be cached")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v2/service_instances/unknown-instance", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected %d but received %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestBroker_GetBinding(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	w := httptest.NewRecorder()
+	osbRouter(env.Broker).ServeHTTP(w, httptest.NewRequest("GET",
+		"/v2/service_instances/instance-id/service_bindings/stored-binding-id", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var binding struct {
+		Credentials map[string]interface{} `json:"credentials"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&binding); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"address": "https://127.0.0.1:8200",
+		"auth": map[string]interface{}{
+			"accessor": "stored-accessor",
+			"token":    "stored-token",
+		},
+		"backends": map[string]interface{}{
+			"generic": "cf/instance-id/secret",
+			"transit": "cf/instance-id/transit",
+		},
+		"backends_shared": map[string]interface{}{
+			"organization": "cf/organization-guid/secret",
+			"space":        "cf/space-guid/secret",
+		},
+		"kv_version": float64(1),
+	}
+	if !reflect.DeepEqual(binding.Credentials, expected) {
+		t.Fatalf("expected %v but received %v", expected, binding.Credentials)
+	}
+}
+
+func TestBroker_GetBinding_Uncached(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	// Instance foo is stored in Vault but not cached, as while the broker
+	// restores its state or after restoring it failed
+	w := httptest.NewRecorder()
+	osbRouter(env.Broker).ServeHTTP(w, httptest.NewRequest("GET",
+		"/v2/service_instances/foo/service_bindings/foo", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d but received %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	var binding struct {
+		Credentials map[string]interface{} `json:"credentials"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&binding); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"organization": "cf/organization-guid/secret",
+		"space":        "cf/space-guid/secret",
+	}
+	if shared := binding.Credentials["backends_shared"]; !reflect.DeepEqual(shared, expected) {
+		t.Fatalf("expected the stored instance's shared mounts %v but received %v", expected, shared)
+	}
+	if !env.Requests.contains("GET /v1/cf/broker/foo") {
+		t.Fatal("expected the instance to be read from vault")
+	}
+}
+
+func TestBroker_GetBinding_NotFound(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	router := osbRouter(env.Broker)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET",
+		"/v2/service_instances/instance-id/service_bindings/missing-binding-id", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected %d for a missing instance but received %d", http.StatusNotFound, w.Code)
+	}
+
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET",
+		"/v2/service_instances/instance-id/service_bindings/missing-binding-id", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected %d for a missing binding but received %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// maxPlatformContextBody is the largest bind request body which is accepted.
+const maxPlatformContextBody = 1 << 20
+
+// platformContext is the context object which the platform sends in the body
+// of requests, describing where the request comes from.
+type platformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid"`
+	SpaceGUID        string `json:"space_guid"`
+}
+
+// platformContextKey is the context key of the platform context.
+type platformContextKey struct{}
+
+// withPlatformContext stores the platform context of each bind request in its
+// context, since the version of brokerapi we use does not pass it to Bind.
+// The body is restored for brokerapi to read.
+func withPlatformContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || !strings.Contains(r.URL.Path, "/service_bindings/") || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPlatformContextBody))
+		r.Body.Close()
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: err.Error()})
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		var request struct {
+			Context *platformContext `json:"context"`
+		}
+		if json.Unmarshal(body, &request) == nil && request.Context != nil {
+			r = r.WithContext(context.WithValue(r.Context(), platformContextKey{}, request.Context))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contextPlatform returns the platform context stored in the context by
+// withPlatformContext, or nil if the platform sent none.
+func contextPlatform(ctx context.Context) *platformContext {
+	pc, _ := ctx.Value(platformContextKey{}).(*platformContext)
+	return pc
+}
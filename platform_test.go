@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithPlatformContext(t *testing.T) {
+	body := `{"plan_id": "plan-id", "context": {"platform": "cloudfoundry", "organization_guid": "org-guid", "space_guid": "space-guid"}}`
+	cases := []struct {
+		method   string
+		path     string
+		expected *platformContext
+	}{
+		{"PUT", "/v2/service_instances/instance-id/service_bindings/binding-id", &platformContext{
+			Platform:         "cloudfoundry",
+			OrganizationGUID: "org-guid",
+			SpaceGUID:        "space-guid",
+		}},
+		{"PUT", "/v2/service_instances/instance-id", nil},
+		{"DELETE", "/v2/service_instances/instance-id/service_bindings/binding-id", nil},
+	}
+
+	for _, tc := range cases {
+		var pc *platformContext
+		var read string
+		handler := withPlatformContext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pc = contextPlatform(r.Context())
+			b, _ := ioutil.ReadAll(r.Body)
+			read = string(b)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tc.method, tc.path, strings.NewReader(body)))
+
+		if !reflect.DeepEqual(pc, tc.expected) {
+			t.Errorf("%s %s: expected %+v but received %+v", tc.method, tc.path, tc.expected, pc)
+		}
+		if read != body {
+			t.Errorf("%s %s: expected the body to be left for the handler but received %q", tc.method, tc.path, read)
+		}
+	}
+}
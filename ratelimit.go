@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// tokenBucket allows events at a steady rate with bursts of up to burst
+// events. A rate of zero allows every event.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// allow takes a token from the bucket, returning false if it is empty.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter rejects requests with 429 Too Many Requests once they exceed
+// their limit. Reads such as the catalog are cheap, while every other request
+// changes instances or bindings in Vault, so the two are limited separately.
+type rateLimiter struct {
+	next  http.Handler
+	read  *tokenBucket
+	write *tokenBucket
+	log   *Logger
+}
+
+func (l *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket := l.write
+	if r.Method == "GET" || r.Method == "HEAD" {
+		bucket = l.read
+	}
+	if !bucket.allow(time.Now()) {
+		l.log.Printf("[WARN] rate limit exceeded, rejecting %s %s", r.Method, r.URL.Path)
+		w.Header().Set("Retry-After", "1")
+		respondJSON(w, http.StatusTooManyRequests, brokerapi.ErrorResponse{
+			Description: "too many requests, retry later",
+		})
+		return
+	}
+	l.next.ServeHTTP(w, r)
+}
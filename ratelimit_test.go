@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3)
+
+	// The burst is allowed at once
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("expected event %d of the burst to be allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Fatal("expected the bucket to be empty")
+	}
+
+	// Tokens refill at the rate
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("expected a token after half a second")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("expected a single token after half a second")
+	}
+
+	// A rate of zero is unlimited
+	unlimited := newTokenBucket(0, 0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow(now) {
+			t.Fatal("expected every event to be allowed")
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &rateLimiter{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		read:  newTokenBucket(1, 2),
+		write: newTokenBucket(1, 1),
+		log:   NewLogger(&bytes.Buffer{}, LogFormatText, LogLevelInfo),
+	}
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		limiter.ServeHTTP(w, httptest.NewRequest(method, "/v2/service_instances/instance-id", nil))
+		return w.Code
+	}
+
+	if c := serve("PUT"); c != http.StatusOK {
+		t.Fatalf("expected %d but received %d", http.StatusOK, c)
+	}
+	if c := serve("PUT"); c != http.StatusTooManyRequests {
+		t.Fatalf("expected %d but received %d", http.StatusTooManyRequests, c)
+	}
+
+	// Reads have their own limit
+	for i := 0; i < 2; i++ {
+		if c := serve("GET"); c != http.StatusOK {
+			t.Fatalf("expected %d but received %d", http.StatusOK, c)
+		}
+	}
+	if c := serve("GET"); c != http.StatusTooManyRequests {
+		t.Fatalf("expected %d but received %d", http.StatusTooManyRequests, c)
+	}
+}
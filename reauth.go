@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// reauthTransport logs the broker in to Vault again when Vault rejects the
+// broker's token, for example because it expired after renewal failed, and
+// retries the request once with the new token. Requests denied because the
+// broker's policy lacks a capability, and requests made with other tokens,
+// such as renewals of binding tokens, are passed through untouched.
+type reauthTransport struct {
+	next http.RoundTripper
+
+	// lock serializes logins and protects the fields below
+	lock     sync.Mutex
+	token    func() string
+	setToken func(string)
+	login    func() (string, error)
+	log      *Logger
+
+	// replaced is the broker token replaced by the last login. Requests made
+	// with it while logging in are retried with the new token.
+	replaced string
+}
+
+// wrap sets the transport requests are sent with and returns the
+// reauthTransport, for use with newVaultClient.
+func (t *reauthTransport) wrap(next http.RoundTripper) http.RoundTripper {
+	t.next = next
+	return t
+}
+
+// setLogin sets the functions which get and replace the broker's token, and
+// the function used to log in. A nil login means the broker has a static
+// token, so rejected requests fail.
+func (t *reauthTransport) setLogin(token func() string, setToken func(string), login func() (string, error), logger *Logger) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.token = token
+	t.setToken = setToken
+	t.login = login
+	t.log = logger
+}
+
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusForbidden {
+		return resp, err
+	}
+	token, ok := t.refresh(req, req.Header.Get("X-Vault-Token"))
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+
+	// Retry the request once with the new token
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("X-Vault-Token", token)
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		r.Body = body
+	}
+	resp.Body.Close()
+	return t.next.RoundTrip(r)
+}
+
+// refresh returns the broker's token to retry a request rejected with the
+// given token, logging in again if it is the current token and is no longer
+// valid. It returns false if the request should not be retried.
+func (t *reauthTransport) refresh(req *http.Request, token string) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.token == nil || token == "" {
+		return "", false
+	}
+	current := t.token()
+	switch token {
+	case t.replaced:
+		// Another request already logged in again
+		return current, true
+	case current:
+	default:
+		// Not the broker's token
+		return "", false
+	}
+
+	// Vault also denies requests which the broker's policy does not allow,
+	// which logging in does not fix
+	if !t.tokenDenied(req, token) {
+		t.log.Printf("[DEBUG] vault denied a request with the broker's token, which is still valid")
+		return "", false
+	}
+
+	if t.login == nil {
+		t.log.Printf("[ERR] vault denied the broker's token, which may have expired. " +
+			"The static VAULT_TOKEN cannot be replaced by logging in, so restart the broker with a valid token")
+		return "", false
+	}
+	t.log.Printf("[WARN] vault denied the broker's token, logging in again")
+	newToken, err := t.login()
+	if err != nil {
+		t.log.Printf("[ERR] failed to login to vault: %s", err)
+		return "", false
+	}
+	t.setToken(newToken)
+	t.replaced = token
+	return newToken, true
+}
+
+// tokenDenied looks up the token at the Vault server the request was sent to
+// and reports whether Vault denied the lookup. Other failures are not taken as
+// the token being invalid.
+func (t *reauthTransport) tokenDenied(req *http.Request, token string) bool {
+	u := *req.URL
+	var prefix string
+	if i := strings.Index(u.Path, "/v1/"); i >= 0 {
+		prefix = u.Path[:i]
+	}
+	u.Path = prefix + "/v1/auth/token/lookup-self"
+	u.RawPath = ""
+	u.RawQuery = ""
+
+	r, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return false
+	}
+	r = r.WithContext(req.Context())
+	r.Header.Set("X-Vault-Token", token)
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.StatusCode == http.StatusForbidden
+}
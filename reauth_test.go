@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// reauthServer returns a fake Vault which only accepts the "fresh" token, and
+// which denies secret/denied to every token as a policy would.
+func reauthServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "fresh" || r.URL.Path == "/v1/secret/denied" {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"data": {"foo": "bar"}}`))
+	}))
+}
+
+func TestReauthTransport(t *testing.T) {
+	ts := reauthServer()
+	defer ts.Close()
+
+	reauth := &reauthTransport{}
+	client, err := newVaultClient(&Configuration{VaultAddr: ts.URL}, reauth.wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("expired")
+	b := &Broker{vaultClient: client}
+	logins := 0
+	reauth.setLogin(b.vaultToken, b.setVaultToken, func() (string, error) {
+		logins++
+		return "fresh", nil
+	}, NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug))
+
+	// The expired token is replaced and the write retried
+	if _, err := b.vault().Logical().Write("secret/foo", map[string]interface{}{"foo": "bar"}); err != nil {
+		t.Fatal(err)
+	}
+	if logins != 1 {
+		t.Fatalf("expected 1 login but received %d", logins)
+	}
+	if b.vaultToken() != "fresh" {
+		t.Fatalf("expected the token to be replaced but it is %q", b.vaultToken())
+	}
+
+	// Requests made with other tokens are not retried
+	if _, err := b.vault().Auth().Token().RenewTokenAsSelf("binding-token", 0); vaultErrorCode(err) != 403 {
+		t.Fatalf("expected a 403 error but received %v", err)
+	}
+	if logins != 1 {
+		t.Fatalf("expected 1 login but received %d", logins)
+	}
+}
+
+func TestReauthTransport_PolicyDenied(t *testing.T) {
+	ts := reauthServer()
+	defer ts.Close()
+
+	reauth := &reauthTransport{}
+	client, err := newVaultClient(&Configuration{VaultAddr: ts.URL}, reauth.wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("fresh")
+	b := &Broker{vaultClient: client}
+	logins := 0
+	reauth.setLogin(b.vaultToken, b.setVaultToken, func() (string, error) {
+		logins++
+		return "other", nil
+	}, NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug))
+
+	// The token is still valid, so a denial by its policy does not log in
+	for i := 0; i < 3; i++ {
+		if _, err := b.vault().Logical().Read("secret/denied"); vaultErrorCode(err) != 403 {
+			t.Fatalf("expected a 403 error but received %v", err)
+		}
+	}
+	if logins != 0 {
+		t.Fatalf("expected no logins but received %d", logins)
+	}
+	if b.vaultToken() != "fresh" {
+		t.Fatalf("expected the token to be kept but it is %q", b.vaultToken())
+	}
+}
+
+func TestReauthTransport_StaticToken(t *testing.T) {
+	ts := reauthServer()
+	defer ts.Close()
+
+	reauth := &reauthTransport{}
+	client, err := newVaultClient(&Configuration{VaultAddr: ts.URL}, reauth.wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("expired")
+	b := &Broker{vaultClient: client}
+	reauth.setLogin(b.vaultToken, b.setVaultToken, nil, NewLogger(ioutil.Discard, LogFormatText, LogLevelDebug))
+
+	if _, err := b.vault().Logical().Read("secret/foo"); vaultErrorCode(err) != 403 {
+		t.Fatalf("expected a 403 error but received %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// bindingLister lists the bindings the platform knows about for an instance.
+type bindingLister interface {
+	ListBindings(instanceID string) ([]string, error)
+}
+
+// reconcileLoop periodically revokes orphaned bindings until the broker is
+// stopped.
+func (b *Broker) reconcileLoop() {
+	for b.sleepOrStop(b.reconcileInterval, nil) {
+		b.reconcile()
+	}
+}
+
+// reconcile revokes the tokens and deletes the metadata of bindings which are
+// stored in Vault but no longer exist in the platform, for example because the
+// broker was down when they were deleted.
+//
+// A binding is only revoked once it has been missing from the platform on two
+// consecutive passes, so that bindings which are still being created are left
+// alone. Instances whose bindings cannot be listed are skipped entirely, so an
+// error talking to the platform never revokes a live binding.
+func (b *Broker) reconcile() {
+	b.log.Printf("[DEBUG] reconciling bindings")
+
+	b.instancesLock.Lock()
+	instanceIDs := make([]string, 0, len(b.instances))
+	for id := range b.instances {
+		instanceIDs = append(instanceIDs, id)
+	}
+	b.instancesLock.Unlock()
+
+	orphans := make(map[string]struct{})
+	for _, instanceID := range instanceIDs {
+		known, err := b.bindingLister.ListBindings(instanceID)
+		if err != nil {
+			b.log.Printf("[WARN] reconcile: failed to list bindings for instance %s, skipping: %s", instanceID, err)
+			continue
+		}
+		knownSet := make(map[string]struct{}, len(known))
+		for _, id := range known {
+			knownSet[id] = struct{}{}
+		}
+
+		stored, err := b.listDir(context.Background(), metadataKey(instanceID))
+		if err != nil {
+			b.log.Printf("[WARN] reconcile: failed to list stored bindings for instance %s, skipping: %s", instanceID, err)
+			continue
+		}
+
+		for _, bindingID := range trimKeys(stored) {
+			if _, ok := knownSet[bindingID]; ok {
+				continue
+			}
+
+			key := instanceID + "/" + bindingID
+			if _, ok := b.orphans[key]; !ok {
+				b.log.Printf("[INFO] reconcile: binding %s for instance %s is unknown to the platform, revoking it if it is still missing on the next pass",
+					bindingID, instanceID)
+				orphans[key] = struct{}{}
+				continue
+			}
+
+			b.log.Printf("[WARN] reconcile: revoking orphaned binding %s for instance %s", bindingID, instanceID)
+			err := b.Unbind(context.Background(), instanceID, bindingID, brokerapi.UnbindDetails{})
+			if err != nil && err != brokerapi.ErrBindingDoesNotExist {
+				b.log.Printf("[ERR] reconcile: failed to revoke orphaned binding %s for instance %s: %s", bindingID, instanceID, err)
+				orphans[key] = struct{}{}
+			}
+		}
+	}
+	b.orphans = orphans
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeBindingLister struct {
+	bindings []string
+	err      error
+}
+
+func (l *fakeBindingLister) ListBindings(instanceID string) ([]string, error) {
+	return l.bindings, l.err
+}
+
+func TestBroker_Reconcile(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	lister := &fakeBindingLister{}
+	env.Broker.bindingLister = lister
+
+	// Restores instance foo with binding foo
+	if err := env.Broker.restore(context.Background(), []string{"foo"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const revoke = "DELETE /v1/cf/broker/foo/foo"
+
+	// Errors from the platform never revoke bindings
+	lister.err = errors.New("cf is down")
+	env.Broker.reconcile()
+	env.Broker.reconcile()
+	if env.Requests.contains(revoke) {
+		t.Fatal("expected the binding to not be revoked while the platform is unavailable")
+	}
+
+	// Known bindings are left alone
+	lister.err = nil
+	lister.bindings = []string{"foo"}
+	env.Broker.reconcile()
+	env.Broker.reconcile()
+	if env.Requests.contains(revoke) {
+		t.Fatal("expected a known binding to not be revoked")
+	}
+
+	// Missing bindings are revoked on the second pass
+	lister.bindings = nil
+	env.Broker.reconcile()
+	if env.Requests.contains(revoke) {
+		t.Fatal("expected the binding to not be revoked on the first pass")
+	}
+	env.Broker.reconcile()
+	if !env.Requests.contains(revoke) {
+		t.Fatal("expected the orphaned binding to be revoked")
+	}
+	if _, ok := env.Broker.binds["foo"]; ok {
+		t.Fatal("expected the orphaned binding to be removed from the cache")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// renewal is a binding token, or the lease of a binding's secret, scheduled
+// for renewal.
+type renewal struct {
+	bindingID string
+	token     string
+	accessor  string
+
+	// leaseID is set for the renewal of a lease instead of a token.
+	leaseID string
+
+	// key identifies the renewal in the manager, the binding ID for tokens
+	// and leaseKey of the binding ID for leases.
+	key string
+
+	// due is when the token is next renewed, and backoff the delay before
+	// retrying a failed renewal.
+	due     time.Time
+	backoff time.Duration
+
+	// index is the position of the renewal in the queue, or -1 while it is
+	// being renewed.
+	index int
+}
+
+// renewalQueue is a heap of renewals ordered by when they are due.
+type renewalQueue []*renewal
+
+func (q renewalQueue) Len() int           { return len(q) }
+func (q renewalQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+
+func (q renewalQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *renewalQueue) Push(x interface{}) {
+	r := x.(*renewal)
+	r.index = len(*q)
+	*q = append(*q, r)
+}
+
+func (q *renewalQueue) Pop() interface{} {
+	old := *q
+	r := old[len(old)-1]
+	old[len(old)-1] = nil
+	r.index = -1
+	*q = old[:len(old)-1]
+	return r
+}
+
+// leaseKey returns the key of the renewal of a binding's lease.
+func leaseKey(bindingID string) string {
+	return bindingID + "/lease"
+}
+
+// renewalManager tracks the binding tokens and leases to renew, so that a single
+// goroutine can renew all of them as they come due. The zero value is ready to
+// use.
+type renewalManager struct {
+	lock      sync.Mutex
+	queue     renewalQueue
+	renewals  map[string]*renewal
+	changedCh chan struct{}
+}
+
+// add schedules the binding's token to be renewed after the given delay,
+// replacing any renewal already scheduled for the binding.
+func (m *renewalManager) add(bindingID, token, accessor string, delay time.Duration) {
+	m.addRenewal(&renewal{
+		bindingID: bindingID,
+		token:     token,
+		accessor:  accessor,
+		key:       bindingID,
+	}, delay)
+}
+
+// addLease schedules the lease of the binding's secret to be renewed after the
+// given delay, replacing any lease renewal already scheduled for the binding.
+func (m *renewalManager) addLease(bindingID, leaseID string, delay time.Duration) {
+	m.addRenewal(&renewal{
+		bindingID: bindingID,
+		leaseID:   leaseID,
+		key:       leaseKey(bindingID),
+	}, delay)
+}
+
+func (m *renewalManager) addRenewal(r *renewal, delay time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.renewals == nil {
+		m.renewals = make(map[string]*renewal)
+	}
+	m.removeLocked(r.key)
+
+	r.due = time.Now().Add(delay)
+	r.backoff = renewRetryMin
+	m.renewals[r.key] = r
+	heap.Push(&m.queue, r)
+	m.notifyLocked()
+}
+
+// remove stops renewing the binding's token and lease. It is safe to call for
+// bindings which are not being renewed.
+func (m *renewalManager) remove(bindingID string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.removeLocked(bindingID)
+	m.removeLocked(leaseKey(bindingID))
+}
+
+func (m *renewalManager) removeLocked(key string) {
+	r, ok := m.renewals[key]
+	if !ok {
+		return
+	}
+	delete(m.renewals, key)
+	if r.index >= 0 {
+		heap.Remove(&m.queue, r.index)
+	}
+	m.notifyLocked()
+}
+
+// next removes and returns the first renewal if it is due. Otherwise it
+// returns how long until it is due, or a negative duration if there are no
+// renewals. The renewal stays tracked until it is rescheduled or finished.
+func (m *renewalManager) next(now time.Time) (*renewal, time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.queue) == 0 {
+		return nil, -1
+	}
+	if wait := m.queue[0].due.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	return heap.Pop(&m.queue).(*renewal), 0
+}
+
+// reschedule queues the renewal again after the given delay, unless it was
+// removed or replaced while it was being renewed.
+func (m *renewalManager) reschedule(r *renewal, delay time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.renewals[r.key] != r {
+		return
+	}
+	r.due = time.Now().Add(delay)
+	heap.Push(&m.queue, r)
+}
+
+// finish stops tracking the renewal, unless it was replaced while it was being
+// renewed.
+func (m *renewalManager) finish(r *renewal) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.renewals[r.key] == r {
+		delete(m.renewals, r.key)
+	}
+}
+
+// healthy returns the number of queued renewals of binding tokens
+// ("binding") and leases ("lease") whose last renewal did not fail. Renewals
+// in progress are not counted.
+func (m *renewalManager) healthy() map[string]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	counts := map[string]int{"binding": 0, "lease": 0}
+	for _, r := range m.queue {
+		if r.backoff != renewRetryMin {
+			continue
+		}
+		if r.leaseID != "" {
+			counts["lease"]++
+		} else {
+			counts["binding"]++
+		}
+	}
+	return counts
+}
+
+// changed returns a channel which receives when renewals are added or
+// removed.
+func (m *renewalManager) changed() <-chan struct{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.changedCh == nil {
+		m.changedCh = make(chan struct{}, 1)
+	}
+	return m.changedCh
+}
+
+func (m *renewalManager) notifyLocked() {
+	if m.changedCh == nil {
+		m.changedCh = make(chan struct{}, 1)
+	}
+	select {
+	case m.changedCh <- struct{}{}:
+	default:
+	}
+}
+
+// goRenewer runs f in a goroutine which Stop waits for.
+func (b *Broker) goRenewer(f func()) {
+	b.renewers.Add(1)
+	atomic.AddInt32(&b.renewersActive, 1)
+	go func() {
+		defer b.renewers.Done()
+		defer atomic.AddInt32(&b.renewersActive, -1)
+		f()
+	}()
+}
+
+// waitRenewers waits up to the timeout for the goroutines started by
+// goRenewer to exit. It returns the number which are still running.
+func (b *Broker) waitRenewers(timeout time.Duration) int {
+	done := make(chan struct{})
+	go func() {
+		b.renewers.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return 0
+	case <-timer.C:
+		return int(atomic.LoadInt32(&b.renewersActive))
+	}
+}
+
+// runRenewals renews binding tokens and leases as they come due until the
+// broker is stopped. Each is renewed at half of its lease duration, and failed
+// renewals are retried with an exponential backoff.
+func (b *Broker) runRenewals() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	changedCh := b.renewals.changed()
+
+	for {
+		r, wait := b.renewals.next(time.Now())
+		if r != nil {
+			if r.leaseID != "" {
+				b.renewLease(r)
+			} else {
+				b.renewBinding(r)
+			}
+			continue
+		}
+
+		// Sleep until the next renewal is due or the renewals change
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var timerCh <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			timerCh = timer.C
+		}
+		select {
+		case <-timerCh:
+		case <-changedCh:
+		case <-b.stopCh:
+			return
+		}
+	}
+}
+
+// renewBinding renews the token of a due renewal and schedules the next one.
+func (b *Broker) renewBinding(r *renewal) {
+	logger := b.log.With("binding_id", r.bindingID, "accessor", r.accessor)
+
+	// Use renew-self instead of lookup here because we want the freshest
+	// renew and we can find out if it's renewable or not.
+	secret, err := b.vault().Auth().Token().RenewTokenAsSelf(r.token, b.renewIncrement)
+	if err != nil {
+		if vaultErrorCode(err) == 403 {
+			logger.Printf("[WARN] renew-token (%s): token is no longer valid, stopping renewal: %s", r.accessor, err)
+			b.renewalFailed("binding", renewFailedInvalid)
+			b.renewals.finish(r)
+			return
+		}
+		logger.Printf("[ERR] renew-token (%s): error renewing self, retrying in %s: %s", r.accessor, r.backoff, err)
+		b.renewalFailed("binding", renewFailedLookup)
+		delay := r.backoff
+		r.backoff = nextBackoff(r.backoff)
+		b.renewals.reschedule(r, delay)
+		return
+	}
+	if secret == nil || secret.Auth == nil || !secret.Auth.Renewable {
+		logger.Printf("[WARN] renew-token (%s): token is not renewable, stopping renewal", r.accessor)
+		b.renewals.finish(r)
+		return
+	}
+	if secret.Auth.LeaseDuration <= 0 {
+		logger.Printf("[INFO] renew-token (%s): token does not expire, stopping renewal", r.accessor)
+		b.renewals.finish(r)
+		return
+	}
+
+	delay := time.Duration(secret.Auth.LeaseDuration) * time.Second / 2
+	logger.Printf("[DEBUG] renew-token (%s): renewed token, renewing again in %s", r.accessor, delay)
+	r.backoff = renewRetryMin
+	b.renewals.reschedule(r, delay)
+}
+
+// renewLease renews the lease of a due renewal and schedules the next one.
+func (b *Broker) renewLease(r *renewal) {
+	logger := b.log.With("binding_id", r.bindingID, "lease_id", r.leaseID)
+
+	secret, err := b.vault().Sys().Renew(r.leaseID, 0)
+	if err != nil {
+		if isInvalidLeaseError(err) {
+			logger.Printf("[WARN] renew-lease (%s): lease is no longer valid, stopping renewal: %s", r.leaseID, err)
+			b.renewalFailed("lease", renewFailedInvalid)
+			b.renewals.finish(r)
+			return
+		}
+		logger.Printf("[ERR] renew-lease (%s): error renewing lease, retrying in %s: %s", r.leaseID, r.backoff, err)
+		b.renewalFailed("lease", renewFailedLookup)
+		delay := r.backoff
+		r.backoff = nextBackoff(r.backoff)
+		b.renewals.reschedule(r, delay)
+		return
+	}
+	if secret == nil || !secret.Renewable || secret.LeaseDuration <= 0 {
+		logger.Printf("[INFO] renew-lease (%s): lease cannot be renewed further, stopping renewal", r.leaseID)
+		b.renewals.finish(r)
+		return
+	}
+
+	delay := time.Duration(secret.LeaseDuration) * time.Second / 2
+	logger.Printf("[DEBUG] renew-lease (%s): renewed lease, renewing again in %s", r.leaseID, delay)
+	r.backoff = renewRetryMin
+	b.renewals.reschedule(r, delay)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// renewing reports whether the binding's token is scheduled for renewal or
+// being renewed.
+func renewing(m *renewalManager, bindingID string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.renewals[bindingID]
+	return ok
+}
+
+func TestRenewalManager(t *testing.T) {
+	var m renewalManager
+	m.add("b", "token-b", "accessor-b", 2*time.Hour)
+	m.add("a", "token-a", "accessor-a", -time.Second)
+	m.add("c", "token-c", "accessor-c", time.Hour)
+
+	// Only due renewals are returned
+	now := time.Now()
+	r, _ := m.next(now)
+	if r == nil || r.bindingID != "a" {
+		t.Fatalf("expected the renewal of a but received %+v", r)
+	}
+	if r, wait := m.next(now); r != nil || wait <= 59*time.Minute {
+		t.Fatalf("expected to wait an hour but received %+v and %s", r, wait)
+	}
+
+	// Renewals are returned in order
+	m.reschedule(r, 3*time.Hour)
+	var order []string
+	for {
+		r, wait := m.next(now.Add(4 * time.Hour))
+		if r == nil {
+			if wait >= 0 {
+				t.Fatalf("expected no renewals but have to wait %s", wait)
+			}
+			break
+		}
+		order = append(order, r.bindingID)
+		m.finish(r)
+	}
+	if len(order) != 3 || order[0] != "c" || order[1] != "b" || order[2] != "a" {
+		t.Fatalf("expected [c b a] but received %v", order)
+	}
+}
+
+func TestRenewalManager_RemoveWhileRenewing(t *testing.T) {
+	var m renewalManager
+	m.add("a", "token-a", "accessor-a", 0)
+	r, _ := m.next(time.Now())
+	if r == nil {
+		t.Fatal("expected a due renewal")
+	}
+
+	// A renewal removed or replaced while it was being renewed is not
+	// rescheduled
+	m.remove("a")
+	m.reschedule(r, 0)
+	if renewing(&m, "a") || m.queue.Len() != 0 {
+		t.Fatal("expected the removed renewal to not be rescheduled")
+	}
+
+	m.add("a", "token-a", "accessor-a", 0)
+	r, _ = m.next(time.Now())
+	m.add("a", "token-a2", "accessor-a2", time.Hour)
+	m.finish(r)
+	if !renewing(&m, "a") || m.queue.Len() != 1 {
+		t.Fatal("expected the replacement renewal to be kept")
+	}
+}
+
+func TestBroker_RunRenewals(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.stopCh = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		env.Broker.runRenewals()
+		close(done)
+	}()
+
+	// The token is renewed once due, then at half of its lease duration
+	env.Broker.renewals.add("binding-id", "ABCD", "accessor", 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for !env.Requests.contains("PUT /v1/auth/token/renew-self") {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the token to be renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		env.Broker.renewals.lock.Lock()
+		var due time.Time
+		if env.Broker.renewals.queue.Len() == 1 {
+			due = env.Broker.renewals.queue[0].due
+		}
+		env.Broker.renewals.lock.Unlock()
+		if !due.IsZero() {
+			if wait := time.Until(due); wait < 29*time.Minute || wait > 30*time.Minute {
+				t.Fatalf("expected the next renewal in 30m but it is in %s", wait)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the renewal to be rescheduled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(env.Broker.stopCh)
+	<-done
+}
+
+func TestBroker_RunRenewals_Lease(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	env.Broker.stopCh = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		env.Broker.runRenewals()
+		close(done)
+	}()
+
+	// The lease is renewed once due, then at half of its lease duration
+	env.Broker.renewals.addLease("binding-id", "cf/instance-id/aws/sts/cf-bind/lease-id", 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		env.Broker.renewals.lock.Lock()
+		var due time.Time
+		if env.Broker.renewals.queue.Len() == 1 {
+			due = env.Broker.renewals.queue[0].due
+		}
+		env.Broker.renewals.lock.Unlock()
+		if !due.IsZero() && env.Requests.contains("PUT /v1/sys/renew") {
+			if wait := time.Until(due); wait < 29*time.Minute || wait > 30*time.Minute {
+				t.Fatalf("expected the next renewal in 30m but it is in %s", wait)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the lease to be renewed and rescheduled")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if env.Requests.contains("PUT /v1/auth/token/renew-self") {
+		t.Fatal("expected no token to be renewed")
+	}
+
+	close(env.Broker.stopCh)
+	<-done
+}
+
+func TestBroker_RenewBinding_Increment(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var body struct {
+		Increment int `json:"increment"`
+	}
+	env.Requests.setHook(func(r *http.Request) {
+		if r.URL.Path == "/v1/auth/token/renew-self" {
+			json.NewDecoder(r.Body).Decode(&body)
+		}
+	})
+
+	env.Broker.renewIncrement = 7200
+	env.Broker.renewals.add("binding-id", "ABCD", "accessor", 0)
+	r, _ := env.Broker.renewals.next(time.Now())
+	if r == nil {
+		t.Fatal("expected a due renewal")
+	}
+	env.Broker.renewBinding(r)
+	if body.Increment != 7200 {
+		t.Fatalf("expected an increment of 7200 but received %d", body.Increment)
+	}
+}
+
+func TestBroker_Stop_WaitsForRenewers(t *testing.T) {
+	b := &Broker{
+		log:     NewLogger(os.Stdout, LogFormatText, LogLevelDebug),
+		running: true,
+		stopCh:  make(chan struct{}),
+	}
+
+	// One renewer is mid-call when the broker stops, the other never exits
+	stuck := make(chan struct{})
+	defer close(stuck)
+	b.goRenewer(func() {
+		<-b.stopCh
+		time.Sleep(50 * time.Millisecond)
+	})
+	b.goRenewer(func() { <-stuck })
+
+	b.stopTimeout = 200 * time.Millisecond
+	start := time.Now()
+	if err := b.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < b.stopTimeout {
+		t.Fatalf("expected Stop to wait for the stuck renewer but it returned after %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&b.renewersActive); n != 1 {
+		t.Fatalf("expected only the stuck renewer to be running but %d are", n)
+	}
+}
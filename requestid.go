@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RequestIdentityHeader is the header in which the platform identifies a
+// request, so that it can be correlated across the platform and the broker.
+const RequestIdentityHeader = "X-Broker-API-Request-Identity"
+
+// maxRequestIDLength is the longest request ID accepted from the platform.
+// Longer IDs are replaced, so that they cannot flood the logs.
+const maxRequestIDLength = 128
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// withRequestID stores the ID of each request in its context, where the
+// broker methods called by brokerapi can add it to their logs. The ID is the
+// one sent by the platform, or a new one if there is none, and is returned in
+// the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get(RequestIdentityHeader))
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+		if id != "" {
+			w.Header().Set(RequestIdentityHeader, id)
+			r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contextRequestID returns the request ID stored in the context by
+// withRequestID, or an empty string if there is none.
+func contextRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLog returns the broker's logger, with the ID of the request in ctx
+// attached if there is one.
+func (b *Broker) requestLog(ctx context.Context) *Logger {
+	if id := contextRequestID(ctx); id != "" {
+		return b.log.With("request_id", id)
+	}
+	return b.log
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestWithRequestID(t *testing.T) {
+	var id string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id = contextRequestID(r.Context())
+	}))
+
+	// The platform's ID is kept
+	r := httptest.NewRequest("PUT", "/v2/service_instances/instance-id", nil)
+	r.Header.Set(RequestIdentityHeader, "e26cea7c-1e2e-4b2c-9cb1-a37e0c8a7d34")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if id != "e26cea7c-1e2e-4b2c-9cb1-a37e0c8a7d34" {
+		t.Fatalf("expected the platform's ID but received %q", id)
+	}
+	if h := w.Header().Get(RequestIdentityHeader); h != id {
+		t.Fatalf("expected the ID in the response but received %q", h)
+	}
+
+	// Missing and oversized IDs are replaced with a new UUID
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, header := range []string{"", strings.Repeat("x", maxRequestIDLength+1)} {
+		r := httptest.NewRequest("GET", "/v2/catalog", nil)
+		r.Header.Set(RequestIdentityHeader, header)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if !uuid.MatchString(id) {
+			t.Fatalf("expected a generated UUID but received %q", id)
+		}
+	}
+}
+
+func TestBroker_RequestLog(t *testing.T) {
+	env, closer := defaultEnvironment(t)
+	defer closer()
+
+	var buf bytes.Buffer
+	env.Broker.log = NewLogger(&buf, LogFormatJSON, LogLevelDebug)
+	env.Broker.instances["instance-id"] = &instanceInfo{
+		OrganizationGUID: "organization-guid",
+		SpaceGUID:        "space-guid",
+	}
+
+	ctx := env.Context
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx = r.Context()
+	}))
+	r := httptest.NewRequest("PUT", "/v2/service_instances/instance-id/service_bindings/binding-id", nil)
+	r.Header.Set(RequestIdentityHeader, "request-1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if _, err := env.Broker.Bind(ctx, env.InstanceID, env.BindingID, brokerapi.BindDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["binding_id"] != env.BindingID {
+			continue
+		}
+		lines++
+		if entry["request_id"] != "request-1" {
+			t.Fatalf("expected the request ID on %v", entry)
+		}
+	}
+	if lines == 0 {
+		t.Fatal("expected the bind to be logged")
+	}
+}
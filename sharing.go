@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sharedPolicyName returns the name of the policy of bindings from spaces
+// which the instance is shared with.
+func sharedPolicyName(instanceID string) string {
+	return "cf-" + instanceID + "-shared"
+}
+
+// shareInstance prepares the instance for a binding from a space it is shared
+// with: it writes the instance's shared policy and records the space on the
+// instance. The first time the instance is shared, its token role is updated
+// to allow the shared policy. It returns the updated instance.
+func (b *Broker) shareInstance(instanceID string, instance *instanceInfo, plan *Plan, space string) (*instanceInfo, error) {
+	if err := b.putSharedPolicy(instanceID, plan); err != nil {
+		return nil, err
+	}
+	for _, s := range instance.SharedSpaces {
+		if s == space {
+			return instance, nil
+		}
+	}
+
+	b.log.Printf("[INFO] recording that instance %s is shared with space %s", instanceID, space)
+	updated := *instance
+	updated.SharedSpaces = append(append([]string(nil), instance.SharedSpaces...), space)
+	updated.UpdatedAt = time.Now().UTC()
+	if err := b.writeInstance(instanceID, &updated); err != nil {
+		return nil, err
+	}
+
+	// The token role only allows the shared policy once the instance is shared
+	if len(instance.SharedSpaces) == 0 {
+		if err := b.putTokenRole(instanceID); err != nil {
+			return nil, err
+		}
+	}
+	return &updated, nil
+}
+
+// putSharedPolicy renders the shared policy of the given instance, which only
+// grants the instance's paths, and writes it to Vault as
+// "cf-instanceID-shared".
+func (b *Broker) putSharedPolicy(instanceID string, plan *Plan) error {
+	var buf bytes.Buffer
+	inp := ServicePolicyTemplateInput{
+		Prefix:    b.mountPrefix,
+		ServiceID: instanceID,
+		ReadOnly:  plan.ReadOnly,
+		Shared:    true,
+
+		ServiceCapabilities: b.serviceCapabilities,
+
+		EnginePaths: enginePolicyPaths(b.mountPrefix, instanceID, plan),
+	}
+	if err := b.generatePolicy(&buf, &inp); err != nil {
+		return errors.Wrapf(err, "failed to generate shared policy for %s", instanceID)
+	}
+
+	policyName := sharedPolicyName(instanceID)
+	b.log.Printf("[DEBUG] creating shared policy %s", policyName)
+	if err := b.vault().Sys().PutPolicy(policyName, buf.String()); err != nil {
+		return errors.Wrapf(err, "failed to create policy %s", policyName)
+	}
+	return nil
+}
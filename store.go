@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// metadataStore stores the broker's metadata about instances and bindings.
+// Keys are relative to the root of the store, for example "instance-id" or
+// "instance-id/binding-id".
+type metadataStore interface {
+	// Read returns the data stored at the key, or nil if there is none.
+	Read(key string) (map[string]interface{}, error)
+
+	// Write stores the data at the key, replacing any existing data.
+	Write(key string, data map[string]interface{}) error
+
+	// Delete removes the data stored at the key.
+	Delete(key string) error
+
+	// List returns the keys in the directory, or nil if it is empty. Keys
+	// which are directories themselves end with a slash.
+	List(dir string) ([]string, error)
+
+	// Path returns the path of the key in Vault, for logs and errors.
+	Path(key string) string
+}
+
+// kvStore is a metadataStore in a KV secrets engine. Version 1 stores each key
+// at its path in the mount, while version 2 stores its data under "data/" and
+// lists and deletes it under "metadata/".
+type kvStore struct {
+	client  func() *api.Client
+	mount   string
+	version int
+}
+
+// newKVStore returns a store in the KV mount at the given path, which uses the
+// client returned by client for each request. A version of zero is version 1.
+func newKVStore(client func() *api.Client, mount string, version int) *kvStore {
+	if version == 0 {
+		version = 1
+	}
+	return &kvStore{
+		client:  client,
+		mount:   strings.Trim(mount, "/"),
+		version: version,
+	}
+}
+
+func (s *kvStore) Path(key string) string {
+	if key == "" {
+		return s.mount
+	}
+	return s.mount + "/" + strings.Trim(key, "/")
+}
+
+// apiPath returns the path to request for the key, inserting the KV version 2
+// prefix for the operation.
+func (s *kvStore) apiPath(v2Prefix, key string) string {
+	if s.version == 1 {
+		return s.Path(key)
+	}
+	return strings.TrimSuffix(s.mount+"/"+v2Prefix+"/"+strings.Trim(key, "/"), "/")
+}
+
+func (s *kvStore) Read(key string) (map[string]interface{}, error) {
+	secret, err := s.client().Logical().Read(s.apiPath("data", key))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || len(secret.Data) == 0 {
+		return nil, nil
+	}
+	if s.version == 1 {
+		return secret.Data, nil
+	}
+
+	// Deleted versions have no data
+	data, _ := secret.Data["data"].(map[string]interface{})
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data, nil
+}
+
+func (s *kvStore) Write(key string, data map[string]interface{}) error {
+	if s.version != 1 {
+		data = map[string]interface{}{"data": data}
+	}
+	_, err := s.client().Logical().Write(s.apiPath("data", key), data)
+	return err
+}
+
+// Delete removes the key. With version 2, all versions of the key are
+// destroyed, so that no binding token is left behind in an old version.
+func (s *kvStore) Delete(key string) error {
+	_, err := s.client().Logical().Delete(s.apiPath("metadata", key))
+	return err
+}
+
+func (s *kvStore) List(dir string) ([]string, error) {
+	path := s.apiPath("metadata", dir) + "/"
+	secret, err := s.client().Logical().List(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || len(secret.Data) == 0 {
+		return nil, nil
+	}
+
+	keysRaw, ok := secret.Data["keys"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("keys of %s are not []interface{}", path)
+	}
+	keys := make([]string, len(keysRaw))
+	for i, v := range keysRaw {
+		typed, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("key %q of %s is not string", v, path)
+		}
+		keys[i] = typed
+	}
+	return keys, nil
+}
+
+// metadataKey returns the key of the metadata of an instance, or of one of its
+// bindings.
+func metadataKey(instanceID string, bindingID ...string) string {
+	return strings.Join(append([]string{instanceID}, bindingID...), "/")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestKVStore_Version2(t *testing.T) {
+	var written map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/v1/secret/data/instance-id":
+			json.NewDecoder(r.Body).Decode(&written)
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"version": 1}}`))
+		case r.Method == "GET" && r.URL.Path == "/v1/secret/data/instance-id":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"data": {"json": "{}"}, "metadata": {"version": 1}}}`))
+		case r.Method == "GET" && r.URL.Path == "/v1/secret/data/deleted-id":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"data": null, "metadata": {"version": 2}}}`))
+		case r.Method == "GET" && r.URL.String() == "/v1/secret/metadata/instance-id?list=true":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"data": {"keys": ["binding-id"]}}`))
+		case r.Method == "DELETE" && r.URL.Path == "/v1/secret/metadata/instance-id/binding-id":
+			w.WriteHeader(204)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer ts.Close()
+
+	client, err := api.NewClient(&api.Config{Address: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newKVStore(func() *api.Client { return client }, "/secret/", 2)
+
+	data := map[string]interface{}{"json": "{}"}
+	if err := store.Write("instance-id", data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, map[string]interface{}{"data": data}) {
+		t.Fatalf("expected the data to be wrapped but received %v", written)
+	}
+
+	read, err := store.Read("instance-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, data) {
+		t.Fatalf("expected %v but received %v", data, read)
+	}
+	for _, key := range []string{"deleted-id", "missing-id"} {
+		if read, err := store.Read(key); err != nil || read != nil {
+			t.Fatalf("expected no data for %s but received %v, %v", key, read, err)
+		}
+	}
+
+	keys, err := store.List(metadataKey("instance-id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"binding-id"}) {
+		t.Fatalf("expected [binding-id] but received %v", keys)
+	}
+
+	if err := store.Delete(metadataKey("instance-id", "binding-id")); err != nil {
+		t.Fatal(err)
+	}
+	if path := store.Path(metadataKey("instance-id", "binding-id")); path != "secret/instance-id/binding-id" {
+		t.Fatalf("unexpected path %s", path)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uaaTokenSource fetches UAA tokens with the client credentials grant and
+// caches them until they are about to expire. It is shared by the clients of
+// the APIs which accept UAA tokens.
+type uaaTokenSource struct {
+	httpClient   *http.Client
+	clientID     string
+	clientSecret string
+
+	// discover returns the URL of the UAA, which APIs advertise in their info
+	// endpoints. It is called until it succeeds once.
+	discover func() (string, error)
+
+	// lock protects the fields below
+	lock          sync.Mutex
+	tokenEndpoint string
+	token         string
+	tokenExpiry   time.Time
+}
+
+// Token returns a cached UAA token, fetching a new one if the cached token is
+// missing or about to expire.
+func (s *uaaTokenSource) Token() (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token != "" && time.Now().Before(s.tokenExpiry) {
+		return s.token, nil
+	}
+
+	if s.tokenEndpoint == "" {
+		endpoint, err := s.discover()
+		if err != nil {
+			return "", err
+		}
+		s.tokenEndpoint = strings.TrimRight(endpoint, "/")
+	}
+
+	token, expiry, err := fetchUAAToken(s.httpClient, s.tokenEndpoint, s.clientID, s.clientSecret)
+	if err != nil {
+		return "", err
+	}
+	s.token = token
+	s.tokenExpiry = expiry
+	return s.token, nil
+}
+
+// getInfo gets the unauthenticated info endpoint of an API at the given URL
+// and decodes the JSON response into out.
+func getInfo(client *http.Client, baseURL, path string, out interface{}) error {
+	resp, err := client.Get(baseURL + path)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get %s: unexpected status %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s: %s", path, err)
+	}
+	return nil
+}
+
+// fetchUAAToken gets a token from the UAA at tokenEndpoint with the client
+// credentials grant. It returns the token and when to refresh it.
+func fetchUAAToken(client *http.Client, tokenEndpoint, clientID, clientSecret string) (string, time.Time, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	req, err := http.NewRequest("POST", tokenEndpoint+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(clientID, clientSecret)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get UAA token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("failed to get UAA token: unexpected status %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to decode UAA token: %s", err)
+	}
+
+	// Refresh a little early so requests never carry an expired token
+	expiry := time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 30*time.Second)
+	return token.AccessToken, expiry, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUAATokenSource(t *testing.T) {
+	tokens := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/uaa/oauth/token" || r.Method != "POST" {
+			w.WriteHeader(404)
+			return
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "broker" || pass != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token": "uaa-token", "expires_in": 3600}`))
+	}))
+	defer ts.Close()
+
+	discovered := 0
+	s := &uaaTokenSource{
+		httpClient:   http.DefaultClient,
+		clientID:     "broker",
+		clientSecret: "secret",
+		discover: func() (string, error) {
+			discovered++
+			if discovered == 1 {
+				return "", errors.New("info is down")
+			}
+			return ts.URL + "/uaa/", nil
+		},
+	}
+
+	// A failed discovery is retried on the next call
+	if _, err := s.Token(); err == nil {
+		t.Fatal("expected an error when discovery fails")
+	}
+	for i := 0; i < 2; i++ {
+		token, err := s.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "uaa-token" {
+			t.Fatalf("unexpected token %q", token)
+		}
+	}
+
+	// The endpoint and the token are cached
+	if discovered != 2 {
+		t.Fatalf("expected 2 discoveries but received %d", discovered)
+	}
+	if tokens != 1 {
+		t.Fatalf("expected 1 token request but received %d", tokens)
+	}
+
+	// Bad client credentials are reported
+	s = &uaaTokenSource{
+		httpClient:   http.DefaultClient,
+		clientID:     "broker",
+		clientSecret: "wrong",
+		discover:     func() (string, error) { return ts.URL + "/uaa", nil },
+	}
+	if _, err := s.Token(); err == nil {
+		t.Fatal("expected an error for bad client credentials")
+	}
+}
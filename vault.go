@@ -1,42 +1,72 @@
 package main
 
 import (
-	"html/template"
 	"io"
+	"io/ioutil"
+	"text/template"
 )
 
 const (
 	// ServicePolicyTemplate is the template used to generate a Vault policy on
 	// service create.
 	ServicePolicyTemplate string = `
-path "cf/{{ .ServiceID }}" {
+path "{{ .Prefix }}/{{ .ServiceID }}" {
   capabilities = ["list"]
 }
 
-path "cf/{{ .ServiceID }}/*" {
+path "{{ .Prefix }}/{{ .ServiceID }}/*" {
+{{- if .ReadOnly }}
+  capabilities = ["read", "list"]
+{{- else if .ServiceCapabilities }}
+  capabilities = [{{ range $i, $c := .ServiceCapabilities }}{{ if $i }}, {{ end }}"{{ $c }}"{{ end }}]
+{{- else }}
 	capabilities = ["create", "read", "update", "delete", "list"]
+{{- end }}
+}
+{{- range $p := .EnginePaths }}
+
+path "{{ $p.Path }}" {
+  capabilities = [{{ range $i, $c := $p.Capabilities }}{{ if $i }}, {{ end }}"{{ $c }}"{{ end }}]
 }
+{{- end }}
+{{- if and (not .Shared) (not .NoSpaceMount) }}
 
-path "cf/{{ .SpaceID }}" {
+path "{{ .Prefix }}/{{ .SpaceID }}" {
   capabilities = ["list"]
 }
 
-path "cf/{{ .SpaceID }}/*" {
+path "{{ .Prefix }}/{{ .SpaceID }}/*" {
+{{- if .ReadOnly }}
+  capabilities = ["read", "list"]
+{{- else if .SpaceCapabilities }}
+  capabilities = [{{ range $i, $c := .SpaceCapabilities }}{{ if $i }}, {{ end }}"{{ $c }}"{{ end }}]
+{{- else }}
   capabilities = ["create", "read", "update", "delete", "list"]
+{{- end }}
 }
+{{- end }}
+{{- if and (not .Shared) (not .NoOrgMount) }}
 
-path "cf/{{ .OrgID }}" {
+path "{{ .Prefix }}/{{ .OrgID }}" {
   capabilities = ["list"]
 }
 
-path "cf/{{ .OrgID }}/*" {
+path "{{ .Prefix }}/{{ .OrgID }}/*" {
+{{- if .OrgCapabilities }}
+  capabilities = [{{ range $i, $c := .OrgCapabilities }}{{ if $i }}, {{ end }}"{{ $c }}"{{ end }}]
+{{- else }}
   capabilities = ["read", "list"]
+{{- end }}
 }
+{{- end }}
 `
 )
 
 // ServicePolicyTemplateInput is used as input to the ServicePolicyTemplate.
 type ServicePolicyTemplateInput struct {
+	// Prefix is the root path of the broker's mounts.
+	Prefix string
+
 	// ServiceID is the unique ID of the service.
 	ServiceID string
 
@@ -45,6 +75,131 @@ type ServicePolicyTemplateInput struct {
 
 	// OrgID is the unique ID of the space.
 	OrgID string
+
+	// ReadOnly restricts the service and space paths to reading and
+	// listing, like the organization path.
+	ReadOnly bool
+
+	// Shared leaves out the space and organization paths, for bindings from
+	// other spaces which the instance is shared with.
+	Shared bool
+
+	// NoSpaceMount and NoOrgMount leave out the space and organization paths
+	// when the broker does not create those shared mounts.
+	NoSpaceMount bool
+	NoOrgMount   bool
+
+	// ServiceCapabilities, SpaceCapabilities, and OrgCapabilities replace
+	// the default capabilities on the service, space, and organization
+	// paths if set. ReadOnly takes precedence over ServiceCapabilities and
+	// SpaceCapabilities.
+	ServiceCapabilities []string
+	SpaceCapabilities   []string
+	OrgCapabilities     []string
+
+	// EnginePaths are the paths of the instance's secret engines which the
+	// broker configures. They are more specific than the service path, so
+	// they take precedence over it and keep bindings from changing the
+	// configuration of the engines.
+	EnginePaths []PolicyPath
+}
+
+// PolicyPath is a path of a policy and the capabilities it grants on it.
+type PolicyPath struct {
+	Path         string
+	Capabilities []string
+}
+
+// enginePolicyPaths returns the paths of the secret engines of an instance
+// which bindings may only use as the broker intends. The engines which the
+// broker does not configure are left to the service path.
+func enginePolicyPaths(prefix, instanceID string, p *Plan) []PolicyPath {
+	var paths []PolicyPath
+	if p.hasEngine(AWS) {
+		mount := mountPath(prefix, instanceID, AWS.PathType())
+		paths = append(paths,
+			PolicyPath{Path: mount + "/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/config/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/roles/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/creds/" + AWSRoleName, Capabilities: []string{"read"}},
+			PolicyPath{Path: mount + "/sts/" + AWSRoleName, Capabilities: []string{"read"}},
+		)
+	}
+	if p.hasEngine(SSH) {
+		mount := mountPath(prefix, instanceID, SSH.PathType())
+		paths = append(paths,
+			PolicyPath{Path: mount + "/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/config/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/roles/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/sign/" + SSHRoleName, Capabilities: []string{"update"}},
+			PolicyPath{Path: mount + "/public_key", Capabilities: []string{"read"}},
+		)
+	}
+	if p.hasEngine(PKI) {
+		mount := mountPath(prefix, instanceID, PKI.PathType())
+		paths = append(paths,
+			PolicyPath{Path: mount + "/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/config/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/roles/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/root/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/intermediate/*", Capabilities: []string{"deny"}},
+			PolicyPath{Path: mount + "/issue/" + PKIRoleName, Capabilities: []string{"update"}},
+			PolicyPath{Path: mount + "/sign/" + PKIRoleName, Capabilities: []string{"update"}},
+			PolicyPath{Path: mount + "/cert/*", Capabilities: []string{"read"}},
+			PolicyPath{Path: mount + "/ca", Capabilities: []string{"read"}},
+			PolicyPath{Path: mount + "/ca/pem", Capabilities: []string{"read"}},
+		)
+	}
+	return paths
+}
+
+// policyCapabilities are the capabilities which may be granted in the
+// generated policy.
+var policyCapabilities = map[string]struct{}{
+	"create": struct{}{},
+	"read":   struct{}{},
+	"update": struct{}{},
+	"patch":  struct{}{},
+	"delete": struct{}{},
+	"list":   struct{}{},
+	"sudo":   struct{}{},
+	"deny":   struct{}{},
+}
+
+// DashboardURLInput is used as input to the DASHBOARD_URL template.
+type DashboardURLInput struct {
+	// ServiceInstanceGUID is the unique ID of the service instance.
+	ServiceInstanceGUID string
+
+	// OrganizationGUID and SpaceGUID are the unique IDs of the organization
+	// and space of the instance.
+	OrganizationGUID string
+	SpaceGUID        string
+
+	// Namespace is the Vault namespace the broker uses, if any.
+	Namespace string
+
+	// Prefix is the root path of the broker's mounts.
+	Prefix string
+}
+
+// AdvertiseAddrInput is used as input to the VAULT_ADVERTISE_ADDR_TEMPLATE
+// template, which renders the address of Vault given to each binding.
+type AdvertiseAddrInput struct {
+	// ServiceInstanceGUID and BindingGUID are the unique IDs of the service
+	// instance and the binding.
+	ServiceInstanceGUID string
+	BindingGUID         string
+
+	// OrganizationGUID is the unique ID of the organization of the instance,
+	// and SpaceGUID that of the space the binding is from, which is another
+	// space than the instance's if the instance is shared with it.
+	OrganizationGUID string
+	SpaceGUID        string
+
+	// DefaultAddr is VAULT_ADVERTISE_ADDR, which is also used if the
+	// template renders nothing.
+	DefaultAddr string
 }
 
 // GeneratePolicy takes an io.Writer object and template input and renders the
@@ -56,3 +211,43 @@ func GeneratePolicy(w io.Writer, i *ServicePolicyTemplateInput) error {
 	}
 	return tmpl.Execute(w, i)
 }
+
+// ParsePolicyTemplate parses a custom template to generate policies with in
+// place of ServicePolicyTemplate. It returns an error if the template fails to
+// render, for example because it refers to fields which
+// ServicePolicyTemplateInput does not have.
+func ParsePolicyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("policy").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// Render the template with every combination of the flags and with and
+	// without capabilities, so that the fields in its branches are checked
+	// as well
+	for flags := 0; flags < 1<<4; flags++ {
+		input := &ServicePolicyTemplateInput{
+			Prefix:       "cf",
+			ServiceID:    "instance-id",
+			SpaceID:      "space-id",
+			OrgID:        "org-id",
+			ReadOnly:     flags&1 != 0,
+			Shared:       flags&2 != 0,
+			NoSpaceMount: flags&4 != 0,
+			NoOrgMount:   flags&4 != 0,
+
+			EnginePaths: []PolicyPath{
+				{Path: "cf/instance-id/aws/*", Capabilities: []string{"deny"}},
+			},
+		}
+		if flags&8 != 0 {
+			input.ServiceCapabilities = []string{"read", "list"}
+			input.SpaceCapabilities = []string{"read", "list"}
+			input.OrgCapabilities = []string{"read", "list"}
+		}
+		if err := tmpl.Execute(ioutil.Discard, input); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGeneratePolicy(t *testing.T) {
+	cases := []struct {
+		name     string
+		readOnly bool
+		e        []string
+	}{
+		{
+			"read-write",
+			false,
+			[]string{
+				`path "cf/instance-id/*" {
+	capabilities = ["create", "read", "update", "delete", "list"]
+}`,
+				`path "cf/space-id/*" {
+  capabilities = ["create", "read", "update", "delete", "list"]
+}`,
+			},
+		},
+		{
+			"read-only",
+			true,
+			[]string{
+				`path "cf/instance-id/*" {
+  capabilities = ["read", "list"]
+}`,
+				`path "cf/space-id/*" {
+  capabilities = ["read", "list"]
+}`,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := GeneratePolicy(&buf, &ServicePolicyTemplateInput{
+				Prefix:    "cf",
+				ServiceID: "instance-id",
+				SpaceID:   "space-id",
+				OrgID:     "org-id",
+				ReadOnly:  tc.readOnly,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy := buf.String()
+
+			e := append(tc.e,
+				`path "cf/instance-id" {
+  capabilities = ["list"]
+}`,
+				`path "cf/space-id" {
+  capabilities = ["list"]
+}`,
+				`path "cf/org-id/*" {
+  capabilities = ["read", "list"]
+}`,
+			)
+			for _, s := range e {
+				if !strings.Contains(policy, s) {
+					t.Errorf("expected policy to contain\n%s\nbut received\n%s", s, policy)
+				}
+			}
+		})
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := GeneratePolicy(&buf, &ServicePolicyTemplateInput{
+			Prefix:              "cf",
+			ServiceID:           "instance-id",
+			SpaceID:             "space-id",
+			OrgID:               "org-id",
+			ServiceCapabilities: []string{"create", "read", "update", "list"},
+			SpaceCapabilities:   []string{"read", "list"},
+			OrgCapabilities:     []string{"deny"},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		policy := buf.String()
+		for _, s := range []string{
+			`path "cf/instance-id/*" {
+  capabilities = ["create", "read", "update", "list"]
+}`,
+			`path "cf/space-id/*" {
+  capabilities = ["read", "list"]
+}`,
+			`path "cf/org-id/*" {
+  capabilities = ["deny"]
+}`,
+		} {
+			if !strings.Contains(policy, s) {
+				t.Errorf("expected policy to contain\n%s\nbut received\n%s", s, policy)
+			}
+		}
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := GeneratePolicy(&buf, &ServicePolicyTemplateInput{
+			Prefix:    "cf",
+			ServiceID: "instance-id",
+			Shared:    true,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		policy := buf.String()
+		if !strings.Contains(policy, `path "cf/instance-id/*"`) {
+			t.Errorf("expected policy to grant the instance paths but received\n%s", policy)
+		}
+		if strings.Count(policy, "path ") != 2 {
+			t.Errorf("expected policy to grant nothing else but received\n%s", policy)
+		}
+	})
+}
+
+func TestGeneratePolicy_EnginePaths(t *testing.T) {
+	cases := []struct {
+		engine SecretEngineType
+		e      []string
+	}{
+		{
+			AWS,
+			[]string{
+				`path "cf/instance-id/aws/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/aws/config/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/aws/roles/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/aws/creds/cf-bind" {
+  capabilities = ["read"]
+}`,
+				`path "cf/instance-id/aws/sts/cf-bind" {
+  capabilities = ["read"]
+}`,
+			},
+		},
+		{
+			SSH,
+			[]string{
+				`path "cf/instance-id/ssh/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/ssh/config/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/ssh/roles/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/ssh/sign/cf-bind" {
+  capabilities = ["update"]
+}`,
+				`path "cf/instance-id/ssh/public_key" {
+  capabilities = ["read"]
+}`,
+			},
+		},
+		{
+			PKI,
+			[]string{
+				`path "cf/instance-id/pki/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/pki/root/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/pki/intermediate/*" {
+  capabilities = ["deny"]
+}`,
+				`path "cf/instance-id/pki/issue/cf-bind" {
+  capabilities = ["update"]
+}`,
+				`path "cf/instance-id/pki/ca/pem" {
+  capabilities = ["read"]
+}`,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(string(tc.engine), func(t *testing.T) {
+			plan := &Plan{Engines: []SecretEngineType{KV, tc.engine}}
+			for _, shared := range []bool{false, true} {
+				var buf bytes.Buffer
+				if err := GeneratePolicy(&buf, &ServicePolicyTemplateInput{
+					Prefix:      "cf",
+					ServiceID:   "instance-id",
+					SpaceID:     "space-id",
+					OrgID:       "org-id",
+					Shared:      shared,
+					EnginePaths: enginePolicyPaths("cf", "instance-id", plan),
+				}); err != nil {
+					t.Fatal(err)
+				}
+				policy := buf.String()
+				for _, s := range tc.e {
+					if !strings.Contains(policy, s) {
+						t.Errorf("expected policy to contain\n%s\nbut received\n%s", s, policy)
+					}
+				}
+			}
+		})
+	}
+
+	// Plans without engines which the broker configures have none of their
+	// paths restricted
+	if paths := enginePolicyPaths("cf", "instance-id", &Plan{Engines: []SecretEngineType{KV, Transit}}); len(paths) != 0 {
+		t.Fatalf("expected no engine paths but received %v", paths)
+	}
+}
+
+func TestParsePolicyTemplate(t *testing.T) {
+	// The built-in template is a valid custom template
+	if _, err := ParsePolicyTemplate(ServicePolicyTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := ParsePolicyTemplate(`path "{{ .Prefix }}/{{ .ServiceID }}/*" {
+  capabilities = [{{ if .ReadOnly }}"read"{{ else }}"read", "update"{{ end }}]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &ServicePolicyTemplateInput{Prefix: "cf", ServiceID: "instance-id"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := "path \"cf/instance-id/*\" {\n  capabilities = [\"read\", \"update\"]\n}"; buf.String() != e {
+		t.Fatalf("expected\n%s\nbut received\n%s", e, buf.String())
+	}
+
+	// Fields inside range and with refer to the element, not the input
+	tmpl, err = ParsePolicyTemplate(`{{ range .EnginePaths }}path "{{ .Path }}" {
+  capabilities = [{{ range $i, $c := .Capabilities }}{{ if $i }}, {{ end }}"{{ $c }}"{{ end }}]
+}
+{{ end }}{{ with .Prefix }}path "{{ . }}/{{ $.ServiceID }}" {}{{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := tmpl.Execute(&buf, &ServicePolicyTemplateInput{
+		Prefix:      "cf",
+		ServiceID:   "instance-id",
+		EnginePaths: []PolicyPath{{Path: "cf/instance-id/aws/*", Capabilities: []string{"deny"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if e := "path \"cf/instance-id/aws/*\" {\n  capabilities = [\"deny\"]\n}\npath \"cf/instance-id\" {}"; buf.String() != e {
+		t.Fatalf("expected\n%s\nbut received\n%s", e, buf.String())
+	}
+
+	for _, text := range []string{
+		`path "{{ .Prefix }}/{{ .ServiceID" {}`,
+		`{{ range .EnginePaths }}path "{{ .Name }}" {}{{ end }}`,
+		`{{ if .ServiceCapabilities }}{{ else }}{{ .Capabilities }}{{ end }}`,
+		`path "{{ .Prefix }}/{{ .InstanceID }}/*" {}`,
+		`{{ if .Shared }}path "{{ .Prefix }}/{{ .SpaceGUID }}/*" {}{{ end }}`,
+		`{{ with .Prefix }}{{ $.Org }}{{ end }}`,
+	} {
+		if _, err := ParsePolicyTemplate(text); err == nil {
+			t.Errorf("expected an error for %s", text)
+		}
+	}
+}
@@ -1,3 +1,26 @@
 package main
 
-const Version = "0.2.0"
+import "runtime"
+
+// These are set at build time with -ldflags "-X main.<name>=<value>", for
+// example by the Makefile. The release below is used if it is not overridden.
+var (
+	Version   = "0.2.0"
+	GitCommit = ""
+)
+
+// buildInfo describes the build of the broker.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// currentBuild returns the build of the running broker.
+func currentBuild() buildInfo {
+	return buildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		GoVersion: runtime.Version(),
+	}
+}